@@ -5,11 +5,15 @@ echo "Generating protobuf code"
 protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative internal/rpc/pb/intercom.proto
 
 echo "Building for Raspberry Pi Zero W"
-GOOS=linux GOARCH=arm GOARM=6 go build -o compiled/gointercom_arm6 ./cmd/...
+GOOS=linux GOARCH=arm GOARM=6 go build -o compiled/gointercom_arm6 ./cmd/grpc
 echo "Created gointercom_arm6 binary"
 echo "Building for Raspberry Pi 4"
-GOOS=linux GOARCH=arm GOARM=7 go build -o compiled/gointercom_arm7 ./cmd/...
+GOOS=linux GOARCH=arm GOARM=7 go build -o compiled/gointercom_arm7 ./cmd/grpc
 echo "Created gointercom_arm7 binary"
+echo "Building hub"
+GOOS=linux GOARCH=arm GOARM=7 go build -o compiled/gointercom-hub_arm7 ./cmd/hub
+GOOS=linux GOARCH=amd64 go build -o compiled/gointercom-hub_amd64 ./cmd/hub
+echo "Created gointercom-hub binaries"
 echo Complete
 
 #echo "Building server for Raspberry Pi Zero W"
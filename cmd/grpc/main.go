@@ -7,8 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/joho/godotenv"
-
+	"github.com/figadore/go-intercom/internal/config"
 	"github.com/figadore/go-intercom/internal/log"
 	"github.com/figadore/go-intercom/internal/rpc"
 	"github.com/figadore/go-intercom/internal/station"
@@ -30,20 +29,36 @@ func run(args []string) int {
 	errCh := make(chan error)
 
 	// Get io specific to this station
-	dotEnv, err := godotenv.Read()
+	cfg, err := config.Load()
 	if err != nil {
-		panic(err)
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		cancel()
+		return 1
 	}
 
 	// Create a grpc call manager to create new clients for outgoing calls
-	intercom := station.New(mainContext, dotEnv, rpc.NewCallManager)
+	intercom := station.New(mainContext, cfg, rpc.NewCallManager)
 	defer log.Debugln("main: Closed intercom")
 	defer intercom.Close()
 	defer log.Debugln("main: Closing intercom")
 
 	grpcServer := rpc.NewServer(intercom)
 	// Start the main process
-	go rpc.Serve(grpcServer, errCh)
+	go rpc.Serve(grpcServer, intercom.ListenAddress, errCh)
+
+	// Take calls from SIP phones, if configured
+	if sipGateway := rpc.StartSIPGateway(mainContext, intercom); sipGateway != nil {
+		defer sipGateway.Close()
+	}
+
+	// Relay calls through a hub, if configured
+	if hubClient := rpc.StartHubClient(mainContext, intercom); hubClient != nil {
+		defer hubClient.Close()
+	}
+
+	// Keep track of which stations are reachable
+	rpc.StartPresence(mainContext, intercom)
 
 	// Do this last so that the context is cancelled *before* intercom.Close,
 	// which has eventHandlers running that will block until the handler exist
@@ -62,6 +77,7 @@ func run(args []string) int {
 		msg = fmt.Sprintf("Main context cancelled: %v", mainContext.Err())
 		exitCode = 0
 	case err := <-errCh:
+		intercom.Publish(station.Event{Type: station.EventError, Err: err})
 		msg = fmt.Sprintf("Closing from error: %v", err)
 		exitCode = 1
 	case sig := <-sigCh:
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc"
+)
+
+const defaultListenAddress = ":20000"
+
+func run(args []string) int {
+	// Handle externally generated OS exit signals
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	// Create a global fatal error channel
+	errCh := make(chan error)
+
+	// The hub has no hardware, so only HUB_LISTEN is used
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		return 1
+	}
+	address := defaultListenAddress
+	if cfg.Peers.HubListen != "" {
+		address = cfg.Peers.HubListen
+	}
+
+	hubServer := rpc.NewHubServer()
+	defer hubServer.Stop()
+	log.Println("Starting hub on", address)
+	go rpc.ServeHub(hubServer, address, errCh)
+
+	var msg string
+	var exitCode int
+	select {
+	case err := <-errCh:
+		msg = fmt.Sprintf("Closing from error: %v", err)
+		exitCode = 1
+	case sig := <-sigCh:
+		msg = fmt.Sprintf("Received system signal: %v", sig)
+		exitCode = 2
+		// In a separate goroutine, listen for a second OS signal
+		go func() {
+			<-sigCh
+			fmt.Println("Error: Received 2nd system signal, hard exit")
+			os.Exit(2)
+		}()
+	}
+	log.Println(msg)
+	return exitCode
+}
+
+func main() {
+	os.Exit(run(os.Args))
+}
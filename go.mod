@@ -3,10 +3,12 @@ module github.com/figadore/go-intercom
 go 1.15
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/esimonov/ifshort v1.0.0 // indirect
 	github.com/golang/protobuf v1.4.2
 	github.com/golangci/golangci-lint v1.35.2 // indirect
 	github.com/jar-o/limlog v0.0.0-20200826200915-9d66a36febe9
+	github.com/jfreymuth/oggvorbis v1.0.5
 	github.com/jfreymuth/pulse v0.1.0
 	github.com/joho/godotenv v1.3.0
 	github.com/rs/xid v1.2.1
@@ -17,4 +19,5 @@ require (
 	github.com/warthog618/gpiod v0.6.0
 	google.golang.org/grpc v1.35.0
 	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"time"
+)
+
+// Config is everything a station or hub is set up with. Each setting has a
+// key in the config file, e.g. pins.red_button, and the .env key it replaces,
+// e.g. RED_BUTTON_PIN, which is also what overrides it from the environment
+//
+// Settings that aren't set are left at zero, and the station's defaults apply
+type Config struct {
+	Station       StationConfig      `yaml:"station"`
+	Features      FeaturesConfig     `yaml:"features"`
+	Pins          PinsConfig         `yaml:"pins"`
+	Audio         AudioConfig        `yaml:"audio"`
+	Media         MediaConfig        `yaml:"media"`
+	Peers         PeersConfig        `yaml:"peers"`
+	SIP           SIPConfig          `yaml:"sip"`
+	Dial          DialConfig         `yaml:"dial"`
+	Policies      PoliciesConfig     `yaml:"policies"`
+	Recording     RecordingConfig    `yaml:"recording"`
+	Voicemail     VoicemailConfig    `yaml:"voicemail"`
+	Announcements AnnouncementConfig `yaml:"announcements"`
+	MQTT          MQTTConfig         `yaml:"mqtt"`
+	Webhooks      []WebhookConfig    `yaml:"webhooks" env:"WEBHOOK_%d_"`
+	RingGroups    []RingGroupConfig  `yaml:"ring_groups" env:"RING_GROUP_%d_"`
+	Monitor       MonitorConfig      `yaml:"monitor"`
+	Voice         VoiceConfig        `yaml:"voice"`
+
+	// env is every setting that was set, by .env key
+	env map[string]string
+	// sources are where each setting came from, and paths their keys in the file, for errors
+	sources map[string]string
+	paths   map[string]string
+}
+
+type StationConfig struct {
+	// Name defaults to the hostname
+	Name string `yaml:"name" env:"STATION_NAME"`
+	// Listen is the address calls are taken on, e.g. ":20000"
+	Listen      string `yaml:"listen" env:"LISTEN_ADDRESS"`
+	StateFile   string `yaml:"state_file" env:"STATE_FILE"`
+	HistoryFile string `yaml:"history_file" env:"CALL_HISTORY_FILE"`
+}
+
+type FeaturesConfig struct {
+	// Inputs are button, volume, control, mqtt and voice
+	Inputs []string `yaml:"inputs" env:"INPUT_TYPE"`
+	// Outputs are led, mqtt, ring and tts
+	Outputs        []string `yaml:"outputs" env:"OUTPUT_TYPE"`
+	ControlAddress string   `yaml:"control_address" env:"CONTROL_ADDRESS"`
+	ControlToken   string   `yaml:"control_token" env:"CONTROL_TOKEN"`
+	CallButtonTo   []string `yaml:"call_button_to" env:"CALL_BUTTON_TO"`
+	// Doorbell makes this a doorbell station, ringing these stations or a ring group
+	Doorbell []string `yaml:"doorbell" env:"DOORBELL"`
+}
+
+// PinsConfig are GPIO line offsets on the first chip
+type PinsConfig struct {
+	RedButton      int `yaml:"red_button" env:"RED_BUTTON_PIN"`
+	BlackButton    int `yaml:"black_button" env:"BLACK_BUTTON_PIN"`
+	GreenLed       int `yaml:"green_led" env:"GREEN_LED_PIN"`
+	YellowLed      int `yaml:"yellow_led" env:"YELLOW_LED_PIN"`
+	VolumeUp       int `yaml:"volume_up" env:"VOLUME_UP_PIN"`
+	VolumeDown     int `yaml:"volume_down" env:"VOLUME_DOWN_PIN"`
+	VolumeEncoderA int `yaml:"volume_encoder_a" env:"VOLUME_ENCODER_A_PIN"`
+	VolumeEncoderB int `yaml:"volume_encoder_b" env:"VOLUME_ENCODER_B_PIN"`
+}
+
+type AudioConfig struct {
+	SampleRate int `yaml:"sample_rate" env:"SAMPLE_RATE"`
+	// Speaker and Microphone are pulse sink and source names. Empty means the default
+	Speaker              string `yaml:"speaker" env:"SPEAKER_DEVICE"`
+	Microphone           string `yaml:"microphone" env:"MIC_DEVICE"`
+	RingVolume           int    `yaml:"ring_volume" env:"RING_VOLUME"`
+	QuietHoursRingVolume int    `yaml:"quiet_hours_ring_volume" env:"QUIET_HOURS_RING_VOLUME"`
+	VolumeStep           int    `yaml:"volume_step" env:"VOLUME_STEP"`
+	TTSCommand           string `yaml:"tts_command" env:"TTS_COMMAND"`
+}
+
+type MediaConfig struct {
+	// Transport is rtp or grpc
+	Transport string `yaml:"transport" env:"MEDIA_TRANSPORT"`
+	// Codecs are l16 and pcmu
+	Codecs   []string `yaml:"codecs" env:"MEDIA_CODECS"`
+	Adaptive bool     `yaml:"adaptive" env:"MEDIA_ADAPTIVE"`
+	// RTPPorts is a range, e.g. "20010-20019"
+	RTPPorts string `yaml:"rtp_ports" env:"RTP_PORTS"`
+}
+
+type PeersConfig struct {
+	// Directory maps station names to addresses
+	Directory        map[string]string `yaml:"directory" env:"DIRECTORY"`
+	Hub              string            `yaml:"hub" env:"HUB_ADDRESS"`
+	HubListen        string            `yaml:"hub_listen" env:"HUB_LISTEN"`
+	PresenceInterval time.Duration     `yaml:"presence_interval" env:"PRESENCE_INTERVAL"`
+}
+
+type SIPConfig struct {
+	Server   string        `yaml:"server" env:"SIP_SERVER"`
+	User     string        `yaml:"user" env:"SIP_USER"`
+	Password string        `yaml:"password" env:"SIP_PASSWORD"`
+	Domain   string        `yaml:"domain" env:"SIP_DOMAIN"`
+	Port     int           `yaml:"port" env:"SIP_PORT"`
+	Expires  time.Duration `yaml:"expires" env:"SIP_EXPIRES"`
+}
+
+type DialConfig struct {
+	Timeout        time.Duration `yaml:"timeout" env:"DIAL_TIMEOUT"`
+	InviteTimeout  time.Duration `yaml:"invite_timeout" env:"INVITE_TIMEOUT"`
+	AutoRedial     bool          `yaml:"auto_redial" env:"AUTO_REDIAL"`
+	RedialAttempts int           `yaml:"redial_attempts" env:"REDIAL_ATTEMPTS"`
+	RedialDelay    time.Duration `yaml:"redial_delay" env:"REDIAL_DELAY"`
+}
+
+type PoliciesConfig struct {
+	// Callers maps station names to default, answer, reject, ring or voicemail
+	Callers       map[string]string `yaml:"callers" env:"CALLER_POLICIES"`
+	UrgentCallers []string          `yaml:"urgent_callers" env:"URGENT_CALLERS"`
+	// Busy is join, busy or wait
+	Busy        string `yaml:"busy" env:"BUSY_POLICY"`
+	DNDSchedule string `yaml:"dnd_schedule" env:"DND_SCHEDULE"`
+	QuietHours  string `yaml:"quiet_hours" env:"QUIET_HOURS"`
+}
+
+type RecordingConfig struct {
+	// Mode is off, mic, remote or mixed
+	Mode string `yaml:"mode" env:"CALL_RECORDING"`
+	// Format is wav or ogg
+	Format    string        `yaml:"format" env:"RECORDING_FORMAT"`
+	Dir       string        `yaml:"dir" env:"RECORDING_DIR"`
+	Retention time.Duration `yaml:"retention" env:"RECORDING_RETENTION"`
+	MaxMB     int           `yaml:"max_mb" env:"RECORDING_MAX_MB"`
+	Notice    bool          `yaml:"notice" env:"RECORDING_NOTICE"`
+}
+
+type VoicemailConfig struct {
+	Dir         string        `yaml:"dir" env:"VOICEMAIL_DIR"`
+	MaxDuration time.Duration `yaml:"max_duration" env:"VOICEMAIL_MAX_DURATION"`
+}
+
+type AnnouncementConfig struct {
+	Dir string `yaml:"dir" env:"ANNOUNCEMENT_DIR"`
+}
+
+type MQTTConfig struct {
+	Broker          string `yaml:"broker" env:"MQTT_BROKER"`
+	Username        string `yaml:"username" env:"MQTT_USERNAME"`
+	Password        string `yaml:"password" env:"MQTT_PASSWORD"`
+	TopicPrefix     string `yaml:"topic_prefix" env:"MQTT_TOPIC_PREFIX"`
+	Discovery       bool   `yaml:"discovery" env:"MQTT_DISCOVERY"`
+	DiscoveryPrefix string `yaml:"discovery_prefix" env:"MQTT_DISCOVERY_PREFIX"`
+}
+
+type WebhookConfig struct {
+	URL     string        `yaml:"url" env:"URL"`
+	Events  []string      `yaml:"events" env:"EVENTS"`
+	Secret  string        `yaml:"secret" env:"SECRET"`
+	Retries int           `yaml:"retries" env:"RETRIES"`
+	Backoff time.Duration `yaml:"backoff" env:"BACKOFF"`
+}
+
+type RingGroupConfig struct {
+	Name    string   `yaml:"name" env:"NAME"`
+	Members []string `yaml:"members" env:"MEMBERS"`
+	// Strategy is first, conference or sequential
+	Strategy string        `yaml:"strategy" env:"STRATEGY"`
+	Timeout  time.Duration `yaml:"timeout" env:"TIMEOUT"`
+}
+
+type MonitorConfig struct {
+	Listeners []string `yaml:"listeners" env:"MONITOR_LISTENERS"`
+	// Threshold is in dBFS, e.g. -30
+	Threshold float64       `yaml:"threshold" env:"MONITOR_THRESHOLD"`
+	Duration  time.Duration `yaml:"duration" env:"MONITOR_DURATION"`
+	AlertTo   []string      `yaml:"alert_to" env:"MONITOR_ALERT_TO"`
+}
+
+type VoiceConfig struct {
+	Recognizer string `yaml:"recognizer" env:"VOICE_RECOGNIZER"`
+	WakeWord   string `yaml:"wake_word" env:"VOICE_WAKE_WORD"`
+}
+
+// IsSet returns whether a setting was given, by .env key, e.g. to tell pin 0
+// from no pin
+func (c *Config) IsSet(key string) bool {
+	return c.env[key] != ""
+}
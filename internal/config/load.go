@@ -0,0 +1,376 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	// fileEnv names the config file, if it isn't defaultFile in the working directory
+	fileEnv     = "INTERCOM_CONFIG"
+	defaultFile = "intercom.yaml"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Errors are every problem found with the settings, so they can all be fixed at once
+type Errors []error
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Load reads the settings from, lowest priority first, .env in the working
+// directory, the config file and the environment, then checks them
+// The config file is INTERCOM_CONFIG, or intercom.yaml if there is one
+func Load() (*Config, error) {
+	c := &Config{
+		env:     make(map[string]string),
+		sources: make(map[string]string),
+		paths:   make(map[string]string),
+	}
+	dotEnv, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf(".env: %w", err)
+	}
+	for key, val := range dotEnv {
+		if !knownKey(reflect.TypeOf(Config{}), "", key) {
+			log.Printf("Unknown setting %v in .env, ignoring\n", key)
+			continue
+		}
+		c.set(key, val, ".env")
+	}
+	path, ok := os.LookupEnv(fileEnv)
+	if !ok {
+		path = defaultFile
+	}
+	file, err := readFile(path)
+	switch {
+	case os.IsNotExist(err) && !ok:
+	case err != nil:
+		return nil, err
+	default:
+		log.Printf("Found config file %v ...\n", path)
+		for key, val := range file {
+			c.set(key, val, path)
+		}
+	}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && knownKey(reflect.TypeOf(Config{}), "", parts[0]) {
+			c.set(parts[0], parts[1], "the environment")
+		}
+	}
+	if errs := c.parse(reflect.ValueOf(c).Elem(), "", ""); len(errs) > 0 {
+		return nil, errs
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+func (c *Config) set(key string, val string, source string) {
+	c.env[key] = val
+	c.sources[key] = source
+}
+
+// errorf describes a problem with the setting with the given .env key
+func (c *Config) errorf(key string, format string, a ...interface{}) error {
+	if source, ok := c.sources[key]; ok {
+		return fmt.Errorf("%v (%v) from %v: %v", c.paths[key], key, source, fmt.Sprintf(format, a...))
+	}
+	return fmt.Errorf("%v (%v): %v", c.paths[key], key, fmt.Sprintf(format, a...))
+}
+
+// readFile reads a YAML config file into .env keys. Settings the file has
+// that don't exist are errors, rather than being ignored
+func readFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root interface{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	env := make(map[string]string)
+	errs := flatten(root, reflect.TypeOf(Config{}), "", "", env)
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("%v: %w", path, err)
+		}
+		return nil, errs
+	}
+	return env, nil
+}
+
+// flatten turns a node of the config file into .env keys, by the yaml and env
+// tags of t's fields. Lists of groups, like webhooks, are numbered from 1
+func flatten(node interface{}, t reflect.Type, path string, prefix string, env map[string]string) Errors {
+	if node == nil {
+		return nil
+	}
+	m, ok := node.(map[interface{}]interface{})
+	if !ok {
+		return Errors{fmt.Errorf("%v: expected a mapping", describe(path))}
+	}
+	var errs Errors
+	for k, v := range m {
+		name := fmt.Sprint(k)
+		p := name
+		if path != "" {
+			p = path + "." + name
+		}
+		f, ok := fieldByYAML(t, name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%v: unknown setting", p))
+			continue
+		}
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			errs = append(errs, flatten(v, f.Type, p, prefix, env)...)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			items, ok := v.([]interface{})
+			if !ok && v != nil {
+				errs = append(errs, fmt.Errorf("%v: expected a list", p))
+				continue
+			}
+			for i, item := range items {
+				errs = append(errs, flatten(item, f.Type.Elem(), fmt.Sprintf("%v[%d]", p, i), fmt.Sprintf(f.Tag.Get("env"), i+1), env)...)
+			}
+		default:
+			val, err := scalar(v, f.Type)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", p, err))
+				continue
+			}
+			env[prefix+f.Tag.Get("env")] = val
+		}
+	}
+	return errs
+}
+
+func describe(path string) string {
+	if path == "" {
+		return "config file"
+	}
+	return path
+}
+
+// scalar formats a value from the config file the way .env has it, e.g. a
+// list as "a,b" and a mapping as "a=1,b=2"
+func scalar(v interface{}, t reflect.Type) (string, error) {
+	if _, ok := v.(map[interface{}]interface{}); !ok && v != nil && t.Kind() == reflect.Map {
+		return "", fmt.Errorf("expected a mapping, e.g. kitchen: 12")
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return "", fmt.Errorf("expected a single value, got a list")
+		}
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := scalar(item, t.Elem())
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list items can't contain commas: %q", s)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		if t.Kind() != reflect.Map {
+			return "", fmt.Errorf("expected a single value, got a mapping")
+		}
+		pairs := make([]string, 0, len(v))
+		for k, val := range v {
+			s, err := scalar(val, t.Elem())
+			if err != nil {
+				return "", err
+			}
+			name := fmt.Sprint(k)
+			if strings.ContainsAny(name, ",=") || strings.Contains(s, ",") {
+				return "", fmt.Errorf("names and values can't contain commas: %v: %v", name, s)
+			}
+			pairs = append(pairs, name+"="+s)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func fieldByYAML(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name != "" && f.Tag.Get("yaml") == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// knownKey returns whether key is the .env key of a setting in t, e.g.
+// RED_BUTTON_PIN, or WEBHOOK_2_URL for the second webhook
+func knownKey(t reflect.Type, prefix string, key string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("env")
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			if knownKey(f.Type, prefix, key) {
+				return true
+			}
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			if n, ok := listIndex(tag, key); ok && knownKey(f.Type.Elem(), fmt.Sprintf(tag, n), key) {
+				return true
+			}
+		case tag != "" && prefix+tag == key:
+			return true
+		}
+	}
+	return false
+}
+
+// listIndex returns n for a key starting with format's prefix for the nth
+// group, e.g. 2 for WEBHOOK_2_URL and WEBHOOK_%d_
+func listIndex(format string, key string) (int, bool) {
+	parts := strings.SplitN(format, "%d", 2)
+	if len(parts) != 2 || !strings.HasPrefix(key, parts[0]) {
+		return 0, false
+	}
+	rest := key[len(parts[0]):]
+	end := strings.Index(rest, parts[1])
+	if end < 1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(rest[:end])
+	if err != nil || n < 1 || strconv.Itoa(n) != rest[:end] {
+		return 0, false
+	}
+	return n, true
+}
+
+// parse sets the fields of v from the settings, by their env tags
+func (c *Config) parse(v reflect.Value, path string, prefix string) Errors {
+	var errs Errors
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, tag := f.Tag.Get("yaml"), f.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		field := v.Field(i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			errs = append(errs, c.parse(field, name, prefix)...)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			count := 0
+			for key, val := range c.env {
+				if n, ok := listIndex(tag, key); ok && val != "" && n > count {
+					count = n
+				}
+			}
+			for n := 1; n <= count; n++ {
+				item := reflect.New(f.Type.Elem()).Elem()
+				errs = append(errs, c.parse(item, fmt.Sprintf("%v[%d]", name, n-1), fmt.Sprintf(tag, n))...)
+				field.Set(reflect.Append(field, item))
+			}
+		default:
+			key := prefix + tag
+			c.paths[key] = name
+			if val := c.env[key]; val != "" {
+				if err := setField(field, val); err != nil {
+					errs = append(errs, c.errorf(key, "%v", err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// setField parses a setting into field, by its type
+func setField(field reflect.Value, val string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("expected a duration, e.g. 30s, got %q", val)
+		}
+		if d < 0 {
+			return fmt.Errorf("can't be negative: %v", val)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(val)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("expected a whole number, got %q", val)
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", val)
+		}
+		field.SetFloat(n)
+	case field.Kind() == reflect.Bool:
+		switch val {
+		case "true":
+			field.SetBool(true)
+		case "false":
+		default:
+			return fmt.Errorf("expected true or false, got %q", val)
+		}
+	case field.Kind() == reflect.Slice:
+		field.Set(reflect.ValueOf(list(val)))
+	case field.Kind() == reflect.Map:
+		pairs := make(map[string]string)
+		for _, item := range list(val) {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+				return fmt.Errorf("expected name=value pairs, got %q", item)
+			}
+			pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+		field.Set(reflect.ValueOf(pairs))
+	}
+	return nil
+}
+
+// list splits a comma separated list, e.g. "kitchen,office"
+func list(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets or, for an empty val, unsets an environment variable until the test ends
+func setenv(t *testing.T, key string, val string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if val == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, val)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// load runs Load in a temporary working directory holding files, with env
+// set in the environment. INTERCOM_CONFIG is unset unless env sets it
+func load(t *testing.T, files map[string]string, env map[string]string) (*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	setenv(t, fileEnv, env[fileEnv])
+	for key, val := range env {
+		setenv(t, key, val)
+	}
+	return Load()
+}
+
+// wantErrors checks that err is Errors, with one naming each of keys
+func wantErrors(t *testing.T, err error, keys ...string) {
+	t.Helper()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("got error %v, want Errors", err)
+	}
+	if len(errs) != len(keys) {
+		t.Errorf("got %d errors, want %d:\n%v", len(errs), len(keys), err)
+	}
+	for _, key := range keys {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("no error for %v:\n%v", key, err)
+		}
+	}
+}
+
+func TestLoadPriority(t *testing.T) {
+	c, err := load(t, map[string]string{
+		".env":          "STATION_NAME=dotenv\nSAMPLE_RATE=8000\nBUSY_POLICY=wait\n",
+		"intercom.yaml": "station:\n  name: file\naudio:\n  sample_rate: 16000\n",
+	}, map[string]string{
+		"STATION_NAME": "environment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Station.Name != "environment" {
+		t.Errorf("name is %q, want it from the environment", c.Station.Name)
+	}
+	if c.Audio.SampleRate != 16000 {
+		t.Errorf("sample rate is %v, want it from the file", c.Audio.SampleRate)
+	}
+	if c.Policies.Busy != "wait" {
+		t.Errorf("busy policy is %q, want it from .env", c.Policies.Busy)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	c, err := load(t, map[string]string{
+		"station.yaml": `
+features:
+  inputs: [button, control]
+  outputs: [led]
+pins:
+  red_button: 0
+  black_button: 17
+  green_led: 22
+  yellow_led: 23
+peers:
+  directory:
+    kitchen: 12
+    desk: sip:201
+  presence_interval: 0s
+dial:
+  timeout: 2s
+  auto_redial: true
+webhooks:
+  - url: http://hooks/one
+    events: [incoming, missed]
+  - url: http://hooks/two
+    retries: 0
+ring_groups:
+  - name: upstairs
+    members: [kitchen, desk]
+    strategy: sequential
+`,
+	}, map[string]string{
+		fileEnv: "station.yaml",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"button", "control"}; !reflect.DeepEqual(c.Features.Inputs, want) {
+		t.Errorf("inputs are %v, want %v", c.Features.Inputs, want)
+	}
+	if c.Pins.RedButton != 0 || c.Pins.BlackButton != 17 {
+		t.Errorf("button pins are %v and %v, want 0 and 17", c.Pins.RedButton, c.Pins.BlackButton)
+	}
+	if want := map[string]string{"kitchen": "12", "desk": "sip:201"}; !reflect.DeepEqual(c.Peers.Directory, want) {
+		t.Errorf("directory is %v, want %v", c.Peers.Directory, want)
+	}
+	if c.Dial.Timeout != 2*time.Second || !c.Dial.AutoRedial {
+		t.Errorf("dial settings are %+v", c.Dial)
+	}
+	if len(c.Webhooks) != 2 || c.Webhooks[0].URL != "http://hooks/one" || c.Webhooks[1].URL != "http://hooks/two" {
+		t.Fatalf("webhooks are %+v", c.Webhooks)
+	}
+	if want := []string{"incoming", "missed"}; !reflect.DeepEqual(c.Webhooks[0].Events, want) {
+		t.Errorf("webhook events are %v, want %v", c.Webhooks[0].Events, want)
+	}
+	want := []RingGroupConfig{{Name: "upstairs", Members: []string{"kitchen", "desk"}, Strategy: "sequential"}}
+	if !reflect.DeepEqual(c.RingGroups, want) {
+		t.Errorf("ring groups are %+v, want %+v", c.RingGroups, want)
+	}
+
+	// Settings set to zero are told apart from settings that weren't given
+	for key, want := range map[string]bool{
+		"RED_BUTTON_PIN":    true,
+		"PRESENCE_INTERVAL": true,
+		"WEBHOOK_2_RETRIES": true,
+		"WEBHOOK_1_RETRIES": false,
+		"VOLUME_UP_PIN":     false,
+	} {
+		if got := c.IsSet(key); got != want {
+			t.Errorf("IsSet(%v) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestLoadUnknownSettings(t *testing.T) {
+	// Unknown .env keys are ignored, as .env may be shared with other programs
+	c, err := load(t, map[string]string{".env": "STATION_NAME=hall\nNOT_A_SETTING=1\n"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Station.Name != "hall" {
+		t.Errorf("name is %q, want hall", c.Station.Name)
+	}
+
+	// but not in the config file, where they are likely typos
+	_, err = load(t, map[string]string{
+		"intercom.yaml": "station:\n  nmae: hall\nmedia:\n  transport: rtp\nextras: 1\n",
+	}, nil)
+	wantErrors(t, err, "station.nmae", "extras")
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := load(t, nil, nil); err != nil {
+		t.Errorf("no config file, got error %v", err)
+	}
+	if _, err := load(t, nil, map[string]string{fileEnv: "missing.yaml"}); !os.IsNotExist(err) {
+		t.Errorf("missing INTERCOM_CONFIG, got error %v", err)
+	}
+}
+
+func TestLoadParseErrors(t *testing.T) {
+	_, err := load(t, map[string]string{
+		".env": "SAMPLE_RATE=fast\nDIAL_TIMEOUT=-1s\nAUTO_REDIAL=yes\nDIRECTORY=kitchen\n",
+	}, nil)
+	wantErrors(t, err, "SAMPLE_RATE", "DIAL_TIMEOUT", "AUTO_REDIAL", "DIRECTORY")
+	if !strings.Contains(err.Error(), "from .env") {
+		t.Errorf("errors don't say where the settings came from:\n%v", err)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want []string
+	}{
+		{"valid", "INPUT_TYPE=button\nRED_BUTTON_PIN=0\nBLACK_BUTTON_PIN=17\nBUSY_POLICY=wait\n", nil},
+		{"unknown options", "INPUT_TYPE=button,keypad\nRED_BUTTON_PIN=0\nBLACK_BUTTON_PIN=17\nBUSY_POLICY=hold\n", []string{"INPUT_TYPE", "BUSY_POLICY"}},
+		{"missing pins", "INPUT_TYPE=button\nOUTPUT_TYPE=led\nGREEN_LED_PIN=22\n", []string{"RED_BUTTON_PIN", "BLACK_BUTTON_PIN", "YELLOW_LED_PIN"}},
+		{"pin used twice", "OUTPUT_TYPE=led\nGREEN_LED_PIN=22\nYELLOW_LED_PIN=22\n", []string{"YELLOW_LED_PIN"}},
+		{"caller policy", "CALLER_POLICIES=hall=answer,spam=block\n", []string{"CALLER_POLICIES"}},
+		{"address", "LISTEN_ADDRESS=20000\n", []string{"LISTEN_ADDRESS"}},
+		{"range", "RING_VOLUME=150\nRTP_PORTS=20019-20010\n", []string{"RING_VOLUME", "RTP_PORTS"}},
+		{"ring group", "DIRECTORY=hall=11\nRING_GROUP_1_NAME=hall\nRING_GROUP_2_MEMBERS=kitchen\n", []string{"RING_GROUP_1_NAME", "RING_GROUP_1_MEMBERS", "RING_GROUP_2_NAME"}},
+		{"features need settings", "INPUT_TYPE=voice,mqtt\nSIP_SERVER=pbx\n", []string{"VOICE_RECOGNIZER", "MQTT_BROKER", "SIP_USER"}},
+		{"schedules", "DND_SCHEDULE=mon-fri 22:00-07:00; sat,sun 23:00-09:00\nQUIET_HOURS=21:00-07:00\n", nil},
+		{"invalid schedules", "DND_SCHEDULE=mon-fri 22:00-25:00\nQUIET_HOURS=someday 21:00-07:00\n", []string{"DND_SCHEDULE", "QUIET_HOURS"}},
+		{"webhook events", "WEBHOOK_1_URL=http://hooks/one\nWEBHOOK_1_EVENTS=missed,connected\nWEBHOOK_2_URL=http://hooks/two\nWEBHOOK_2_EVENTS=missed,hangup\n", []string{"WEBHOOK_2_EVENTS"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, map[string]string{".env": tt.env}, nil)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			wantErrors(t, err, tt.want...)
+		})
+	}
+}
+
+func TestLoadExample(t *testing.T) {
+	example, err := filepath.Abs("../../intercom.yaml.dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(t, nil, map[string]string{fileEnv: example}); err != nil {
+		t.Errorf("intercom.yaml.dist doesn't load:\n%v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// timeRange is a daily window, such as 22:00-07:00 on weekdays
+// A window that crosses midnight belongs to the day it starts on
+type timeRange struct {
+	days       [7]bool
+	start, end time.Duration
+}
+
+// Schedule is a set of daily windows, as in DND_SCHEDULE and QUIET_HOURS
+type Schedule []timeRange
+
+// ParseSchedule reads a schedule such as "mon-fri 22:00-07:00; sat,sun 23:00-09:00"
+// If the days are left out, the window applies every day
+func ParseSchedule(val string) (Schedule, error) {
+	var s Schedule
+	for _, entry := range strings.Split(val, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var r timeRange
+		days := "daily"
+		if len(fields) == 2 {
+			days = fields[0]
+			fields = fields[1:]
+		}
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid schedule entry %q", entry)
+		}
+		if err := r.parseDays(days); err != nil {
+			return nil, err
+		}
+		times := strings.Split(fields[0], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range %q", fields[0])
+		}
+		var err error
+		if r.start, err = parseClock(times[0]); err != nil {
+			return nil, err
+		}
+		if r.end, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		s = append(s, r)
+	}
+	return s, nil
+}
+
+func (r *timeRange) parseDays(val string) error {
+	if val == "daily" || val == "*" {
+		for i := range r.days {
+			r.days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(val, ",") {
+		bounds := strings.Split(part, "-")
+		first, err := parseWeekday(bounds[0])
+		if err != nil {
+			return err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseWeekday(bounds[1]); err != nil {
+				return err
+			}
+		} else if len(bounds) > 2 {
+			return fmt.Errorf("invalid day range %q", part)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			r.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseWeekday(val string) (int, error) {
+	val = strings.ToLower(val)
+	for i, day := range weekdays {
+		if strings.HasPrefix(val, day) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", val)
+}
+
+func parseClock(val string) (time.Duration, error) {
+	t, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", val)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active returns whether t falls within any window of the schedule
+func (s Schedule) Active(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	today := int(t.Weekday())
+	yesterday := (today + 6) % 7
+	for _, r := range s {
+		if r.start <= r.end {
+			if r.days[today] && sinceMidnight >= r.start && sinceMidnight < r.end {
+				return true
+			}
+			continue
+		}
+		// Crosses midnight: either the evening part today, or the morning part of yesterday's window
+		if r.days[today] && sinceMidnight >= r.start {
+			return true
+		}
+		if r.days[yesterday] && sinceMidnight < r.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns a time in the week from Sunday 7 January 2024, e.g. at("mon 22:00")
+func at(when string) time.Time {
+	day, err := parseWeekday(when[:3])
+	if err != nil {
+		panic(err)
+	}
+	clock, err := parseClock(when[4:])
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2024, 1, 7+day, 0, 0, 0, 0, time.Local).Add(clock)
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		val     string
+		entries int
+		valid   bool
+	}{
+		{"22:00-07:00", 1, true},
+		{"mon-fri 22:00-07:00; sat,sun 23:00-09:00", 2, true},
+		{"daily 12:00-13:00;", 1, true},
+		{"* 00:00-23:59", 1, true},
+		{"Monday-Friday 08:00-17:00", 1, true},
+		{"fri-mon 20:00-08:00", 1, true},
+		{"", 0, true},
+		{"22:00", 0, false},
+		{"22:00-25:00", 0, false},
+		{"10pm-7am", 0, false},
+		{"someday 22:00-07:00", 0, false},
+		{"mon-wed-fri 22:00-07:00", 0, false},
+		{"mon fri 22:00-07:00", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			s, err := ParseSchedule(tt.val)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+			if len(s) != tt.entries {
+				t.Errorf("got %d windows, want %d", len(s), tt.entries)
+			}
+		})
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		schedule string
+		at       string
+		want     bool
+	}{
+		// Windows that cross midnight run into the next morning
+		{"22:00-07:00", "mon 21:59", false},
+		{"22:00-07:00", "mon 22:00", true},
+		{"22:00-07:00", "tue 00:00", true},
+		{"22:00-07:00", "tue 06:59", true},
+		{"22:00-07:00", "tue 07:00", false},
+		{"22:00-07:00", "sun 12:00", false},
+		// Weekdays, where Friday night runs into Saturday morning, but
+		// Sunday night isn't in the window
+		{"mon-fri 22:00-07:00", "fri 23:00", true},
+		{"mon-fri 22:00-07:00", "sat 06:00", true},
+		{"mon-fri 22:00-07:00", "sat 23:00", false},
+		{"mon-fri 22:00-07:00", "sun 23:00", false},
+		{"mon-fri 22:00-07:00", "mon 06:00", false},
+		{"mon-fri 22:00-07:00", "mon 22:30", true},
+		// Weekends, with a range that wraps past Saturday
+		{"sat,sun 23:00-09:00", "sun 08:59", true},
+		{"sat,sun 23:00-09:00", "mon 08:00", true},
+		{"sat,sun 23:00-09:00", "tue 08:00", false},
+		{"fri-sun 12:00-14:00", "sun 13:00", true},
+		{"fri-sun 12:00-14:00", "mon 13:00", false},
+		// Windows within a day, and several windows
+		{"mon-fri 12:00-13:00; sat,sun 10:00-12:00", "wed 12:30", true},
+		{"mon-fri 12:00-13:00; sat,sun 10:00-12:00", "wed 13:00", false},
+		{"mon-fri 12:00-13:00; sat,sun 10:00-12:00", "sat 11:00", true},
+		{"mon-fri 12:00-13:00; sat,sun 10:00-12:00", "sat 12:30", false},
+		{"", "mon 12:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule+" at "+tt.at, func(t *testing.T) {
+			s, err := ParseSchedule(tt.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Active(at(tt.at)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	inputTypes     = []string{"button", "volume", "control", "mqtt", "voice"}
+	outputTypes    = []string{"led", "mqtt", "ring", "tts"}
+	sampleRates    = []string{"8000", "16000", "32000", "44100", "48000"}
+	transports     = []string{"rtp", "grpc"}
+	codecs         = []string{"l16", "pcmu"}
+	callerPolicies = []string{"default", "answer", "reject", "ring", "voicemail"}
+	busyPolicies   = []string{"join", "busy", "wait"}
+	recordingModes = []string{"off", "mic", "remote", "mixed"}
+	audioFormats   = []string{"wav", "ogg"}
+	ringStrategies = []string{"first", "conference", "sequential"}
+	// webhookEvents are the names of the station's events
+	webhookEvents = []string{"incoming", "missed", "connected", "ended", "error", "voicemail", "updated", "recorded", "announcement", "alert", "listening", "busy"}
+)
+
+// validate checks the values of the settings, and that the features that
+// are turned on have the settings they need
+func (c *Config) validate() Errors {
+	var errs Errors
+	check := func(ok bool, key string, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, c.errorf(key, format, a...))
+		}
+	}
+	checkOneOf := func(key string, options []string) {
+		for _, val := range list(c.env[key]) {
+			check(oneOf(val, options), key, "expected one of %v, got %q", strings.Join(options, ", "), val)
+		}
+	}
+	checkRange := func(key string, n int, min int, max int) {
+		if c.IsSet(key) {
+			check(n >= min && n <= max, key, "expected %d-%d, got %d", min, max, n)
+		}
+	}
+	checkPositive := func(key string, d time.Duration) {
+		if c.IsSet(key) {
+			check(d > 0, key, "must be more than 0")
+		}
+	}
+	need := func(key string, feature string) {
+		check(c.IsSet(key), key, "must be set for %v", feature)
+	}
+
+	check(!strings.ContainsAny(c.Station.Name, ",="), "STATION_NAME", "can't contain commas or =")
+	for _, key := range []string{"LISTEN_ADDRESS", "CONTROL_ADDRESS", "HUB_ADDRESS", "HUB_LISTEN"} {
+		if val := c.env[key]; val != "" {
+			check(validAddress(val), key, "expected host:port, e.g. :20000, got %q", val)
+		}
+	}
+
+	checkOneOf("INPUT_TYPE", inputTypes)
+	checkOneOf("OUTPUT_TYPE", outputTypes)
+	inputs, outputs := toSet(c.Features.Inputs), toSet(c.Features.Outputs)
+	if inputs["button"] {
+		need("RED_BUTTON_PIN", "the button input")
+		need("BLACK_BUTTON_PIN", "the button input")
+	}
+	if outputs["led"] {
+		need("GREEN_LED_PIN", "the led output")
+		need("YELLOW_LED_PIN", "the led output")
+	}
+	if inputs["volume"] {
+		if c.IsSet("VOLUME_ENCODER_A_PIN") || c.IsSet("VOLUME_ENCODER_B_PIN") {
+			need("VOLUME_ENCODER_A_PIN", "a volume encoder")
+			need("VOLUME_ENCODER_B_PIN", "a volume encoder")
+		} else {
+			need("VOLUME_UP_PIN", "the volume input, without an encoder")
+			need("VOLUME_DOWN_PIN", "the volume input, without an encoder")
+		}
+	}
+	if inputs["mqtt"] || outputs["mqtt"] {
+		need("MQTT_BROKER", "mqtt inputs and outputs")
+	}
+	if inputs["voice"] {
+		need("VOICE_RECOGNIZER", "the voice input")
+	}
+	pins := []struct {
+		key string
+		pin int
+	}{
+		{"RED_BUTTON_PIN", c.Pins.RedButton},
+		{"BLACK_BUTTON_PIN", c.Pins.BlackButton},
+		{"GREEN_LED_PIN", c.Pins.GreenLed},
+		{"YELLOW_LED_PIN", c.Pins.YellowLed},
+		{"VOLUME_UP_PIN", c.Pins.VolumeUp},
+		{"VOLUME_DOWN_PIN", c.Pins.VolumeDown},
+		{"VOLUME_ENCODER_A_PIN", c.Pins.VolumeEncoderA},
+		{"VOLUME_ENCODER_B_PIN", c.Pins.VolumeEncoderB},
+	}
+	used := make(map[int]string)
+	for _, p := range pins {
+		if !c.IsSet(p.key) {
+			continue
+		}
+		check(p.pin >= 0, p.key, "can't be negative: %d", p.pin)
+		if other, ok := used[p.pin]; ok {
+			check(false, p.key, "pin %d is already used for %v", p.pin, other)
+		}
+		used[p.pin] = p.key
+	}
+
+	checkOneOf("SAMPLE_RATE", sampleRates)
+	checkRange("RING_VOLUME", c.Audio.RingVolume, 0, 100)
+	checkRange("QUIET_HOURS_RING_VOLUME", c.Audio.QuietHoursRingVolume, 0, 100)
+	checkRange("VOLUME_STEP", c.Audio.VolumeStep, 1, 100)
+
+	checkOneOf("MEDIA_TRANSPORT", transports)
+	checkOneOf("MEDIA_CODECS", codecs)
+	if c.IsSet("RTP_PORTS") {
+		check(validPortRange(c.Media.RTPPorts), "RTP_PORTS", "expected a port or range, e.g. 20010-20019, got %q", c.Media.RTPPorts)
+	}
+
+	if c.IsSet("SIP_SERVER") {
+		need("SIP_USER", "SIP")
+	}
+	checkRange("SIP_PORT", c.SIP.Port, 1, 65535)
+	if c.IsSet("SIP_EXPIRES") {
+		check(c.SIP.Expires >= time.Minute, "SIP_EXPIRES", "must be at least 1m")
+	}
+
+	checkPositive("DIAL_TIMEOUT", c.Dial.Timeout)
+	checkPositive("INVITE_TIMEOUT", c.Dial.InviteTimeout)
+	checkPositive("REDIAL_DELAY", c.Dial.RedialDelay)
+	if c.IsSet("REDIAL_ATTEMPTS") {
+		check(c.Dial.RedialAttempts >= 1, "REDIAL_ATTEMPTS", "must be at least 1")
+	}
+
+	for name, policy := range c.Policies.Callers {
+		check(oneOf(policy, callerPolicies), "CALLER_POLICIES", "expected one of %v for %v, got %q", strings.Join(callerPolicies, ", "), name, policy)
+	}
+	checkOneOf("BUSY_POLICY", busyPolicies)
+	if _, err := ParseSchedule(c.Policies.DNDSchedule); err != nil {
+		check(false, "DND_SCHEDULE", "%v", err)
+	}
+	if _, err := ParseSchedule(c.Policies.QuietHours); err != nil {
+		check(false, "QUIET_HOURS", "%v", err)
+	}
+
+	checkOneOf("CALL_RECORDING", recordingModes)
+	checkOneOf("RECORDING_FORMAT", audioFormats)
+	if c.IsSet("RECORDING_MAX_MB") {
+		check(c.Recording.MaxMB >= 0, "RECORDING_MAX_MB", "can't be negative")
+	}
+
+	for i, w := range c.Webhooks {
+		prefix := fmt.Sprintf("WEBHOOK_%d_", i+1)
+		need(prefix+"URL", "a webhook")
+		checkOneOf(prefix+"EVENTS", webhookEvents)
+		if c.IsSet(prefix + "RETRIES") {
+			check(w.Retries >= 0, prefix+"RETRIES", "can't be negative")
+		}
+	}
+
+	groups := make(map[string]bool)
+	for i, g := range c.RingGroups {
+		prefix := fmt.Sprintf("RING_GROUP_%d_", i+1)
+		need(prefix+"NAME", "a ring group")
+		need(prefix+"MEMBERS", "a ring group")
+		checkOneOf(prefix+"STRATEGY", ringStrategies)
+		checkPositive(prefix+"TIMEOUT", g.Timeout)
+		if _, ok := c.Peers.Directory[g.Name]; ok {
+			check(false, prefix+"NAME", "%v is already a station in the directory", g.Name)
+		}
+		if g.Name != "" && groups[g.Name] {
+			check(false, prefix+"NAME", "there is already a ring group called %v", g.Name)
+		}
+		groups[g.Name] = true
+	}
+
+	if c.IsSet("MONITOR_THRESHOLD") {
+		check(c.Monitor.Threshold < 0, "MONITOR_THRESHOLD", "expected a level below 0dBFS, e.g. -30")
+	}
+	return errs
+}
+
+func oneOf(val string, options []string) bool {
+	for _, o := range options {
+		if val == o {
+			return true
+		}
+	}
+	return false
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// validAddress returns whether address is a host and port to listen on or dial
+func validAddress(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	return err == nil && validPort(port)
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// validPortRange returns whether ports is a port, or a range like "20010-20019"
+func validPortRange(ports string) bool {
+	bounds := strings.SplitN(ports, "-", 2)
+	if !validPort(bounds[0]) {
+		return false
+	}
+	if len(bounds) == 1 {
+		return true
+	}
+	min, _ := strconv.Atoi(bounds[0])
+	max, err := strconv.Atoi(bounds[1])
+	return err == nil && validPort(bounds[1]) && max >= min
+}
@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/figadore/go-intercom/pkg/rtp"
+)
+
+// mediaProfile is how audio is sent over RTP
+type mediaProfile struct {
+	// payloadType is PCMU, or L16 at the call's sample rate
+	payloadType uint8
+	// frame is the length of audio in each packet, in milliseconds
+	frame int
+	// redundancy repeats each frame in the next packet
+	redundancy bool
+}
+
+// codec is the MEDIA_CODECS name of the profile's payload type
+func (p mediaProfile) codec() string {
+	if p.payloadType == rtp.PayloadTypePCMU {
+		return "pcmu"
+	}
+	return "l16"
+}
+
+func (p mediaProfile) String() string {
+	s := fmt.Sprintf("%v %vms", strings.ToUpper(p.codec()), p.frame)
+	if p.redundancy {
+		s += "+RED"
+	}
+	return s
+}
+
+// mediaProfiles go from the best sound to the most robust. Fewer, bigger
+// packets cope better with a busy network, and redundancy covers single
+// lost packets. Every profile fits in a 1500 byte packet
+var mediaProfiles = []mediaProfile{
+	{payloadType: rtp.PayloadTypeL16, frame: 20},
+	{payloadType: rtp.PayloadTypeL16, frame: 20, redundancy: true},
+	{payloadType: rtp.PayloadTypePCMU, frame: 40, redundancy: true},
+	{payloadType: rtp.PayloadTypePCMU, frame: 60, redundancy: true},
+	{payloadType: rtp.PayloadTypePCMU, frame: 80, redundancy: true},
+}
+
+const (
+	// Move to a more robust profile at this much loss, or this RTT in milliseconds
+	adaptLossPercent = 3
+	adaptRTT         = 250
+	// Move back after this many reports in a row with less loss and RTT than these
+	adaptRecoverReports     = 5
+	adaptRecoverLossPercent = 1
+	adaptRecoverRTT         = 150
+)
+
+// adapter picks the media profile for one call from the loss reported by
+// the other end and the RTT. An adapter with one profile never changes it
+type adapter struct {
+	sync.Mutex
+	// profiles are the mediaProfiles allowed on the call, in the same order
+	profiles []mediaProfile
+	level    int
+	// good counts reports in a row good enough to move back up
+	good int
+}
+
+// newAdapter allows the profiles using codecs, e.g. "pcmu", or all of them
+// if codecs is empty. Unless adaptive, only the first of those is used
+func newAdapter(codecs []string, adaptive bool) *adapter {
+	a := &adapter{}
+	for _, p := range mediaProfiles {
+		if len(codecs) == 0 || contains(codecs, p.codec()) {
+			a.profiles = append(a.profiles, p)
+		}
+	}
+	if len(a.profiles) == 0 {
+		a.profiles = mediaProfiles
+	}
+	if !adaptive {
+		a.profiles = a.profiles[:1]
+	}
+	return a
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adapter) profile() mediaProfile {
+	a.Lock()
+	defer a.Unlock()
+	return a.profiles[a.level]
+}
+
+// report takes the latest loss and RTT, and returns the profile to use and
+// whether it changed
+func (a *adapter) report(lossPercent int, rtt float64) (mediaProfile, bool) {
+	a.Lock()
+	defer a.Unlock()
+	level := a.level
+	switch {
+	case lossPercent >= adaptLossPercent || rtt >= adaptRTT:
+		a.good = 0
+		if a.level < len(a.profiles)-1 {
+			a.level++
+		}
+	case lossPercent < adaptRecoverLossPercent && rtt < adaptRecoverRTT:
+		a.good++
+		if a.good >= adaptRecoverReports && a.level > 0 {
+			a.level--
+			a.good = 0
+		}
+	default:
+		a.good = 0
+	}
+	return a.profiles[a.level], a.level != level
+}
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewAdapter(t *testing.T) {
+	tests := []struct {
+		codecs   []string
+		adaptive bool
+		want     string
+	}{
+		{nil, true, "[L16 20ms L16 20ms+RED PCMU 40ms+RED PCMU 60ms+RED PCMU 80ms+RED]"},
+		{[]string{"pcmu"}, true, "[PCMU 40ms+RED PCMU 60ms+RED PCMU 80ms+RED]"},
+		{[]string{"l16"}, true, "[L16 20ms L16 20ms+RED]"},
+		{[]string{"l16", "pcmu"}, true, "[L16 20ms L16 20ms+RED PCMU 40ms+RED PCMU 60ms+RED PCMU 80ms+RED]"},
+		{[]string{"opus"}, true, "[L16 20ms L16 20ms+RED PCMU 40ms+RED PCMU 60ms+RED PCMU 80ms+RED]"},
+		{nil, false, "[L16 20ms]"},
+		{[]string{"pcmu"}, false, "[PCMU 40ms+RED]"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v adaptive %v", tt.codecs, tt.adaptive), func(t *testing.T) {
+			if got := fmt.Sprint(newAdapter(tt.codecs, tt.adaptive).profiles); got != tt.want {
+				t.Errorf("got profiles %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdapterReport(t *testing.T) {
+	type report struct {
+		loss  int
+		rtt   float64
+		level int
+	}
+	good := report{loss: 0, rtt: 50}
+	// repeat returns n copies of r, all expecting level
+	repeat := func(n int, r report, level int) []report {
+		r.level = level
+		reports := make([]report, n)
+		for i := range reports {
+			reports[i] = r
+		}
+		return reports
+	}
+	concat := func(parts ...[]report) []report {
+		var all []report
+		for _, p := range parts {
+			all = append(all, p...)
+		}
+		return all
+	}
+	tests := []struct {
+		name     string
+		codecs   []string
+		adaptive bool
+		reports  []report
+	}{
+		{"steps down on loss", nil, true, []report{{2, 50, 0}, {3, 50, 1}, {10, 50, 2}}},
+		{"steps down on RTT", nil, true, []report{{0, 249, 0}, {0, 250, 1}}},
+		{"stops at the most robust", []string{"pcmu"}, true, []report{{5, 50, 1}, {5, 50, 2}, {5, 50, 2}}},
+		{"recovers after good reports", nil, true, concat(
+			[]report{{5, 50, 1}, {5, 50, 2}},
+			repeat(adaptRecoverReports-1, good, 2),
+			[]report{{0, 50, 1}},
+			repeat(adaptRecoverReports-1, good, 1),
+			[]report{{0, 50, 0}},
+			repeat(adaptRecoverReports, good, 0),
+		)},
+		{"fair reports don't count towards recovery", nil, true, concat(
+			[]report{{5, 50, 1}},
+			repeat(adaptRecoverReports-1, good, 1),
+			[]report{{2, 50, 1}},
+			repeat(adaptRecoverReports-1, good, 1),
+			[]report{{0, 200, 1}},
+			repeat(adaptRecoverReports-1, good, 1),
+			[]report{{0, 50, 0}},
+		)},
+		{"bad reports restart recovery", nil, true, concat(
+			[]report{{5, 50, 1}},
+			repeat(adaptRecoverReports-1, good, 1),
+			[]report{{0, 300, 2}},
+			repeat(adaptRecoverReports-1, good, 2),
+			[]report{{0, 50, 1}},
+		)},
+		{"not adaptive", nil, false, []report{{50, 1000, 0}, {50, 1000, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdapter(tt.codecs, tt.adaptive)
+			level := 0
+			for i, r := range tt.reports {
+				got, changed := a.report(r.loss, r.rtt)
+				if want := a.profiles[r.level]; got != want || a.level != r.level {
+					t.Fatalf("report %d (%d%%, %vms): got %v, want %v", i, r.loss, r.rtt, got, want)
+				}
+				if changed != (r.level != level) {
+					t.Errorf("report %d: changed is %v", i, changed)
+				}
+				level = r.level
+			}
+		})
+	}
+}
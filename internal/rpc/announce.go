@@ -0,0 +1,197 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/resample"
+)
+
+const (
+	// Clips are sent in 100ms messages, at the wideband rate
+	announcementChunk = station.WidebandRate / 10
+	// Silence played after a clip, so the end of it gets through the speaker before it stops
+	announcementTail = 250 * time.Millisecond
+)
+
+// announcementPlayer tracks the one-way audio playing on this station, an
+// announcement or a monitor being listened to, so that calls can take over
+// the speaker from it
+type announcementPlayer struct {
+	sync.Mutex
+	call *call.Call
+	done chan struct{}
+}
+
+// stopAnnouncement ends the announcement playing, if any, and waits for the speaker to be free
+func (callManager *grpcCallManager) stopAnnouncement() {
+	callManager.announcing.Lock()
+	c, done := callManager.announcing.call, callManager.announcing.done
+	callManager.announcing.Unlock()
+	if c == nil {
+		return
+	}
+	log.Println("Stopping announcement for a call")
+	c.Hangup()
+	<-done
+}
+
+// Announce plays audio on stations by name, or on every known station for
+// "*". name is the clip or text it came from. Each station is sent the audio
+// separately. SIP phones and stations that are known to be offline are skipped
+func (callManager *grpcCallManager) Announce(name string, samples []float32, sampleRate int, to []string) {
+	if len(to) == 1 && to[0] == "*" {
+		to = knownStations(callManager.station)
+	}
+	// Pad with silence, so the resampler lets the end of the audio through
+	samples = append(samples, make([]float32, sampleRate/50)...)
+	audio := resample.New(sampleRate, station.WidebandRate).Process(samples)
+	for _, target := range to {
+		address := callManager.station.Lookup(target)
+		switch {
+		case strings.HasPrefix(address, "sip:"):
+			log.Println("Announce: skipping SIP phone", target)
+		case !callManager.station.Presence(target).Reachable():
+			log.Printf("Announce: skipping %v, offline\n", target)
+		default:
+			go callManager.announceTo(target, address, name, audio)
+		}
+	}
+}
+
+// announceTo streams audio at the wideband rate to one station
+func (callManager *grpcCallManager) announceTo(target string, address string, name string, audio []float32) {
+	fullAddress := stationAddress(address)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialCtx, dialCancel := context.WithTimeout(ctx, callManager.station.Dial.Timeout)
+	defer dialCancel()
+	conn, err := grpc.DialContext(dialCtx, fullAddress, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		log.Printf("Announce: unable to dial %v: %v\n", fullAddress, err)
+		return
+	}
+	defer conn.Close()
+	stream, err := pb.NewIntercomClient(conn).Announce(ctx)
+	if err != nil {
+		log.Printf("Announce: unable to announce to %v: %v\n", target, err)
+		return
+	}
+	log.Printf("Announce: playing %q on %v\n", name, target)
+	msg := &pb.Announcement{Station: callManager.station.Name, Clip: name, SampleRate: station.WidebandRate}
+	for first := true; first || len(audio) > 0; first = false {
+		n := announcementChunk
+		if n > len(audio) {
+			n = len(audio)
+		}
+		msg.Data, audio = audio[:n], audio[n:]
+		// The other end plays audio as it arrives, which paces the stream
+		if err := stream.Send(msg); err != nil {
+			break
+		}
+		msg = &pb.Announcement{}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		log.Printf("Announce: %v did not play %q: %v\n", target, name, err)
+		return
+	}
+	log.Printf("Announce: played %q on %v\n", name, target)
+}
+
+// Announce plays another station's clip on the speaker. Announcements don't
+// ring, and aren't played during do-not-disturb or while there are calls
+// The announcement is in the call list while it plays, so it can be hung up
+func (s *Server) Announce(stream pb.Intercom_AnnounceServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if s.station.Status.Has(station.StatusDoNotDisturb) {
+		return status.Error(codes.FailedPrecondition, "do not disturb")
+	}
+	callManager := s.station.CallManager.(*grpcCallManager)
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	c := call.New(call.NewCallId(), s.station.Name, first.Station, cancel)
+	c.Peer = first.Station
+	c.Volume = s.station.PeerVolume(first.Station)
+	c.SampleRate = int(first.SampleRate)
+	if c.SampleRate == 0 {
+		c.SampleRate = station.SampleRate
+	}
+	done := make(chan struct{})
+	defer close(done)
+	callManager.announcing.Lock()
+	if callManager.announcing.call != nil || callManager.HasCalls() {
+		callManager.announcing.Unlock()
+		return status.Error(codes.Unavailable, "station is busy")
+	}
+	callManager.announcing.call, callManager.announcing.done = c, done
+	callManager.announcing.Unlock()
+	defer func() {
+		callManager.announcing.Lock()
+		callManager.announcing.call = nil
+		callManager.announcing.Unlock()
+	}()
+	callManager.addCall(c)
+	defer s.station.UpdateStatus()
+	defer callManager.removeCall(c)
+	c.SetStatus(call.StatusActive)
+	log.Printf("Playing announcement %v from %v\n", first.Clip, first.Station)
+	s.station.Publish(station.Event{Type: station.EventAnnouncement, Call: c, Recording: first.Clip})
+
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.station.StartPlayback(ctx, &wg, errCh)
+	defer wg.Wait()
+	defer cancel()
+	err = s.playAnnouncement(ctx, c, stream, first)
+	if errors.Is(err, context.Canceled) {
+		log.Println("Announcement hung up")
+		return status.Error(codes.Aborted, "announcement hung up")
+	} else if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.AnnounceReply{})
+}
+
+// playAnnouncement sends audio to the speaker until the other end has sent the whole clip
+func (s *Server) playAnnouncement(ctx context.Context, c *call.Call, stream pb.Intercom_AnnounceServer, in *pb.Announcement) error {
+	toDevice := resample.New(c.SampleRate, s.station.DeviceRate)
+	speaker := s.station.SpeakerAudioCh()
+	tail := make([]float32, int(announcementTail.Seconds()*float64(s.station.DeviceRate)))
+	for {
+		data := toDevice.Process(in.Data)
+		station.ApplyGain(data, station.CallGain(c.CurrentVolume()))
+		select {
+		case speaker <- data:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		var err error
+		if in, err = stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	select {
+	case speaker <- tail:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -6,37 +6,117 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/figadore/go-intercom/internal/log"
 	"github.com/figadore/go-intercom/internal/rpc/pb"
 	"github.com/figadore/go-intercom/internal/station"
 	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/resample"
+	"github.com/figadore/go-intercom/pkg/rtp"
 )
 
 type grpcCallManager struct {
 	call.GenericManager
 	station  *station.Station
 	acceptCh chan bool
+	// sip places calls to SIP phones, if a SIP server is configured
+	sip *SIPGateway
+	// hub relays calls while the station is registered with one
+	hub *HubClient
+	// announcing is the announcement from another station playing, if any
+	announcing announcementPlayer
+	// replaceTokens are given out for attended transfers
+	replaceTokens replaceTokens
+	// callStation places each call of outgoingCall, with directCall. Tests
+	// replace it, as calls that connect need the sound card
+	callStation func(name string, address string, urgent bool, redialing bool, join func(*call.Call) bool) (bool, error)
 }
 
 func (callManager *grpcCallManager) HangupAll() {
-	for _, c := range callManager.CallList {
+	for _, c := range callManager.Calls() {
 		c.Hangup()
 		callManager.removeCall(c)
 	}
 	callManager.station.UpdateStatus()
 }
 
+// Mute stops sending mic audio for one call. The other end is told through the audio stream
+func (callManager *grpcCallManager) Mute(id call.CallId, muted bool) error {
+	c, err := callManager.Get(id)
+	if err != nil {
+		return err
+	}
+	if c.SetMuted(muted) {
+		log.Printf("Call %v muted: %v\n", id, muted)
+		callManager.station.Publish(station.Event{Type: station.EventCallUpdated, Call: c})
+		callManager.station.UpdateStatus()
+	}
+	return nil
+}
+
+func (callManager *grpcCallManager) hasActive() bool {
+	for _, c := range callManager.Calls() {
+		if c.CurrentStatus() == call.StatusActive {
+			return true
+		}
+	}
+	return false
+}
+
+// holdActive puts the connected calls on hold, e.g. to answer a waiting call
+func (callManager *grpcCallManager) holdActive() {
+	for _, c := range callManager.Calls() {
+		if c.CurrentStatus() == call.StatusActive {
+			if err := callManager.Hold(c.Id, true); err != nil {
+				log.Println("Unable to hold call:", err)
+			}
+		}
+	}
+}
+
+// Hold pauses audio in both directions for one call, but keeps it in the call list
+func (callManager *grpcCallManager) Hold(id call.CallId, held bool) error {
+	c, err := callManager.Get(id)
+	if err != nil {
+		return err
+	}
+	if c.SetHeld(held) {
+		log.Printf("Call %v held: %v\n", id, held)
+		callManager.station.Publish(station.Event{Type: station.EventCallUpdated, Call: c})
+		callManager.station.UpdateStatus()
+	}
+	return nil
+}
+
+// SetVolume changes the speaker volume of one call, and remembers it for the next call with the same station
+func (callManager *grpcCallManager) SetVolume(id call.CallId, percent int) error {
+	c, err := callManager.Get(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("Call %v volume: %v\n", id, percent)
+	c.SetVolume(percent)
+	callManager.station.SavePeerVolume(c.Peer, percent)
+	callManager.station.Publish(station.Event{Type: station.EventCallUpdated, Call: c})
+	return nil
+}
+
 func NewCallManager(intercom *station.Station) call.Manager {
 	m := &grpcCallManager{
 		station:  intercom,
 		acceptCh: make(chan bool),
 	}
 	m.CallList = make(map[call.CallId]*call.Call)
+	m.callStation = m.directCall
 	return m
 }
 
@@ -49,6 +129,8 @@ func (callManager *grpcCallManager) SetStation(s *station.Station) {
 }
 
 func (callManager *grpcCallManager) addCall(c *call.Call) {
+	callManager.Lock()
+	defer callManager.Unlock()
 	callManager.CallList[c.Id] = c
 }
 
@@ -59,8 +141,11 @@ func (callManager *grpcCallManager) RejectCall() {
 }
 
 func (callManager *grpcCallManager) removeCall(c *call.Call) {
+	callManager.Lock()
 	delete(callManager.CallList, c.Id)
-	if len(callManager.CallList) == 0 {
+	empty := len(callManager.CallList) == 0
+	callManager.Unlock()
+	if empty {
 		_ = callManager.station.Status.Clear(station.StatusCallConnected)
 	}
 }
@@ -70,13 +155,13 @@ type streamer interface {
 	Recv() (*pb.AudioData, error)
 }
 
-// A cancel function is passed in here so that the grpc stream's context can be cancelled
-func (callManager *grpcCallManager) duplexCall(parentContext context.Context, from string, to string, stream streamer, cancel func()) error {
+// The call's cancel function must cancel parentContext, so that the grpc stream's context can be cancelled
+// If media is set, audio moves to RTP once both ends have received RTP from each other
+func (callManager *grpcCallManager) duplexCall(parentContext context.Context, c *call.Call, stream streamer, media *rtp.Session) error {
 	defer log.Println("callManager.duplexCall: Exiting, no more error receivable")
-	callId := call.NewCallId()
-	log.Debugf("Created new callId: %v", callId)
-	callContext := context.WithValue(parentContext, call.ContextKey("id"), callId)
-	c := call.New(callId, to, from, cancel)
+	log.Debugf("duplexCall: starting call %v", c.Id)
+	callContext := context.WithValue(parentContext, call.ContextKey("id"), c.Id)
+	cancel := c.Hangup
 	defer log.Debugln("duplexCall: call.Hangup() complete")
 	defer c.Hangup()
 	defer log.Debugln("duplexCall: call.Hangup() is next, should cancel goroutines' contexts")
@@ -84,61 +169,114 @@ func (callManager *grpcCallManager) duplexCall(parentContext context.Context, fr
 	defer intercom.UpdateStatus()
 	callManager.addCall(c)
 	defer callManager.removeCall(c) // TODO remove this when c.Hangup() removes the call
+	// Calls take over the speaker from announcements
+	callManager.stopAnnouncement()
 	log.Printf("Starting call with id %v:", callContext.Value(call.ContextKey("id")))
-	errCh := make(chan error)
+	// Buffered, so that an error setting up the call is kept for below
+	errCh := make(chan error, 1)
 	var wg sync.WaitGroup
 	wg.Add(4)
-	connected := initializeConnection(callContext, stream.Send, stream.Recv, errCh)
+	rtpReady := false
+	if media != nil {
+		defer media.Close()
+		rtpReady = media.Probe(callContext, rtpProbeTimeout)
+	}
+	first, connected := initializeConnection(callContext, stream.Send, stream.Recv, errCh, rtpReady, intercom.WireRate())
 	if !connected {
-		msg := "Call did not initialize"
-		log.Println(msg)
-		return errors.New(msg)
+		err := errors.New("Call did not initialize")
+		select {
+		case setupErr := <-errCh:
+			// Other members of a ring group may still answer
+			if isBusy(setupErr) && c.Group == "" {
+				intercom.CalledBusy(c)
+				return setupErr
+			} else if isBusy(setupErr) {
+				log.Printf("duplexCall: %v is busy\n", c.Peer)
+				return setupErr
+			} else if isTransient(setupErr) {
+				// Kept, so that outgoing calls know to redial
+				err = setupErr
+			}
+		default:
+		}
+		log.Println(err)
+		intercom.Publish(station.Event{Type: station.EventError, Call: c, Err: err})
+		return err
 	}
-	c.Status = call.StatusActive
+	rate := station.NegotiateRate(intercom.WireRate(), int(first.SampleRate))
+	log.Printf("duplexCall: sending audio at %vHz\n", rate)
+	c.Lock()
+	c.SampleRate = rate
+	c.Unlock()
+	c.SetStatus(call.StatusActive)
+	intercom.Publish(station.Event{Type: station.EventCallConnected, Call: c})
 	callManager.station.Status.Set(station.StatusCallConnected)
 	callManager.station.Status.Clear(station.StatusOutgoingCall)
 	callManager.station.Status.Clear(station.StatusIncomingCall)
-	go callManager.startSending(callContext, &wg, errCh, stream.Send)
-	go callManager.startReceiving(callContext, &wg, errCh, stream.Recv)
+	audio := mediaStream(callContext, stream, media, rtpReady && first.Rtp, intercom.Media, rate, errCh, cancel)
+	playout := station.NewPlayoutBuffer(intercom.DeviceRate)
+	meter := newQualityMeter(c, intercom.Speaker, audio, playout, rate)
+	audio = meter.wrap(audio)
+	if recording, err := intercom.RecordCall(c); err != nil {
+		log.Println("duplexCall: unable to record call:", err)
+		intercom.Publish(station.Event{Type: station.EventError, Call: c, Err: err})
+	} else if recording != nil {
+		defer recording.Close()
+		audio = &recordingStreamer{streamer: audio, recording: recording}
+		if intercom.RecordingNotice() {
+			if err := audio.Send(&pb.AudioData{Data: recordingNotice(rate)}); err != nil {
+				log.Println("duplexCall: error sending recording notice:", err)
+			}
+		}
+	}
+	go callManager.startSending(callContext, c, &wg, errCh, audio.Send, rate)
+	go callManager.startReceiving(callContext, c, &wg, errCh, audio.Recv, playout, rate)
 	go intercom.StartRecording(callContext, &wg, errCh)
 	go intercom.StartPlayback(callContext, &wg, errCh)
 	log.Debugln("DuplexCall: go routines started")
+	var err error
 	select {
 	case <-callContext.Done():
 		log.Printf("duplexCall: context.Done: %v", callContext.Err())
 		cancel()
 		wg.Wait()
-		return callContext.Err()
-	case err := <-errCh:
+		err = callContext.Err()
+	case err = <-errCh:
 		log.Printf("duplexCall: Received error on errCh: %v", err)
 		cancel()
 		log.Printf("duplexCall: waiting on waitgroup")
 		wg.Wait()
 		log.Printf("duplexCall: finished waiting on waitgroup")
-		return err
 	}
+	meter.finish()
+	intercom.Publish(station.Event{Type: station.EventCallEnded, Call: c, Err: err})
+	return err
 }
 
 // Send and receive the first packets of data. These will be empty slices
-func initializeConnection(ctx context.Context, sendFn func(*pb.AudioData) error, recvFn func() (*pb.AudioData, error), errCh chan error) bool {
+// rtpReady tells the other end that RTP audio from it has arrived, and
+// sampleRate is the highest rate this end can send and receive
+func initializeConnection(ctx context.Context, sendFn func(*pb.AudioData) error, recvFn func() (*pb.AudioData, error), errCh chan error, rtpReady bool, sampleRate int) (*pb.AudioData, bool) {
 	// Initial send
 	data := pb.AudioData{
-		Data: make([]float32, 0),
+		Data:       make([]float32, 0),
+		Rtp:        rtpReady,
+		SampleRate: uint32(sampleRate),
 	}
 	err := sendFn(&data)
 	if err != nil {
 		log.Println("startSending.initialSend: error grpc sending", err)
 		sendWithTimeout(err, errCh)
 		log.Println("startSending.initialSend: sent error grpc sending", err)
-		return false
+		return nil, false
 	}
 	log.Println("startSending.initialSend: sent first packet", err)
 
 	// Initial receive
-	_, err = recvFn()
+	in, err := recvFn()
 	if err == io.EOF {
 		log.Println("startReceiving.initialReceive: received io.EOF")
-		return false
+		return nil, false
 	} else if err != nil {
 		log.Println("startReceiving.initialReceive: error receiving", err)
 		select {
@@ -149,10 +287,10 @@ func initializeConnection(ctx context.Context, sendFn func(*pb.AudioData) error,
 		case <-time.After(5 * time.Second):
 			log.Println("WARN: startReceiving.initialReceive: timeout sending error", err)
 		}
-		return false
+		return nil, false
 	}
 	log.Println("startReceiving.initialReceive: received first packet")
-	return true
+	return in, true
 }
 
 // CallAll calls every intercom station it knows about
@@ -160,40 +298,155 @@ func initializeConnection(ctx context.Context, sendFn func(*pb.AudioData) error,
 func (callManager *grpcCallManager) CallAll() {
 	log.Debugln("Debug: callManager.CallAll: enter")
 	defer log.Debugln("Debug: callManager.CallAll: exit")
+	if callManager.hub.isRegistered() {
+		go callManager.hub.call(callManager, []string{"*"}, false, nil)
+		return
+	}
 	intercoms := os.Args[1:]
 	for _, address := range intercoms {
-		go callManager.outgoingCall(address)
+		// Don't leave the outgoing call pending on stations that are known to be down
+		if !callManager.station.Presence(address).Reachable() {
+			log.Printf("CallAll: skipping %v, offline\n", address)
+			continue
+		}
+		go callManager.outgoingCall(address, false, nil)
 		// callManager.outgoingCall(mainContext, address)
 	}
 }
 
-func (callManager *grpcCallManager) outgoingCall(address string) {
+// PlaceCall calls each of the given intercom stations
+func (callManager *grpcCallManager) PlaceCall(to []string) {
+	callManager.placeCall(to, false)
+}
+
+// PlaceUrgentCall is like PlaceCall, but asks the other stations to break
+// through do-not-disturb, if their policy allows it
+func (callManager *grpcCallManager) PlaceUrgentCall(to []string) {
+	callManager.placeCall(to, true)
+}
+
+// placeCall calls stations through the hub, as one call, while registered
+// with one. SIP phones and stations without a hub are called directly
+func (callManager *grpcCallManager) placeCall(to []string, urgent bool) {
+	var viaHub []string
+	for _, name := range to {
+		if callManager.hub.isRegistered() && !strings.HasPrefix(callManager.station.Lookup(name), "sip:") {
+			viaHub = append(viaHub, name)
+			continue
+		}
+		go callManager.outgoingCall(name, urgent, nil)
+	}
+	if len(viaHub) > 0 {
+		go callManager.hub.call(callManager, viaHub, urgent, nil)
+	}
+}
+
+// outgoingCall calls a station by name, or by address if it isn't in the directory
+// With AUTO_REDIAL, a call that drops because of a network error is dialed again
+// join, if set, is given each call before it's dialed, and returns false to not dial it
+func (callManager *grpcCallManager) outgoingCall(name string, urgent bool, join func(*call.Call) bool) {
+	address := callManager.station.Lookup(name)
+	if strings.HasPrefix(address, "sip:") {
+		callManager.sipCall(name, address)
+		return
+	}
+	dial := callManager.station.Dial
+	redialing, attempts := false, 0
+	for {
+		connected, err := callManager.callStation(name, address, urgent, redialing, join)
+		if connected {
+			attempts = 0
+		}
+		// Only redial calls that were connected, until the station answers again
+		if !dial.Redial || !(connected || redialing) || !isTransient(err) || attempts >= dial.RedialAttempts {
+			return
+		}
+		attempts++
+		redialing = true
+		log.Printf("outgoingCall: call to %v dropped, redialing (%d of %d): %v\n", name, attempts, dial.RedialAttempts, err)
+	}
+}
+
+// isTransient returns whether a call ended because of the network, rather
+// than either end hanging up
+func isTransient(err error) bool {
+	return status.Code(err) == codes.Unavailable || errors.Is(err, context.DeadlineExceeded)
+}
+
+// directCall calls a station over gRPC. It returns whether the call was
+// connected, and the error it ended with
+// The call is in the call list while dialing and ringing, so it can be hung up
+// before it connects. If it isn't answered within InviteTimeout, it is hung up
+func (callManager *grpcCallManager) directCall(name string, address string, urgent bool, redialing bool, join func(*call.Call) bool) (bool, error) {
 	log.Println("outgoingCall: Start client side DuplexCall")
+	dial := callManager.station.Dial
 
 	// Initiate a grpc connection with the server
-	fullAddress := fmt.Sprintf("192.168.0.%s%s", address, port)
+	fullAddress := stationAddress(address)
 	to := fullAddress
 	from := "self"
-	log.Println("outgoingCall: dialing", fullAddress)
+	grpcCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := call.New(call.NewCallId(), to, from, cancel)
+	c.Peer = name
+	c.Urgent = urgent
+	c.Volume = callManager.station.PeerVolume(name)
+	if join != nil && !join(c) {
+		return false, nil
+	}
+	callManager.addCall(c)
+	defer callManager.station.UpdateStatus()
+	defer callManager.removeCall(c)
 	_ = callManager.station.Status.Set(station.StatusOutgoingCall)
+	invite := time.AfterFunc(dial.InviteTimeout, func() {
+		if c.CurrentStatus() == call.StatusPending {
+			log.Println("outgoingCall: not answered, hanging up", fullAddress)
+			c.Hangup()
+		}
+	})
+	defer invite.Stop()
+
+	// Wait before redialing, but let the hang up button cancel the redial
+	if redialing {
+		select {
+		case <-time.After(dial.RedialDelay):
+		case <-grpcCtx.Done():
+			return false, grpcCtx.Err()
+		}
+	}
+	log.Println("outgoingCall: dialing", fullAddress)
 	// TODO send separate "call request" grpc call to ring other end and wait if auto-answer not enabled? or set status once first successful send/receive happens?
-	conn, err := grpc.Dial(fullAddress, grpc.WithInsecure(), grpc.WithBlock())
+	dialCtx, dialCancel := context.WithTimeout(grpcCtx, dial.Timeout)
+	defer dialCancel()
+	conn, err := grpc.DialContext(dialCtx, fullAddress, grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
 		msg := fmt.Sprintf("Warning: Unable to dial %v: %v", fullAddress, err)
 		log.Println(msg)
-		return
+		return false, err
 	}
 	log.Debugln("outgoingCall: dialed")
 	defer log.Debugln("outgoingCall: conn.Closed")
 	defer conn.Close()
 	defer log.Debugln("outgoingCall: conn.Closing")
 	client := pb.NewIntercomClient(conn)
-	grpcCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	grpcCtx = metadata.AppendToOutgoingContext(grpcCtx, stationHeader, callManager.station.Name, urgentHeader, strconv.FormatBool(urgent))
+	if c.Doorbell {
+		grpcCtx = metadata.AppendToOutgoingContext(grpcCtx, doorbellHeader, "true")
+	}
+	if c.Replaces != "" {
+		grpcCtx = metadata.AppendToOutgoingContext(grpcCtx, replacesHeader, c.Replaces, replaceTokenHeader, c.ReplacesToken)
+	}
+	media := listenMedia(callManager.station.Media)
+	if media != nil {
+		grpcCtx = metadata.AppendToOutgoingContext(grpcCtx, rtpPortHeader, strconv.Itoa(media.LocalPort()))
+	}
 	serverStream, err := client.DuplexCall(grpcCtx)
 	if err != nil {
 		log.Printf("outgoingCall: error creating duplex call client: %v", err)
-		return
+		if media != nil {
+			media.Close()
+		}
+		return false, err
 	}
 	defer func() {
 		// doesn't return errors, always nil
@@ -201,8 +454,9 @@ func (callManager *grpcCallManager) outgoingCall(address string) {
 		_ = serverStream.CloseSend()
 		log.Println("outgoingCall: CloseSend() complete")
 	}()
-	err = callManager.duplexCall(grpcCtx, to, from, serverStream, cancel)
+	err = callManager.duplexCall(grpcCtx, c, serverStream, dialMedia(media, fullAddress, serverStream))
 	log.Println("outgoingCall: client-side duplex call ended with:", err)
+	return c.Connected(), err
 }
 
 func sendWithTimeout(err error, errCh chan error) {
@@ -214,11 +468,17 @@ func sendWithTimeout(err error, errCh chan error) {
 }
 
 // Infinite loop to receive from the gRPC stream and send it to the speaker
-func (callManager *grpcCallManager) startReceiving(ctx context.Context, wg *sync.WaitGroup, errCh chan error, recvFn func() (*pb.AudioData, error)) {
+// Audio arrives at rate, and is converted to the sound card's rate before it
+// goes through playout, which corrects for clock drift between the two ends
+func (callManager *grpcCallManager) startReceiving(ctx context.Context, c *call.Call, wg *sync.WaitGroup, errCh chan error, recvFn func() (*pb.AudioData, error), playout *station.PlayoutBuffer, rate int) {
 	log.Println("startReceiving: enter")
 	defer log.Println("startReceiving: exit")
 	defer wg.Done()
 	intercom := callManager.station
+	playCtx, stopPlaying := context.WithCancel(ctx)
+	defer stopPlaying()
+	go playout.Play(playCtx, intercom.SpeakerAudioCh())
+	fromWire := resample.New(rate, intercom.DeviceRate)
 	// log.SetPrefix("startReceiving: ")
 	// log.SetFlags(log.Ldate | log.Lmicroseconds)
 	for {
@@ -248,14 +508,21 @@ func (callManager *grpcCallManager) startReceiving(ctx context.Context, wg *sync
 			}
 			return
 		}
+		if c.SetRemote(in.Muted, in.Held) {
+			log.Printf("startReceiving: remote muted: %v, held: %v\n", in.Muted, in.Held)
+			intercom.Publish(station.Event{Type: station.EventCallUpdated, Call: c})
+		}
+		if len(in.Participants) > 0 && c.SetParticipants(in.Participants) {
+			log.Printf("startReceiving: participants: %v\n", in.Participants)
+			intercom.Publish(station.Event{Type: station.EventCallUpdated, Call: c})
+		}
 		data := make([]float32, len(in.Data))
-		copy(data, in.Data)
-		select {
-		case <-ctx.Done():
-			log.Println("startReceiving: context done3: ", ctx.Err())
-			return
-		case intercom.SpeakerAudioCh() <- data:
+		// While on hold, play silence instead of the remote audio
+		if !c.IsHeld() {
+			copy(data, in.Data)
+			station.ApplyGain(data, station.CallGain(c.CurrentVolume()))
 		}
+		playout.Write(fromWire.Process(data))
 	}
 }
 
@@ -269,20 +536,43 @@ func (callManager *grpcCallManager) startReceiving(ctx context.Context, wg *sync
 //}
 
 // Infinite loop to receive from the mic and stream it to the gRPC server
-func (callManager *grpcCallManager) startSending(ctx context.Context, wg *sync.WaitGroup, errCh chan error, sendFn func(*pb.AudioData) error) {
+// Audio is converted from the sound card's rate to rate before it is sent
+func (callManager *grpcCallManager) startSending(ctx context.Context, c *call.Call, wg *sync.WaitGroup, errCh chan error, sendFn func(*pb.AudioData) error, rate int) {
 	log.Println("startSending: enter")
 	defer log.Println("startSending: exit")
 	defer wg.Done()
 	intercom := callManager.station
 	// when streaming ends, client receives io.EOF
 	// not sure how to initiate this on the server side though
+	toWire := resample.New(intercom.DeviceRate, rate)
 	var audioBytes []float32
 	var data pb.AudioData
 	for {
+		// A held call leaves the mic to the active calls, if there are any, and
+		// keeps the stream flowing with silence on its own
+		mic := intercom.MicAudioCh()
+		var silence <-chan time.Time
+		if c.IsHeld() && callManager.hasActive() {
+			mic = nil
+			silence = time.After(time.Second * station.FragmentSize / station.SampleRate)
+		}
 		select {
-		case audioBytes = <-intercom.MicAudioCh():
+		case <-silence:
 			data = pb.AudioData{
-				Data: audioBytes,
+				Data:  make([]float32, station.FragmentSize*rate/station.SampleRate),
+				Muted: c.IsMuted(),
+				Held:  true,
+			}
+		case audioBytes = <-mic:
+			audioBytes = toWire.Process(audioBytes)
+			data = pb.AudioData{
+				Data:  audioBytes,
+				Muted: c.IsMuted(),
+				Held:  c.IsHeld(),
+			}
+			// Keep the stream flowing with silence, so neither end times out
+			if data.Muted || data.Held {
+				data.Data = make([]float32, len(audioBytes))
 			}
 		case <-time.After(5 * time.Second):
 			log.Println("WARN: timeout receiving from mic audio channel")
@@ -0,0 +1,231 @@
+package rpc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// stubStation fails its first calls as if it were restarting, then rings
+// without answering until the caller hangs up
+type stubStation struct {
+	pb.UnimplementedIntercomServer
+	sync.Mutex
+	address  string
+	failures int
+	calls    []time.Time
+	ended    []time.Time
+	// ringing gets a value when a call starts ringing, and hungUp when the
+	// caller hangs up
+	ringing chan struct{}
+	hungUp  chan struct{}
+}
+
+func newStubStation(t *testing.T, failures int) *stubStation {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubStation{address: lis.Addr().String(), failures: failures, ringing: make(chan struct{}, 1), hungUp: make(chan struct{}, 1)}
+	server := grpc.NewServer()
+	pb.RegisterIntercomServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return s
+}
+
+func (s *stubStation) DuplexCall(stream pb.Intercom_DuplexCallServer) error {
+	s.Lock()
+	s.calls = append(s.calls, time.Now())
+	n := len(s.calls)
+	s.Unlock()
+	if n <= s.failures {
+		return status.Error(codes.Unavailable, "restarting")
+	}
+	s.ringing <- struct{}{}
+	<-stream.Context().Done()
+	s.Lock()
+	s.ended = append(s.ended, time.Now())
+	s.Unlock()
+	s.hungUp <- struct{}{}
+	return nil
+}
+
+func (s *stubStation) callTimes() []time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return append([]time.Time(nil), s.calls...)
+}
+
+func (s *stubStation) hangupTimes() []time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return append([]time.Time(nil), s.ended...)
+}
+
+// dropFirstCall makes the first call of outgoingCall connect and drop, as
+// the network going away would, and places the rest as usual
+func dropFirstCall(callManager *grpcCallManager) {
+	first := true
+	callManager.callStation = func(name string, address string, urgent bool, redialing bool, join func(*call.Call) bool) (bool, error) {
+		if first {
+			first = false
+			return true, status.Error(codes.Unavailable, "connection lost")
+		}
+		return callManager.directCall(name, address, urgent, redialing, join)
+	}
+}
+
+// callGarage runs outgoingCall to the garage, closing the channel once it returns
+func callGarage(callManager *grpcCallManager) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		callManager.outgoingCall("garage", false, nil)
+		close(done)
+	}()
+	return done
+}
+
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(what)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Accepts connections, but never speaks gRPC
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	kitchen := newTestStation(t, "kitchen", config.Config{Dial: config.DialConfig{Timeout: 200 * time.Millisecond}})
+	callManager := kitchen.CallManager.(*grpcCallManager)
+
+	start := time.Now()
+	connected, err := callManager.directCall("garage", lis.Addr().String(), false, false, nil)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("dialing gave up after %v, want 200ms", elapsed)
+	}
+	if connected || !isTransient(err) {
+		t.Errorf("got connected %v with error %v, want a transient error", connected, err)
+	}
+	if calls := callManager.Calls(); len(calls) != 0 {
+		t.Errorf("calls left behind: %v", calls)
+	}
+}
+
+func TestInviteTimeout(t *testing.T) {
+	garage := newStubStation(t, 0)
+	kitchen := newTestStation(t, "kitchen", config.Config{Dial: config.DialConfig{InviteTimeout: 300 * time.Millisecond}})
+	callManager := kitchen.CallManager.(*grpcCallManager)
+
+	start := time.Now()
+	var connected bool
+	var err error
+	done := make(chan struct{})
+	go func() {
+		connected, err = callManager.directCall("garage", garage.address, false, false, nil)
+		close(done)
+	}()
+	waitFor(t, garage.ringing, "garage didn't ring")
+	if calls := callManager.Calls(); len(calls) != 1 || calls[0].CurrentStatus() != call.StatusPending {
+		t.Errorf("got calls %v while ringing, want one pending", calls)
+	}
+	waitFor(t, done, "call wasn't hung up")
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("unanswered call was hung up after %v, want 300ms", elapsed)
+	}
+	if connected || isTransient(err) {
+		t.Errorf("got connected %v with error %v, want an unanswered call that isn't redialed", connected, err)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	delay := 50 * time.Millisecond
+	tests := []struct {
+		name     string
+		drop     bool
+		failures int
+		calls    int
+		rings    bool
+	}{
+		{"after a dropped call, until it rings", true, 2, 3, true},
+		{"up to the number of attempts", true, 10, 3, false},
+		{"not when the call never connected", false, 10, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			garage := newStubStation(t, tt.failures)
+			kitchen := newTestStation(t, "kitchen", config.Config{
+				Peers: directory("garage=" + garage.address),
+				Dial:  config.DialConfig{AutoRedial: true, RedialAttempts: 3, RedialDelay: delay},
+			})
+			callManager := kitchen.CallManager.(*grpcCallManager)
+			if tt.drop {
+				dropFirstCall(callManager)
+			}
+			done := callGarage(callManager)
+			if tt.rings {
+				waitFor(t, garage.ringing, "garage didn't ring")
+				callManager.HangupAll()
+			}
+			waitFor(t, done, "outgoingCall didn't return")
+
+			calls := garage.callTimes()
+			if len(calls) != tt.calls {
+				t.Fatalf("garage was called %d times, want %d", len(calls), tt.calls)
+			}
+			for i := 1; i < len(calls); i++ {
+				if wait := calls[i].Sub(calls[i-1]); wait < delay {
+					t.Errorf("redialed %v after the last call, want at least %v", wait, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestHangupCancelsRedial(t *testing.T) {
+	garage := newStubStation(t, 0)
+	kitchen := newTestStation(t, "kitchen", config.Config{
+		Peers: directory("garage=" + garage.address),
+		Dial:  config.DialConfig{AutoRedial: true, RedialDelay: time.Minute},
+	})
+	callManager := kitchen.CallManager.(*grpcCallManager)
+	dropFirstCall(callManager)
+	done := callGarage(callManager)
+
+	// The redial waits in the call list, so it can be hung up
+	for deadline := time.Now().Add(5 * time.Second); len(callManager.Calls()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("redial isn't in the call list")
+		}
+	}
+	callManager.HangupAll()
+	waitFor(t, done, "hanging up didn't cancel the redial")
+	if calls := garage.callTimes(); len(calls) != 0 {
+		t.Errorf("garage was called %d times after hanging up", len(calls))
+	}
+}
@@ -0,0 +1,206 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/resample"
+)
+
+const (
+	// The hub mixes 50ms of audio at a time, at the wideband rate. Narrowband
+	// participants are converted to and from it
+	conferenceTick    = 50 * time.Millisecond
+	conferenceFrame   = station.WidebandRate * int(conferenceTick/time.Millisecond) / 1000
+	conferenceBacklog = 4 * conferenceFrame
+	// How long the caller waits alone for someone to join
+	conferenceInviteTimeout = 30 * time.Second
+)
+
+// conference is a call on the hub. Each participant hears everyone else mixed together
+type conference struct {
+	sync.Mutex
+	id           string
+	caller       string
+	participants []*participant
+	// joined is the most participants there have been at once
+	joined int
+	done   chan struct{}
+}
+
+type participant struct {
+	sync.Mutex
+	name string
+	// in holds received audio waiting to be mixed
+	in  []float32
+	out chan []float32
+	// up converts audio from the participant's rate to the mixing rate, and down back again
+	up, down *resample.Sinc
+}
+
+func newConference(id string, caller string) *conference {
+	return &conference{
+		id:     id,
+		caller: caller,
+		done:   make(chan struct{}),
+	}
+}
+
+// receive queues audio from the participant. If the backlog grows, e.g.
+// because the station's clock runs fast, the oldest audio is dropped to keep latency down
+func (p *participant) receive(data []float32) {
+	p.Lock()
+	defer p.Unlock()
+	p.in = append(p.in, p.up.Process(data)...)
+	if len(p.in) > conferenceBacklog {
+		p.in = p.in[len(p.in)-conferenceBacklog:]
+	}
+}
+
+// frame returns the next frame of received audio, padded with silence
+func (p *participant) frame() []float32 {
+	p.Lock()
+	defer p.Unlock()
+	frame := make([]float32, conferenceFrame)
+	n := copy(frame, p.in)
+	p.in = p.in[n:]
+	return frame
+}
+
+// join adds a participant who sends and receives audio at rate, unless the conference has ended
+func (c *conference) join(name string, rate int) *participant {
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	p := &participant{
+		name: name,
+		out:  make(chan []float32, 4),
+		up:   resample.New(rate, station.WidebandRate),
+		down: resample.New(station.WidebandRate, rate),
+	}
+	c.participants = append(c.participants, p)
+	if len(c.participants) > c.joined {
+		c.joined = len(c.participants)
+	}
+	return p
+}
+
+func (c *conference) leave(p *participant) {
+	c.Lock()
+	defer c.Unlock()
+	for i, other := range c.participants {
+		if other == p {
+			c.participants = append(c.participants[:i], c.participants[i+1:]...)
+			close(p.out)
+			break
+		}
+	}
+	log.Printf("Hub: %v left call %v\n", p.name, c.id)
+}
+
+func (c *conference) names() []string {
+	c.Lock()
+	defer c.Unlock()
+	names := make([]string, len(c.participants))
+	for i, p := range c.participants {
+		names[i] = p.name
+	}
+	return names
+}
+
+// others returns the names of everyone in the conference except p
+func (c *conference) others(p *participant) []string {
+	c.Lock()
+	defer c.Unlock()
+	var names []string
+	for _, other := range c.participants {
+		if other != p {
+			names = append(names, other.name)
+		}
+	}
+	return names
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// run mixes audio until the conference ends. It ends when everyone has
+// left, when only one participant is left after others have joined, or when
+// nobody joins the caller in time
+func (c *conference) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(conferenceTick)
+	defer ticker.Stop()
+	started := time.Now()
+	for range ticker.C {
+		if !c.mixOrEnd(time.Since(started)) {
+			return
+		}
+	}
+}
+
+// mixOrEnd mixes one frame, and returns false if the conference has ended
+// The lock is held while mixing, so that nobody leaves mid-frame
+func (c *conference) mixOrEnd(elapsed time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	switch {
+	case len(c.participants) == 0 && c.joined > 0:
+		log.Println("Hub: call ended:", c.id)
+		return false
+	case len(c.participants) <= 1 && c.joined > 1:
+		log.Println("Hub: everyone else left call", c.id)
+		return false
+	case c.joined <= 1 && elapsed > conferenceInviteTimeout:
+		log.Println("Hub: nobody joined call", c.id)
+		return false
+	}
+	mix(c.participants)
+	return true
+}
+
+// mix sends each participant the sum of everyone else's audio
+func mix(participants []*participant) {
+	frames := make([][]float32, len(participants))
+	for i, p := range participants {
+		frames[i] = p.frame()
+	}
+	for i, p := range participants {
+		out := make([]float32, conferenceFrame)
+		for j, frame := range frames {
+			if i == j {
+				continue
+			}
+			for k, s := range frame {
+				out[k] += s
+			}
+		}
+		for k, s := range out {
+			if s > 1 {
+				out[k] = 1
+			} else if s < -1 {
+				out[k] = -1
+			}
+		}
+		select {
+		case p.out <- out:
+		default:
+			// The participant's connection is falling behind, skip a frame rather than wait
+		}
+	}
+}
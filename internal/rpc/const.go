@@ -1,5 +1,25 @@
 package rpc
 
 const (
+	// port is where other stations are called, unless their directory entry says otherwise
 	port = ":20000"
+	// gRPC metadata sent by the caller when setting up a call
+	stationHeader = "x-intercom-station"
+	urgentHeader  = "x-intercom-urgent"
+	// Sent by doorbell stations, so that the call rings with the doorbell tone
+	doorbellHeader = "x-intercom-doorbell"
+	// Sent in place of a call with the named station, which the receiver is in.
+	// The receiver answers, and hangs up the old call once this one connects
+	replacesHeader = "x-intercom-replaces"
+	// Sent with replacesHeader on direct calls, the token the receiver gave
+	// for the transfer. Calls without it are treated like any other call
+	replaceTokenHeader = "x-intercom-replace-token"
+	// Sent to the hub with replacesHeader, the token each target gave the
+	// caller, as name=token. The hub passes each on with the target's invitation
+	hubReplaceTokensHeader = "x-intercom-hub-replace-tokens"
+	// Sent by both ends when they can receive RTP audio on this UDP port
+	rtpPortHeader = "x-intercom-rtp-port"
+	// Sent to the hub, either to call stations by name (or * for all), or to join a call
+	hubTargetsHeader = "x-intercom-hub-to"
+	hubCallHeader    = "x-intercom-hub-call"
 )
@@ -0,0 +1,299 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+const hubInvitationQueueSize = 8
+
+// Hub relays and mixes calls between stations that register with it. Stations
+// connect to the hub, never the other way around, so a station only needs to
+// be able to reach the hub
+type Hub struct {
+	pb.UnimplementedIntercomServer
+	pb.UnimplementedHubServer
+	sync.Mutex
+	stations    map[string]*registration
+	conferences map[string]*conference
+}
+
+// registration is a station waiting for invitations
+type registration struct {
+	name        string
+	invitations chan *pb.Invitation
+	// address is where the station registered from
+	address string
+}
+
+// NewHubServer creates a gRPC server for the hub, which serves both the Hub
+// service for stations to register, and the Intercom service for calls
+func NewHubServer() *grpc.Server {
+	h := &Hub{
+		stations:    make(map[string]*registration),
+		conferences: make(map[string]*conference),
+	}
+	s := grpc.NewServer()
+	pb.RegisterIntercomServer(s, h)
+	pb.RegisterHubServer(s, h)
+	return s
+}
+
+// Register keeps a station registered until it disconnects. A station that
+// registers again from the same host replaces its old registration, e.g.
+// after its connection dropped. While it's registered, the name can't be
+// taken from another host
+func (h *Hub) Register(req *pb.Registration, stream pb.Hub_RegisterServer) error {
+	if req.Station == "" {
+		return status.Error(codes.InvalidArgument, "station name is required")
+	}
+	r := &registration{
+		name:        req.Station,
+		invitations: make(chan *pb.Invitation, hubInvitationQueueSize),
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok && p.Addr != nil {
+		r.address = p.Addr.String()
+	}
+	h.Lock()
+	if old := h.stations[r.name]; old != nil && !sameHost(old.address, r.address) {
+		h.Unlock()
+		log.Printf("Hub: refused %v registering from %v, already registered from %v\n", r.name, r.address, old.address)
+		return status.Error(codes.PermissionDenied, "station is registered from another address")
+	}
+	h.stations[r.name] = r
+	h.Unlock()
+	log.Println("Hub: station registered:", r.name)
+	defer func() {
+		h.Lock()
+		if h.stations[r.name] == r {
+			delete(h.stations, r.name)
+		}
+		h.Unlock()
+		log.Println("Hub: station unregistered:", r.name)
+	}()
+	// Let the station know it is registered
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case inv := <-r.invitations:
+			if err := stream.Send(inv); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Stations lists the registered stations, and whether they are in a call
+func (h *Hub) Stations(ctx context.Context, req *pb.StationsRequest) (*pb.StationList, error) {
+	h.Lock()
+	defer h.Unlock()
+	inCall := make(map[string]bool)
+	for _, conf := range h.conferences {
+		for _, name := range conf.names() {
+			inCall[name] = true
+		}
+	}
+	list := &pb.StationList{}
+	for name := range h.stations {
+		list.Stations = append(list.Stations, &pb.StationPresence{Name: name, InCall: inCall[name]})
+	}
+	return list, nil
+}
+
+// invite asks registered stations to join a conference. "*" invites every
+// station except the caller. It returns the number of stations invited
+// replaces, if set, is the station whose calls the conference replaces, and
+// tokens are the tokens the stations gave it for that, by name
+func (h *Hub) invite(conf *conference, targets []string, urgent bool, replaces string, tokens map[string]string) int {
+	h.Lock()
+	defer h.Unlock()
+	if len(targets) == 1 && targets[0] == "*" {
+		targets = nil
+		for name := range h.stations {
+			if name != conf.caller {
+				targets = append(targets, name)
+			}
+		}
+	}
+	invited := 0
+	for _, name := range targets {
+		r, ok := h.stations[name]
+		if !ok {
+			log.Printf("Hub: %v is not registered, can't invite to call from %v\n", name, conf.caller)
+			continue
+		}
+		select {
+		case r.invitations <- &pb.Invitation{CallId: conf.id, From: conf.caller, Urgent: urgent, Replaces: replaces, ReplaceToken: tokens[name]}:
+			invited++
+		default:
+			log.Println("Hub: invitation queue is full for", name)
+		}
+	}
+	return invited
+}
+
+// DuplexCall starts a conference, or joins one the station was invited to
+func (h *Hub) DuplexCall(stream pb.Intercom_DuplexCallServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	name := "unknown"
+	if val := md.Get(stationHeader); len(val) > 0 {
+		name = val[0]
+	}
+	var conf *conference
+	if val := md.Get(hubCallHeader); len(val) > 0 {
+		h.Lock()
+		conf = h.conferences[val[0]]
+		h.Unlock()
+		if conf == nil {
+			return status.Error(codes.NotFound, "call has ended")
+		}
+	} else {
+		targets := getTargets(md.Get(hubTargetsHeader))
+		urgent := false
+		if val := md.Get(urgentHeader); len(val) > 0 {
+			urgent, _ = strconv.ParseBool(val[0])
+		}
+		replaces := ""
+		var tokens map[string]string
+		if val := md.Get(replacesHeader); len(val) > 0 {
+			replaces = val[0]
+			// Invited stations answer in place of their calls with the caller,
+			// so only a registered station may ask, for its own calls
+			if !h.registeredFrom(stream.Context(), name) || replaces != name {
+				log.Printf("Hub: refused call from %v replacing calls with %v\n", name, replaces)
+				return status.Error(codes.PermissionDenied, "can only replace calls of the registered station")
+			}
+			tokens = getReplaceTokens(md.Get(hubReplaceTokensHeader))
+		}
+		conf = newConference(call.NewCallId().String(), name)
+		// Stored before inviting, so an invited station can join straight away
+		h.Lock()
+		h.conferences[conf.id] = conf
+		h.Unlock()
+		if h.invite(conf, targets, urgent, replaces, tokens) == 0 {
+			h.Lock()
+			delete(h.conferences, conf.id)
+			h.Unlock()
+			return status.Error(codes.Unavailable, "none of the stations are registered")
+		}
+		go func() {
+			conf.run()
+			h.Lock()
+			delete(h.conferences, conf.id)
+			h.Unlock()
+		}()
+	}
+	log.Printf("Hub: %v joining call %v\n", name, conf.id)
+	// Same handshake as between stations. The hub mixes at the wideband rate,
+	// and converts for stations that only offer narrowband
+	if err := stream.Send(&pb.AudioData{Data: make([]float32, 0), SampleRate: station.WidebandRate}); err != nil {
+		return err
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	rate := station.NegotiateRate(station.WidebandRate, int(first.SampleRate))
+	p := conf.join(name, rate)
+	if p == nil {
+		return status.Error(codes.NotFound, "call has ended")
+	}
+	defer conf.leave(p)
+	go func() {
+		// Tell the station who else is in the call whenever that changes
+		var others []string
+		for frame := range p.out {
+			msg := &pb.AudioData{Data: p.down.Process(frame)}
+			if names := conf.others(p); !sameNames(names, others) {
+				msg.Participants = names
+				others = names
+			}
+			if err := stream.Send(msg); err != nil {
+				return
+			}
+		}
+	}()
+	// Receive in the background, so that the call can end while waiting for audio
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			p.receive(in.Data)
+		}
+	}()
+	select {
+	case err := <-recvErr:
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	case <-conf.done:
+		return nil
+	}
+}
+
+// registeredFrom returns whether the caller in ctx is at the address the station registered from
+func (h *Hub) registeredFrom(ctx context.Context, name string) bool {
+	h.Lock()
+	r := h.stations[name]
+	h.Unlock()
+	return r != nil && r.address != "" && peerMatches(ctx, r.address)
+}
+
+// sameHost returns whether two host:port addresses are on the same host
+func sameHost(a string, b string) bool {
+	hostA, _, errA := net.SplitHostPort(a)
+	hostB, _, errB := net.SplitHostPort(b)
+	return errA == nil && errB == nil && hostA == hostB
+}
+
+func getTargets(vals []string) []string {
+	var targets []string
+	for _, val := range vals {
+		for _, t := range strings.Split(val, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// getReplaceTokens reads the replace tokens sent to the hub, by station name
+func getReplaceTokens(vals []string) map[string]string {
+	tokens := make(map[string]string)
+	for _, val := range vals {
+		if parts := strings.SplitN(val, "=", 2); len(parts) == 2 {
+			tokens[parts[0]] = parts[1]
+		}
+	}
+	return tokens
+}
+
+// ServeHub listens for stations on address until the server is stopped
+func ServeHub(s *grpc.Server, address string, errCh chan error) {
+	serve(s, address, errCh)
+}
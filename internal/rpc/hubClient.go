@@ -0,0 +1,211 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// How long a station waits before registering with the hub again
+const hubRetryInterval = 5 * time.Second
+
+// HubClient keeps the station registered with a hub, places calls through it
+// while registered, and answers invitations from it
+type HubClient struct {
+	sync.Mutex
+	station    *station.Station
+	server     *Server
+	conn       *grpc.ClientConn
+	registered bool
+}
+
+// StartHubClient registers the station with its hub until ctx is done. It
+// returns nil if no hub is configured
+// ctx is the main context from cmd
+func StartHubClient(ctx context.Context, intercom *station.Station) *HubClient {
+	if intercom.Hub == "" {
+		return nil
+	}
+	// Doesn't block, the connection is made when registering
+	conn, err := grpc.Dial(intercom.Hub, grpc.WithInsecure())
+	if err != nil {
+		log.Println("Unable to connect to hub:", err)
+		return nil
+	}
+	h := &HubClient{
+		station: intercom,
+		server:  &Server{station: intercom},
+		conn:    conn,
+	}
+	intercom.CallManager.(*grpcCallManager).hub = h
+	go h.register(ctx)
+	return h
+}
+
+func (h *HubClient) setRegistered(v bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.registered = v
+}
+
+// isRegistered returns whether calls can go through the hub
+func (h *HubClient) isRegistered() bool {
+	if h == nil {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	return h.registered
+}
+
+// stations lists the stations registered with the hub, and whether each is in a call
+func (h *HubClient) stations(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	list, err := pb.NewHubClient(h.conn).Stations(ctx, &pb.StationsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	stations := make(map[string]bool, len(list.Stations))
+	for _, s := range list.Stations {
+		stations[s.Name] = s.InCall
+	}
+	return stations, nil
+}
+
+// register stays registered with the hub, registering again whenever the connection drops
+func (h *HubClient) register(ctx context.Context) {
+	client := pb.NewHubClient(h.conn)
+	for {
+		stream, err := client.Register(ctx, &pb.Registration{Station: h.station.Name})
+		if err == nil {
+			// The hub sends a header once the station is registered
+			_, err = stream.Header()
+		}
+		if err == nil {
+			log.Println("Registered with hub", h.station.Hub)
+			h.setRegistered(true)
+			for {
+				var inv *pb.Invitation
+				if inv, err = stream.Recv(); err != nil {
+					break
+				}
+				go h.incomingCall(ctx, inv)
+			}
+			h.setRegistered(false)
+		}
+		log.Println("Not registered with hub, calling stations directly:", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hubRetryInterval):
+		}
+	}
+}
+
+// incomingCall handles an invitation like any other incoming call. The
+// station joins the call on the hub when it answers
+func (h *HubClient) incomingCall(parentContext context.Context, inv *pb.Invitation) {
+	log.Printf("Hub call from %v\n", inv.From)
+	ctx, cancel := context.WithCancel(parentContext)
+	defer cancel()
+	c := call.New(call.NewCallId(), h.station.Name, h.station.Hub, cancel)
+	c.Peer = inv.From
+	c.Urgent = inv.Urgent
+	c.Replaces = inv.Replaces
+	c.ReplacesToken = inv.ReplaceToken
+	c.Volume = h.station.PeerVolume(inv.From)
+	stream := &hubStreamer{
+		open: func() (streamer, error) {
+			joinCtx := metadata.AppendToOutgoingContext(ctx, stationHeader, h.station.Name, hubCallHeader, inv.CallId)
+			return pb.NewIntercomClient(h.conn).DuplexCall(joinCtx)
+		},
+	}
+	err := h.server.incomingCall(ctx, c, stream, nil)
+	log.Println("Hub call ended with:", err)
+}
+
+// call places a call through the hub, to stations by name, or * for all of them
+// If replaceTokens is set, stations in to that are in a call with this one
+// and gave it a token answer the new call, and leave the old one
+func (h *HubClient) call(callManager *grpcCallManager, to []string, urgent bool, replaceTokens map[string]string) {
+	_ = h.station.Status.Set(station.StatusOutgoingCall)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := call.New(call.NewCallId(), h.station.Hub, "self", cancel)
+	c.Peer = strings.Join(to, ",")
+	c.Urgent = urgent
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		stationHeader, h.station.Name,
+		urgentHeader, strconv.FormatBool(urgent),
+		hubTargetsHeader, strings.Join(to, ","))
+	if len(replaceTokens) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, replacesHeader, h.station.Name)
+		for name, token := range replaceTokens {
+			ctx = metadata.AppendToOutgoingContext(ctx, hubReplaceTokensHeader, name+"="+token)
+		}
+	}
+	stream, err := pb.NewIntercomClient(h.conn).DuplexCall(ctx)
+	if err != nil {
+		log.Println("Unable to call through hub:", err)
+		h.station.UpdateStatus()
+		return
+	}
+	defer func() {
+		_ = stream.CloseSend()
+	}()
+	err = callManager.duplexCall(ctx, c, stream, nil)
+	log.Println("Hub call ended with:", err)
+}
+
+// Close disconnects from the hub
+func (h *HubClient) Close() {
+	h.conn.Close()
+}
+
+// hubStreamer joins a call on the hub the first time audio is sent, which
+// is when the call is answered
+type hubStreamer struct {
+	sync.Mutex
+	open   func() (streamer, error)
+	stream streamer
+}
+
+func (s *hubStreamer) get() (streamer, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stream == nil {
+		stream, err := s.open()
+		if err != nil {
+			return nil, err
+		}
+		s.stream = stream
+	}
+	return s.stream, nil
+}
+
+func (s *hubStreamer) Send(data *pb.AudioData) error {
+	stream, err := s.get()
+	if err != nil {
+		return err
+	}
+	return stream.Send(data)
+}
+
+func (s *hubStreamer) Recv() (*pb.AudioData, error) {
+	stream, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return stream.Recv()
+}
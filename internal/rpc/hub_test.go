@@ -0,0 +1,226 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+)
+
+// hubStream is the hub's end of a station's DuplexCall
+type hubStream struct {
+	pb.Intercom_DuplexCallServer
+	stream *fakeStream
+	ctx    context.Context
+}
+
+func (s *hubStream) Context() context.Context      { return s.ctx }
+func (s *hubStream) Send(data *pb.AudioData) error { return s.stream.Send(data) }
+func (s *hubStream) Recv() (*pb.AudioData, error)  { return s.stream.Recv() }
+func (s *hubStream) SendHeader(metadata.MD) error  { return nil }
+func (s *hubStream) SetHeader(metadata.MD) error   { return nil }
+func (s *hubStream) SetTrailer(metadata.MD)        {}
+func (s *hubStream) SendMsg(interface{}) error     { return nil }
+func (s *hubStream) RecvMsg(interface{}) error     { return nil }
+
+// hubCall starts a DuplexCall with the given headers, and returns the
+// station's end of it, and where the call's result goes
+func hubCall(h *Hub, headers ...string) (*fakeStream, chan error) {
+	return hubCallFrom(h, context.Background(), headers...)
+}
+
+// hubCallFrom is hubCall from the peer in ctx
+func hubCallFrom(h *Hub, ctx context.Context, headers ...string) (*fakeStream, chan error) {
+	hubEnd, stationEnd := fakeStreamPair()
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(headers...))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.DuplexCall(&hubStream{stream: hubEnd, ctx: ctx})
+	}()
+	// The station's half of the handshake
+	stationEnd.Send(&pb.AudioData{Data: make([]float32, 0), SampleRate: station.WidebandRate})
+	return stationEnd, errCh
+}
+
+func newTestHub(stations ...string) *Hub {
+	h := &Hub{
+		stations:    make(map[string]*registration),
+		conferences: make(map[string]*conference),
+	}
+	for _, name := range stations {
+		h.stations[name] = &registration{name: name, invitations: make(chan *pb.Invitation, hubInvitationQueueSize)}
+	}
+	return h
+}
+
+func TestHubInvitedStationJoins(t *testing.T) {
+	h := newTestHub("hall")
+	kitchen, kitchenErr := hubCall(h, stationHeader, "kitchen", hubTargetsHeader, "hall")
+	var inv *pb.Invitation
+	select {
+	case inv = <-h.stations["hall"].invitations:
+	case <-time.After(time.Second):
+		t.Fatal("hall wasn't invited")
+	}
+	// The invited station may join before the caller has even started
+	hall, hallErr := hubCall(h, stationHeader, "hall", hubCallHeader, inv.CallId)
+	select {
+	case err := <-hallErr:
+		t.Fatalf("hall couldn't join: %v", err)
+	case <-time.After(3 * conferenceTick):
+	}
+	close(hall.out)
+	close(kitchen.out)
+	for _, errCh := range []chan error{hallErr, kitchenErr} {
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestHubNobodyInvited(t *testing.T) {
+	h := newTestHub()
+	_, errCh := hubCall(h, stationHeader, "kitchen", hubTargetsHeader, "hall")
+	if err := <-errCh; status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable", err)
+	}
+	if len(h.conferences) != 0 {
+		t.Errorf("conferences left behind: %v", h.conferences)
+	}
+}
+
+func TestHubReplaces(t *testing.T) {
+	h := newTestHub("hall")
+	h.stations["kitchen"] = &registration{
+		name:        "kitchen",
+		invitations: make(chan *pb.Invitation, hubInvitationQueueSize),
+		address:     "192.168.0.10:40000",
+	}
+	tests := []struct {
+		name     string
+		station  string
+		from     string
+		replaces string
+	}{
+		{"another address", "kitchen", "192.168.0.66", "kitchen"},
+		{"another station's calls", "kitchen", "192.168.0.10", "hall"},
+		{"unregistered station", "office", "192.168.0.10", "office"},
+	}
+	for _, tt := range tests {
+		_, errCh := hubCallFrom(h, fromAddress(tt.from), stationHeader, tt.station, hubTargetsHeader, "hall", replacesHeader, tt.replaces)
+		if err := <-errCh; status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%v: got %v, want PermissionDenied", tt.name, err)
+		}
+	}
+	select {
+	case inv := <-h.stations["hall"].invitations:
+		t.Fatalf("hall was invited by a refused call: %v", inv)
+	default:
+	}
+
+	// Each station's token is passed on with its invitation
+	kitchen, errCh := hubCallFrom(h, fromAddress("192.168.0.10"), stationHeader, "kitchen", hubTargetsHeader, "hall",
+		replacesHeader, "kitchen", hubReplaceTokensHeader, "hall=secret", hubReplaceTokensHeader, "office=other")
+	select {
+	case inv := <-h.stations["hall"].invitations:
+		if inv.From != "kitchen" || inv.Replaces != "kitchen" || inv.ReplaceToken != "secret" {
+			t.Errorf("hall was invited by %v, replacing %v with token %q", inv.From, inv.Replaces, inv.ReplaceToken)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hall wasn't invited")
+	}
+	close(kitchen.out)
+	if err := <-errCh; err != nil {
+		t.Error(err)
+	}
+}
+
+// registerStream is the hub's end of a station's Register
+type registerStream struct {
+	pb.Hub_RegisterServer
+	ctx context.Context
+}
+
+func (s *registerStream) Context() context.Context     { return s.ctx }
+func (s *registerStream) Send(*pb.Invitation) error    { return nil }
+func (s *registerStream) SendHeader(metadata.MD) error { return nil }
+
+// register registers a station with the hub from the peer in ctx, until ctx
+// is done, and returns where the result goes
+func register(h *Hub, ctx context.Context, name string) chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.Register(&pb.Registration{Station: name}, &registerStream{ctx: ctx})
+	}()
+	return errCh
+}
+
+// waitForRegistration waits for name to be registered from a host
+func waitForRegistration(t *testing.T, h *Hub, name string, host string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		h.Lock()
+		r := h.stations[name]
+		h.Unlock()
+		if r != nil && sameHost(r.address, net.JoinHostPort(host, "0")) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v isn't registered from %v", name, host)
+		}
+	}
+}
+
+func TestHubRegisterFromAnotherAddress(t *testing.T) {
+	h := newTestHub()
+	ctx, cancel := context.WithCancel(fromAddress("192.168.0.10"))
+	kitchen := register(h, ctx, "kitchen")
+	waitForRegistration(t, h, "kitchen", "192.168.0.10")
+
+	// Another host can't take the name, or the kitchen's invitations
+	rogueCtx, rogueCancel := context.WithCancel(fromAddress("192.168.0.66"))
+	defer rogueCancel()
+	select {
+	case err := <-register(h, rogueCtx, "kitchen"):
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("got %v, want PermissionDenied", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("another host registered as the kitchen")
+	}
+	waitForRegistration(t, h, "kitchen", "192.168.0.10")
+	_, errCh := hubCallFrom(h, fromAddress("192.168.0.66"), stationHeader, "kitchen", hubTargetsHeader, "hall", replacesHeader, "kitchen")
+	if err := <-errCh; status.Code(err) != codes.PermissionDenied {
+		t.Errorf("call replacing the kitchen's calls from another host got %v, want PermissionDenied", err)
+	}
+
+	// The kitchen can register again, e.g. after its connection dropped
+	againCtx, againCancel := context.WithCancel(fromAddress("192.168.0.10"))
+	defer againCancel()
+	again := register(h, againCtx, "kitchen")
+	cancel()
+	if err := <-kitchen; err != nil {
+		t.Errorf("first registration ended with %v", err)
+	}
+	select {
+	case err := <-again:
+		t.Fatalf("registering again ended with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	waitForRegistration(t, h, "kitchen", "192.168.0.10")
+
+	// Once the kitchen is gone, the name is free
+	againCancel()
+	<-again
+	other := register(h, rogueCtx, "kitchen")
+	waitForRegistration(t, h, "kitchen", "192.168.0.66")
+	rogueCancel()
+	<-other
+}
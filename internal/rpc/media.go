@@ -0,0 +1,394 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/resample"
+	"github.com/figadore/go-intercom/pkg/rtp"
+)
+
+const (
+	// How long to wait for RTP from the other end before falling back to gRPC
+	rtpProbeTimeout = 2 * time.Second
+	// One-byte header extension (RFC 8285) carrying the mute and hold flags,
+	// and the keepalive timestamps
+	rtpExtensionProfile = 0xBEDE
+	rtpFlagsExtensionId = 1
+	rtpFlagMuted        = 1 << 0
+	rtpFlagHeld         = 1 << 1
+	// 8 byte ping, and 8 byte pong followed by the 4 byte pong delay in microseconds
+	rtpPingExtensionId = 2
+	rtpPongExtensionId = 3
+	// 1 byte loss percentage, sent with pings
+	rtpLossExtensionId = 4
+)
+
+// rtpStreamer sends and receives audio over RTP, in place of the gRPC stream
+//
+// Audio is sent in packets of the size and codec the adapter picks, and can
+// be received in any of them, so the other end may change profiles at any time
+//
+// Audio is sent and received at the call's sample rate. PCMU is always 8kHz,
+// so on a wideband call it is converted on the way in and out
+type rtpStreamer struct {
+	session *rtp.Session
+	adapter *adapter
+	rate    int
+	// down converts audio from the call's rate to 8kHz, and up back again
+	down, up *resample.Sinc
+	// previous is the last frame sent, repeated in the next packet for redundancy
+	previous rtp.Block
+	// Receive state. pending is audio to return before reading the next packet
+	pending   *pb.AudioData
+	started   bool
+	lastSeq   uint16
+	recovered uint64
+}
+
+// newRTPStreamer sends audio at rate on session, in the codecs config allows,
+// adapting it to the network if config is adaptive
+func newRTPStreamer(session *rtp.Session, config station.MediaConfig, rate int) *rtpStreamer {
+	r := &rtpStreamer{
+		session: session,
+		adapter: newAdapter(config.Codecs, config.Adaptive),
+		rate:    rate,
+		down:    resample.New(rate, station.SampleRate),
+		up:      resample.New(station.SampleRate, rate),
+	}
+	for _, p := range mediaProfiles {
+		session.AcceptPayloadType(p.payloadType)
+	}
+	session.AcceptPayloadType(rtp.PayloadTypeL16Wideband)
+	session.AcceptPayloadType(rtp.PayloadTypeRED)
+	return r
+}
+
+// Send splits data into frames. Only the first packet has the keepalives
+func (r *rtpStreamer) Send(data *pb.AudioData) error {
+	// startSending sends nil when the call ends, which only means something to gRPC
+	if data == nil {
+		return nil
+	}
+	profile := r.adapter.profile()
+	extension := rtpExtension(data)
+	payloadType, rate := r.payloadType(profile)
+	samples := data.Data
+	if rate != r.rate {
+		samples = r.down.Process(samples)
+	}
+	for first := true; first || len(samples) > 0; first = false {
+		n := profile.frame * rate / 1000
+		if n > len(samples) {
+			n = len(samples)
+		}
+		block := rtp.Block{PayloadType: payloadType, Payload: encodeAudio(payloadType, samples[:n])}
+		samples = samples[n:]
+		pt, payload := block.PayloadType, block.Payload
+		if profile.redundancy {
+			pt = rtp.PayloadTypeRED
+			var redundant []rtp.Block
+			if r.previous.Payload != nil {
+				redundant = []rtp.Block{r.previous}
+			}
+			payload = rtp.EncodeRED(block, redundant)
+		}
+		// The next packet's timestamp is n samples on, so that's how far back this block will be
+		block.TimestampOffset = uint32(n)
+		r.previous = block
+		if err := r.session.WriteAudioAs(pt, payload, n, rtpExtensionProfile, extension); err != nil {
+			return err
+		}
+		extension = rtpExtension(&pb.AudioData{Muted: data.Muted, Held: data.Held})
+	}
+	return nil
+}
+
+// Recv returns the audio in each packet. When the packet before it was lost,
+// the lost audio is returned first if it came with this one
+func (r *rtpStreamer) Recv() (*pb.AudioData, error) {
+	if r.pending != nil {
+		data := r.pending
+		r.pending = nil
+		return data, nil
+	}
+	for {
+		p, err := r.session.ReadAudio()
+		if err != nil {
+			return nil, err
+		}
+		// ReadAudio only returns packets newer than the last one
+		lost := r.started && p.SequenceNumber-r.lastSeq == 2
+		r.started, r.lastSeq = true, p.SequenceNumber
+		data := &pb.AudioData{}
+		if p.ExtensionProfile == rtpExtensionProfile {
+			parseRTPExtension(p.Extension, data)
+		}
+		primary := rtp.Block{PayloadType: p.PayloadType, Payload: p.Payload}
+		var redundant []rtp.Block
+		if p.PayloadType == rtp.PayloadTypeRED {
+			if primary, redundant, err = rtp.DecodeRED(p.Payload); err != nil {
+				continue
+			}
+		}
+		// Lost audio is decoded first, since it is played first
+		var recovered []float32
+		if lost && len(redundant) > 0 {
+			last := redundant[len(redundant)-1]
+			recovered, _ = r.decode(last.PayloadType, last.Payload)
+		}
+		if data.Data, err = r.decode(primary.PayloadType, primary.Payload); err != nil {
+			continue
+		}
+		if recovered != nil {
+			atomic.AddUint64(&r.recovered, 1)
+			r.pending = data
+			return &pb.AudioData{Data: recovered, Muted: data.Muted, Held: data.Held}, nil
+		}
+		return data, nil
+	}
+}
+
+// Recovered returns how many lost packets were replaced from redundant audio
+func (r *rtpStreamer) Recovered() uint64 {
+	return atomic.LoadUint64(&r.recovered)
+}
+
+// payloadType returns the payload type to send a profile as, and its sample rate
+func (r *rtpStreamer) payloadType(p mediaProfile) (uint8, int) {
+	if p.payloadType == rtp.PayloadTypeL16 && r.rate == station.WidebandRate {
+		return rtp.PayloadTypeL16Wideband, station.WidebandRate
+	}
+	return p.payloadType, station.SampleRate
+}
+
+// decode returns the audio in a payload at the call's rate
+func (r *rtpStreamer) decode(pt uint8, payload []byte) ([]float32, error) {
+	samples, err := decodeAudio(pt, payload)
+	if err != nil {
+		return nil, err
+	}
+	rate := station.SampleRate
+	if pt == rtp.PayloadTypeL16Wideband {
+		rate = station.WidebandRate
+	}
+	switch rate {
+	case r.rate:
+		return samples, nil
+	case station.SampleRate:
+		return r.up.Process(samples), nil
+	}
+	return nil, fmt.Errorf("RTP payload type %v is faster than the call's %vHz", pt, r.rate)
+}
+
+func encodeAudio(pt uint8, samples []float32) []byte {
+	if pt == rtp.PayloadTypePCMU {
+		return rtp.EncodePCMU(samples)
+	}
+	return rtp.EncodeL16(samples)
+}
+
+func decodeAudio(pt uint8, payload []byte) ([]float32, error) {
+	switch pt {
+	case rtp.PayloadTypeL16, rtp.PayloadTypeL16Wideband:
+		return rtp.DecodeL16(payload), nil
+	case rtp.PayloadTypePCMU:
+		return rtp.DecodePCMU(payload), nil
+	}
+	return nil, fmt.Errorf("unsupported RTP payload type %v", pt)
+}
+
+// rtpExtension encodes everything in data except the audio as header extension elements
+func rtpExtension(data *pb.AudioData) []byte {
+	var flags byte
+	if data.Muted {
+		flags |= rtpFlagMuted
+	}
+	if data.Held {
+		flags |= rtpFlagHeld
+	}
+	extension := []byte{rtpFlagsExtensionId << 4, flags}
+	if data.Ping != 0 {
+		element := make([]byte, 9)
+		element[0] = rtpPingExtensionId<<4 | 7
+		binary.BigEndian.PutUint64(element[1:], uint64(data.Ping))
+		extension = append(extension, element...)
+	}
+	if data.Pong != 0 {
+		element := make([]byte, 13)
+		element[0] = rtpPongExtensionId<<4 | 11
+		binary.BigEndian.PutUint64(element[1:], uint64(data.Pong))
+		binary.BigEndian.PutUint32(element[9:], uint32(time.Duration(data.PongDelay)/time.Microsecond))
+		extension = append(extension, element...)
+	}
+	if data.Ping != 0 {
+		extension = append(extension, rtpLossExtensionId<<4, byte(data.LossPercent))
+	}
+	// Pad to a multiple of 4 bytes
+	for len(extension)%4 != 0 {
+		extension = append(extension, 0)
+	}
+	return extension
+}
+
+// parseRTPExtension reads the elements written by rtpExtension into data, and skips any others
+func parseRTPExtension(extension []byte, data *pb.AudioData) {
+	for i := 0; i < len(extension); {
+		// Padding
+		if extension[i] == 0 {
+			i++
+			continue
+		}
+		id, n := extension[i]>>4, int(extension[i]&0x0f)+1
+		i++
+		if id == 15 || i+n > len(extension) {
+			return
+		}
+		element := extension[i : i+n]
+		switch {
+		case id == rtpFlagsExtensionId:
+			data.Muted = element[0]&rtpFlagMuted != 0
+			data.Held = element[0]&rtpFlagHeld != 0
+		case id == rtpPingExtensionId && n == 8:
+			data.Ping = int64(binary.BigEndian.Uint64(element))
+		case id == rtpPongExtensionId && n == 12:
+			data.Pong = int64(binary.BigEndian.Uint64(element))
+			data.PongDelay = int64(time.Duration(binary.BigEndian.Uint32(element[8:])) * time.Microsecond)
+		case id == rtpLossExtensionId:
+			data.LossPercent = uint32(element[0])
+		}
+		i += n
+	}
+}
+
+// watchSignaling ends the call when the gRPC stream ends, once audio has
+// moved to RTP and nothing else is reading from the stream. Errors other than
+// the other end hanging up are sent on errCh, like audio errors
+func watchSignaling(ctx context.Context, stream streamer, errCh chan error, hangup func()) {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			log.Println("watchSignaling: gRPC stream ended:", err)
+			if err == io.EOF {
+				hangup()
+				return
+			}
+			select {
+			case errCh <- err:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+}
+
+// mediaStream returns what the call's audio goes over: RTP on media if
+// probes got through in both directions, otherwise the gRPC stream. Once
+// audio is on RTP, the stream only signals the end of the call, and media is
+// closed when ctx is done. Unused, media is closed straight away
+func mediaStream(ctx context.Context, stream streamer, media *rtp.Session, rtpReady bool, config station.MediaConfig, rate int, errCh chan error, hangup func()) streamer {
+	if rtpReady {
+		log.Println("duplexCall: sending audio over RTP")
+		go watchSignaling(ctx, stream, errCh, hangup)
+		// Unblock startReceiving when the call ends, like the gRPC stream does
+		go func() {
+			<-ctx.Done()
+			media.Close()
+		}()
+		return newRTPStreamer(media, config, rate)
+	}
+	if media != nil {
+		log.Println("duplexCall: RTP blocked, sending audio over gRPC")
+		media.Close()
+	}
+	return stream
+}
+
+// listenMedia opens a UDP port for RTP, if enabled
+func listenMedia(config station.MediaConfig) *rtp.Session {
+	if !config.RTP {
+		return nil
+	}
+	session, err := rtp.Listen(config.MinPort, config.MaxPort)
+	if err != nil {
+		log.Println("Unable to listen for RTP, using gRPC for audio:", err)
+		return nil
+	}
+	return session
+}
+
+// mediaPort reads the other end's RTP port from gRPC metadata
+func mediaPort(md metadata.MD) (int, bool) {
+	val := md.Get(rtpPortHeader)
+	if len(val) == 0 {
+		return 0, false
+	}
+	port, err := strconv.Atoi(val[0])
+	if err != nil {
+		log.Println("Invalid RTP port from other end:", val[0])
+		return 0, false
+	}
+	return port, true
+}
+
+// acceptMedia is the server side of RTP negotiation. If the caller offered an
+// RTP port, this station answers with its own in the response header
+func acceptMedia(config station.MediaConfig, md metadata.MD, p *peer.Peer, stream pb.Intercom_DuplexCallServer) *rtp.Session {
+	remotePort, ok := mediaPort(md)
+	if !ok {
+		return nil
+	}
+	session := listenMedia(config)
+	if session == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err == nil {
+		err = session.SetRemote(host, remotePort)
+	}
+	if err == nil {
+		err = stream.SendHeader(metadata.Pairs(rtpPortHeader, strconv.Itoa(session.LocalPort())))
+	}
+	if err != nil {
+		log.Println("Unable to set up RTP, using gRPC for audio:", err)
+		session.Close()
+		return nil
+	}
+	return session
+}
+
+// dialMedia is the client side of RTP negotiation. It waits for the response
+// header, and keeps the session only if the other end answered with a port
+func dialMedia(session *rtp.Session, address string, stream pb.Intercom_DuplexCallClient) *rtp.Session {
+	if session == nil {
+		return nil
+	}
+	md, err := stream.Header()
+	remotePort, ok := mediaPort(md)
+	if err != nil || !ok {
+		log.Println("Other end did not offer RTP, using gRPC for audio")
+		session.Close()
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		err = session.SetRemote(host, remotePort)
+	}
+	if err != nil {
+		log.Println("Unable to set up RTP, using gRPC for audio:", err)
+		session.Close()
+		return nil
+	}
+	return session
+}
@@ -0,0 +1,365 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/rtp"
+)
+
+// shimRule is what a udpShim does to packets going one way
+type shimRule struct {
+	// block drops everything, probes too, like a firewall blocking UDP
+	block bool
+	// drop and hold pick audio packets by number, from 0. A held packet is
+	// sent after the one following it, so it arrives late
+	drop, hold map[int]bool
+	// delay is added to every packet, keeping their order
+	delay time.Duration
+}
+
+// udpShim sits between two RTP sessions, and loses, delays and reorders
+// the packets between them
+type udpShim struct {
+	toA, toB *net.UDPConn
+	wg       sync.WaitGroup
+}
+
+// newUDPShim points a and b at the shim, which forwards a's packets to b by
+// ab, and b's to a by ba
+func newUDPShim(t *testing.T, a, b *rtp.Session, ab, ba shimRule) *udpShim {
+	t.Helper()
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	s := &udpShim{toA: listen(), toB: listen()}
+	for _, err := range []error{
+		a.SetRemote("127.0.0.1", s.toA.LocalAddr().(*net.UDPAddr).Port),
+		b.SetRemote("127.0.0.1", s.toB.LocalAddr().(*net.UDPAddr).Port),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	aAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.LocalPort()}
+	bAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.LocalPort()}
+	s.wg.Add(2)
+	go s.forward(s.toA, s.toB, bAddr, ab)
+	go s.forward(s.toB, s.toA, aAddr, ba)
+	return s
+}
+
+func (s *udpShim) forward(from, to *net.UDPConn, addr *net.UDPAddr, rule shimRule) {
+	defer s.wg.Done()
+	type delayed struct {
+		buf []byte
+		due time.Time
+	}
+	queue := make(chan delayed, 1000)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for d := range queue {
+			time.Sleep(time.Until(d.due))
+			to.WriteToUDP(d.buf, addr)
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-done
+	}()
+	var held []byte
+	n := 0
+	for {
+		buf := make([]byte, 1500)
+		size, _, err := from.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		buf = buf[:size]
+		if rule.block {
+			continue
+		}
+		var p rtp.Packet
+		if err := p.Unmarshal(buf); err != nil {
+			continue
+		}
+		// Probes go straight through
+		if p.PayloadType == 127 {
+			queue <- delayed{buf, time.Now().Add(rule.delay)}
+			continue
+		}
+		i := n
+		n++
+		switch {
+		case rule.drop[i]:
+			continue
+		case rule.hold[i]:
+			held = buf
+			continue
+		}
+		queue <- delayed{buf, time.Now().Add(rule.delay)}
+		if held != nil {
+			queue <- delayed{held, time.Now().Add(rule.delay)}
+			held = nil
+		}
+	}
+}
+
+func (s *udpShim) Close() {
+	s.toA.Close()
+	s.toB.Close()
+	s.wg.Wait()
+}
+
+// rtpPair opens two sessions joined by a shim
+func rtpPair(t *testing.T, ab, ba shimRule) (*rtp.Session, *rtp.Session, func()) {
+	t.Helper()
+	a, err := rtp.Listen(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := rtp.Listen(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shim := newUDPShim(t, a, b, ab, ba)
+	return a, b, func() {
+		a.Close()
+		b.Close()
+		shim.Close()
+	}
+}
+
+// probe probes from both ends at once, like the two stations in a call
+func probe(a, b *rtp.Session, timeout time.Duration) (bool, bool) {
+	var aReady, bReady bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aReady = a.Probe(context.Background(), timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		bReady = b.Probe(context.Background(), timeout)
+	}()
+	wg.Wait()
+	return aReady, bReady
+}
+
+// frame is 20ms of 8kHz audio, with each sample set to i, so frames can be told apart
+func frame(i int) []float32 {
+	samples := make([]float32, 160)
+	for j := range samples {
+		samples[j] = float32(i) / 100
+	}
+	return samples
+}
+
+// frameNumber is the i that frame was called with, after a round trip through L16
+func frameNumber(samples []float32) int {
+	return int(samples[0]*100 + 0.5)
+}
+
+func TestRTPLossAccounting(t *testing.T) {
+	a, b, close := rtpPair(t, shimRule{
+		drop:  map[int]bool{5: true, 10: true, 11: true},
+		hold:  map[int]bool{20: true},
+		delay: 5 * time.Millisecond,
+	}, shimRule{})
+	defer close()
+	if aReady, bReady := probe(a, b, time.Second); !aReady || !bReady {
+		t.Fatalf("probes didn't get through: %v, %v", aReady, bReady)
+	}
+
+	const sent = 30
+	received := make(chan []uint16)
+	go func() {
+		var seqs []uint16
+		for {
+			p, err := b.ReadAudio()
+			if err != nil {
+				received <- seqs
+				return
+			}
+			seqs = append(seqs, p.SequenceNumber)
+		}
+	}()
+	for i := 0; i < sent; i++ {
+		if err := a.WriteAudio(rtp.EncodeL16(frame(i)), 160, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	b.Close()
+	seqs := <-received
+
+	// 3 dropped, and the held one is dropped for arriving after the one after it
+	if len(seqs) != sent-4 {
+		t.Errorf("received %v packets, want %v", len(seqs), sent-4)
+	}
+	for i := 1; i < len(seqs); i++ {
+		if int16(seqs[i]-seqs[i-1]) <= 0 {
+			t.Errorf("packet %v returned after %v", seqs[i], seqs[i-1])
+		}
+	}
+	// The held packet counts as lost when the one after it arrives, then as late
+	lost, late := b.Stats()
+	if lost != 4 || late != 1 {
+		t.Errorf("got %v lost and %v late, want 4 and 1", lost, late)
+	}
+	sentBytes, _ := a.Bytes()
+	_, receivedBytes := b.Bytes()
+	if want := sentBytes / sent * (sent - 3); receivedBytes != want {
+		t.Errorf("received %v bytes, want %v", receivedBytes, want)
+	}
+}
+
+func TestRTPRecovery(t *testing.T) {
+	a, b, close := rtpPair(t, shimRule{
+		drop:  map[int]bool{3: true, 8: true},
+		delay: 5 * time.Millisecond,
+	}, shimRule{})
+	defer close()
+	if aReady, bReady := probe(a, b, time.Second); !aReady || !bReady {
+		t.Fatalf("probes didn't get through: %v, %v", aReady, bReady)
+	}
+	config := station.MediaConfig{RTP: true, Adaptive: true}
+	sender := newRTPStreamer(a, config, station.SampleRate)
+	receiver := newRTPStreamer(b, config, station.SampleRate)
+	// L16 with redundancy, so a single lost packet comes with the next one
+	sender.adapter.level = 1
+
+	const sent = 12
+	for i := 0; i < sent; i++ {
+		if err := sender.Send(&pb.AudioData{Data: frame(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < sent; i++ {
+		data, err := receiver.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := frameNumber(data.Data); got != i {
+			t.Fatalf("frame %v: got frame %v", i, got)
+		}
+	}
+	if got := receiver.Recovered(); got != 2 {
+		t.Errorf("recovered %v packets, want 2", got)
+	}
+	if lost, _ := b.Stats(); lost != 2 {
+		t.Errorf("session counted %v lost, want 2", lost)
+	}
+}
+
+// fakeStream is one end of an in-memory gRPC audio stream
+type fakeStream struct {
+	in  chan *pb.AudioData
+	out chan *pb.AudioData
+}
+
+func fakeStreamPair() (*fakeStream, *fakeStream) {
+	ab, ba := make(chan *pb.AudioData, 100), make(chan *pb.AudioData, 100)
+	return &fakeStream{in: ba, out: ab}, &fakeStream{in: ab, out: ba}
+}
+
+func (s *fakeStream) Send(data *pb.AudioData) error {
+	s.out <- data
+	return nil
+}
+
+func (s *fakeStream) Recv() (*pb.AudioData, error) {
+	data, ok := <-s.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+// connect probes and exchanges the first packets like duplexCall, and
+// returns what each end's audio goes over
+func connect(t *testing.T, ctx context.Context, a, b *rtp.Session) (streamer, streamer) {
+	t.Helper()
+	aReady, bReady := probe(a, b, 300*time.Millisecond)
+	aStream, bStream := fakeStreamPair()
+	errCh := make(chan error, 2)
+	// aFirst is what a receives, from b
+	var aFirst, bFirst *pb.AudioData
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aFirst, _ = initializeConnection(ctx, aStream.Send, aStream.Recv, errCh, aReady, station.SampleRate)
+	}()
+	go func() {
+		defer wg.Done()
+		bFirst, _ = initializeConnection(ctx, bStream.Send, bStream.Recv, errCh, bReady, station.SampleRate)
+	}()
+	wg.Wait()
+	if aFirst == nil || bFirst == nil {
+		t.Fatal("call did not initialize")
+	}
+	config := station.MediaConfig{RTP: true}
+	hangup := func() {}
+	return mediaStream(ctx, aStream, a, aReady && aFirst.Rtp, config, station.SampleRate, errCh, hangup),
+		mediaStream(ctx, bStream, b, bReady && bFirst.Rtp, config, station.SampleRate, errCh, hangup)
+}
+
+func TestMediaFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		ab, ba shimRule
+		rtp    bool
+	}{
+		{"lossy", shimRule{drop: map[int]bool{0: true}, delay: 10 * time.Millisecond}, shimRule{delay: 10 * time.Millisecond}, true},
+		{"blocked", shimRule{block: true}, shimRule{block: true}, false},
+		// Only one end hears the other's probes, so both have to stay on gRPC
+		{"one way", shimRule{block: true}, shimRule{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, close := rtpPair(t, tt.ab, tt.ba)
+			defer close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			aAudio, bAudio := connect(t, ctx, a, b)
+			_, aRTP := aAudio.(*rtpStreamer)
+			_, bRTP := bAudio.(*rtpStreamer)
+			if aRTP != tt.rtp || bRTP != tt.rtp {
+				t.Fatalf("audio over RTP: %v and %v, want %v", aRTP, bRTP, tt.rtp)
+			}
+			// Audio gets through either way. The first RTP packet may be lost
+			for i := 0; i < 3; i++ {
+				if err := aAudio.Send(&pb.AudioData{Data: frame(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := make(chan int)
+			go func() {
+				if data, err := bAudio.Recv(); err == nil {
+					got <- frameNumber(data.Data)
+				}
+			}()
+			select {
+			case i := <-got:
+				if i > 1 {
+					t.Errorf("first audio received was frame %v", i)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no audio received")
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/resample"
+)
+
+// Alerts are sent to each station separately, and give up after this long
+const alertTimeout = 5 * time.Second
+
+// Listen plays a monitor station's mic on the speaker until it's hung up
+// It shows in the call list like an announcement, and a call that starts
+// takes over the speaker from it
+func (callManager *grpcCallManager) Listen(name string) {
+	address := callManager.station.Lookup(name)
+	if strings.HasPrefix(address, "sip:") {
+		log.Println("Listen: can't listen to SIP phone", name)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := call.New(call.NewCallId(), name, callManager.station.Name, cancel)
+	c.Peer = name
+	c.Volume = callManager.station.PeerVolume(name)
+	done := make(chan struct{})
+	defer close(done)
+	callManager.announcing.Lock()
+	if callManager.announcing.call != nil || callManager.HasCalls() {
+		callManager.announcing.Unlock()
+		log.Println("Listen: station is busy")
+		return
+	}
+	callManager.announcing.call, callManager.announcing.done = c, done
+	callManager.announcing.Unlock()
+	defer func() {
+		callManager.announcing.Lock()
+		callManager.announcing.call = nil
+		callManager.announcing.Unlock()
+	}()
+	callManager.addCall(c)
+	defer callManager.station.UpdateStatus()
+	defer callManager.removeCall(c)
+
+	fullAddress := stationAddress(address)
+	dialCtx, dialCancel := context.WithTimeout(ctx, callManager.station.Dial.Timeout)
+	defer dialCancel()
+	conn, err := grpc.DialContext(dialCtx, fullAddress, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		log.Printf("Listen: unable to dial %v: %v\n", fullAddress, err)
+		return
+	}
+	defer conn.Close()
+	stream, err := pb.NewIntercomClient(conn).Listen(ctx, &pb.ListenRequest{
+		Station:    callManager.station.Name,
+		SampleRate: uint32(callManager.station.WireRate()),
+	})
+	if err != nil {
+		log.Printf("Listen: unable to listen to %v: %v\n", name, err)
+		return
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		log.Printf("Listen: %v refused: %v\n", name, err)
+		return
+	}
+	c.SampleRate = int(first.SampleRate)
+	if c.SampleRate == 0 {
+		c.SampleRate = station.SampleRate
+	}
+	c.SetStatus(call.StatusActive)
+	log.Printf("Listening to %v\n", name)
+
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go callManager.station.StartPlayback(ctx, &wg, errCh)
+	defer wg.Wait()
+	defer cancel()
+	toDevice := resample.New(c.SampleRate, callManager.station.DeviceRate)
+	speaker := callManager.station.SpeakerAudioCh()
+	for in := first; ; {
+		data := toDevice.Process(in.Data)
+		station.ApplyGain(data, station.CallGain(c.CurrentVolume()))
+		select {
+		case speaker <- data:
+		case <-ctx.Done():
+			log.Printf("Stopped listening to %v\n", name)
+			return
+		}
+		if in, err = stream.Recv(); err != nil {
+			if !errors.Is(ctx.Err(), context.Canceled) && err != io.EOF {
+				log.Printf("Listen: lost %v: %v\n", name, err)
+			}
+			return
+		}
+	}
+}
+
+// Listen streams the mic to a station that may listen in to this one, until it hangs up
+func (s *Server) Listen(req *pb.ListenRequest, stream pb.Intercom_ListenServer) error {
+	if !s.station.MayListen(req.Station) {
+		log.Printf("Refused to let %v listen in\n", req.Station)
+		return status.Error(codes.PermissionDenied, "not allowed to listen in")
+	}
+	// Anyone can claim to be a listener, so it must call from that station's address
+	if !peerMatches(stream.Context(), s.station.Lookup(req.Station)) {
+		log.Printf("Refused to let %v listen in from another address\n", req.Station)
+		return status.Error(codes.PermissionDenied, "not calling from the station's address")
+	}
+	rate := station.NegotiateRate(s.station.WireRate(), int(req.SampleRate))
+	log.Printf("%v is listening in\n", req.Station)
+	s.station.Publish(station.Event{Type: station.EventListening, From: req.Station})
+	defer log.Printf("%v stopped listening in\n", req.Station)
+	ctx := stream.Context()
+	toWire := resample.New(s.station.DeviceRate, rate)
+	// The first message tells the listener the rate
+	msg := &pb.AudioData{Data: []float32{}, SampleRate: uint32(rate)}
+	if err := stream.Send(msg); err != nil {
+		return err
+	}
+	audio := s.station.MonitorAudio(ctx)
+	for {
+		select {
+		case samples := <-audio:
+			if err := stream.Send(&pb.AudioData{Data: toWire.Process(samples)}); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Alert tells stations by name, or every known station for "*", that this
+// station's monitor heard noise
+func (callManager *grpcCallManager) Alert(level float64, to []string) {
+	if len(to) == 1 && to[0] == "*" {
+		to = knownStations(callManager.station)
+	}
+	for _, target := range to {
+		address := callManager.station.Lookup(target)
+		if strings.HasPrefix(address, "sip:") {
+			log.Println("Alert: skipping SIP phone", target)
+			continue
+		}
+		go func(target string, address string) {
+			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+			defer cancel()
+			conn, err := grpc.DialContext(ctx, stationAddress(address), grpc.WithInsecure(), grpc.WithBlock())
+			if err != nil {
+				log.Printf("Alert: unable to dial %v: %v\n", target, err)
+				return
+			}
+			defer conn.Close()
+			req := &pb.AlertRequest{Station: callManager.station.Name, Level: level}
+			if _, err := pb.NewIntercomClient(conn).Alert(ctx, req); err != nil {
+				log.Printf("Alert: unable to alert %v: %v\n", target, err)
+			}
+		}(target, address)
+	}
+}
+
+// Alert plays a chime and lights the alert LED for a monitor that heard noise
+func (s *Server) Alert(ctx context.Context, req *pb.AlertRequest) (*pb.AlertReply, error) {
+	if !peerMatches(ctx, s.station.Lookup(req.Station)) {
+		log.Printf("Ignored alert from %v, from another address\n", req.Station)
+		return nil, status.Error(codes.PermissionDenied, "not calling from the station's address")
+	}
+	s.station.ReceiveAlert(req.Station, req.Level)
+	return &pb.AlertReply{}, nil
+}
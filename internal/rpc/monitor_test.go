@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+)
+
+// fromAddress returns a context for a call from ip
+func fromAddress(ip string) context.Context {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 51234}
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+}
+
+func TestPeerMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		address string
+		want    bool
+	}{
+		{"last part of the address", "192.168.0.12", "12", true},
+		{"another station", "192.168.0.13", "12", false},
+		{"address with a port", "10.0.0.5", "10.0.0.5:20002", true},
+		{"address without a port", "10.0.0.5", "10.0.0.5", true},
+		{"host name", "127.0.0.1", "localhost:20000", true},
+		{"host name elsewhere", "10.0.0.5", "localhost", false},
+		{"IPv6", "::1", "[::1]:20000", true},
+		{"SIP phone", "192.168.0.12", "sip:12", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peerMatches(fromAddress(tt.from), tt.address); got != tt.want {
+				t.Errorf("peerMatches from %v to %v = %v, want %v", tt.from, tt.address, got, tt.want)
+			}
+		})
+	}
+	if peerMatches(context.Background(), "127.0.0.1") {
+		t.Error("matched a context without a peer")
+	}
+}
+
+func TestAlertFromAnotherAddress(t *testing.T) {
+	s := &Server{station: &station.Station{Name: "kitchen"}}
+	_, err := s.Alert(fromAddress("192.168.0.66"), &pb.AlertRequest{Station: "192.168.0.12", Level: -20})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got error %v, want PermissionDenied", err)
+	}
+}
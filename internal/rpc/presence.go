@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+)
+
+// How long to wait for a ping reply before a station is marked offline
+const pingTimeout = 2 * time.Second
+
+// presence pings every known station, and records the replies on the station
+type presence struct {
+	station     *station.Station
+	callManager *grpcCallManager
+	// conns are kept between pings, grpc reconnects them as needed
+	conns map[string]*grpc.ClientConn
+}
+
+// StartPresence pings every known station every PresenceInterval until ctx is
+// done. Start it after the hub client, so that stations registered with the
+// hub are asked about there
+// ctx is the main context from cmd
+func StartPresence(ctx context.Context, intercom *station.Station) {
+	if intercom.PresenceInterval == 0 {
+		return
+	}
+	p := &presence{
+		station:     intercom,
+		callManager: intercom.CallManager.(*grpcCallManager),
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+	go p.run(ctx)
+}
+
+// knownStations returns the stations in the directory, and any given on the command line
+func knownStations(intercom *station.Station) []string {
+	names := intercom.Stations()
+	for _, arg := range os.Args[1:] {
+		known := false
+		for _, name := range names {
+			known = known || name == arg
+		}
+		if !known {
+			names = append(names, arg)
+		}
+	}
+	return names
+}
+
+func (p *presence) run(ctx context.Context) {
+	defer func() {
+		for _, conn := range p.conns {
+			conn.Close()
+		}
+	}()
+	ticker := time.NewTicker(p.station.PresenceInterval)
+	defer ticker.Stop()
+	for {
+		p.pingAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pingAll updates the presence of every known station. Stations registered
+// with the hub are online, the rest are pinged directly
+func (p *presence) pingAll(ctx context.Context) {
+	var onHub map[string]bool
+	if p.callManager.hub.isRegistered() {
+		var err error
+		if onHub, err = p.callManager.hub.stations(ctx); err != nil {
+			log.Println("Unable to list hub stations:", err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, name := range knownStations(p.station) {
+		if inCall, ok := onHub[name]; ok {
+			if inCall {
+				p.station.SetPresence(name, station.PresenceInCall)
+			} else {
+				p.station.SetPresence(name, station.PresenceOnline)
+			}
+			continue
+		}
+		conn, err := p.conn(name)
+		if err != nil {
+			log.Printf("Unable to ping %v: %v\n", name, err)
+			p.station.SetPresence(name, station.PresenceOffline)
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p.station.SetPresence(name, p.ping(ctx, conn))
+		}(name)
+	}
+	wg.Wait()
+}
+
+// conn returns the connection for a station, dialing it without blocking if needed
+func (p *presence) conn(name string) (*grpc.ClientConn, error) {
+	address := stationAddress(p.station.Lookup(name))
+	if conn, ok := p.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	p.conns[address] = conn
+	return conn, nil
+}
+
+func (p *presence) ping(parentContext context.Context, conn *grpc.ClientConn) station.Presence {
+	ctx, cancel := context.WithTimeout(parentContext, pingTimeout)
+	defer cancel()
+	reply, err := pb.NewIntercomClient(conn).Ping(ctx, &pb.PingRequest{Station: p.station.Name})
+	switch {
+	case err != nil:
+		return station.PresenceOffline
+	case reply.InCall:
+		// Calls are auto-answered while another call is active
+		return station.PresenceInCall
+	case reply.DoNotDisturb:
+		return station.PresenceDoNotDisturb
+	}
+	return station.PresenceOnline
+}
+
+// stationAddress returns the gRPC address for a directory address, either the
+// last part of a station's IP address, or a host with an optional port
+func stationAddress(address string) string {
+	if !strings.ContainsAny(address, ".:") {
+		return fmt.Sprintf("192.168.0.%s%s", address, port)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return address + port
+	}
+	return address
+}
+
+// peerMatches returns whether the caller in ctx is at a directory address,
+// looking up host names. SIP phones never match
+func peerMatches(ctx context.Context, address string) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil || strings.HasPrefix(address, "sip:") {
+		return false
+	}
+	from, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return false
+	}
+	fromIP := net.ParseIP(from)
+	host, _, err := net.SplitHostPort(stationAddress(address))
+	if err != nil || fromIP == nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(fromIP)
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		log.Printf("Unable to look up %v: %v\n", host, err)
+		return false
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.Equal(fromIP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package rpc
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/rtp"
+)
+
+// How often keepalives are sent, and the call's quality is updated
+const qualityInterval = time.Second
+
+// qualityMeter measures the quality of one call from the audio sent and
+// received, and keeps call.Quality up to date. On RTP, it also reports loss
+// to the other end, and adapts the audio sent to what the other end reports
+type qualityMeter struct {
+	sync.Mutex
+	call    *call.Call
+	speaker *station.Speaker
+	// session counts bytes and lost packets, if audio is on RTP
+	session *rtp.Session
+	// rtp is set if the audio can adapt to the network
+	rtp             *rtpStreamer
+	playout         *station.PlayoutBuffer
+	quality         call.Quality
+	underflowsStart uint64
+	// Keepalives
+	lastPing     time.Time
+	echo         int64
+	echoReceived time.Time
+	// Loss since the last ping, in packets
+	packets  uint64
+	lostLast uint64
+	// Jitter compares arrival times to the number of samples received, at rate
+	rate         int
+	firstArrival time.Time
+	lastTransit  float64
+	samples      int64
+	jitter       float64
+	// Rates are calculated over each qualityInterval
+	windowStart         time.Time
+	windowSentStart     int64
+	windowReceivedStart int64
+}
+
+// newQualityMeter measures the audio on stream, which may be gRPC, RTP or SIP,
+// sent at rate. playout reports the clock drift
+func newQualityMeter(c *call.Call, speaker *station.Speaker, stream streamer, playout *station.PlayoutBuffer, rate int) *qualityMeter {
+	m := &qualityMeter{
+		call:            c,
+		speaker:         speaker,
+		playout:         playout,
+		rate:            rate,
+		underflowsStart: speaker.Underflows(),
+		windowStart:     time.Now(),
+	}
+	m.quality.Media = "gRPC"
+	switch s := stream.(type) {
+	case *rtpStreamer:
+		m.session = s.session
+		m.rtp = s
+		m.quality.Media = s.adapter.profile().String()
+	case *sipStreamer:
+		m.session = s.session
+		m.quality.Media = "PCMU 20ms"
+	}
+	c.SetQuality(m.quality)
+	return m
+}
+
+// meteredStreamer passes audio through a qualityMeter
+type meteredStreamer struct {
+	streamer
+	meter *qualityMeter
+}
+
+func (m *qualityMeter) wrap(stream streamer) streamer {
+	return &meteredStreamer{streamer: stream, meter: m}
+}
+
+func (s *meteredStreamer) Send(data *pb.AudioData) error {
+	if data != nil {
+		s.meter.sent(data)
+	}
+	return s.streamer.Send(data)
+}
+
+func (s *meteredStreamer) Recv() (*pb.AudioData, error) {
+	data, err := s.streamer.Recv()
+	if err == nil {
+		s.meter.received(data)
+	}
+	return data, err
+}
+
+// sent adds keepalives and loss reports to outgoing audio, and counts it
+func (m *qualityMeter) sent(data *pb.AudioData) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastPing) >= qualityInterval {
+		data.Ping = now.UnixNano()
+		data.LossPercent = m.lossPercent()
+		m.lastPing = now
+	}
+	if m.echo != 0 {
+		data.Pong = m.echo
+		data.PongDelay = int64(now.Sub(m.echoReceived))
+		m.echo = 0
+	}
+	if m.session == nil {
+		m.quality.BytesSent += int64(proto.Size(data))
+	}
+	m.update(now, false)
+}
+
+// lossPercent returns the percentage of packets lost since it was last called
+func (m *qualityMeter) lossPercent() uint32 {
+	if m.session == nil {
+		return 0
+	}
+	lost, _ := m.session.Stats()
+	lostSince := lost - m.lostLast
+	total := lostSince + m.packets
+	m.lostLast, m.packets = lost, 0
+	if total == 0 {
+		return 0
+	}
+	return uint32(lostSince * 100 / total)
+}
+
+// received answers keepalives, measures the round-trip time and jitter, and
+// adapts to the loss the other end reports
+func (m *qualityMeter) received(data *pb.AudioData) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	m.packets++
+	if data.Pong != 0 {
+		rtt := now.Sub(time.Unix(0, data.Pong)) - time.Duration(data.PongDelay)
+		m.quality.RTT = milliseconds(rtt.Seconds())
+		m.quality.MaxRTT = math.Max(m.quality.MaxRTT, m.quality.RTT)
+	}
+	if data.Ping != 0 {
+		m.echo = data.Ping
+		m.echoReceived = now
+		m.quality.RemoteLoss = int(data.LossPercent)
+		if m.rtp != nil {
+			if profile, changed := m.rtp.adapter.report(m.quality.RemoteLoss, m.quality.RTT); changed {
+				log.Printf("Call %v: %v%% loss, %vms RTT, sending %v\n", m.call.Id, m.quality.RemoteLoss, m.quality.RTT, profile)
+				m.quality.Media = profile.String()
+			}
+		}
+	}
+	// Inter-arrival jitter as in RFC 3550, using samples in place of RTP timestamps
+	if m.firstArrival.IsZero() {
+		m.firstArrival = now
+	}
+	transit := now.Sub(m.firstArrival).Seconds() - float64(m.samples)/float64(m.rate)
+	if m.samples > 0 {
+		m.jitter += (math.Abs(transit-m.lastTransit) - m.jitter) / 16
+		m.quality.Jitter = milliseconds(m.jitter)
+		m.quality.MaxJitter = math.Max(m.quality.MaxJitter, m.quality.Jitter)
+	}
+	m.lastTransit = transit
+	m.samples += int64(len(data.Data))
+	if m.session == nil {
+		m.quality.BytesReceived += int64(proto.Size(data))
+	}
+	m.update(now, false)
+}
+
+// finish records the final quality of the call, before it is published as ended
+func (m *qualityMeter) finish() {
+	m.Lock()
+	defer m.Unlock()
+	m.update(time.Now(), true)
+}
+
+// update copies the quality to the call once every qualityInterval, or now if forced
+func (m *qualityMeter) update(now time.Time, force bool) {
+	elapsed := now.Sub(m.windowStart)
+	if elapsed < qualityInterval && !force {
+		return
+	}
+	if m.session != nil {
+		m.quality.PacketsLost, m.quality.PacketsLate = m.session.Stats()
+		sent, received := m.session.Bytes()
+		m.quality.BytesSent, m.quality.BytesReceived = int64(sent), int64(received)
+	}
+	if m.rtp != nil {
+		m.quality.PacketsRecovered = m.rtp.Recovered()
+	}
+	if elapsed >= qualityInterval {
+		m.quality.SendRate = int(float64(m.quality.BytesSent-m.windowSentStart) / elapsed.Seconds())
+		m.quality.ReceiveRate = int(float64(m.quality.BytesReceived-m.windowReceivedStart) / elapsed.Seconds())
+		m.windowStart = now
+		m.windowSentStart, m.windowReceivedStart = m.quality.BytesSent, m.quality.BytesReceived
+	}
+	m.quality.Underflows = m.speaker.Underflows() - m.underflowsStart
+	drift, buffer := m.playout.Drift()
+	m.quality.Drift, m.quality.Buffer = math.Round(drift), math.Round(buffer)
+	m.call.SetQuality(m.quality)
+}
+
+// milliseconds rounds seconds to milliseconds, to 0.01ms
+func milliseconds(seconds float64) float64 {
+	return math.Round(seconds*100000) / 100
+}
@@ -0,0 +1,36 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+)
+
+// recordingStreamer records the audio sent and received on a call
+type recordingStreamer struct {
+	streamer
+	recording *station.CallRecording
+}
+
+func (s *recordingStreamer) Send(data *pb.AudioData) error {
+	if data != nil {
+		s.recording.Mic(data.Data)
+	}
+	return s.streamer.Send(data)
+}
+
+func (s *recordingStreamer) Recv() (*pb.AudioData, error) {
+	data, err := s.streamer.Recv()
+	if err == nil {
+		s.recording.Remote(data.Data)
+	}
+	return data, err
+}
+
+// recordingNotice is two short beeps, to let the other end know the call is recorded
+func recordingNotice(rate int) []float32 {
+	tone := beep(200*time.Millisecond, rate)
+	notice := append(tone, make([]float32, len(tone))...)
+	return append(notice, tone...)
+}
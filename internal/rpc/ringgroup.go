@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// groupCall tracks the calls to the members of a ring group, so that the
+// rest can be hung up once one answers
+type groupCall struct {
+	sync.Mutex
+	group    call.RingGroup
+	calls    []*call.Call
+	answered *call.Call
+}
+
+// join adds a member's call before it's dialed. Unless the group is a
+// conference, once a member has answered, only that member is dialed, e.g.
+// to redial a dropped call
+func (g *groupCall) join(c *call.Call) bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.group.Strategy != call.RingConference && g.answered != nil && g.answered.Peer != c.Peer {
+		return false
+	}
+	c.Doorbell = g.group.Doorbell
+	c.Group = g.group.Name
+	c.OnAnswer(g.answer)
+	g.calls = append(g.calls, c)
+	if g.group.Strategy == call.RingSequential && g.group.Timeout > 0 {
+		time.AfterFunc(g.group.Timeout, func() {
+			if c.CurrentStatus() == call.StatusPending {
+				log.Printf("Ring group %v: %v didn't answer, trying the next station\n", g.group.Name, c.Peer)
+				c.Hangup()
+			}
+		})
+	}
+	return true
+}
+
+// answer hangs up the other members' calls, unless the group is a
+// conference. If another member answered first, this call is hung up instead
+func (g *groupCall) answer(c *call.Call) {
+	g.Lock()
+	if g.group.Strategy == call.RingConference {
+		if g.answered == nil {
+			g.answered = c
+		}
+		g.Unlock()
+		return
+	}
+	if g.answered != nil && g.answered.Peer != c.Peer {
+		g.Unlock()
+		log.Printf("Ring group %v: %v answered too late, hanging up\n", g.group.Name, c.Peer)
+		c.Hangup()
+		return
+	}
+	g.answered = c
+	calls := g.calls
+	g.Unlock()
+	log.Printf("Ring group %v: answered by %v\n", g.group.Name, c.Peer)
+	for _, other := range calls {
+		if other.Peer != c.Peer {
+			other.Hangup()
+		}
+	}
+}
+
+func (g *groupCall) isAnswered() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.answered != nil
+}
+
+// Ring calls the members of a group, by the group's strategy. Members are
+// called directly, except for conference groups while registered with a hub,
+// which go through the hub like any other call to several stations. If no
+// one answers, a missed call is published for the group
+// SIP phones and stations that are known to be offline are skipped
+func (callManager *grpcCallManager) Ring(group call.RingGroup) {
+	if group.Strategy == call.RingConference && !group.Doorbell && callManager.hub.isRegistered() {
+		callManager.hub.call(callManager, group.Members, group.Urgent, nil)
+		return
+	}
+	members := group.Members
+	if len(members) == 1 && members[0] == "*" {
+		members = knownStations(callManager.station)
+	}
+	g := &groupCall{group: group}
+	var wg sync.WaitGroup
+	for _, name := range members {
+		switch {
+		case strings.HasPrefix(callManager.station.Lookup(name), "sip:"):
+			log.Printf("Ring group %v: skipping SIP phone %v\n", group.Name, name)
+		case !callManager.station.Presence(name).Reachable():
+			log.Printf("Ring group %v: skipping %v, offline\n", group.Name, name)
+		case group.Strategy == call.RingSequential:
+			if g.isAnswered() {
+				break
+			}
+			log.Printf("Ring group %v: ringing %v\n", group.Name, name)
+			callManager.outgoingCall(name, group.Urgent, g.join)
+		default:
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				callManager.outgoingCall(name, group.Urgent, g.join)
+			}(name)
+		}
+	}
+	wg.Wait()
+	if g.isAnswered() {
+		return
+	}
+	log.Printf("Ring group %v: no one answered\n", group.Name)
+	c := call.New(call.NewCallId(), group.Name, callManager.station.Name, func() {})
+	c.Peer = group.Name
+	c.Group = group.Name
+	c.Urgent = group.Urgent
+	c.Doorbell = group.Doorbell
+	callManager.station.Publish(station.Event{Type: station.EventMissedCall, Call: c})
+}
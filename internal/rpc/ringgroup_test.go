@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// answerAs makes calls to name answer once answer is closed, as a station
+// picking up would, and places the rest as usual. It returns a channel that
+// gets the time of the answer
+// Connected calls play audio, which tests can't, so the answered call stays
+// in the call list until it's hung up
+func answerAs(callManager *grpcCallManager, name string, answer <-chan struct{}) <-chan time.Time {
+	answered := make(chan time.Time, 1)
+	callManager.callStation = func(to string, address string, urgent bool, redialing bool, join func(*call.Call) bool) (bool, error) {
+		if to != name {
+			return callManager.directCall(to, address, urgent, redialing, join)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := call.New(call.NewCallId(), address, "self", cancel)
+		c.Peer = to
+		if join != nil && !join(c) {
+			return false, nil
+		}
+		callManager.addCall(c)
+		defer callManager.removeCall(c)
+		select {
+		case <-answer:
+		case <-ctx.Done():
+			return false, nil
+		}
+		c.SetStatus(call.StatusActive)
+		answered <- time.Now()
+		<-ctx.Done()
+		return true, nil
+	}
+	return answered
+}
+
+// ringGroup runs Ring, closing the channel once it returns
+func ringGroup(callManager *grpcCallManager, group call.RingGroup) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		callManager.Ring(group)
+		close(done)
+	}()
+	return done
+}
+
+// missedCalls records the groups of missed call events
+type missedCalls struct {
+	sync.Mutex
+	groups []string
+}
+
+func (m *missedCalls) HandleEvent(e station.Event) {
+	if e.Type != station.EventMissedCall {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.groups = append(m.groups, e.Call.Group)
+}
+
+func (m *missedCalls) get() []string {
+	m.Lock()
+	defer m.Unlock()
+	return append([]string(nil), m.groups...)
+}
+
+func TestRingFirstAnswer(t *testing.T) {
+	office, garage := newStubStation(t, 0), newStubStation(t, 0)
+	kitchen := newTestStation(t, "kitchen", config.Config{
+		Peers: directory("office="+office.address, "garage="+garage.address, "hall=192.0.2.1"),
+	})
+	missed := &missedCalls{}
+	kitchen.Subscribe(missed)
+	callManager := kitchen.CallManager.(*grpcCallManager)
+	answer := make(chan struct{})
+	answered := answerAs(callManager, "hall", answer)
+
+	done := ringGroup(callManager, call.RingGroup{
+		Name:     "downstairs",
+		Members:  []string{"office", "garage", "hall"},
+		Strategy: call.RingFirstAnswer,
+	})
+	waitFor(t, office.ringing, "office didn't ring")
+	waitFor(t, garage.ringing, "garage didn't ring")
+	close(answer)
+	<-answered
+
+	// The first answer hangs up the other members
+	waitFor(t, office.hungUp, "office kept ringing after hall answered")
+	waitFor(t, garage.hungUp, "garage kept ringing after hall answered")
+	for deadline := time.Now().Add(5 * time.Second); len(callManager.Calls()) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got calls %v, want only hall's", callManager.Calls())
+		}
+	}
+	c := callManager.Calls()[0]
+	if c.Peer != "hall" || c.CurrentStatus() != call.StatusActive || c.Group != "downstairs" {
+		t.Errorf("got call to %v in group %q with status %v, want an active call to hall", c.Peer, c.Group, c.CurrentStatus())
+	}
+	select {
+	case <-done:
+		t.Error("Ring returned while hall was in the call")
+	default:
+	}
+
+	callManager.HangupAll()
+	waitFor(t, done, "Ring didn't return after hanging up")
+	if got := missed.get(); len(got) != 0 {
+		t.Errorf("got missed calls for %v, want none", got)
+	}
+}
+
+func TestRingSequential(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	office, garage := newStubStation(t, 0), newStubStation(t, 0)
+	kitchen := newTestStation(t, "kitchen", config.Config{
+		Peers: directory("office="+office.address, "garage="+garage.address, "hall=192.0.2.1"),
+	})
+	missed := &missedCalls{}
+	kitchen.Subscribe(missed)
+	callManager := kitchen.CallManager.(*grpcCallManager)
+	answer := make(chan struct{})
+	close(answer)
+	answered := answerAs(callManager, "hall", answer)
+
+	done := ringGroup(callManager, call.RingGroup{
+		Name:     "downstairs",
+		Members:  []string{"office", "garage", "hall"},
+		Strategy: call.RingSequential,
+		Timeout:  timeout,
+	})
+	var answeredAt time.Time
+	select {
+	case answeredAt = <-answered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hunt didn't reach hall")
+	}
+
+	// Each member rings for the timeout before it's hung up, and the next is
+	// called. The timeout starts as the call is placed, a little before the
+	// member sees it
+	least := timeout - 50*time.Millisecond
+	previous := time.Time{}
+	for _, member := range []struct {
+		name string
+		stub *stubStation
+	}{{"office", office}, {"garage", garage}} {
+		waitFor(t, member.stub.hungUp, member.name+" wasn't hung up")
+		calls, hangups := member.stub.callTimes(), member.stub.hangupTimes()
+		if len(calls) != 1 {
+			t.Fatalf("%v was called %d times, want once", member.name, len(calls))
+		}
+		if rang := hangups[0].Sub(calls[0]); rang < least || rang > 3*time.Second {
+			t.Errorf("%v rang for %v, want %v", member.name, rang, timeout)
+		}
+		if wait := calls[0].Sub(previous); !previous.IsZero() && wait < least {
+			t.Errorf("%v was called %v after the last member, want %v", member.name, wait, timeout)
+		}
+		previous = calls[0]
+	}
+	if wait := answeredAt.Sub(previous); wait < least {
+		t.Errorf("hall was called %v after garage, want %v", wait, timeout)
+	}
+
+	// The member that answered isn't hung up after the timeout
+	time.Sleep(2 * timeout)
+	if calls := callManager.Calls(); len(calls) != 1 || calls[0].CurrentStatus() != call.StatusActive {
+		t.Errorf("got calls %v, want hall's call active", calls)
+	}
+	callManager.HangupAll()
+	waitFor(t, done, "Ring didn't return after hanging up")
+	if got := missed.get(); len(got) != 0 {
+		t.Errorf("got missed calls for %v, want none", got)
+	}
+}
+
+func TestRingNoAnswer(t *testing.T) {
+	office, garage := newStubStation(t, 0), newStubStation(t, 0)
+	kitchen := newTestStation(t, "kitchen", config.Config{
+		Peers: directory("office="+office.address, "garage="+garage.address),
+	})
+	missed := &missedCalls{}
+	kitchen.Subscribe(missed)
+	callManager := kitchen.CallManager.(*grpcCallManager)
+
+	done := ringGroup(callManager, call.RingGroup{
+		Name:     "downstairs",
+		Members:  []string{"office", "garage"},
+		Strategy: call.RingSequential,
+		Timeout:  100 * time.Millisecond,
+	})
+	waitFor(t, done, "Ring didn't give up")
+	if len(office.callTimes()) != 1 || len(garage.callTimes()) != 1 {
+		t.Errorf("office was called %d times and garage %d times, want once each", len(office.callTimes()), len(garage.callTimes()))
+	}
+	if got := missed.get(); len(got) != 1 || got[0] != "downstairs" {
+		t.Errorf("got missed calls for %v, want one for downstairs", got)
+	}
+}
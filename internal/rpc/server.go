@@ -6,12 +6,16 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 
 	"github.com/figadore/go-intercom/internal/log"
 	"github.com/figadore/go-intercom/internal/rpc/pb"
 	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/rtp"
 )
 
 func NewServer(intercom *station.Station) *grpc.Server {
@@ -23,13 +27,19 @@ func NewServer(intercom *station.Station) *grpc.Server {
 	return s
 }
 
-func Serve(s *grpc.Server, errCh chan error) {
-	log.Debugf("Start net.Listen: %v", port)
-	defer log.Debugf("Serve: Finished net.Listen: %v", port)
-	lis, err := net.Listen("tcp", port)
+// Serve takes calls on address, e.g. ":20000", until the server is stopped
+func Serve(s *grpc.Server, address string, errCh chan error) {
+	serve(s, address, errCh)
+}
+
+func serve(s *grpc.Server, address string, errCh chan error) {
+	log.Debugf("Start net.Listen: %v", address)
+	defer log.Debugf("Serve: Finished net.Listen: %v", address)
+	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Printf("Serve: failed to listen: %v", err)
 		errCh <- err
+		return
 	}
 	if err := s.Serve(lis); err != nil {
 		log.Printf("Serve: failed to serve: %v", err)
@@ -37,53 +47,183 @@ func Serve(s *grpc.Server, errCh chan error) {
 	}
 }
 
+// busyMessage tells errBusy apart from other ResourceExhausted errors, e.g.
+// messages that are too big
+const busyMessage = "station is busy"
+
+// errBusy ends a call that the station won't take because it's in another one
+var errBusy = status.Error(codes.ResourceExhausted, busyMessage)
+
+func isBusy(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.ResourceExhausted && s.Message() == busyMessage
+}
+
 type Server struct {
 	pb.UnimplementedIntercomServer
 	station *station.Station
 }
 
+// Ping tells another station whether this one is likely to answer a call
+func (s *Server) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingReply, error) {
+	log.Debugf("Ping from %v", req.Station)
+	return &pb.PingReply{
+		Station:      s.station.Name,
+		DoNotDisturb: s.station.Status.Has(station.StatusDoNotDisturb),
+		InCall:       len(s.station.CallManager.Calls()) > 0,
+	}, nil
+}
+
 // DuplexCall is run whenever the server receives an incoming call
 // Return nil to end stream. client receives io.EOF
 func (s *Server) DuplexCall(clientStream pb.Intercom_DuplexCallServer) error {
-	s.station.Status.Set(station.StatusIncomingCall)
-	// If calls already active, accept call
-	if s.station.Status.Has(station.StatusCallConnected) {
-		log.Println("One or more calls already active, auto-answering")
-	} else if s.station.Status.Has(station.StatusDoNotDisturb) {
-		// Wait for call call manager accept/reject-call function
-		acceptCh := s.station.CallManager.AcceptCh()
-		log.Println("Waiting 20 seconds for call to be accepted")
-		select {
-		case accept := <-acceptCh:
-			if accept {
-				log.Println("Call accepted")
-			} else {
-				log.Println("Call rejected")
-				s.station.Status.Clear(station.StatusIncomingCall)
-				return nil
-			}
-		case <-time.After(20 * time.Second):
-			log.Println("Call rejected")
-			s.station.Status.Clear(station.StatusIncomingCall)
-			return nil
-		}
-	}
-	log.Println("Server accepting call")
-	// Update status appropriately
-	s.station.Status.Clear(station.StatusIncomingCall)
 	streamCtx := clientStream.Context()
 	p, _ := peer.FromContext(streamCtx)
 	addrPort := p.Addr.String()
 	md, _ := metadata.FromIncomingContext(streamCtx)
 	to := md[":authority"][0]
 	from := addrPort
-
-	log.Println("Start server side DuplexCall, receiving from ", addrPort)
 	grpcCtx, cancel := context.WithCancel(streamCtx)
 	// TODO figure out whether this cancel should be the one in the Call object
 	defer cancel()
-	callManager := s.station.CallManager.(*grpcCallManager)
-	err := callManager.duplexCall(grpcCtx, to, from, clientStream, cancel)
+	c := call.New(call.NewCallId(), to, from, cancel)
+
+	if name := md.Get(stationHeader); len(name) > 0 {
+		c.Peer = name[0]
+		c.Volume = s.station.PeerVolume(c.Peer)
+	}
+	if urgent := md.Get(urgentHeader); len(urgent) > 0 && urgent[0] == "true" {
+		c.Urgent = true
+	}
+	if doorbell := md.Get(doorbellHeader); len(doorbell) > 0 && doorbell[0] == "true" {
+		c.Doorbell = true
+	}
+	if replaces := md.Get(replacesHeader); len(replaces) > 0 {
+		c.Replaces = replaces[0]
+	}
+	if token := md.Get(replaceTokenHeader); len(token) > 0 {
+		c.ReplacesToken = token[0]
+	}
+	log.Println("Start server side DuplexCall, receiving from ", addrPort)
+	err := s.incomingCall(grpcCtx, c, clientStream, func() *rtp.Session {
+		return acceptMedia(s.station.Media, md, p, clientStream)
+	})
 	log.Println("Server-side duplex call ended with:", err)
 	return err
 }
+
+// incomingCall decides whether to answer, ring or send the call to voicemail,
+// then runs the call until it ends. It returns without sending anything on
+// stream if the call is rejected. media, if set, negotiates RTP once the call is answered
+func (s *Server) incomingCall(ctx context.Context, c *call.Call, stream streamer, media func() *rtp.Session) error {
+	s.station.Status.Set(station.StatusIncomingCall)
+	s.station.Publish(station.Event{Type: station.EventIncomingCall, Call: c})
+	policy := s.station.CallPolicy(c.Peer, c.Urgent)
+	// Anyone can put a name in the station header, so the caller's policy
+	// only applies to calls from that station's address
+	if policy != station.PolicyDefault && !peerMatches(ctx, s.station.Lookup(c.Peer)) {
+		log.Printf("Call from %v isn't from its address, ignoring its %v policy\n", c.Peer, policy)
+		policy = station.PolicyDefault
+	}
+	log.Printf("Incoming call from %v (%v), policy: %v\n", c.Peer, c.From, policy)
+	callManager := s.station.CallManager.(*grpcCallManager)
+	busy := s.station.Status.Has(station.StatusCallConnected)
+	// Rejected callers can't take over calls either
+	var replaced *call.Call
+	if policy != station.PolicyReject {
+		replaced = callManager.replaced(c)
+	}
+	switch {
+	case policy == station.PolicyReject:
+		log.Println("Call rejected by policy")
+		s.station.Status.Clear(station.StatusIncomingCall)
+		s.station.Publish(station.Event{Type: station.EventMissedCall, Call: c})
+		return nil
+	// A call that takes over one in progress, e.g. after a transfer, is answered
+	case replaced != nil:
+		log.Printf("Call from %v replaces the call with %v, answering\n", c.Peer, c.Replaces)
+		c.OnAnswer(func(*call.Call) {
+			replaced.Hangup()
+		})
+	case policy == station.PolicyVoicemail:
+		s.station.Status.Clear(station.StatusIncomingCall)
+		return s.voicemail(ctx, c, stream)
+	// If calls are already active, the busy policy decides, before the caller's policy
+	case busy && s.station.BusyPolicy == station.BusyReject:
+		log.Println("One or more calls already active, rejecting as busy")
+		s.station.Status.Clear(station.StatusIncomingCall)
+		s.station.Publish(station.Event{Type: station.EventMissedCall, Call: c})
+		return errBusy
+	// Call waiting. Calls that would ring anyway, e.g. doorbells, ring this way
+	// with the join policy too. Accepting puts the calls in progress on hold
+	case busy && (s.station.BusyPolicy == station.BusyWait || policy == station.PolicyRing || c.Doorbell):
+		if !s.waitForAccept(ctx, c, policy == station.PolicyRing) {
+			return errBusy
+		}
+		callManager.holdActive()
+	case busy:
+		log.Println("One or more calls already active, auto-answering")
+	case policy == station.PolicyAnswer:
+		log.Println("Call answered by policy")
+	case policy == station.PolicyRing:
+		if !s.waitForAccept(ctx, c, true) {
+			return nil
+		}
+	case c.Doorbell:
+		if !s.waitForAccept(ctx, c, false) {
+			return nil
+		}
+	case s.station.Status.Has(station.StatusDoNotDisturb):
+		if !s.waitForAccept(ctx, c, false) {
+			return nil
+		}
+	}
+	log.Println("Server accepting call")
+	// Update status appropriately
+	s.station.Status.Clear(station.StatusIncomingCall)
+
+	var session *rtp.Session
+	if media != nil {
+		session = media()
+	}
+	return callManager.duplexCall(ctx, c, stream, session)
+}
+
+// waitForAccept rings until the call is accepted or rejected, the caller
+// gives up, or 20 seconds pass
+// Urgent calls ring at full volume, even during quiet hours
+func (s *Server) waitForAccept(ctx context.Context, c *call.Call, urgent bool) bool {
+	// Wait for call call manager accept/reject-call function
+	acceptCh := s.station.CallManager.AcceptCh()
+	if urgent {
+		s.station.Status.Set(station.StatusUrgentCall)
+		defer s.station.Status.Clear(station.StatusUrgentCall)
+	}
+	if c.Doorbell {
+		s.station.Status.Set(station.StatusDoorbell)
+		defer s.station.Status.Clear(station.StatusDoorbell)
+	}
+	// During a call, the ringer beeps instead
+	if s.station.Status.Has(station.StatusCallConnected) {
+		s.station.Status.Set(station.StatusCallWaiting)
+		defer s.station.Status.Clear(station.StatusCallWaiting)
+	}
+	s.station.Status.Set(station.StatusRinging)
+	defer s.station.Status.Clear(station.StatusRinging)
+	log.Println("Waiting 20 seconds for call to be accepted")
+	select {
+	case accept := <-acceptCh:
+		if accept {
+			log.Println("Call accepted")
+			return true
+		}
+		log.Println("Call rejected")
+	case <-time.After(20 * time.Second):
+		log.Println("Call rejected")
+	case <-ctx.Done():
+		log.Println("Caller hung up while ringing")
+	}
+	s.station.Status.Clear(station.StatusIncomingCall)
+	s.station.Publish(station.Event{Type: station.EventMissedCall, Call: c})
+	return false
+}
@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// hungUpStream is a caller that hangs up as soon as the call is answered.
+// sent counts the times the station tried to send, which it only does once it answers
+type hungUpStream struct {
+	sent int32
+}
+
+func (s *hungUpStream) Send(*pb.AudioData) error {
+	atomic.AddInt32(&s.sent, 1)
+	return errors.New("hung up")
+}
+
+func (s *hungUpStream) Recv() (*pb.AudioData, error) {
+	return nil, io.EOF
+}
+
+// callerAddresses are the directory entries of the callers in the tests
+var callerAddresses = map[string]string{
+	"hall":    "192.168.0.20",
+	"office":  "192.168.0.21",
+	"spam":    "192.168.0.22",
+	"garage":  "192.168.0.23",
+	"porch":   "192.168.0.24",
+	"nursery": "192.168.0.25",
+}
+
+// callFrom returns an incoming call from ip, from the station named caller
+func callFrom(s *station.Station, caller string, ip string) *call.Call {
+	c := call.New(call.NewCallId(), s.Name, ip+":41000", func() {})
+	c.Peer = caller
+	return c
+}
+
+// incomingCall starts handling c on the station. It returns the caller's
+// stream and the call's result
+func incomingCall(s *station.Station, c *call.Call) (*hungUpStream, <-chan error) {
+	stream := &hungUpStream{}
+	ip, _, _ := net.SplitHostPort(c.From)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- (&Server{station: s}).incomingCall(fromAddress(ip), c, stream, nil)
+	}()
+	return stream, errCh
+}
+
+func TestBusyPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		busyPolicy string
+		// busy is whether another call is connected
+		busy     bool
+		caller   string
+		doorbell bool
+		// rings is whether the call rings, and accept whether it's then accepted
+		rings    bool
+		accept   bool
+		answered bool
+		// held is whether the call in progress is put on hold
+		held     bool
+		wantBusy bool
+	}{
+		{name: "not busy", busyPolicy: "busy", caller: "hall", answered: true},
+		{name: "busy rejects answer policy", busyPolicy: "busy", busy: true, caller: "hall", wantBusy: true},
+		{name: "busy rejects ring policy", busyPolicy: "busy", busy: true, caller: "office", wantBusy: true},
+		{name: "busy rejects doorbell", busyPolicy: "busy", busy: true, caller: "porch", doorbell: true, wantBusy: true},
+		{name: "reject policy isn't busy", busyPolicy: "busy", busy: true, caller: "spam"},
+		{name: "wait rings for answer policy", busyPolicy: "wait", busy: true, caller: "hall", rings: true, accept: true, answered: true, held: true},
+		{name: "wait rejected", busyPolicy: "wait", busy: true, caller: "garage", rings: true, wantBusy: true},
+		{name: "join answers", busyPolicy: "join", busy: true, caller: "garage", answered: true},
+		{name: "join answers answer policy", busyPolicy: "join", busy: true, caller: "hall", answered: true},
+		{name: "join rings for ring policy", busyPolicy: "join", busy: true, caller: "office", rings: true, accept: true, answered: true, held: true},
+		{name: "join rings for doorbell", busyPolicy: "join", busy: true, caller: "porch", doorbell: true, rings: true, accept: true, answered: true, held: true},
+		{name: "ring policy rejected during a call", busyPolicy: "join", busy: true, caller: "office", rings: true, wantBusy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kitchen := newTestStation(t, "kitchen", config.Config{
+				Peers: config.PeersConfig{Directory: callerAddresses},
+				Policies: config.PoliciesConfig{
+					Busy:    tt.busyPolicy,
+					Callers: map[string]string{"hall": "answer", "office": "ring", "spam": "reject"},
+				},
+			})
+			var inProgress *call.Call
+			if tt.busy {
+				inProgress, _ = connectedCall(kitchen, "den", "kitchen", "192.168.0.30:41000")
+				kitchen.Status.Set(station.StatusCallConnected)
+			}
+			c := callFrom(kitchen, tt.caller, callerAddresses[tt.caller])
+			c.Doorbell = tt.doorbell
+			stream, errCh := incomingCall(kitchen, c)
+
+			ringing := kitchen.Outputs.(*quietOutputs).ringing
+			if tt.rings {
+				select {
+				case waiting := <-ringing:
+					if waiting != tt.busy {
+						t.Errorf("rang as a waiting call: %v", waiting)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("didn't ring")
+				}
+				kitchen.CallManager.AcceptCh() <- tt.accept
+			}
+			var err error
+			select {
+			case err = <-errCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("call wasn't answered or rejected")
+			}
+			select {
+			case <-ringing:
+				if !tt.rings {
+					t.Error("rang")
+				}
+			default:
+			}
+
+			if isBusy(err) != tt.wantBusy {
+				t.Errorf("call ended with %v, want busy: %v", err, tt.wantBusy)
+			}
+			if answered := atomic.LoadInt32(&stream.sent) > 0; answered != tt.answered {
+				t.Errorf("answered: %v, want %v", answered, tt.answered)
+			}
+			if inProgress != nil && inProgress.IsHeld() != tt.held {
+				t.Errorf("call in progress held: %v, want %v", inProgress.IsHeld(), tt.held)
+			}
+		})
+	}
+}
+
+func TestSpoofedCallerPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		urgent bool
+		// rings is whether the call waits to be accepted, rather than being answered
+		rings bool
+	}{
+		{name: "answered from the nursery", from: callerAddresses["nursery"]},
+		{name: "spoofed nursery rings in do-not-disturb", from: "192.168.0.66", rings: true},
+		{name: "spoofed urgent call rings", from: "192.168.0.66", urgent: true, rings: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kitchen := newTestStation(t, "kitchen", config.Config{
+				Peers: config.PeersConfig{Directory: callerAddresses},
+				Policies: config.PoliciesConfig{
+					Callers:       map[string]string{"nursery": "answer"},
+					UrgentCallers: []string{"nursery"},
+				},
+			})
+			kitchen.Status.Set(station.StatusDoNotDisturb)
+			ringing := kitchen.Outputs.(*quietOutputs).ringing
+			c := callFrom(kitchen, "nursery", tt.from)
+			c.Urgent = tt.urgent
+			stream, errCh := incomingCall(kitchen, c)
+
+			if tt.rings {
+				select {
+				case <-ringing:
+				case <-time.After(5 * time.Second):
+					t.Fatal("didn't ring")
+				}
+				if kitchen.Status.Has(station.StatusUrgentCall) {
+					t.Error("rang as an urgent call")
+				}
+				kitchen.CallManager.AcceptCh() <- false
+			}
+			select {
+			case <-errCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("call wasn't answered or rejected")
+			}
+			if answered := atomic.LoadInt32(&stream.sent) > 0; answered == tt.rings {
+				t.Errorf("answered: %v, want %v", answered, !tt.rings)
+			}
+		})
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errBusy, true},
+		{status.Error(codes.ResourceExhausted, busyMessage), true},
+		{status.Error(codes.ResourceExhausted, "grpc: received message larger than max"), false},
+		{status.Error(codes.Unavailable, busyMessage), false},
+		{errors.New(busyMessage), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isBusy(tt.err); got != tt.want {
+			t.Errorf("isBusy(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
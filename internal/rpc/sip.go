@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/sip"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/rtp"
+)
+
+// SIP phones send 20ms of audio per packet, so do the same
+const sipPacketSamples = station.SampleRate / 50
+
+// SIPGateway bridges calls to and from SIP phones into the call manager, so
+// they are handled like calls between stations
+type SIPGateway struct {
+	station *station.Station
+	server  *Server
+	ua      *sip.UserAgent
+}
+
+// StartSIPGateway registers with the station's SIP server and starts taking
+// calls. It returns nil if SIP is not configured or can't be started
+// ctx is the main context from cmd
+func StartSIPGateway(ctx context.Context, intercom *station.Station) *SIPGateway {
+	if intercom.SIP == nil {
+		return nil
+	}
+	ua, err := sip.Start(*intercom.SIP)
+	if err != nil {
+		log.Println("Unable to start SIP:", err)
+		intercom.Publish(station.Event{Type: station.EventError, Err: err})
+		return nil
+	}
+	g := &SIPGateway{
+		station: intercom,
+		server:  &Server{station: intercom},
+		ua:      ua,
+	}
+	intercom.CallManager.(*grpcCallManager).sip = g
+	go ua.Register(ctx)
+	go func() {
+		for ic := range ua.Incoming() {
+			go g.incomingCall(ctx, ic)
+		}
+	}()
+	return g
+}
+
+// incomingCall handles an INVITE like any other incoming call. The call is
+// answered by the first audio sent to it
+func (g *SIPGateway) incomingCall(parentContext context.Context, ic *sip.IncomingCall) {
+	caller := "sip:" + ic.Caller()
+	log.Println("Incoming SIP call from", caller)
+	ic.Ringing()
+	session := listenMedia(station.MediaConfig{RTP: true, MinPort: g.station.Media.MinPort, MaxPort: g.station.Media.MaxPort})
+	if session == nil {
+		ic.Reject(500, "Server Internal Error")
+		return
+	}
+	defer session.Close()
+	session.SetPayloadType(rtp.PayloadTypePCMU)
+	ctx, cancel := context.WithCancel(parentContext)
+	defer cancel()
+	c := call.New(call.NewCallId(), g.station.Name, caller, cancel)
+	c.Peer = caller
+	c.Volume = g.station.PeerVolume(caller)
+	go g.endWith(ctx, c, session, ic.Dialog.Done(), ic.Cancelled())
+	stream := &sipStreamer{
+		session: session,
+		answer: func() error {
+			if err := ic.Answer(session.LocalPort()); err != nil {
+				return err
+			}
+			return session.SetRemote(ic.Dialog.RemoteHost, ic.Dialog.RemotePort)
+		},
+	}
+	err := g.server.incomingCall(ctx, c, stream, nil)
+	log.Println("SIP call ended with:", err)
+	if stream.answered() {
+		if err := ic.Dialog.Hangup(); err != nil {
+			log.Println("Error hanging up SIP call:", err)
+		}
+	} else if isBusy(err) {
+		ic.Reject(486, "Busy Here")
+	} else {
+		ic.Reject(603, "Decline")
+	}
+}
+
+// endWith hangs up when the SIP side ends the call, or gives up before it is
+// answered. It closes the RTP session when the call ends, so that nothing is
+// left waiting for audio. cancelled may be nil
+func (g *SIPGateway) endWith(ctx context.Context, c *call.Call, session *rtp.Session, ended <-chan struct{}, cancelled <-chan struct{}) {
+	select {
+	case <-ended:
+		log.Println("SIP call ended by the other end")
+		c.Hangup()
+	case <-cancelled:
+		log.Println("SIP caller gave up")
+		c.Hangup()
+	case <-ctx.Done():
+	}
+	session.Close()
+}
+
+// sipCall calls a SIP phone through the SIP server
+func (callManager *grpcCallManager) sipCall(name string, address string) {
+	if callManager.sip == nil {
+		log.Println("Unable to call", name, "because SIP_SERVER is not set")
+		return
+	}
+	g := callManager.sip
+	session := listenMedia(station.MediaConfig{RTP: true, MinPort: g.station.Media.MinPort, MaxPort: g.station.Media.MaxPort})
+	if session == nil {
+		return
+	}
+	defer session.Close()
+	session.SetPayloadType(rtp.PayloadTypePCMU)
+	_ = callManager.station.Status.Set(station.StatusOutgoingCall)
+	defer callManager.station.UpdateStatus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := call.New(call.NewCallId(), address, "self", cancel)
+	c.Peer = name
+	c.Volume = callManager.station.PeerVolume(name)
+	// Pending calls can be hung up, and give up if they aren't answered in time
+	callManager.addCall(c)
+	defer callManager.removeCall(c)
+	invite := time.AfterFunc(callManager.station.Dial.InviteTimeout, func() {
+		if c.CurrentStatus() == call.StatusPending {
+			log.Println("sipCall: not answered, hanging up", address)
+			c.Hangup()
+		}
+	})
+	defer invite.Stop()
+	log.Println("sipCall: calling", address)
+	dialog, err := g.ua.Invite(ctx, address, session.LocalPort())
+	if err != nil {
+		log.Println("sipCall: call failed:", err)
+		return
+	}
+	if err := session.SetRemote(dialog.RemoteHost, dialog.RemotePort); err != nil {
+		log.Println("sipCall: invalid media address:", err)
+		_ = dialog.Hangup()
+		return
+	}
+	go g.endWith(ctx, c, session, dialog.Done(), nil)
+	err = callManager.duplexCall(ctx, c, &sipStreamer{session: session}, nil)
+	log.Println("sipCall: call ended with:", err)
+	if err := dialog.Hangup(); err != nil {
+		log.Println("sipCall: error hanging up:", err)
+	}
+}
+
+// Close stops taking SIP calls. Registration ends with the main context
+func (g *SIPGateway) Close() {
+	g.ua.Close()
+}
+
+// sipStreamer sends and receives G.711 audio in place of the gRPC stream
+// Mute and hold are not signaled to SIP phones, they only hear silence
+type sipStreamer struct {
+	sync.Mutex
+	session *rtp.Session
+	// answer is called before the first audio is sent, for incoming calls
+	answer     func() error
+	answeredOk bool
+}
+
+func (s *sipStreamer) answered() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.answeredOk
+}
+
+func (s *sipStreamer) Send(data *pb.AudioData) error {
+	if data == nil {
+		return nil
+	}
+	s.Lock()
+	if s.answer != nil && !s.answeredOk {
+		if err := s.answer(); err != nil {
+			s.Unlock()
+			return err
+		}
+		s.answeredOk = true
+	}
+	s.Unlock()
+	samples := data.Data
+	for len(samples) > 0 {
+		n := sipPacketSamples
+		if n > len(samples) {
+			n = len(samples)
+		}
+		if err := s.session.WriteAudio(rtp.EncodePCMU(samples[:n]), n, 0, nil); err != nil {
+			return err
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+func (s *sipStreamer) Recv() (*pb.AudioData, error) {
+	p, err := s.session.ReadAudio()
+	if err != nil {
+		// The session is closed when either end hangs up
+		return nil, io.EOF
+	}
+	return &pb.AudioData{Data: rtp.DecodePCMU(p.Payload)}, nil
+}
@@ -0,0 +1,346 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+const (
+	// How long to wait for the other end of a call to take a transfer
+	transferTimeout = 5 * time.Second
+	// How long a replace token may be used for, long enough to dial the call that presents it
+	replaceTokenLifetime = 30 * time.Second
+)
+
+// Transfer asks the other end of a call to call another station, then hangs up
+func (callManager *grpcCallManager) Transfer(id call.CallId, to string) error {
+	c, err := callManager.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := callManager.transferable(c); err != nil {
+		return err
+	}
+	if c.Peer == to || to == callManager.station.Name {
+		return fmt.Errorf("can't transfer a call from %v to %v", c.Peer, to)
+	}
+	log.Printf("Transferring call from %v to %v\n", c.Peer, to)
+	if err := callManager.sendTransfer(c.Peer, to, ""); err != nil {
+		return err
+	}
+	c.Hangup()
+	return nil
+}
+
+// CompleteTransfer asks the other end of a call to call the other end of
+// consult, which answers in place of its call with this station. Both calls
+// end once they're connected
+func (callManager *grpcCallManager) CompleteTransfer(id call.CallId, consult call.CallId) error {
+	c, err := callManager.Get(id)
+	if err != nil {
+		return err
+	}
+	target, err := callManager.Get(consult)
+	if err != nil {
+		return err
+	}
+	if c == target || c.Peer == target.Peer {
+		return errors.New("can't transfer a call to itself")
+	}
+	if err := callManager.transferable(c); err != nil {
+		return err
+	}
+	if err := callManager.transferable(target); err != nil {
+		return err
+	}
+	log.Printf("Transferring call from %v to %v\n", c.Peer, target.Peer)
+	token, err := callManager.allowReplace(target.Peer)
+	if err != nil {
+		return err
+	}
+	return callManager.sendTransfer(c.Peer, target.Peer, token)
+}
+
+// AddParticipant moves a call to the hub, where another station can join
+// it. The stations already in the call each give this one a token, so that
+// they answer the new call, and leave the old one
+func (callManager *grpcCallManager) AddParticipant(id call.CallId, to string) error {
+	c, err := callManager.Get(id)
+	if err != nil {
+		return err
+	}
+	if !c.Connected() {
+		return errors.New("call isn't connected")
+	}
+	if !callManager.hub.isRegistered() {
+		return errors.New("adding a station to a call needs a hub")
+	}
+	if strings.HasPrefix(callManager.station.Lookup(to), "sip:") {
+		return fmt.Errorf("can't add SIP phone %v to a call", to)
+	}
+	if c.Includes(to) || to == callManager.station.Name {
+		return fmt.Errorf("%v is already in the call", to)
+	}
+	c.Lock()
+	peers := append([]string(nil), c.Participants...)
+	c.Unlock()
+	if len(peers) == 0 {
+		peers = strings.Split(c.Peer, ",")
+	}
+	tokens := make(map[string]string)
+	for _, peer := range peers {
+		token, err := callManager.allowReplace(peer)
+		if err != nil {
+			return err
+		}
+		tokens[peer] = token
+	}
+	log.Printf("Adding %v to the call with %v\n", to, strings.Join(peers, ","))
+	go callManager.hub.call(callManager, append(peers, to), c.Urgent, tokens)
+	return nil
+}
+
+// transferable returns why a call can't be transferred, if it can't. Only
+// connected calls with another station, rather than through the hub or with
+// a SIP phone, can be
+func (callManager *grpcCallManager) transferable(c *call.Call) error {
+	switch {
+	case c.CurrentStatus()&(call.StatusActive|call.StatusHeld) == 0:
+		return fmt.Errorf("call with %v isn't connected", c.Peer)
+	case c.Peer == "" || strings.Contains(c.Peer, ","):
+		return errors.New("call isn't with a single station")
+	case callManager.station.Hub != "" && (c.To == callManager.station.Hub || c.From == callManager.station.Hub):
+		return errors.New("calls through the hub can't be transferred")
+	case strings.HasPrefix(callManager.station.Lookup(c.Peer), "sip:"):
+		return fmt.Errorf("can't transfer a call with SIP phone %v", c.Peer)
+	}
+	return nil
+}
+
+// sendTransfer asks a station this one is in a call with to call target
+// token, if set, is from target, and lets the call replace target's call with this station
+func (callManager *grpcCallManager) sendTransfer(name string, target string, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	conn, err := callManager.dialStation(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := &pb.TransferRequest{Station: callManager.station.Name, Target: target, Replaces: token != "", Token: token}
+	if _, err := pb.NewIntercomClient(conn).Transfer(ctx, req); err != nil {
+		return fmt.Errorf("%v didn't take the transfer: %w", name, err)
+	}
+	return nil
+}
+
+// allowReplace asks a station this one is in a call with for a token, which
+// lets another station's call take over that call
+func (callManager *grpcCallManager) allowReplace(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	conn, err := callManager.dialStation(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := pb.NewIntercomClient(conn).AllowReplace(ctx, &pb.AllowReplaceRequest{Station: callManager.station.Name})
+	if err != nil {
+		return "", fmt.Errorf("%v didn't allow the transfer: %w", name, err)
+	}
+	return reply.Token, nil
+}
+
+func (callManager *grpcCallManager) dialStation(ctx context.Context, name string) (*grpc.ClientConn, error) {
+	address := stationAddress(callManager.station.Lookup(name))
+	conn, err := grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial %v: %w", name, err)
+	}
+	return conn, nil
+}
+
+// callWith returns the connected call that the station is in, if any
+func (callManager *grpcCallManager) callWith(name string) *call.Call {
+	for _, c := range callManager.Calls() {
+		if c.CurrentStatus()&(call.StatusActive|call.StatusHeld) != 0 && c.Includes(name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// replaced returns the call that an incoming call takes over, if any. The
+// call, or the hub's invitation, must bring a token this station gave out for it
+func (callManager *grpcCallManager) replaced(c *call.Call) *call.Call {
+	if c.Replaces == "" {
+		return nil
+	}
+	if !callManager.replaceTokens.redeem(c.ReplacesToken, c.Replaces) {
+		log.Printf("Call from %v can't replace the call with %v without a valid token\n", c.Peer, c.Replaces)
+		return nil
+	}
+	return callManager.callWith(c.Replaces)
+}
+
+// callAddress returns the address of the other end of a direct call
+func callAddress(c *call.Call) string {
+	if c.From == "self" {
+		return c.To
+	}
+	return c.From
+}
+
+// replaceToken lets a call take over the call with station, until expires
+type replaceToken struct {
+	station string
+	expires time.Time
+}
+
+// replaceTokens are the tokens given out for attended transfers. Each can be used once
+type replaceTokens struct {
+	sync.Mutex
+	tokens map[string]replaceToken
+}
+
+// issue returns a new token for replacing the call with station
+func (t *replaceTokens) issue(station string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	t.Lock()
+	defer t.Unlock()
+	if t.tokens == nil {
+		t.tokens = make(map[string]replaceToken)
+	}
+	now := time.Now()
+	for k, v := range t.tokens {
+		if now.After(v.expires) {
+			delete(t.tokens, k)
+		}
+	}
+	t.tokens[token] = replaceToken{station: station, expires: now.Add(replaceTokenLifetime)}
+	return token, nil
+}
+
+// redeem returns whether token was given out for replacing the call with
+// station, and hasn't expired. It can't be used again either way
+func (t *replaceTokens) redeem(token string, station string) bool {
+	if token == "" {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	v, ok := t.tokens[token]
+	delete(t.tokens, token)
+	return ok && v.station == station && time.Now().Before(v.expires)
+}
+
+// Transfer calls the target in place of the station that sent the transfer
+// For attended transfers, the call with the sender is hung up once the
+// target answers. Otherwise the sender hangs up
+func (s *Server) Transfer(ctx context.Context, req *pb.TransferRequest) (*pb.TransferReply, error) {
+	callManager := s.station.CallManager.(*grpcCallManager)
+	c, err := s.transferringCall(ctx, req.Station)
+	if err != nil {
+		return nil, err
+	}
+	if req.Target == "" || req.Target == s.station.Name || req.Target == req.Station || !isKnown(s.station, req.Target) {
+		return nil, status.Error(codes.InvalidArgument, "invalid transfer target")
+	}
+	if req.Replaces && req.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "attended transfer without a token")
+	}
+	log.Printf("%v transferred the call to %v\n", req.Station, req.Target)
+	go callManager.outgoingCall(req.Target, c.Urgent, func(next *call.Call) bool {
+		next.Doorbell = c.Doorbell
+		if req.Replaces {
+			next.Replaces = req.Station
+			next.ReplacesToken = req.Token
+			next.OnAnswer(func(*call.Call) {
+				c.Hangup()
+			})
+		}
+		return true
+	})
+	return &pb.TransferReply{}, nil
+}
+
+// AllowReplace gives a station this one is in a call with a token, which
+// lets a call from the station it transfers the call to, or a call through
+// the hub it moves the call to, take over
+func (s *Server) AllowReplace(ctx context.Context, req *pb.AllowReplaceRequest) (*pb.AllowReplaceReply, error) {
+	callManager := s.station.CallManager.(*grpcCallManager)
+	if _, err := s.replaceableCall(ctx, req.Station); err != nil {
+		return nil, err
+	}
+	token, err := callManager.replaceTokens.issue(req.Station)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Printf("Allowed %v to transfer its call\n", req.Station)
+	return &pb.AllowReplaceReply{Token: token}, nil
+}
+
+// transferringCall returns the direct call with a station that asks to
+// transfer it, as long as the request comes from the other end of that call
+func (s *Server) transferringCall(ctx context.Context, name string) (*call.Call, error) {
+	callManager := s.station.CallManager.(*grpcCallManager)
+	c := callManager.callWith(name)
+	if c == nil {
+		return nil, status.Error(codes.NotFound, "not in a call with "+name)
+	}
+	if err := callManager.transferable(c); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if !peerMatches(ctx, callAddress(c)) {
+		log.Printf("Refused transfer from %v, from another address\n", name)
+		return nil, status.Error(codes.PermissionDenied, "not calling from the address of the call")
+	}
+	return c, nil
+}
+
+// replaceableCall is like transferringCall, but includes calls through the
+// hub, as the stations in them move to a new call on the hub to add another.
+// Those calls have the hub's address, so the request must come from the
+// station's directory address instead
+func (s *Server) replaceableCall(ctx context.Context, name string) (*call.Call, error) {
+	callManager := s.station.CallManager.(*grpcCallManager)
+	c := callManager.callWith(name)
+	hub := s.station.Hub
+	if c == nil || hub == "" || (c.From != hub && c.To != hub) {
+		return s.transferringCall(ctx, name)
+	}
+	if !peerMatches(ctx, s.station.Lookup(name)) {
+		log.Printf("Refused replace token for %v, from another address\n", name)
+		return nil, status.Error(codes.PermissionDenied, "not calling from the address of the station")
+	}
+	return c, nil
+}
+
+// isKnown returns whether name is a station calls can be transferred to
+func isKnown(intercom *station.Station, name string) bool {
+	for _, known := range knownStations(intercom) {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,418 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// fakeStation is another station, or a hub, on a local port. It records
+// what it's asked, and refuses calls before they connect, so that no audio
+// devices are used
+type fakeStation struct {
+	pb.UnimplementedIntercomServer
+	pb.UnimplementedHubServer
+	sync.Mutex
+	address   string
+	token     string
+	transfers []*pb.TransferRequest
+	allowed   []*pb.AllowReplaceRequest
+	// called gets the headers of each DuplexCall
+	called chan metadata.MD
+}
+
+func newFakeStation(t *testing.T) *fakeStation {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeStation{address: lis.Addr().String(), called: make(chan metadata.MD, 4)}
+	s := grpc.NewServer()
+	pb.RegisterIntercomServer(s, f)
+	pb.RegisterHubServer(s, f)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return f
+}
+
+func (f *fakeStation) Transfer(ctx context.Context, req *pb.TransferRequest) (*pb.TransferReply, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.transfers = append(f.transfers, req)
+	return &pb.TransferReply{}, nil
+}
+
+func (f *fakeStation) AllowReplace(ctx context.Context, req *pb.AllowReplaceRequest) (*pb.AllowReplaceReply, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.allowed = append(f.allowed, req)
+	return &pb.AllowReplaceReply{Token: f.token}, nil
+}
+
+func (f *fakeStation) DuplexCall(stream pb.Intercom_DuplexCallServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	f.called <- md
+	return status.Error(codes.PermissionDenied, "fake station")
+}
+
+func (f *fakeStation) Register(req *pb.Registration, stream pb.Hub_RegisterServer) error {
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// waitForCall returns the headers of the next call to the fake station
+func (f *fakeStation) waitForCall(t *testing.T) metadata.MD {
+	t.Helper()
+	select {
+	case md := <-f.called:
+		return md
+	case <-time.After(5 * time.Second):
+		t.Fatal("no call")
+	}
+	return nil
+}
+
+// newTestStation creates a station set up with cfg, with its state kept in a
+// temporary directory, the control API on a local port and quiet outputs
+func newTestStation(t *testing.T, name string, cfg config.Config) *station.Station {
+	t.Helper()
+	dir := t.TempDir()
+	cfg.Station = config.StationConfig{
+		Name:        name,
+		StateFile:   filepath.Join(dir, "state.json"),
+		HistoryFile: filepath.Join(dir, "history.jsonl"),
+	}
+	cfg.Media.Transport = "grpc"
+	cfg.Features.Inputs = []string{"control"}
+	cfg.Features.ControlAddress = "127.0.0.1:0"
+	cfg.Features.Outputs = []string{"ring"}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := station.New(ctx, &cfg, NewCallManager)
+	s.Outputs = &quietOutputs{ringing: make(chan bool, 1)}
+	return s
+}
+
+// quietOutputs stand in for the ringer, so tests don't make any sound
+type quietOutputs struct {
+	// ringing gets whether it's a waiting call each time the station starts ringing
+	ringing chan bool
+}
+
+func (o *quietOutputs) UpdateStatus(status *station.Status) {
+	if status.Has(station.StatusRinging) {
+		select {
+		case o.ringing <- status.Has(station.StatusCallWaiting):
+		default:
+		}
+	}
+}
+
+func (o *quietOutputs) Close() {}
+
+// connectedCall adds a call to the station's call list, as if it had been
+// answered, and returns a channel that's closed when it's hung up
+func connectedCall(s *station.Station, peer string, to string, from string) (*call.Call, <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := call.New(call.NewCallId(), to, from, cancel)
+	c.Peer = peer
+	c.SetStatus(call.StatusActive)
+	s.CallManager.(*grpcCallManager).addCall(c)
+	return c, ctx.Done()
+}
+
+func hungUp(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// directory returns the config for a directory with entries, e.g. "hall=192.168.0.11"
+func directory(entries ...string) config.PeersConfig {
+	d := make(map[string]string)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		d[parts[0]] = parts[1]
+	}
+	return config.PeersConfig{Directory: d}
+}
+
+func TestBlindTransfer(t *testing.T) {
+	hall, garage := newFakeStation(t), newFakeStation(t)
+
+	// The kitchen hands its call with the hall over to the garage
+	kitchen := newTestStation(t, "kitchen", config.Config{Peers: directory("hall="+hall.address, "garage="+garage.address)})
+	c, done := connectedCall(kitchen, "hall", hall.address, "self")
+	if err := kitchen.CallManager.Transfer(c.Id, "garage"); err != nil {
+		t.Fatal(err)
+	}
+	want := []*pb.TransferRequest{{Station: "kitchen", Target: "garage"}}
+	if len(hall.transfers) != 1 || hall.transfers[0].String() != want[0].String() {
+		t.Errorf("hall was sent %v, want %v", hall.transfers, want)
+	}
+	if !hungUp(done) {
+		t.Error("kitchen didn't leave the call")
+	}
+	if err := kitchen.CallManager.Transfer(c.Id, "hall"); err == nil {
+		t.Error("transferred a call to the station it's with")
+	}
+
+	// The hall takes the transfer, but only from the kitchen's end of the call
+	hallStation := newTestStation(t, "hall", config.Config{Peers: directory("kitchen=192.168.0.10", "garage="+garage.address)})
+	s := &Server{station: hallStation}
+	connectedCall(hallStation, "kitchen", "hall", "192.168.0.10:41000")
+	tests := []struct {
+		name string
+		from string
+		req  *pb.TransferRequest
+		code codes.Code
+	}{
+		{"another address", "192.168.0.66", &pb.TransferRequest{Station: "kitchen", Target: "garage"}, codes.PermissionDenied},
+		{"not in a call", "192.168.0.10", &pb.TransferRequest{Station: "office", Target: "garage"}, codes.NotFound},
+		{"unknown target", "192.168.0.10", &pb.TransferRequest{Station: "kitchen", Target: "10.1.1.1"}, codes.InvalidArgument},
+		{"back to the sender", "192.168.0.10", &pb.TransferRequest{Station: "kitchen", Target: "kitchen"}, codes.InvalidArgument},
+		{"replaces without a token", "192.168.0.10", &pb.TransferRequest{Station: "kitchen", Target: "garage", Replaces: true}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		if _, err := s.Transfer(fromAddress(tt.from), tt.req); status.Code(err) != tt.code {
+			t.Errorf("%v: got error %v, want %v", tt.name, err, tt.code)
+		}
+	}
+	select {
+	case md := <-garage.called:
+		t.Fatalf("refused transfer called the garage with %v", md)
+	default:
+	}
+	if _, err := s.Transfer(fromAddress("192.168.0.10"), &pb.TransferRequest{Station: "kitchen", Target: "garage"}); err != nil {
+		t.Fatal(err)
+	}
+	md := garage.waitForCall(t)
+	if got := md.Get(stationHeader); !reflect.DeepEqual(got, []string{"hall"}) {
+		t.Errorf("garage was called by %v", got)
+	}
+	if got := md.Get(replacesHeader); len(got) > 0 {
+		t.Errorf("blind transfer replaces %v", got)
+	}
+}
+
+func TestAttendedTransfer(t *testing.T) {
+	hall, garage := newFakeStation(t), newFakeStation(t)
+	garage.token = "secret"
+
+	// The kitchen asks the garage, which it's talking to, for a token, then
+	// gives it to the hall
+	kitchen := newTestStation(t, "kitchen", config.Config{Peers: directory("hall="+hall.address, "garage="+garage.address)})
+	hallCall, _ := connectedCall(kitchen, "hall", hall.address, "self")
+	garageCall, _ := connectedCall(kitchen, "garage", garage.address, "self")
+	if err := kitchen.CallManager.CompleteTransfer(hallCall.Id, garageCall.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(garage.allowed) != 1 || garage.allowed[0].Station != "kitchen" {
+		t.Errorf("garage was asked for a token by %v", garage.allowed)
+	}
+	want := &pb.TransferRequest{Station: "kitchen", Target: "garage", Replaces: true, Token: "secret"}
+	if len(hall.transfers) != 1 || hall.transfers[0].String() != want.String() {
+		t.Errorf("hall was sent %v, want %v", hall.transfers, want)
+	}
+
+	// The hall calls the garage with the token
+	hallStation := newTestStation(t, "hall", config.Config{Peers: directory("kitchen=192.168.0.10", "garage="+garage.address)})
+	connectedCall(hallStation, "kitchen", "hall", "192.168.0.10:41000")
+	s := &Server{station: hallStation}
+	if _, err := s.Transfer(fromAddress("192.168.0.10"), want); err != nil {
+		t.Fatal(err)
+	}
+	md := garage.waitForCall(t)
+	if got := md.Get(replacesHeader); !reflect.DeepEqual(got, []string{"kitchen"}) {
+		t.Errorf("call replaces %v, want kitchen", got)
+	}
+	if got := md.Get(replaceTokenHeader); !reflect.DeepEqual(got, []string{"secret"}) {
+		t.Errorf("call has token %v", got)
+	}
+}
+
+func TestReplaceToken(t *testing.T) {
+	garage := newTestStation(t, "garage", config.Config{Peers: directory("kitchen=192.168.0.10", "hall=192.168.0.11")})
+	callManager := garage.CallManager.(*grpcCallManager)
+	kitchenCall, done := connectedCall(garage, "kitchen", "garage", "192.168.0.10:41000")
+	s := &Server{station: garage}
+
+	if _, err := s.AllowReplace(fromAddress("192.168.0.66"), &pb.AllowReplaceRequest{Station: "kitchen"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got error %v from another address, want PermissionDenied", err)
+	}
+	if _, err := s.AllowReplace(fromAddress("192.168.0.11"), &pb.AllowReplaceRequest{Station: "hall"}); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v for a station not in a call, want NotFound", err)
+	}
+	reply, err := s.AllowReplace(fromAddress("192.168.0.10"), &pb.AllowReplaceRequest{Station: "kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replacing := func(token string) *call.Call {
+		c := call.New(call.NewCallId(), "garage", "192.168.0.11:42000", func() {})
+		c.Peer = "hall"
+		c.Replaces = "kitchen"
+		c.ReplacesToken = token
+		return c
+	}
+	for _, token := range []string{"", "forged"} {
+		if callManager.replaced(replacing(token)) != nil {
+			t.Errorf("token %q replaced the call", token)
+		}
+	}
+	if got := callManager.replaced(replacing(reply.Token)); got != kitchenCall {
+		t.Errorf("token replaced %v, want the call with the kitchen", got)
+	}
+	if callManager.replaced(replacing(reply.Token)) != nil {
+		t.Error("token was used twice")
+	}
+	if hungUp(done) {
+		t.Error("call was hung up before the new one was answered")
+	}
+
+	// Tokens are for the call with one station
+	reply, err = s.AllowReplace(fromAddress("192.168.0.10"), &pb.AllowReplaceRequest{Station: "kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := replacing(reply.Token)
+	c.Replaces = "hall"
+	if callManager.replaced(c) != nil {
+		t.Error("token replaced the call with another station")
+	}
+}
+
+func TestRejectedCallerCantReplace(t *testing.T) {
+	garage := newTestStation(t, "garage", config.Config{
+		Peers:    directory("kitchen=192.168.0.10", "hall=192.168.0.11"),
+		Policies: config.PoliciesConfig{Callers: map[string]string{"hall": "reject"}},
+	})
+	callManager := garage.CallManager.(*grpcCallManager)
+	_, done := connectedCall(garage, "kitchen", "garage", "192.168.0.10:41000")
+	token, err := callManager.replaceTokens.issue("kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := call.New(call.NewCallId(), "garage", "192.168.0.11:42000", func() {})
+	c.Peer = "hall"
+	c.Replaces = "kitchen"
+	c.ReplacesToken = token
+	s := &Server{station: garage}
+	if err := s.incomingCall(fromAddress("192.168.0.11"), c, nil, nil); err != nil {
+		t.Errorf("rejected call ended with %v", err)
+	}
+	if hungUp(done) {
+		t.Error("rejected call hung up the call it would have replaced")
+	}
+	if !callManager.replaceTokens.redeem(token, "kitchen") {
+		t.Error("rejected call used up the token")
+	}
+}
+
+func TestAddParticipant(t *testing.T) {
+	hub := newFakeStation(t)
+	hall := newFakeStation(t)
+	hall.token = "secret"
+	peers := directory("hall="+hall.address, "garage=192.168.0.12")
+	peers.Hub = hub.address
+	kitchen := newTestStation(t, "kitchen", config.Config{Peers: peers})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := StartHubClient(ctx, kitchen)
+	defer h.Close()
+	for deadline := time.Now().Add(5 * time.Second); !h.isRegistered(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not registered with the hub")
+		}
+	}
+
+	// The kitchen gets a token from the hall, moves its call with the hall
+	// to the hub, and invites the garage
+	c, _ := connectedCall(kitchen, "hall", hall.address, "self")
+	if err := kitchen.CallManager.AddParticipant(c.Id, "hall"); err == nil {
+		t.Error("added a station that's already in the call")
+	}
+	if err := kitchen.CallManager.AddParticipant(c.Id, "garage"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hall.allowed) != 1 || hall.allowed[0].Station != "kitchen" {
+		t.Errorf("hall was asked for a token by %v", hall.allowed)
+	}
+	md := hub.waitForCall(t)
+	if got := getTargets(md.Get(hubTargetsHeader)); !reflect.DeepEqual(got, []string{"hall", "garage"}) {
+		t.Errorf("hub was asked to call %v", got)
+	}
+	if got := md.Get(replacesHeader); !reflect.DeepEqual(got, []string{"kitchen"}) {
+		t.Errorf("hub call replaces %v, want kitchen", got)
+	}
+	if got := md.Get(hubReplaceTokensHeader); !reflect.DeepEqual(got, []string{"hall=secret"}) {
+		t.Errorf("hub call sent tokens %v, want the hall's", got)
+	}
+}
+
+func TestHubInvitationReplaces(t *testing.T) {
+	hub := newFakeStation(t)
+	peers := directory("kitchen=192.168.0.10")
+	peers.Hub = hub.address
+	hall := newTestStation(t, "hall", config.Config{Peers: peers})
+	callManager := hall.CallManager.(*grpcCallManager)
+	kitchenCall, _ := connectedCall(hall, "kitchen", "hall", "192.168.0.10:41000")
+	s := &Server{station: hall}
+	reply, err := s.AllowReplace(fromAddress("192.168.0.10"), &pb.AllowReplaceRequest{Station: "kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invitations from the hub need a token like any other call
+	invitation := func(token string) *call.Call {
+		inv := call.New(call.NewCallId(), "hall", hub.address, func() {})
+		inv.Peer = "kitchen"
+		inv.Replaces = "kitchen"
+		inv.ReplacesToken = token
+		return inv
+	}
+	for _, token := range []string{"", "forged"} {
+		if callManager.replaced(invitation(token)) != nil {
+			t.Errorf("invitation with token %q replaced the call", token)
+		}
+	}
+	if got := callManager.replaced(invitation(reply.Token)); got != kitchenCall {
+		t.Errorf("invitation replaced %v, want the call with the kitchen", got)
+	}
+
+	// Calls through the hub get tokens too, for requests from the station's address
+	kitchenCall.Hangup()
+	hubCall, _ := connectedCall(hall, "kitchen", "hall", hub.address)
+	if _, err := s.AllowReplace(fromAddress("192.168.0.66"), &pb.AllowReplaceRequest{Station: "kitchen"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got error %v from another address, want PermissionDenied", err)
+	}
+	reply, err = s.AllowReplace(fromAddress("192.168.0.10"), &pb.AllowReplaceRequest{Station: "kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := callManager.replaced(invitation(reply.Token)); got != hubCall {
+		t.Errorf("invitation replaced %v, want the call with the kitchen through the hub", got)
+	}
+}
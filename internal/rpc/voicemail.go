@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/rpc/pb"
+	"github.com/figadore/go-intercom/internal/station"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// voicemail answers the call without ringing, beeps, and records what the
+// caller says until they hang up, the call is hung up here, or the time
+// limit is reached. The call shows in the call list while it's recorded
+func (s *Server) voicemail(ctx context.Context, c *call.Call, stream streamer) error {
+	log.Println("Sending call to voicemail")
+	callManager := s.station.CallManager.(*grpcCallManager)
+	callManager.addCall(c)
+	defer callManager.station.UpdateStatus()
+	defer callManager.removeCall(c)
+	errCh := make(chan error, 1)
+	first, ok := initializeConnection(ctx, stream.Send, stream.Recv, errCh, false, s.station.WireRate())
+	if !ok {
+		return errors.New("voicemail did not initialize")
+	}
+	// The message is recorded at the rate the caller sends
+	c.Lock()
+	c.SampleRate = station.NegotiateRate(s.station.WireRate(), int(first.SampleRate))
+	c.Unlock()
+	vm, err := s.station.RecordVoicemail(c)
+	if err != nil {
+		log.Println("Unable to record voicemail:", err)
+		return err
+	}
+	defer vm.Close()
+	c.SetStatus(call.StatusActive)
+	// Let the caller know when to start talking
+	if err := stream.Send(&pb.AudioData{Data: beep(time.Second/2, c.SampleRate)}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(vm.MaxDuration))
+	defer cancel()
+	// Recv doesn't take a context, so it runs on its own until the stream ends,
+	// which is once this returns
+	audioCh := make(chan *pb.AudioData)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case audioCh <- in:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case in := <-audioCh:
+			if err := vm.Write(in.Data); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if err == io.EOF {
+				log.Println("voicemail: caller hung up")
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Println("voicemail: time limit reached")
+			} else {
+				log.Println("voicemail: hung up")
+			}
+			return nil
+		}
+	}
+}
+
+// beep generates a 1kHz tone at rate
+func beep(d time.Duration, rate int) []float32 {
+	data := make([]float32, int(d.Seconds()*float64(rate)))
+	for i := range data {
+		data[i] = 0.5 * float32(math.Sin(2*math.Pi*1000*float64(i)/float64(rate)))
+	}
+	return data
+}
@@ -0,0 +1,342 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+// Dialog is an established call, or one that is being answered
+type Dialog struct {
+	sync.Mutex
+	ua     *UserAgent
+	callID string
+	// local and remote are the From and To header values from this end's point of view, with tags
+	local, remote  string
+	remoteTarget   string
+	remoteAddr     *net.UDPAddr
+	localMediaPort int
+	// RemoteHost and RemotePort are where to send audio
+	RemoteHost string
+	RemotePort int
+	// ackMsg acknowledges the 200 OK of an outgoing call, in case it is retransmitted
+	ackMsg  *Message
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// Done is closed when the call ends, from either end
+func (d *Dialog) Done() <-chan struct{} {
+	return d.done
+}
+
+// RemoteUser is the user part of the other end's address, e.g. an extension number
+func (d *Dialog) RemoteUser() string {
+	return URIUser(addressURI(d.remote))
+}
+
+func (d *Dialog) end() {
+	d.endOnce.Do(func() {
+		d.ua.removeDialog(d)
+		close(d.done)
+	})
+}
+
+// targetAddr is where in-dialog requests are sent
+func (d *Dialog) targetAddr() *net.UDPAddr {
+	if d.remoteTarget != "" {
+		if addr, err := net.ResolveUDPAddr("udp", uriHostPort(d.remoteTarget)); err == nil {
+			return addr
+		}
+	}
+	return d.remoteAddr
+}
+
+func (d *Dialog) ack() {
+	d.Lock()
+	ack := d.ackMsg
+	d.Unlock()
+	if ack != nil {
+		if err := d.ua.send(ack, d.targetAddr()); err != nil {
+			log.Println("SIP: error sending ACK:", err)
+		}
+	}
+}
+
+// Hangup sends BYE, unless the call has already ended
+func (d *Dialog) Hangup() error {
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	defer d.end()
+	target := d.remoteTarget
+	if target == "" {
+		target = addressURI(d.remote)
+	}
+	req := d.ua.newRequest("BYE", target, d.local, d.remote, d.callID, d.ua.nextCSeq())
+	ctx, cancel := context.WithTimeout(context.Background(), transactionTimeout)
+	defer cancel()
+	resp, err := d.ua.transaction(ctx, req, d.targetAddr(), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sip: BYE failed: %v", resp)
+	}
+	return nil
+}
+
+// IncomingCall is an INVITE waiting to be answered or rejected
+type IncomingCall struct {
+	sync.Mutex
+	Dialog       *Dialog
+	invite       *Message
+	from         *net.UDPAddr
+	lastResponse *Message
+	finished     bool
+	ackCh        chan struct{}
+	ackOnce      sync.Once
+	cancelled    chan struct{}
+	cancelOnce   sync.Once
+}
+
+// Caller is the user part of the caller's address, e.g. an extension number
+func (c *IncomingCall) Caller() string {
+	return URIUser(addressURI(c.invite.Get("From")))
+}
+
+// Cancelled is closed if the caller gives up before the call is answered
+func (c *IncomingCall) Cancelled() <-chan struct{} {
+	return c.cancelled
+}
+
+// Ringing tells the caller that the call is ringing
+func (c *IncomingCall) Ringing() {
+	c.Lock()
+	defer c.Unlock()
+	if c.finished {
+		return
+	}
+	resp := response(c.invite, 180, "Ringing")
+	resp.Set("To", c.Dialog.local)
+	resp.Add("Contact", c.Dialog.ua.contact())
+	c.lastResponse = resp
+	c.Dialog.ua.reply(resp, c.from)
+}
+
+// Answer accepts the call, sending audio from the local RTP port
+func (c *IncomingCall) Answer(rtpPort int) error {
+	d := c.Dialog
+	host, port, err := parseSDP(c.invite.Body)
+	if err != nil {
+		c.Reject(488, "Not Acceptable Here")
+		return err
+	}
+	c.Lock()
+	if c.finished {
+		c.Unlock()
+		return fmt.Errorf("sip: call already ended")
+	}
+	d.RemoteHost, d.RemotePort, d.localMediaPort = host, port, rtpPort
+	resp := response(c.invite, 200, "OK")
+	resp.Set("To", d.local)
+	resp.Add("Contact", d.ua.contact())
+	resp.Add("Content-Type", "application/sdp")
+	resp.Body = sdpOffer(d.ua.localHost, rtpPort)
+	c.Unlock()
+	d.ua.addDialog(d)
+	c.respond(resp)
+	return nil
+}
+
+// Reject ends the call without answering, e.g. with 486 Busy Here or 603 Decline
+func (c *IncomingCall) Reject(code int, reason string) {
+	resp := response(c.invite, code, reason)
+	resp.Set("To", c.Dialog.local)
+	c.respond(resp)
+	c.Dialog.end()
+}
+
+// respond sends a final response, and retransmits it until it is acknowledged
+func (c *IncomingCall) respond(resp *Message) {
+	c.Lock()
+	if c.finished {
+		c.Unlock()
+		return
+	}
+	c.finished = true
+	c.lastResponse = resp
+	c.Unlock()
+	ua := c.Dialog.ua
+	ua.reply(resp, c.from)
+	go func() {
+		defer func() {
+			ua.Lock()
+			delete(ua.pending, c.Dialog.callID)
+			ua.Unlock()
+		}()
+		interval := t1
+		timeout := time.After(transactionTimeout)
+		for {
+			select {
+			case <-c.ackCh:
+				return
+			case <-timeout:
+				log.Println("SIP: no ACK received for", resp)
+				if resp.StatusCode/100 == 2 {
+					c.Dialog.end()
+				}
+				return
+			case <-time.After(interval):
+				ua.reply(resp, c.from)
+				if interval *= 2; interval > t2 {
+					interval = t2
+				}
+			}
+		}
+	}()
+}
+
+func (c *IncomingCall) resend() {
+	c.Lock()
+	resp := c.lastResponse
+	c.Unlock()
+	c.Dialog.ua.reply(resp, c.from)
+}
+
+func (c *IncomingCall) acked() {
+	c.ackOnce.Do(func() { close(c.ackCh) })
+}
+
+// cancel handles CANCEL, which only has an effect before the call is answered
+func (c *IncomingCall) cancel() {
+	c.Lock()
+	finished := c.finished
+	c.Unlock()
+	if finished {
+		return
+	}
+	c.Reject(487, "Request Terminated")
+	c.cancelOnce.Do(func() { close(c.cancelled) })
+}
+
+// targetURI turns an extension such as 201 or sip:201 into a URI in the
+// configured domain
+func (ua *UserAgent) targetURI(target string) string {
+	target = strings.TrimPrefix(target, "sip:")
+	if strings.Contains(target, "@") {
+		return "sip:" + target
+	}
+	return fmt.Sprintf("sip:%s@%s", target, ua.config.Domain)
+}
+
+// Invite calls target, an extension or SIP URI, through the server. It
+// returns once the call is answered, and cancels the call if ctx is done first
+func (ua *UserAgent) Invite(ctx context.Context, target string, rtpPort int) (*Dialog, error) {
+	uri := ua.targetURI(target)
+	callID := randomHex(16)
+	from := "<" + ua.aor() + ">;tag=" + randomHex(8)
+	req := ua.newRequest("INVITE", uri, from, "<"+uri+">", callID, ua.nextCSeq())
+	req.Add("Contact", ua.contact())
+	req.Add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+	req.Add("Content-Type", "application/sdp")
+	req.Body = sdpOffer(ua.localHost, rtpPort)
+	resp, err := ua.invite(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 401 || resp.StatusCode == 407 {
+		if !ua.authorize(req, resp) {
+			return nil, fmt.Errorf("sip: unable to authenticate: %v", resp)
+		}
+		ua.retry(req)
+		if resp, err = ua.invite(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("sip: call to %v failed: %v", target, resp)
+	}
+	d := &Dialog{
+		ua:             ua,
+		callID:         callID,
+		local:          from,
+		remote:         resp.Get("To"),
+		remoteTarget:   addressURI(resp.Get("Contact")),
+		remoteAddr:     ua.server,
+		localMediaPort: rtpPort,
+		done:           make(chan struct{}),
+	}
+	cseq, _ := req.CSeq()
+	ack := ua.newRequest("ACK", d.remoteTarget, d.local, d.remote, callID, cseq)
+	if d.remoteTarget == "" {
+		ack.RequestURI = uri
+	}
+	d.ackMsg = ack
+	ua.addDialog(d)
+	d.ack()
+	if d.RemoteHost, d.RemotePort, err = parseSDP(resp.Body); err != nil {
+		_ = d.Hangup()
+		return nil, err
+	}
+	return d, nil
+}
+
+// invite runs an INVITE transaction. Failures are acknowledged here, and if
+// ctx is done before the call is answered, the INVITE is cancelled
+func (ua *UserAgent) invite(ctx context.Context, req *Message) (*Message, error) {
+	resp, err := ua.transaction(ctx, req, ua.server, func(resp *Message) {
+		log.Printf("SIP: %v is %v\n", req.RequestURI, resp)
+	})
+	if err != nil && err == ctx.Err() {
+		ua.cancel(req)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		ua.ackFailure(req, resp)
+	}
+	return resp, nil
+}
+
+// cancel sends CANCEL for an INVITE that has not been answered yet. The
+// 487 response to the INVITE is acknowledged by handleResponse
+func (ua *UserAgent) cancel(invite *Message) {
+	cseq, _ := invite.CSeq()
+	req := newRequest("CANCEL", invite.RequestURI)
+	req.Add("Via", invite.Get("Via"))
+	req.Add("Max-Forwards", "70")
+	req.Add("From", invite.Get("From"))
+	req.Add("To", invite.Get("To"))
+	req.Add("Call-ID", invite.Get("Call-ID"))
+	req.Add("CSeq", strconv.Itoa(cseq)+" CANCEL")
+	ctx, cancel := context.WithTimeout(context.Background(), transactionTimeout)
+	defer cancel()
+	if _, err := ua.transaction(ctx, req, ua.server, nil); err != nil {
+		log.Println("SIP: error cancelling call:", err)
+	}
+}
+
+// ackFailure acknowledges a failure response to an INVITE, using the same branch
+func (ua *UserAgent) ackFailure(invite *Message, resp *Message) {
+	cseq, _ := invite.CSeq()
+	ack := newRequest("ACK", invite.RequestURI)
+	ack.Add("Via", invite.Get("Via"))
+	ack.Add("Max-Forwards", "70")
+	ack.Add("From", invite.Get("From"))
+	ack.Add("To", resp.Get("To"))
+	ack.Add("Call-ID", invite.Get("Call-ID"))
+	ack.Add("CSeq", strconv.Itoa(cseq)+" ACK")
+	if err := ua.send(ack, ua.server); err != nil {
+		log.Println("SIP: error sending ACK:", err)
+	}
+}
@@ -0,0 +1,92 @@
+package sip
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// challenge is a WWW-Authenticate or Proxy-Authenticate header
+type challenge struct {
+	realm, nonce, opaque, algorithm string
+	qopAuth                         bool
+}
+
+func parseChallenge(value string) (challenge, error) {
+	var c challenge
+	if !strings.HasPrefix(strings.ToLower(value), "digest ") {
+		return c, fmt.Errorf("sip: unsupported authentication %q", value)
+	}
+	for _, part := range splitParams(value[len("digest "):]) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "realm":
+			c.realm = val
+		case "nonce":
+			c.nonce = val
+		case "opaque":
+			c.opaque = val
+		case "algorithm":
+			c.algorithm = val
+		case "qop":
+			for _, q := range strings.Split(val, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					c.qopAuth = true
+				}
+			}
+		}
+	}
+	if c.algorithm != "" && !strings.EqualFold(c.algorithm, "MD5") {
+		return c, fmt.Errorf("sip: unsupported digest algorithm %q", c.algorithm)
+	}
+	return c, nil
+}
+
+// splitParams splits on commas that are not inside quotes
+func splitParams(s string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorization answers a digest challenge (RFC 2617)
+func (c challenge) authorization(user, password, method, uri string, nc int, cnonce string) string {
+	ha1 := md5Hex(user + ":" + c.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	var response string
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user, c.realm, c.nonce, uri)
+	if c.qopAuth {
+		count := fmt.Sprintf("%08x", nc)
+		response = md5Hex(ha1 + ":" + c.nonce + ":" + count + ":" + cnonce + ":auth:" + ha2)
+		auth += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, count, cnonce)
+	} else {
+		response = md5Hex(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+	auth += fmt.Sprintf(`, response="%s", algorithm=MD5`, response)
+	if c.opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	return auth
+}
@@ -0,0 +1,84 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		value string
+		want  challenge
+		ok    bool
+	}{
+		{
+			`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			challenge{realm: "testrealm@host.com", nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque: "5ccc069c403ebaf9f0171e9517f40e41", qopAuth: true},
+			true,
+		},
+		{
+			`Digest realm="asterisk",nonce="1a2b",algorithm=MD5`,
+			challenge{realm: "asterisk", nonce: "1a2b", algorithm: "MD5"},
+			true,
+		},
+		{
+			`Digest realm="a, b", nonce="n", qop="auth-int"`,
+			challenge{realm: "a, b", nonce: "n"},
+			true,
+		},
+		{`Digest realm="x", nonce="n", algorithm=SHA-256`, challenge{}, false},
+		{`Basic realm="x"`, challenge{}, false},
+	}
+	for _, tt := range tests {
+		c, err := parseChallenge(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && c != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.value, c, tt.want)
+		}
+	}
+}
+
+// The examples from RFC 2617 section 3.5, and RFC 2069 with its errata
+func TestAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        challenge
+		password string
+		nc       int
+		response string
+		params   []string
+	}{
+		{
+			name:     "qop auth",
+			c:        challenge{realm: "testrealm@host.com", nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque: "5ccc069c403ebaf9f0171e9517f40e41", qopAuth: true},
+			password: "Circle Of Life",
+			nc:       1,
+			response: "6629fae49393a05397450978507c4ef1",
+			params:   []string{`qop=auth`, `nc=00000001`, `cnonce="0a4f113b"`, `opaque="5ccc069c403ebaf9f0171e9517f40e41"`},
+		},
+		{
+			name:     "no qop",
+			c:        challenge{realm: "testrealm@host.com", nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque: "5ccc069c403ebaf9f0171e9517f40e41"},
+			password: "CircleOfLife",
+			nc:       1,
+			response: "1949323746fe6a43ef61f9606e7febea",
+			params:   []string{`opaque="5ccc069c403ebaf9f0171e9517f40e41"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := tt.c.authorization("Mufasa", tt.password, "GET", "/dir/index.html", tt.nc, "0a4f113b")
+			for _, p := range append(tt.params, `response="`+tt.response+`"`, `username="Mufasa"`, `uri="/dir/index.html"`) {
+				if !strings.Contains(auth, p) {
+					t.Errorf("%v is missing %v", auth, p)
+				}
+			}
+			if !tt.c.qopAuth && strings.Contains(auth, "nc=") {
+				t.Errorf("%v has a nonce count without qop", auth)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// Package sip is a minimal SIP user agent (RFC 3261) over UDP, enough to
+// register with a PBX and to place and receive audio calls
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const sipVersion = "SIP/2.0"
+
+// Compact header names (RFC 3261 section 7.3.3)
+var compactHeaders = map[string]string{
+	"v": "Via",
+	"f": "From",
+	"t": "To",
+	"i": "Call-ID",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"k": "Supported",
+}
+
+type header struct {
+	name, value string
+}
+
+// Message is a SIP request or response. Requests have a Method, responses a StatusCode
+type Message struct {
+	Method     string
+	RequestURI string
+	StatusCode int
+	Reason     string
+	headers    []header
+	Body       []byte
+}
+
+func newRequest(method, uri string) *Message {
+	return &Message{Method: method, RequestURI: uri}
+}
+
+// IsRequest returns whether the message is a request rather than a response
+func (m *Message) IsRequest() bool {
+	return m.Method != ""
+}
+
+func canonicalName(name string) string {
+	if long, ok := compactHeaders[strings.ToLower(name)]; ok {
+		return long
+	}
+	return name
+}
+
+// Get returns the first value of the header, or an empty string
+func (m *Message) Get(name string) string {
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+	return ""
+}
+
+// Values returns every value of the header, in order
+func (m *Message) Values(name string) []string {
+	var values []string
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, name) {
+			values = append(values, h.value)
+		}
+	}
+	return values
+}
+
+// Add appends a header value
+func (m *Message) Add(name, value string) {
+	m.headers = append(m.headers, header{name, value})
+}
+
+// Set replaces every value of the header with one value
+func (m *Message) Set(name, value string) {
+	m.Del(name)
+	m.Add(name, value)
+}
+
+func (m *Message) Del(name string) {
+	headers := m.headers[:0]
+	for _, h := range m.headers {
+		if !strings.EqualFold(h.name, name) {
+			headers = append(headers, h)
+		}
+	}
+	m.headers = headers
+}
+
+// CSeq returns the sequence number and method of the CSeq header
+func (m *Message) CSeq() (int, string) {
+	fields := strings.Fields(m.Get("CSeq"))
+	if len(fields) != 2 {
+		return 0, ""
+	}
+	n, _ := strconv.Atoi(fields[0])
+	return n, fields[1]
+}
+
+// Bytes encodes the message, setting Content-Length
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		fmt.Fprintf(&b, "%s %s %s\r\n", m.Method, m.RequestURI, sipVersion)
+	} else {
+		fmt.Fprintf(&b, "%s %d %s\r\n", sipVersion, m.StatusCode, m.Reason)
+	}
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, "Content-Length") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(m.Body))
+	b.Write(m.Body)
+	return b.Bytes()
+}
+
+func (m *Message) String() string {
+	if m.IsRequest() {
+		return m.Method + " " + m.RequestURI
+	}
+	return fmt.Sprintf("%d %s", m.StatusCode, m.Reason)
+}
+
+// Parse decodes a message received over UDP
+func Parse(data []byte) (*Message, error) {
+	head := data
+	var body []byte
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i], data[i+4:]
+	}
+	lines := strings.Split(string(head), "\r\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, errors.New("sip: empty message")
+	}
+	m := &Message{}
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) != 3 {
+		return nil, fmt.Errorf("sip: invalid start line %q", lines[0])
+	}
+	if start[0] == sipVersion {
+		code, err := strconv.Atoi(start[1])
+		if err != nil {
+			return nil, fmt.Errorf("sip: invalid status code %q", start[1])
+		}
+		m.StatusCode = code
+		m.Reason = start[2]
+	} else if start[2] == sipVersion {
+		m.Method = start[0]
+		m.RequestURI = start[1]
+	} else {
+		return nil, fmt.Errorf("sip: invalid start line %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		// Folded continuation lines
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(m.headers) > 0 {
+				m.headers[len(m.headers)-1].value += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("sip: invalid header %q", line)
+		}
+		name := canonicalName(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+		// Via and Contact may hold several comma separated values
+		if strings.EqualFold(name, "Via") {
+			for _, v := range strings.Split(value, ",") {
+				m.Add(name, strings.TrimSpace(v))
+			}
+			continue
+		}
+		m.Add(name, value)
+	}
+	if n, err := strconv.Atoi(m.Get("Content-Length")); err == nil && n < len(body) {
+		body = body[:n]
+	}
+	m.Body = body
+	return m, nil
+}
+
+// param returns a ;name=value parameter from a header value, such as the tag of a From header
+func param(value, name string) string {
+	// Skip anything in angle brackets, which belongs to the URI
+	if i := strings.LastIndex(value, ">"); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, p := range strings.Split(value, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if strings.EqualFold(kv[0], name) {
+			if len(kv) == 2 {
+				return kv[1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// addressURI returns the URI from a name-addr such as "Kitchen" <sip:201@pbx>;tag=1
+func addressURI(value string) string {
+	if i := strings.Index(value, "<"); i >= 0 {
+		if j := strings.Index(value[i:], ">"); j >= 0 {
+			return value[i+1 : i+j]
+		}
+	}
+	if i := strings.Index(value, ";"); i >= 0 {
+		return strings.TrimSpace(value[:i])
+	}
+	return strings.TrimSpace(value)
+}
+
+// URIUser returns the user part of a SIP URI, e.g. 201 for sip:201@pbx.local
+func URIUser(uri string) string {
+	uri = strings.TrimPrefix(strings.TrimPrefix(uri, "sips:"), "sip:")
+	if i := strings.Index(uri, "@"); i >= 0 {
+		return uri[:i]
+	}
+	return ""
+}
+
+// uriHostPort returns the host and port of a SIP URI, defaulting to port 5060
+func uriHostPort(uri string) string {
+	uri = strings.TrimPrefix(strings.TrimPrefix(uri, "sips:"), "sip:")
+	if i := strings.Index(uri, "@"); i >= 0 {
+		uri = uri[i+1:]
+	}
+	if i := strings.IndexAny(uri, ";?>"); i >= 0 {
+		uri = uri[:i]
+	}
+	if !strings.Contains(uri, ":") {
+		uri += ":5060"
+	}
+	return uri
+}
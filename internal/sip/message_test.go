@@ -0,0 +1,151 @@
+package sip
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		method  string
+		code    int
+		headers map[string][]string
+		body    string
+	}{
+		{
+			name:   "request",
+			data:   "INVITE sip:201@pbx.local SIP/2.0\r\nVia: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK1\r\nCall-ID: abc\r\nCSeq: 2 INVITE\r\nContent-Length: 4\r\n\r\nv=0\n",
+			method: "INVITE",
+			headers: map[string][]string{
+				"Via":     {"SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK1"},
+				"Call-ID": {"abc"},
+			},
+			body: "v=0\n",
+		},
+		{
+			name: "response",
+			data: "SIP/2.0 486 Busy Here\r\nCall-ID: abc\r\n\r\n",
+			code: 486,
+			headers: map[string][]string{
+				"Call-ID": {"abc"},
+			},
+		},
+		{
+			name:   "compact headers",
+			data:   "BYE sip:201@pbx.local SIP/2.0\r\nv: SIP/2.0/UDP a;branch=1\r\ni: abc\r\nf: <sip:200@pbx.local>;tag=1\r\nt: <sip:201@pbx.local>\r\nl: 0\r\n\r\n",
+			method: "BYE",
+			headers: map[string][]string{
+				"Via":     {"SIP/2.0/UDP a;branch=1"},
+				"Call-ID": {"abc"},
+				"From":    {"<sip:200@pbx.local>;tag=1"},
+				"To":      {"<sip:201@pbx.local>"},
+			},
+		},
+		{
+			name:   "folded header",
+			data:   "OPTIONS sip:pbx.local SIP/2.0\r\nSubject: one\r\n  two\r\n\r\n",
+			method: "OPTIONS",
+			headers: map[string][]string{
+				"Subject": {"one two"},
+			},
+		},
+		{
+			name: "several vias in one header",
+			data: "SIP/2.0 200 OK\r\nVia: SIP/2.0/UDP a;branch=1, SIP/2.0/UDP b;branch=2\r\nVia: SIP/2.0/UDP c;branch=3\r\n\r\n",
+			code: 200,
+			headers: map[string][]string{
+				"Via": {"SIP/2.0/UDP a;branch=1", "SIP/2.0/UDP b;branch=2", "SIP/2.0/UDP c;branch=3"},
+			},
+		},
+		{
+			name:   "body longer than content length",
+			data:   "MESSAGE sip:201@pbx.local SIP/2.0\r\nContent-Length: 5\r\n\r\nhello, and more",
+			method: "MESSAGE",
+			body:   "hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Method != tt.method || m.StatusCode != tt.code {
+				t.Errorf("got %q %v, want %q %v", m.Method, m.StatusCode, tt.method, tt.code)
+			}
+			for name, want := range tt.headers {
+				if got := m.Values(name); !reflect.DeepEqual(got, want) {
+					t.Errorf("%v: got %q, want %q", name, got, want)
+				}
+			}
+			if string(m.Body) != tt.body {
+				t.Errorf("body is %q, want %q", m.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"INVITE sip:201@pbx.local\r\n\r\n",
+		"SIP/2.0 OK Fine\r\n\r\n",
+		"INVITE sip:201@pbx.local HTTP/1.1\r\n\r\n",
+		"INVITE sip:201@pbx.local SIP/2.0\r\nno colon\r\n\r\n",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("parsed %q", data)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := newRequest("INVITE", "sip:201@pbx.local")
+	m.Add("Via", "SIP/2.0/UDP a;branch=1")
+	m.Add("CSeq", "7 INVITE")
+	m.Add("Content-Length", "99")
+	m.Body = []byte("v=0\r\n")
+	data := m.Bytes()
+	if strings.Count(string(data), "Content-Length") != 1 {
+		t.Errorf("Content-Length should be replaced: %q", data)
+	}
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, method := parsed.CSeq(); n != 7 || method != "INVITE" {
+		t.Errorf("CSeq is %v %v, want 7 INVITE", n, method)
+	}
+	if string(parsed.Body) != "v=0\r\n" {
+		t.Errorf("body is %q", parsed.Body)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	tests := []struct {
+		value, uri, user, hostPort, tag string
+	}{
+		{`"Kitchen" <sip:201@pbx.local>;tag=abc`, "sip:201@pbx.local", "201", "pbx.local:5060", "abc"},
+		{`<sip:202@10.0.0.5:5070;transport=udp>`, "sip:202@10.0.0.5:5070;transport=udp", "202", "10.0.0.5:5070", ""},
+		{`sip:203@pbx.local;tag=x`, "sip:203@pbx.local", "203", "pbx.local:5060", "x"},
+		{`<sips:pbx.local>`, "sips:pbx.local", "", "pbx.local:5060", ""},
+	}
+	for _, tt := range tests {
+		uri := addressURI(tt.value)
+		if uri != tt.uri {
+			t.Errorf("addressURI(%q) = %q, want %q", tt.value, uri, tt.uri)
+		}
+		if got := URIUser(uri); got != tt.user {
+			t.Errorf("URIUser(%q) = %q, want %q", uri, got, tt.user)
+		}
+		if got := uriHostPort(uri); got != tt.hostPort {
+			t.Errorf("uriHostPort(%q) = %q, want %q", uri, got, tt.hostPort)
+		}
+		if got := param(tt.value, "tag"); got != tt.tag {
+			t.Errorf("tag of %q is %q, want %q", tt.value, got, tt.tag)
+		}
+	}
+}
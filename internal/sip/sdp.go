@@ -0,0 +1,63 @@
+package sip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/figadore/go-intercom/pkg/rtp"
+)
+
+// sdpOffer describes this end's audio: G.711 mu-law (PCMU) at 8kHz, which every
+// SIP phone supports, sent to host:port
+func sdpOffer(host string, port int) []byte {
+	id := time.Now().Unix()
+	return []byte(strings.Join([]string{
+		"v=0",
+		fmt.Sprintf("o=intercom %d %d IN IP4 %s", id, id, host),
+		"s=intercom",
+		"c=IN IP4 " + host,
+		"t=0 0",
+		fmt.Sprintf("m=audio %d RTP/AVP %d", port, rtp.PayloadTypePCMU),
+		fmt.Sprintf("a=rtpmap:%d PCMU/8000", rtp.PayloadTypePCMU),
+		"a=ptime:20",
+		"a=sendrecv",
+		"",
+	}, "\r\n"))
+}
+
+// parseSDP returns where the other end wants audio sent, and whether it accepts PCMU
+func parseSDP(body []byte) (host string, port int, err error) {
+	pcmu := false
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "c="):
+			fields := strings.Fields(line[2:])
+			if len(fields) == 3 {
+				host = fields[2]
+			}
+		case strings.HasPrefix(line, "m=audio "):
+			fields := strings.Fields(line[2:])
+			if len(fields) < 4 {
+				return "", 0, fmt.Errorf("sip: invalid media line %q", line)
+			}
+			if port, err = strconv.Atoi(fields[1]); err != nil {
+				return "", 0, fmt.Errorf("sip: invalid media port %q", fields[1])
+			}
+			for _, pt := range fields[3:] {
+				if pt == strconv.Itoa(rtp.PayloadTypePCMU) {
+					pcmu = true
+				}
+			}
+		}
+	}
+	if host == "" || port == 0 {
+		return "", 0, fmt.Errorf("sip: no audio in session description")
+	}
+	if !pcmu {
+		return "", 0, fmt.Errorf("sip: other end does not support PCMU")
+	}
+	return host, port, nil
+}
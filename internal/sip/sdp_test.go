@@ -0,0 +1,65 @@
+package sip
+
+import "testing"
+
+func TestSDPOfferAnswer(t *testing.T) {
+	host, port, err := parseSDP(sdpOffer("10.0.0.2", 40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "10.0.0.2" || port != 40000 {
+		t.Errorf("offer is for %v:%v, want 10.0.0.2:40000", host, port)
+	}
+}
+
+func TestParseSDP(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		host string
+		port int
+		ok   bool
+	}{
+		{
+			name: "pcmu among others",
+			body: "v=0\r\no=- 1 1 IN IP4 10.0.0.5\r\nc=IN IP4 10.0.0.5\r\nm=audio 5004 RTP/AVP 8 0 101\r\na=rtpmap:101 telephone-event/8000\r\n",
+			host: "10.0.0.5",
+			port: 5004,
+			ok:   true,
+		},
+		{
+			name: "bare newlines",
+			body: "v=0\nc=IN IP4 10.0.0.6\nm=audio 6000 RTP/AVP 0\n",
+			host: "10.0.0.6",
+			port: 6000,
+			ok:   true,
+		},
+		{
+			name: "no pcmu",
+			body: "v=0\r\nc=IN IP4 10.0.0.5\r\nm=audio 5004 RTP/AVP 8 9\r\n",
+		},
+		{
+			name: "no connection",
+			body: "v=0\r\nm=audio 5004 RTP/AVP 0\r\n",
+		},
+		{
+			name: "video only",
+			body: "v=0\r\nc=IN IP4 10.0.0.5\r\nm=video 5006 RTP/AVP 96\r\n",
+		},
+		{
+			name: "invalid port",
+			body: "v=0\r\nc=IN IP4 10.0.0.5\r\nm=audio x RTP/AVP 0\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, err := parseSDP([]byte(tt.body))
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("got %v:%v, want %v:%v", host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
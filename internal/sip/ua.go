@@ -0,0 +1,518 @@
+package sip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	// Retransmission timers for UDP (RFC 3261 section 17)
+	t1 = 500 * time.Millisecond
+	t2 = 4 * time.Second
+	// How long a transaction waits for a final response
+	transactionTimeout = 64 * t1
+	registerRetry      = 30 * time.Second
+	maxMessageSize     = 65535
+	userAgentName      = "go-intercom"
+)
+
+var errTimeout = errors.New("sip: transaction timed out")
+
+// Config is how the user agent registers with a PBX. Server is also used as
+// the outbound proxy for calls
+type Config struct {
+	Server   string
+	User     string
+	Password string
+	// Domain defaults to the server's host
+	Domain string
+	// Port is the local UDP port, 5060 by default
+	Port    int
+	Expires time.Duration
+}
+
+// UserAgent registers with a PBX, places calls and receives them
+//
+// Only UDP and PCMU audio are supported. Record-Route is not followed, so
+// in-dialog requests go straight to the other end's Contact address
+type UserAgent struct {
+	sync.Mutex
+	config    Config
+	conn      *net.UDPConn
+	server    *net.UDPAddr
+	localHost string
+	localPort int
+	cseq      int
+	// nonces are the last nonce from each realm, and how often it was used
+	nonces map[string]*nonceCount
+	// Client transactions waiting for responses, by Via branch
+	transactions map[string]chan *Message
+	// Dialogs by Call-ID
+	dialogs map[string]*Dialog
+	// Incoming calls that have not been answered yet, by Call-ID
+	pending   map[string]*IncomingCall
+	incoming  chan *IncomingCall
+	closeOnce sync.Once
+}
+
+// Start opens the local port and starts handling messages. Call Register to
+// register with the server, and Incoming to receive calls
+func Start(config Config) (*UserAgent, error) {
+	server, err := net.ResolveUDPAddr("udp", withDefaultPort(config.Server))
+	if err != nil {
+		return nil, err
+	}
+	if config.Domain == "" {
+		config.Domain, _, _ = net.SplitHostPort(withDefaultPort(config.Server))
+	}
+	if config.Port == 0 {
+		config.Port = 5060
+	}
+	// Find the local address the server can reach us on
+	probe, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return nil, err
+	}
+	localHost := probe.LocalAddr().(*net.UDPAddr).IP.String()
+	probe.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: config.Port})
+	if err != nil {
+		return nil, err
+	}
+	ua := &UserAgent{
+		config:       config,
+		conn:         conn,
+		server:       server,
+		localHost:    localHost,
+		localPort:    conn.LocalAddr().(*net.UDPAddr).Port,
+		cseq:         1,
+		nonces:       make(map[string]*nonceCount),
+		transactions: make(map[string]chan *Message),
+		dialogs:      make(map[string]*Dialog),
+		pending:      make(map[string]*IncomingCall),
+		incoming:     make(chan *IncomingCall, 4),
+	}
+	go ua.readLoop()
+	return ua, nil
+}
+
+func withDefaultPort(hostPort string) string {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return net.JoinHostPort(hostPort, "5060")
+	}
+	return hostPort
+}
+
+// LocalHost is the address other ends should send audio to
+func (ua *UserAgent) LocalHost() string {
+	return ua.localHost
+}
+
+// Incoming receives calls, which must be answered or rejected
+func (ua *UserAgent) Incoming() <-chan *IncomingCall {
+	return ua.incoming
+}
+
+func (ua *UserAgent) aor() string {
+	return fmt.Sprintf("sip:%s@%s", ua.config.User, ua.config.Domain)
+}
+
+func (ua *UserAgent) contact() string {
+	return fmt.Sprintf("<sip:%s@%s>", ua.config.User, net.JoinHostPort(ua.localHost, strconv.Itoa(ua.localPort)))
+}
+
+func (ua *UserAgent) via(branch string) string {
+	return fmt.Sprintf("%s/UDP %s;branch=%s;rport", sipVersion, net.JoinHostPort(ua.localHost, strconv.Itoa(ua.localPort)), branch)
+}
+
+func (ua *UserAgent) nextCSeq() int {
+	ua.Lock()
+	defer ua.Unlock()
+	ua.cseq++
+	return ua.cseq
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newBranch() string {
+	// The magic cookie marks RFC 3261 branches
+	return "z9hG4bK" + randomHex(8)
+}
+
+// newRequest fills in the headers every request needs
+func (ua *UserAgent) newRequest(method, uri, from, to, callID string, cseq int) *Message {
+	req := newRequest(method, uri)
+	req.Add("Via", ua.via(newBranch()))
+	req.Add("Max-Forwards", "70")
+	req.Add("From", from)
+	req.Add("To", to)
+	req.Add("Call-ID", callID)
+	req.Add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	req.Add("User-Agent", userAgentName)
+	return req
+}
+
+func (ua *UserAgent) send(m *Message, addr *net.UDPAddr) error {
+	log.Debugf("SIP: sending %v to %v", m, addr)
+	_, err := ua.conn.WriteToUDP(m.Bytes(), addr)
+	return err
+}
+
+// transaction sends a request and returns its final response, retransmitting
+// until a response arrives. Provisional responses are passed to provisional,
+// which may be nil. An INVITE waits for a final response until ctx is done
+func (ua *UserAgent) transaction(ctx context.Context, req *Message, addr *net.UDPAddr, provisional func(*Message)) (*Message, error) {
+	branch := param(req.Get("Via"), "branch")
+	responses := make(chan *Message, 8)
+	ua.Lock()
+	ua.transactions[branch] = responses
+	ua.Unlock()
+	defer func() {
+		ua.Lock()
+		delete(ua.transactions, branch)
+		ua.Unlock()
+	}()
+	if err := ua.send(req, addr); err != nil {
+		return nil, err
+	}
+	interval := t1
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	timeout := time.After(transactionTimeout)
+	for {
+		select {
+		case resp := <-responses:
+			if resp.StatusCode >= 200 {
+				return resp, nil
+			}
+			if provisional != nil {
+				provisional(resp)
+			}
+			// The other end has the request, so stop retransmitting, and
+			// for INVITE, wait as long as it takes to answer
+			retransmit.Stop()
+			if req.Method == "INVITE" {
+				timeout = nil
+			}
+		case <-retransmit.C:
+			if err := ua.send(req, addr); err != nil {
+				return nil, err
+			}
+			if interval *= 2; interval > t2 {
+				interval = t2
+			}
+			retransmit.Reset(interval)
+		case <-timeout:
+			return nil, errTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// authorize adds credentials for a 401 or 407 challenge, and returns false if
+// the challenge can't be answered
+func (ua *UserAgent) authorize(req *Message, resp *Message) bool {
+	challengeHeader, authHeader := "WWW-Authenticate", "Authorization"
+	if resp.StatusCode == 407 {
+		challengeHeader, authHeader = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	c, err := parseChallenge(resp.Get(challengeHeader))
+	if err != nil {
+		log.Println("SIP:", err)
+		return false
+	}
+	req.Set(authHeader, c.authorization(ua.config.User, ua.config.Password, req.Method, req.RequestURI, ua.nonceCount(c), randomHex(8)))
+	return true
+}
+
+type nonceCount struct {
+	nonce string
+	count int
+}
+
+// nonceCount returns the nc to send with an answer to c, which counts the
+// requests sent with its nonce, starting from 1 for each new nonce
+func (ua *UserAgent) nonceCount(c challenge) int {
+	ua.Lock()
+	defer ua.Unlock()
+	n, ok := ua.nonces[c.realm]
+	if !ok || n.nonce != c.nonce {
+		n = &nonceCount{nonce: c.nonce}
+		ua.nonces[c.realm] = n
+	}
+	n.count++
+	return n.count
+}
+
+// retry prepares a request to be sent again with a new branch and CSeq
+func (ua *UserAgent) retry(req *Message) {
+	_, method := req.CSeq()
+	req.Set("Via", ua.via(newBranch()))
+	req.Set("CSeq", fmt.Sprintf("%d %s", ua.nextCSeq(), method))
+}
+
+// Register keeps this user agent registered until ctx is done, then unregisters
+func (ua *UserAgent) Register(ctx context.Context) {
+	callID := randomHex(16)
+	tag := randomHex(8)
+	for {
+		wait := registerRetry
+		if err := ua.register(ctx, callID, tag, ua.config.Expires); err != nil {
+			log.Println("SIP registration failed:", err)
+		} else {
+			log.Printf("SIP: registered as %v\n", ua.aor())
+			wait = ua.config.Expires / 2
+		}
+		select {
+		case <-ctx.Done():
+			unregisterCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := ua.register(unregisterCtx, callID, tag, 0); err != nil {
+				log.Println("SIP: unable to unregister:", err)
+			}
+			cancel()
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (ua *UserAgent) register(ctx context.Context, callID, tag string, expires time.Duration) error {
+	aor := "<" + ua.aor() + ">"
+	req := ua.newRequest("REGISTER", "sip:"+ua.config.Domain, aor+";tag="+tag, aor, callID, ua.nextCSeq())
+	req.Add("Contact", ua.contact())
+	req.Add("Expires", strconv.Itoa(int(expires.Seconds())))
+	resp, err := ua.transaction(ctx, req, ua.server, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == 401 || resp.StatusCode == 407 {
+		if !ua.authorize(req, resp) {
+			return fmt.Errorf("unable to authenticate: %v", resp)
+		}
+		ua.retry(req)
+		if resp, err = ua.transaction(ctx, req, ua.server, nil); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("registrar responded %v", resp)
+	}
+	return nil
+}
+
+// Close stops handling messages. Calls should be hung up first
+func (ua *UserAgent) Close() {
+	ua.closeOnce.Do(func() {
+		ua.conn.Close()
+	})
+}
+
+func (ua *UserAgent) readLoop() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := ua.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("SIP: stopped receiving:", err)
+			close(ua.incoming)
+			return
+		}
+		// Keep-alives are blank lines
+		if strings.TrimSpace(string(buf[:n])) == "" {
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		m, err := Parse(data)
+		if err != nil {
+			log.Println("SIP: ignoring invalid message:", err)
+			continue
+		}
+		log.Debugf("SIP: received %v from %v", m, from)
+		if m.IsRequest() {
+			ua.handleRequest(m, from)
+		} else {
+			ua.handleResponse(m)
+		}
+	}
+}
+
+func (ua *UserAgent) handleResponse(resp *Message) {
+	branch := param(resp.Get("Via"), "branch")
+	ua.Lock()
+	responses, ok := ua.transactions[branch]
+	ua.Unlock()
+	if !ok {
+		_, method := resp.CSeq()
+		if method != "INVITE" {
+			return
+		}
+		if resp.StatusCode/100 == 2 {
+			// A retransmitted 200 OK means our ACK was lost
+			if d := ua.dialog(resp.Get("Call-ID")); d != nil {
+				d.ack()
+			}
+		} else if resp.StatusCode >= 300 {
+			// E.g. 487 after a CANCEL, which arrives after the transaction has ended
+			invite := newRequest("INVITE", addressURI(resp.Get("To")))
+			invite.Add("Via", resp.Get("Via"))
+			invite.Add("From", resp.Get("From"))
+			invite.Add("Call-ID", resp.Get("Call-ID"))
+			invite.Add("CSeq", resp.Get("CSeq"))
+			ua.ackFailure(invite, resp)
+		}
+		return
+	}
+	select {
+	case responses <- resp:
+	default:
+	}
+}
+
+// response builds a response to a request, as RFC 3261 section 8.2.6 describes
+func response(req *Message, code int, reason string) *Message {
+	resp := &Message{StatusCode: code, Reason: reason}
+	for _, via := range req.Values("Via") {
+		resp.Add("Via", via)
+	}
+	resp.Add("From", req.Get("From"))
+	resp.Add("To", req.Get("To"))
+	resp.Add("Call-ID", req.Get("Call-ID"))
+	resp.Add("CSeq", req.Get("CSeq"))
+	resp.Add("User-Agent", userAgentName)
+	return resp
+}
+
+// reply sends a response back to where the request came from, or to the
+// port given by rport
+func (ua *UserAgent) reply(resp *Message, to *net.UDPAddr) {
+	if err := ua.send(resp, to); err != nil {
+		log.Println("SIP: error sending response:", err)
+	}
+}
+
+func (ua *UserAgent) handleRequest(req *Message, from *net.UDPAddr) {
+	callID := req.Get("Call-ID")
+	switch req.Method {
+	case "INVITE":
+		ua.handleInvite(req, from)
+	case "ACK":
+		ua.Lock()
+		c := ua.pending[callID]
+		ua.Unlock()
+		if c != nil {
+			c.acked()
+		}
+	case "BYE":
+		d := ua.dialog(callID)
+		if d == nil {
+			ua.reply(response(req, 481, "Call/Transaction Does Not Exist"), from)
+			return
+		}
+		ua.reply(response(req, 200, "OK"), from)
+		d.end()
+	case "CANCEL":
+		ua.Lock()
+		c := ua.pending[callID]
+		ua.Unlock()
+		if c == nil {
+			ua.reply(response(req, 481, "Call/Transaction Does Not Exist"), from)
+			return
+		}
+		ua.reply(response(req, 200, "OK"), from)
+		c.cancel()
+	case "OPTIONS":
+		resp := response(req, 200, "OK")
+		resp.Add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+		ua.reply(resp, from)
+	default:
+		resp := response(req, 405, "Method Not Allowed")
+		resp.Add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+		ua.reply(resp, from)
+	}
+}
+
+func (ua *UserAgent) handleInvite(req *Message, from *net.UDPAddr) {
+	callID := req.Get("Call-ID")
+	ua.Lock()
+	c := ua.pending[callID]
+	ua.Unlock()
+	if c != nil {
+		// Retransmission, the other end missed our last response
+		c.resend()
+		return
+	}
+	if d := ua.dialog(callID); d != nil {
+		// A re-INVITE, e.g. the phone putting us on hold. Keep the media as it is
+		resp := response(req, 200, "OK")
+		resp.Set("To", d.local)
+		resp.Add("Contact", ua.contact())
+		resp.Add("Content-Type", "application/sdp")
+		resp.Body = sdpOffer(ua.localHost, d.localMediaPort)
+		ua.reply(resp, from)
+		return
+	}
+	d := &Dialog{
+		ua:           ua,
+		callID:       callID,
+		local:        req.Get("To") + ";tag=" + randomHex(8),
+		remote:       req.Get("From"),
+		remoteTarget: addressURI(req.Get("Contact")),
+		remoteAddr:   from,
+		done:         make(chan struct{}),
+	}
+	c = &IncomingCall{
+		Dialog:    d,
+		invite:    req,
+		from:      from,
+		ackCh:     make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	trying := response(req, 100, "Trying")
+	c.lastResponse = trying
+	ua.Lock()
+	ua.pending[callID] = c
+	ua.Unlock()
+	ua.reply(trying, from)
+	if len(req.Body) == 0 {
+		c.Reject(488, "Not Acceptable Here")
+		return
+	}
+	select {
+	case ua.incoming <- c:
+	default:
+		c.Reject(486, "Busy Here")
+	}
+}
+
+func (ua *UserAgent) dialog(callID string) *Dialog {
+	ua.Lock()
+	defer ua.Unlock()
+	return ua.dialogs[callID]
+}
+
+func (ua *UserAgent) addDialog(d *Dialog) {
+	ua.Lock()
+	defer ua.Unlock()
+	ua.dialogs[d.callID] = d
+}
+
+func (ua *UserAgent) removeDialog(d *Dialog) {
+	ua.Lock()
+	defer ua.Unlock()
+	delete(ua.dialogs, d.callID)
+}
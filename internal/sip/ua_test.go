@@ -0,0 +1,300 @@
+package sip
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePBX is the other end of a user agent's messages, on the loopback interface
+type fakePBX struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newFakePBX(t *testing.T) *fakePBX {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakePBX{t: t, conn: conn}
+}
+
+func (p *fakePBX) addr() string {
+	return p.conn.LocalAddr().String()
+}
+
+// receive returns the next message with the method, or response to it,
+// skipping retransmissions and anything else
+func (p *fakePBX) receive(method string) (*Message, *net.UDPAddr) {
+	p.t.Helper()
+	buf := make([]byte, maxMessageSize)
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, from, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			p.t.Fatalf("waiting for %v: %v", method, err)
+		}
+		m, err := Parse(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if _, cseqMethod := m.CSeq(); m.Method == method || (!m.IsRequest() && cseqMethod == method) {
+			return m, from
+		}
+	}
+}
+
+func (p *fakePBX) send(m *Message, to *net.UDPAddr) {
+	p.t.Helper()
+	if _, err := p.conn.WriteToUDP(m.Bytes(), to); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// startUserAgent starts a user agent for extension 200 registering with the PBX
+func startUserAgent(t *testing.T, pbx *fakePBX) *UserAgent {
+	t.Helper()
+	// Find a free port, as the user agent defaults to 5060
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	ua, err := Start(Config{
+		Server:   pbx.addr(),
+		User:     "200",
+		Password: "secret",
+		Domain:   "pbx.local",
+		Port:     port,
+		Expires:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ua
+}
+
+// checkDigest checks the credentials in an Authorization header, and
+// returns its nonce count
+func checkDigest(t *testing.T, req *Message, header, nonce string) string {
+	t.Helper()
+	value := req.Get(header)
+	fields := make(map[string]string)
+	for _, part := range splitParams(strings.TrimPrefix(value, "Digest ")) {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		fields[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	if fields["nonce"] != nonce || fields["username"] != "200" || fields["uri"] != req.RequestURI {
+		t.Fatalf("wrong credentials: %v", value)
+	}
+	ha1 := md5Hex("200:pbx.local:secret")
+	ha2 := md5Hex(req.Method + ":" + req.RequestURI)
+	want := md5Hex(ha1 + ":" + nonce + ":" + fields["nc"] + ":" + fields["cnonce"] + ":auth:" + ha2)
+	if fields["response"] != want {
+		t.Fatalf("response is %v, want %v", fields["response"], want)
+	}
+	return fields["nc"]
+}
+
+// challengeResponse responds to a request with a 401 or 407 for nonce
+func challengeResponse(req *Message, code int, nonce string) *Message {
+	header, reason := "WWW-Authenticate", "Unauthorized"
+	if code == 407 {
+		header, reason = "Proxy-Authenticate", "Proxy Authentication Required"
+	}
+	resp := response(req, code, reason)
+	resp.Set("To", req.Get("To")+";tag=pbx")
+	resp.Add(header, `Digest realm="pbx.local", nonce="`+nonce+`", qop="auth", algorithm=MD5`)
+	return resp
+}
+
+func TestRegister(t *testing.T) {
+	pbx := newFakePBX(t)
+	defer pbx.conn.Close()
+	ua := startUserAgent(t, pbx)
+	defer ua.Close()
+
+	// Each registration is challenged, and answered with the next nonce count
+	// until the nonce changes
+	for i, tt := range []struct {
+		nonce, nc string
+	}{
+		{"n1", "00000001"},
+		{"n1", "00000002"},
+		{"n2", "00000001"},
+	} {
+		errCh := make(chan error)
+		go func() {
+			errCh <- ua.register(context.Background(), "call", "tag", time.Minute)
+		}()
+		req, from := pbx.receive("REGISTER")
+		if req.Get("Authorization") != "" {
+			t.Fatalf("registration %v: sent credentials before being challenged", i)
+		}
+		if got := req.Get("Contact"); got != ua.contact() {
+			t.Errorf("contact is %v, want %v", got, ua.contact())
+		}
+		pbx.send(challengeResponse(req, 401, tt.nonce), from)
+		req, from = pbx.receive("REGISTER")
+		if nc := checkDigest(t, req, "Authorization", tt.nonce); nc != tt.nc {
+			t.Errorf("registration %v: nonce count is %v, want %v", i, nc, tt.nc)
+		}
+		pbx.send(response(req, 200, "OK"), from)
+		if err := <-errCh; err != nil {
+			t.Fatalf("registration %v: %v", i, err)
+		}
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ua.register(context.Background(), "call", "tag", time.Minute)
+	}()
+	req, from := pbx.receive("REGISTER")
+	pbx.send(response(req, 403, "Forbidden"), from)
+	if err := <-errCh; err == nil {
+		t.Error("registration succeeded after 403 Forbidden")
+	}
+}
+
+func TestInvite(t *testing.T) {
+	pbx := newFakePBX(t)
+	defer pbx.conn.Close()
+	ua := startUserAgent(t, pbx)
+	defer ua.Close()
+
+	type result struct {
+		d   *Dialog
+		err error
+	}
+	resultCh := make(chan result)
+	go func() {
+		d, err := ua.Invite(context.Background(), "201", 40000)
+		resultCh <- result{d, err}
+	}()
+	req, from := pbx.receive("INVITE")
+	if req.RequestURI != "sip:201@pbx.local" {
+		t.Errorf("request URI is %v", req.RequestURI)
+	}
+	pbx.send(challengeResponse(req, 407, "n1"), from)
+	if ack, _ := pbx.receive("ACK"); ack.RequestURI != req.RequestURI {
+		t.Errorf("ACK for 407 went to %v", ack.RequestURI)
+	}
+	req, from = pbx.receive("INVITE")
+	checkDigest(t, req, "Proxy-Authorization", "n1")
+	if host, port, err := parseSDP(req.Body); err != nil || host != "127.0.0.1" || port != 40000 {
+		t.Errorf("offer is %v:%v, %v", host, port, err)
+	}
+	pbx.send(response(req, 180, "Ringing"), from)
+	ok := response(req, 200, "OK")
+	ok.Set("To", req.Get("To")+";tag=phone")
+	ok.Add("Contact", "<sip:201@"+pbx.addr()+">")
+	ok.Add("Content-Type", "application/sdp")
+	ok.Body = sdpOffer("127.0.0.1", 50000)
+	pbx.send(ok, from)
+	ack, _ := pbx.receive("ACK")
+	if ack.RequestURI != "sip:201@"+pbx.addr() || !strings.Contains(ack.Get("To"), "tag=phone") {
+		t.Errorf("ACK is for %v to %v", ack.RequestURI, ack.Get("To"))
+	}
+	r := <-resultCh
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.d.RemoteHost != "127.0.0.1" || r.d.RemotePort != 50000 || r.d.RemoteUser() != "201" {
+		t.Errorf("call is to %v at %v:%v", r.d.RemoteUser(), r.d.RemoteHost, r.d.RemotePort)
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- r.d.Hangup()
+	}()
+	bye, from := pbx.receive("BYE")
+	if bye.Get("Call-ID") != req.Get("Call-ID") {
+		t.Errorf("BYE is for call %v, want %v", bye.Get("Call-ID"), req.Get("Call-ID"))
+	}
+	pbx.send(response(bye, 200, "OK"), from)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-r.d.Done():
+	default:
+		t.Error("call isn't done after hanging up")
+	}
+}
+
+func TestIncomingCall(t *testing.T) {
+	pbx := newFakePBX(t)
+	defer pbx.conn.Close()
+	ua := startUserAgent(t, pbx)
+	defer ua.Close()
+	uaAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ua.localPort}
+
+	invite := newRequest("INVITE", "sip:200@127.0.0.1")
+	invite.Add("Via", "SIP/2.0/UDP "+pbx.addr()+";branch=z9hG4bKin")
+	invite.Add("From", "<sip:201@pbx.local>;tag=phone")
+	invite.Add("To", "<sip:200@pbx.local>")
+	invite.Add("Call-ID", "incoming")
+	invite.Add("CSeq", "1 INVITE")
+	invite.Add("Contact", "<sip:201@"+pbx.addr()+">")
+	invite.Add("Content-Type", "application/sdp")
+	invite.Body = sdpOffer("127.0.0.1", 50000)
+	pbx.send(invite, uaAddr)
+	if trying, _ := pbx.receive("INVITE"); trying.StatusCode != 100 {
+		t.Fatalf("got %v, want 100 Trying", trying)
+	}
+
+	var c *IncomingCall
+	select {
+	case c = <-ua.Incoming():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no incoming call")
+	}
+	if c.Caller() != "201" {
+		t.Errorf("caller is %v, want 201", c.Caller())
+	}
+	c.Ringing()
+	if ringing, _ := pbx.receive("INVITE"); ringing.StatusCode != 180 {
+		t.Fatalf("got %v, want 180 Ringing", ringing)
+	}
+	if err := c.Answer(40000); err != nil {
+		t.Fatal(err)
+	}
+	ok, _ := pbx.receive("INVITE")
+	if ok.StatusCode != 200 || param(ok.Get("To"), "tag") == "" {
+		t.Fatalf("got %v to %v, want 200 OK with a tag", ok, ok.Get("To"))
+	}
+	if host, port, err := parseSDP(ok.Body); err != nil || host != "127.0.0.1" || port != 40000 {
+		t.Errorf("answer is %v:%v, %v", host, port, err)
+	}
+	if c.Dialog.RemoteHost != "127.0.0.1" || c.Dialog.RemotePort != 50000 {
+		t.Errorf("audio goes to %v:%v", c.Dialog.RemoteHost, c.Dialog.RemotePort)
+	}
+	ack := newRequest("ACK", "sip:200@127.0.0.1")
+	ack.Add("Via", "SIP/2.0/UDP "+pbx.addr()+";branch=z9hG4bKack")
+	ack.Add("From", invite.Get("From"))
+	ack.Add("To", ok.Get("To"))
+	ack.Add("Call-ID", "incoming")
+	ack.Add("CSeq", "1 ACK")
+	pbx.send(ack, uaAddr)
+
+	bye := newRequest("BYE", "sip:200@127.0.0.1")
+	bye.Add("Via", "SIP/2.0/UDP "+pbx.addr()+";branch=z9hG4bKbye")
+	bye.Add("From", invite.Get("From"))
+	bye.Add("To", ok.Get("To"))
+	bye.Add("Call-ID", "incoming")
+	bye.Add("CSeq", "2 BYE")
+	pbx.send(bye, uaAddr)
+	if resp, _ := pbx.receive("BYE"); resp.StatusCode != 200 {
+		t.Errorf("got %v to BYE, want 200 OK", resp)
+	}
+	select {
+	case <-c.Dialog.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("call isn't done after BYE")
+	}
+}
@@ -0,0 +1,79 @@
+package station
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/figadore/go-intercom/pkg/ogg"
+	"github.com/figadore/go-intercom/pkg/wav"
+)
+
+const defaultAnnouncementDir = "announcements"
+
+// clipExtensions are the files announcements can be played from, in the
+// order they are looked for
+var clipExtensions = []string{".wav", ".ogg"}
+
+// AnnouncementPath finds a clip in the announcement directory by name, e.g.
+// "laundry-done" for laundry-done.wav or laundry-done.ogg
+func (s *Station) AnnouncementPath(clip string) (string, error) {
+	if clip == "" || strings.ContainsAny(clip, `/\`) || strings.HasPrefix(clip, ".") {
+		return "", fmt.Errorf("invalid announcement name %q", clip)
+	}
+	names := []string{clip}
+	switch ext := filepath.Ext(clip); ext {
+	case "":
+		names = nil
+		for _, ext := range clipExtensions {
+			names = append(names, clip+ext)
+		}
+	case ".wav", ".ogg":
+	default:
+		return "", fmt.Errorf("unsupported announcement %q, only WAV and Ogg Vorbis files can be played", clip)
+	}
+	var err error
+	for _, name := range names {
+		path := filepath.Join(s.announcementDir, name)
+		if _, err = os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", err
+}
+
+// announce plays a clip on other stations, by name or "*" for all of them
+func (s *Station) announce(clip string, to []string) error {
+	path, err := s.AnnouncementPath(clip)
+	if err != nil {
+		return err
+	}
+	samples, rate, err := readClip(path)
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		to = []string{"*"}
+	}
+	s.CallManager.Announce(clip, samples, rate, to)
+	return nil
+}
+
+// readClip reads a whole WAV or Ogg Vorbis file, and returns it with its sample rate
+func readClip(path string) ([]float32, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if filepath.Ext(path) == ".ogg" {
+		return ogg.ReadVorbis(f)
+	}
+	r, err := wav.NewReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	samples, err := r.ReadAll()
+	return samples, r.SampleRate(), err
+}
@@ -0,0 +1,48 @@
+package station
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnnouncementPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "announcements")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"chime.wav", "chime.ogg", "laundry-done.ogg", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Station{announcementDir: dir}
+	tests := []struct {
+		clip string
+		want string
+	}{
+		// WAV first when both are there
+		{"chime", "chime.wav"},
+		{"chime.ogg", "chime.ogg"},
+		{"laundry-done", "laundry-done.ogg"},
+		{"laundry-done.wav", ""},
+		{"notes.txt", ""},
+		{"missing", ""},
+		{"../chime", ""},
+		{".chime", ""},
+	}
+	for _, tt := range tests {
+		path, err := s.AnnouncementPath(tt.clip)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%v: found %v", tt.clip, path)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, tt.want); err != nil || path != want {
+			t.Errorf("%v: got %v, %v, want %v", tt.clip, path, err, want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package station
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jfreymuth/pulse"
@@ -11,14 +13,29 @@ import (
 )
 
 const (
+	// FragmentSize is 200ms of audio at SampleRate
 	FragmentSize = 1600
-	SampleRate   = 8000
+	// SampleRate is the narrowband rate every station supports
+	SampleRate = 8000
 )
 
 type Speaker struct {
 	AudioCh  chan []float32
 	buffered []float32
 	done     chan struct{}
+	// rate is the sound card's sample rate, which audio on AudioCh is expected at
+	rate int
+	// device is the pulse sink played to. Empty means the default sink
+	device string
+	// gain is the speaker volume, applied to everything played
+	gain *gain
+	// underflows counts the times Read had nothing buffered and had to wait for audio
+	underflows uint64
+}
+
+// Underflows returns how many times the speaker has run out of audio
+func (s *Speaker) Underflows() uint64 {
+	return atomic.LoadUint64(&s.underflows)
 }
 
 func (s *Speaker) Close() {
@@ -33,6 +50,34 @@ func sendWithTimeout(err error, errCh chan error) {
 	}
 }
 
+// newPlayback creates a pulse stream playing at rate to the named sink, or
+// the default sink if device is empty
+func newPlayback(c *pulse.Client, r pulse.Reader, device string, rate int) (*pulse.PlaybackStream, error) {
+	opts := []pulse.PlaybackOption{pulse.PlaybackSampleRate(rate), pulse.PlaybackBufferSize(fragmentSize(rate))}
+	if device != "" {
+		sink, err := c.SinkByID(device)
+		if err != nil {
+			return nil, fmt.Errorf("speaker device %v: %w", device, err)
+		}
+		opts = append(opts, pulse.PlaybackSink(sink))
+	}
+	return c.NewPlayback(r, opts...)
+}
+
+// newRecord creates a pulse stream recording at rate from the named source,
+// or the default source if device is empty
+func newRecord(c *pulse.Client, w pulse.Writer, device string, rate int) (*pulse.RecordStream, error) {
+	opts := []pulse.RecordOption{pulse.RecordSampleRate(rate), pulse.RecordBufferFragmentSize(uint32(fragmentSize(rate)))}
+	if device != "" {
+		source, err := c.SourceByID(device)
+		if err != nil {
+			return nil, fmt.Errorf("mic device %v: %w", device, err)
+		}
+		opts = append(opts, pulse.RecordSource(source))
+	}
+	return c.NewRecord(w, opts...)
+}
+
 // startPlayback receives data from a channel and plays through the speaker
 // func (speaker *Speaker) StartPlayback(ctx context.Context, errCh chan error) {
 func (speaker *Speaker) StartPlayback(ctx context.Context, wg *sync.WaitGroup, errCh chan error) {
@@ -47,7 +92,7 @@ func (speaker *Speaker) StartPlayback(ctx context.Context, wg *sync.WaitGroup, e
 		return
 	}
 	defer c.Close()
-	speakerStream, err := c.NewPlayback(pulse.Float32Reader(speaker.Read), pulse.PlaybackSampleRate(SampleRate), pulse.PlaybackBufferSize(FragmentSize))
+	speakerStream, err := newPlayback(c, pulse.Float32Reader(speaker.Read), speaker.device, speaker.rate)
 	if err != nil {
 		log.Println("startPlayback: error creating speaker stream", err)
 		sendWithTimeout(err, errCh)
@@ -96,6 +141,15 @@ func (s *Speaker) Read(buf []float32) (n int, err error) {
 	default:
 		break
 	}
+	if len(s.buffered) == 0 {
+		// It's an underflow if no audio is already waiting to be played
+		select {
+		case data := <-s.AudioCh:
+			s.buffered = append(s.buffered, data...)
+		default:
+			atomic.AddUint64(&s.underflows, 1)
+		}
+	}
 	if len(s.buffered) == 0 {
 		// receives from the audio channel and places it in the buffer
 		// blocking
@@ -122,6 +176,7 @@ func (s *Speaker) Read(buf []float32) (n int, err error) {
 	} else {
 		n = len(s.buffered)
 	}
+	s.gain.apply(buf[:n])
 	// Truncate data that has already been sent to the channel
 	// Save the rest for the next call to Read
 	s.buffered = s.buffered[n:]
@@ -131,6 +186,21 @@ func (s *Speaker) Read(buf []float32) (n int, err error) {
 type Microphone struct {
 	AudioCh chan []float32
 	done    chan struct{}
+	gain    *gain
+	// rate is the sound card's sample rate, which audio on AudioCh is sent at
+	rate int
+	// device is the pulse source recorded from. Empty means the default source
+	device string
+	// tap gets a copy of what calls record, if set, e.g. for voice commands
+	// Audio is dropped when it's full
+	tap chan []float32
+	// recording counts the calls using the mic
+	recording int32
+}
+
+// inUse is whether any calls are recording
+func (m *Microphone) inUse() bool {
+	return atomic.LoadInt32(&m.recording) > 0
 }
 
 func (m *Microphone) Close() {
@@ -148,6 +218,13 @@ func (m *Microphone) Write(buf []float32) (n int, err error) {
 	}
 	data := make([]float32, len(buf))
 	copy(data, buf)
+	m.gain.apply(data)
+	if m.tap != nil {
+		select {
+		case m.tap <- append([]float32(nil), data...):
+		default:
+		}
+	}
 
 	select {
 	case m.AudioCh <- data:
@@ -167,6 +244,8 @@ func (mic *Microphone) StartRecording(ctx context.Context, wg *sync.WaitGroup, e
 	log.Println("startRecording: enter")
 	defer log.Println("startRecording: exit")
 	defer wg.Done()
+	atomic.AddInt32(&mic.recording, 1)
+	defer atomic.AddInt32(&mic.recording, -1)
 	c, err := pulse.NewClient()
 	if err != nil {
 		log.Println("startRecording: error creating pulse client", err)
@@ -175,7 +254,7 @@ func (mic *Microphone) StartRecording(ctx context.Context, wg *sync.WaitGroup, e
 		return
 	}
 	defer c.Close()
-	micStream, err := c.NewRecord(pulse.Float32Writer(mic.Write), pulse.RecordSampleRate(SampleRate), pulse.RecordBufferFragmentSize(FragmentSize))
+	micStream, err := newRecord(c, pulse.Float32Writer(mic.Write), mic.device, mic.rate)
 	if err != nil {
 		log.Println("startRecording: error creating new recorder", err)
 		sendWithTimeout(err, errCh)
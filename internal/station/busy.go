@@ -0,0 +1,79 @@
+package station
+
+import (
+	"context"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// BusyPolicy decides what happens to a call that comes in while another is connected
+type BusyPolicy int
+
+const (
+	// BusyJoin answers the call, so the caller joins the call in progress
+	BusyJoin BusyPolicy = iota
+	// BusyReject tells the caller the station is busy
+	BusyReject
+	// BusyWait beeps, and lets the call be accepted, which puts the calls in
+	// progress on hold, or rejected. Callers not accepted in time are told
+	// the station is busy
+	BusyWait
+)
+
+func (p BusyPolicy) String() string {
+	switch p {
+	case BusyJoin:
+		return "join"
+	case BusyReject:
+		return "busy"
+	case BusyWait:
+		return "wait"
+	}
+	return "unknown"
+}
+
+// parseBusyPolicy returns the policy named by BUSY_POLICY, which defaults to join
+func parseBusyPolicy(name string) BusyPolicy {
+	for p := BusyJoin; p <= BusyWait; p++ {
+		if p.String() == name {
+			return p
+		}
+	}
+	return BusyJoin
+}
+
+// CalledBusy plays the busy tone when a station that was called is busy
+func (s *Station) CalledBusy(c *call.Call) {
+	log.Printf("%v is busy\n", c.Peer)
+	s.Publish(Event{Type: EventBusy, Call: c})
+	ctx, cancel := context.WithTimeout(context.Background(), busyToneDuration)
+	go func() {
+		defer cancel()
+		playTone(ctx, busyTone(s.Volume(), s.DeviceRate), s.Speaker.device)
+	}()
+}
+
+// swapCalls takes calls on hold off hold, and puts the rest on hold, e.g. to
+// go back and forth between a call and a waiting call that was accepted
+func (s *Station) swapCalls() {
+	for _, c := range s.CallManager.Calls() {
+		held := c.IsHeld()
+		if !held && c.CurrentStatus() != call.StatusActive {
+			continue
+		}
+		if err := s.CallManager.Hold(c.Id, !held); err != nil {
+			log.Println("Unable to swap call:", err)
+		}
+	}
+}
+
+// canSwap returns whether there are calls both on and off hold
+func (s *Station) canSwap() bool {
+	held, active := false, false
+	for _, c := range s.CallManager.Calls() {
+		held = held || c.IsHeld()
+		active = active || c.CurrentStatus() == call.StatusActive
+	}
+	return held && active
+}
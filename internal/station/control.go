@@ -0,0 +1,367 @@
+package station
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// defaultControlAddress only takes requests from this device, since without
+// CONTROL_TOKEN anyone who can reach the API can use it
+const defaultControlAddress = "127.0.0.1:20001"
+
+// controlInputs is an HTTP/JSON control API, e.g. for scripts and home automation
+// Actions are POST requests with an optional JSON body, see controlRequest
+type controlInputs struct {
+	station *Station
+	server  *http.Server
+}
+
+type controlRequest struct {
+	To      []string `json:"to"`
+	Urgent  bool     `json:"urgent"`
+	On      bool     `json:"on"`
+	Percent int      `json:"percent"`
+	Clip    string   `json:"clip"`
+	Text    string   `json:"text"`
+	// Call is the id of another call, e.g. the consultation call for an attended transfer
+	Call string `json:"call"`
+}
+
+var errBadRequest = errors.New("bad request")
+
+func newControlInputs(features config.FeaturesConfig, station *Station) *controlInputs {
+	address := defaultControlAddress
+	if features.ControlAddress != "" {
+		address = features.ControlAddress
+	}
+	token := features.ControlToken
+	if token == "" && !isLoopback(address) {
+		log.Printf("Warning: control API on %v has no CONTROL_TOKEN, anyone who can reach it can use it\n", address)
+	}
+	c := &controlInputs{
+		station: station,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/calls", c.handleCalls)
+	mux.HandleFunc("/calls/", c.handleCall)
+	mux.HandleFunc("/history", c.handleHistory)
+	mux.HandleFunc("/recordings", c.handleRecordings)
+	mux.HandleFunc("/recordings/", c.handleRecording)
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	mux.HandleFunc("/call", c.post(func(req controlRequest) error {
+		if len(req.To) == 0 {
+			return errBadRequest
+		}
+		if req.Urgent {
+			c.station.placeUrgentCall(req.To)
+		} else {
+			c.placeCall(req.To)
+		}
+		return nil
+	}))
+	mux.HandleFunc("/call-all", c.post(func(controlRequest) error {
+		c.callAll()
+		return nil
+	}))
+	mux.HandleFunc("/doorbell", c.post(func(controlRequest) error {
+		if len(c.station.doorbell) == 0 {
+			return fmt.Errorf("%w: DOORBELL is not set", errBadRequest)
+		}
+		c.station.ringDoorbell()
+		return nil
+	}))
+	mux.HandleFunc("/announce", c.post(func(req controlRequest) error {
+		if err := c.station.announce(req.Clip, req.To); err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		return nil
+	}))
+	mux.HandleFunc("/listen", c.post(func(req controlRequest) error {
+		if len(req.To) != 1 {
+			return errBadRequest
+		}
+		c.station.listen(req.To[0])
+		return nil
+	}))
+	mux.HandleFunc("/say", c.post(func(req controlRequest) error {
+		if strings.TrimSpace(req.Text) == "" {
+			return errBadRequest
+		}
+		return c.station.say(req.Text, req.To)
+	}))
+	mux.HandleFunc("/hangup", c.post(func(controlRequest) error {
+		c.hangup()
+		return nil
+	}))
+	mux.HandleFunc("/accept", c.post(func(controlRequest) error {
+		if !c.station.Status.Has(StatusRinging) {
+			return errors.New("no call is ringing")
+		}
+		c.acceptCall()
+		return nil
+	}))
+	mux.HandleFunc("/reject", c.post(func(controlRequest) error {
+		if !c.station.Status.Has(StatusRinging) {
+			return errors.New("no call is ringing")
+		}
+		c.station.RejectCall()
+		return nil
+	}))
+	mux.HandleFunc("/dnd", c.post(func(req controlRequest) error {
+		c.setDoNotDisturb(req.On)
+		return nil
+	}))
+	mux.HandleFunc("/mute", c.post(func(req controlRequest) error {
+		c.setMute(req.On)
+		return nil
+	}))
+	mux.HandleFunc("/hold", c.post(func(req controlRequest) error {
+		c.setHold(req.On)
+		return nil
+	}))
+	mux.HandleFunc("/swap", c.post(func(controlRequest) error {
+		if !c.station.canSwap() {
+			return errors.New("no calls to swap")
+		}
+		c.station.swapCalls()
+		return nil
+	}))
+	mux.HandleFunc("/volume", c.post(func(req controlRequest) error {
+		if req.Percent < 0 || req.Percent > 100 {
+			return errBadRequest
+		}
+		c.setVolume(req.Percent)
+		return nil
+	}))
+	mux.HandleFunc("/mic-gain", c.post(func(req controlRequest) error {
+		if err := c.station.setMicGain(req.Percent); err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		return nil
+	}))
+	c.server = &http.Server{
+		Addr:    address,
+		Handler: requireToken(token, mux),
+	}
+	log.Printf("Starting control API on %v\n", address)
+	go func() {
+		if err := c.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Control API stopped with error:", err)
+		}
+	}()
+	return c
+}
+
+// isLoopback returns whether address only listens on this device
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken only passes on requests with "Authorization: Bearer <token>",
+// unless token is empty
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error writing control API response:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusConflict
+	if errors.Is(err, errBadRequest) {
+		status = http.StatusBadRequest
+	} else if errors.Is(err, call.ErrCallNotFound) {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// post handles an action, decoding the optional JSON body
+func (c *controlInputs) post(action func(controlRequest) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req controlRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, errBadRequest)
+				return
+			}
+		}
+		if err := action(req); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (c *controlInputs) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"station":  c.station.Name,
+		"status":   statusPayload(c.station.Status),
+		"volume":   c.station.Volume(),
+		"mic_gain": c.station.micGain(),
+		"calls":    c.station.CallManager.Calls(),
+		"peers":    c.station.Peers(),
+	})
+}
+
+func (c *controlInputs) handleCalls(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.station.CallManager.Calls())
+}
+
+func (c *controlInputs) handleHistory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.station.History())
+}
+
+func (c *controlInputs) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.station.Recordings())
+}
+
+// handleRecording serves a call recording as a WAV or Ogg file, e.g. GET /recordings/<id>
+func (c *controlInputs) handleRecording(w http.ResponseWriter, r *http.Request) {
+	id, err := call.ParseCallId(strings.TrimPrefix(r.URL.Path, "/recordings/"))
+	if err != nil {
+		writeError(w, call.ErrCallNotFound)
+		return
+	}
+	path, format, ok := c.station.RecordingPath(id)
+	if !ok {
+		writeError(w, call.ErrCallNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/"+format)
+	http.ServeFile(w, r, path)
+}
+
+// handleCall handles actions on a single call, e.g. POST /calls/<id>/mute
+func (c *controlInputs) handleCall(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/calls/"), "/")
+	id, err := call.ParseCallId(parts[0])
+	if err != nil {
+		writeError(w, call.ErrCallNotFound)
+		return
+	}
+	if len(parts) != 2 {
+		writeError(w, errBadRequest)
+		return
+	}
+	var action func(controlRequest) error
+	switch parts[1] {
+	case "mute":
+		action = func(req controlRequest) error {
+			return c.station.CallManager.Mute(id, req.On)
+		}
+	case "hold":
+		action = func(req controlRequest) error {
+			return c.station.CallManager.Hold(id, req.On)
+		}
+	// Blind transfers name the station in to. Attended transfers give the
+	// call with the station the call is transferred to
+	case "transfer":
+		action = func(req controlRequest) error {
+			if req.Call != "" {
+				consult, err := call.ParseCallId(req.Call)
+				if err != nil {
+					return call.ErrCallNotFound
+				}
+				return c.station.CallManager.CompleteTransfer(id, consult)
+			}
+			if len(req.To) != 1 {
+				return errBadRequest
+			}
+			return c.station.CallManager.Transfer(id, req.To[0])
+		}
+	case "add":
+		action = func(req controlRequest) error {
+			if len(req.To) != 1 {
+				return errBadRequest
+			}
+			return c.station.CallManager.AddParticipant(id, req.To[0])
+		}
+	default:
+		writeError(w, fmt.Errorf("%w: unknown action %v", errBadRequest, parts[1]))
+		return
+	}
+	c.post(action)(w, r)
+}
+
+func (c *controlInputs) acceptCall() {
+	c.station.AcceptCall()
+}
+
+func (c *controlInputs) placeCall(to []string) {
+	c.station.placeCall(to)
+}
+
+func (c *controlInputs) callAll() {
+	c.station.callAll()
+}
+
+func (c *controlInputs) hangup() {
+	c.station.hangupAll()
+}
+
+func (c *controlInputs) setVolume(percent int) {
+	c.station.setVolume(percent)
+}
+
+func (c *controlInputs) setDoNotDisturb(v bool) {
+	c.station.setDoNotDisturb(v)
+}
+
+func (c *controlInputs) setMute(v bool) {
+	c.station.muteAll(v)
+}
+
+func (c *controlInputs) setHold(v bool) {
+	c.station.holdAll(v)
+}
+
+func (c *controlInputs) Close() {
+	log.Debugln("controlInputs.Close: enter")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down control API:", err)
+	}
+}
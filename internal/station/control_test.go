@@ -0,0 +1,51 @@
+package station
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		token  string
+		header string
+		want   int
+	}{
+		{"", "", http.StatusNoContent},
+		{"secret", "Bearer secret", http.StatusNoContent},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret2", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/hangup", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		requireToken(tt.token, ok).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q, Authorization %q: got %v, want %v", tt.token, tt.header, w.Code, tt.want)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for address, want := range map[string]bool{
+		defaultControlAddress: true,
+		"localhost:20001":     true,
+		"[::1]:20001":         true,
+		":20001":              false,
+		"0.0.0.0:20001":       false,
+		"192.168.0.12:20001":  false,
+	} {
+		if got := isLoopback(address); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", address, got, want)
+		}
+	}
+}
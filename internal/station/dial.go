@@ -0,0 +1,45 @@
+package station
+
+import (
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+)
+
+// DialConfig bounds how long outgoing calls take to connect, and decides
+// whether calls that drop because of a network error are dialed again
+type DialConfig struct {
+	// Timeout bounds connecting to the other station
+	Timeout time.Duration
+	// InviteTimeout bounds how long a call stays pending, including ringing
+	InviteTimeout time.Duration
+	// Redial calls again, up to RedialAttempts times, RedialDelay apart
+	Redial         bool
+	RedialAttempts int
+	RedialDelay    time.Duration
+}
+
+// newDialConfig applies the defaults, a 5s dial timeout, a 30s invite
+// timeout and 3 redial attempts 2s apart
+func newDialConfig(c config.DialConfig) DialConfig {
+	d := DialConfig{
+		Timeout:        5 * time.Second,
+		InviteTimeout:  30 * time.Second,
+		Redial:         c.AutoRedial,
+		RedialAttempts: 3,
+		RedialDelay:    2 * time.Second,
+	}
+	if c.Timeout > 0 {
+		d.Timeout = c.Timeout
+	}
+	if c.InviteTimeout > 0 {
+		d.InviteTimeout = c.InviteTimeout
+	}
+	if c.RedialAttempts > 0 {
+		d.RedialAttempts = c.RedialAttempts
+	}
+	if c.RedialDelay > 0 {
+		d.RedialDelay = c.RedialDelay
+	}
+	return d
+}
@@ -0,0 +1,29 @@
+package station
+
+// defaultListenAddress is where stations take calls, unless LISTEN_ADDRESS says
+// otherwise. Stations that don't listen on it need their port in their
+// directory entry on other stations
+const defaultListenAddress = ":20000"
+
+// directory maps station names to addresses, so calls can be placed by name
+// An address is either the last part of a station's IP address, a host with
+// an optional port, e.g. "10.0.0.5:20002", or a SIP URI
+type directory map[string]string
+
+// newDirectory copies DIRECTORY, e.g. "kitchen=12,garage=13,desk=sip:201"
+func newDirectory(entries map[string]string) directory {
+	d := make(directory, len(entries))
+	for name, address := range entries {
+		d[name] = address
+	}
+	return d
+}
+
+// Lookup returns the address for a station name. Anything that isn't in the
+// directory is assumed to be an address already
+func (s *Station) Lookup(name string) string {
+	if address, ok := s.directory[name]; ok {
+		return address
+	}
+	return name
+}
@@ -0,0 +1,23 @@
+package station
+
+import (
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// ringDoorbell rings the doorbell's stations with the doorbell tone. The
+// first station to accept gets the call, unless DOORBELL names a ring group
+// with another strategy. Presses while it's ringing or connected are ignored
+func (s *Station) ringDoorbell() {
+	if s.hasCalls() {
+		log.Println("Doorbell already ringing")
+		return
+	}
+	group := call.RingGroup{Name: "doorbell", Members: s.doorbell}
+	if g, ok := s.ringGroups[s.doorbell[0]]; ok && len(s.doorbell) == 1 {
+		group = g
+	}
+	group.Doorbell = true
+	log.Println("Ringing doorbell group", group.Members)
+	go s.CallManager.Ring(group)
+}
@@ -0,0 +1,145 @@
+package station
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+type EventType int
+
+const (
+	EventIncomingCall EventType = iota
+	EventMissedCall
+	EventCallConnected
+	EventCallEnded
+	EventError
+	EventVoicemail
+	// EventCallUpdated is sent when a call is muted or held, by either end, or
+	// the stations in a conference change
+	EventCallUpdated
+	// EventCallRecorded is sent when a call recording has been saved
+	EventCallRecorded
+	// EventAnnouncement is sent when another station's announcement starts playing
+	EventAnnouncement
+	// EventMonitorAlert is sent when a monitor hears noise, on the monitor and the stations it alerts
+	EventMonitorAlert
+	// EventListening is sent when another station starts listening in to this one
+	EventListening
+	// EventBusy is sent when a station that was called is busy
+	EventBusy
+	eventTypeCount
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventIncomingCall:
+		return "incoming"
+	case EventMissedCall:
+		return "missed"
+	case EventCallConnected:
+		return "connected"
+	case EventCallEnded:
+		return "ended"
+	case EventError:
+		return "error"
+	case EventVoicemail:
+		return "voicemail"
+	case EventCallUpdated:
+		return "updated"
+	case EventCallRecorded:
+		return "recorded"
+	case EventAnnouncement:
+		return "announcement"
+	case EventMonitorAlert:
+		return "alert"
+	case EventListening:
+		return "listening"
+	case EventBusy:
+		return "busy"
+	}
+	return "unknown"
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event describes something that happened on this station, such as a call
+// being connected. Call, Err, Recording, From and Level are optional
+type Event struct {
+	Type    EventType
+	Station string
+	Call    *call.Call
+	Err     error
+	// Recording is the path of an audio file, e.g. a voicemail or call
+	// recording, or the name of an announcement
+	Recording string
+	// From is the other station, for events that aren't about a call
+	From string
+	// Level is the noise level that raised a monitor alert, in dBFS
+	Level float64
+	Time  time.Time
+}
+
+// MarshalJSON is used by subscribers that forward events to other systems.
+// Call the marshaller from HandleEvent, before the call object changes again
+func (e Event) MarshalJSON() ([]byte, error) {
+	payload := struct {
+		Event     EventType  `json:"event"`
+		Station   string     `json:"station"`
+		Time      time.Time  `json:"time"`
+		Call      *call.Call `json:"call,omitempty"`
+		Error     string     `json:"error,omitempty"`
+		Recording string     `json:"recording,omitempty"`
+		From      string     `json:"from,omitempty"`
+		Level     float64    `json:"level,omitempty"`
+	}{
+		Event:     e.Type,
+		Station:   e.Station,
+		Time:      e.Time,
+		Call:      e.Call,
+		Recording: e.Recording,
+		From:      e.From,
+		Level:     e.Level,
+	}
+	if e.Err != nil {
+		payload.Error = e.Err.Error()
+	}
+	return json.Marshal(payload)
+}
+
+// EventHandler receives station events, e.g. to forward them to home automation
+// HandleEvent is called synchronously from the call path, so it must not block
+type EventHandler interface {
+	HandleEvent(Event)
+}
+
+type eventHandlers struct {
+	sync.Mutex
+	handlers []EventHandler
+}
+
+// Subscribe registers a handler for all future station events
+func (s *Station) Subscribe(h EventHandler) {
+	s.events.Lock()
+	defer s.events.Unlock()
+	s.events.handlers = append(s.events.handlers, h)
+}
+
+// Publish sends an event to every subscribed handler
+func (s *Station) Publish(e Event) {
+	e.Station = s.Name
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.events.Lock()
+	handlers := make([]EventHandler, len(s.events.handlers))
+	copy(handlers, s.events.handlers)
+	s.events.Unlock()
+	for _, h := range handlers {
+		h.HandleEvent(e)
+	}
+}
@@ -0,0 +1,157 @@
+package station
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+const (
+	defaultHistoryFile = "history.jsonl"
+	// How many calls are kept in memory for the control API
+	historySize = 100
+)
+
+// HistoryRecord summarizes a call once it has ended
+type HistoryRecord struct {
+	Id       call.CallId `json:"id"`
+	Peer     string      `json:"peer,omitempty"`
+	To       string      `json:"to"`
+	From     string      `json:"from"`
+	Urgent   bool        `json:"urgent,omitempty"`
+	Doorbell bool        `json:"doorbell,omitempty"`
+	Group    string      `json:"group,omitempty"`
+	// Missed calls were never answered, e.g. a doorbell no one came to
+	Missed      bool      `json:"missed,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	ConnectedAt time.Time `json:"connected_at,omitempty"`
+	EndedAt     time.Time `json:"ended_at"`
+	// Duration is how long the call was connected, in seconds
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+	// Quality is as measured at the end of the call, with the average rates over the whole call
+	Quality            call.Quality `json:"quality"`
+	AverageSendRate    int          `json:"average_send_bytes_per_second"`
+	AverageReceiveRate int          `json:"average_receive_bytes_per_second"`
+}
+
+// callHistory records every call that ends, appending to a file as JSON lines
+type callHistory struct {
+	sync.Mutex
+	path    string
+	records []HistoryRecord
+	// fileLock keeps appends in order, without holding up HandleEvent
+	fileLock sync.Mutex
+}
+
+// loadCallHistory reads the last calls from CALL_HISTORY_FILE (default history.jsonl)
+func loadCallHistory(path string) *callHistory {
+	h := &callHistory{path: defaultHistoryFile}
+	if path != "" {
+		h.path = path
+	}
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return h
+	} else if err != nil {
+		log.Println("Unable to read call history:", err)
+		return h
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Println("Unable to parse call history:", err)
+			continue
+		}
+		h.add(r)
+	}
+	return h
+}
+
+// add must be called with the lock held, or before the history is shared
+func (h *callHistory) add(r HistoryRecord) {
+	h.records = append(h.records, r)
+	if len(h.records) > historySize {
+		h.records = h.records[len(h.records)-historySize:]
+	}
+}
+
+// HandleEvent records calls as they end, and calls that were missed
+func (h *callHistory) HandleEvent(e Event) {
+	if e.Type != EventCallEnded && e.Type != EventMissedCall || e.Call == nil {
+		return
+	}
+	r := newHistoryRecord(e)
+	h.Lock()
+	h.add(r)
+	h.Unlock()
+	go h.append(r)
+}
+
+func newHistoryRecord(e Event) HistoryRecord {
+	c := e.Call
+	c.Lock()
+	defer c.Unlock()
+	r := HistoryRecord{
+		Id:          c.Id,
+		Peer:        c.Peer,
+		To:          c.To,
+		From:        c.From,
+		Urgent:      c.Urgent,
+		Doorbell:    c.Doorbell,
+		Group:       c.Group,
+		Missed:      e.Type == EventMissedCall,
+		StartedAt:   c.StartedAt,
+		ConnectedAt: c.ConnectedAt,
+		EndedAt:     e.Time,
+		Quality:     c.Quality,
+	}
+	if e.Err != nil {
+		r.Error = e.Err.Error()
+	}
+	if !c.ConnectedAt.IsZero() {
+		duration := e.Time.Sub(c.ConnectedAt).Seconds()
+		r.Duration = math.Round(duration*10) / 10
+		if duration > 0 {
+			r.AverageSendRate = int(float64(c.Quality.BytesSent) / duration)
+			r.AverageReceiveRate = int(float64(c.Quality.BytesReceived) / duration)
+		}
+	}
+	return r
+}
+
+func (h *callHistory) append(r HistoryRecord) {
+	h.fileLock.Lock()
+	defer h.fileLock.Unlock()
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Println("Unable to encode call history:", err)
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Unable to save call history:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Println("Unable to save call history:", err)
+	}
+}
+
+// History returns the most recent calls, oldest first
+func (s *Station) History() []HistoryRecord {
+	s.history.Lock()
+	defer s.history.Unlock()
+	records := make([]HistoryRecord, len(s.history.records))
+	copy(records, s.history.records)
+	return records
+}
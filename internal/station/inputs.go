@@ -3,13 +3,16 @@ package station
 import (
 	"context"
 	"fmt"
-	"strconv"
 	"time"
 
+	"github.com/figadore/go-intercom/internal/config"
 	"github.com/figadore/go-intercom/internal/log"
 	"github.com/warthog618/gpiod"
 )
 
+// Buttons held down for at least this long trigger their long-press action
+const longPressDuration = time.Second
+
 // Allow various ways to interact with the intercom
 // E.g. buttons, menu with display, voice commands
 type Inputs interface {
@@ -19,14 +22,37 @@ type Inputs interface {
 	hangup()
 	setVolume(percent int)
 	setDoNotDisturb(bool)
+	// setMute and setHold apply to all calls
+	setMute(bool)
+	setHold(bool)
 	Close()
 }
 
+// multiInputs allows several Inputs to be active at once, e.g. buttons and MQTT
+// Actions only need to reach the station once, so they are forwarded to the first input
+type multiInputs []Inputs
+
+func (m multiInputs) acceptCall()            { m[0].acceptCall() }
+func (m multiInputs) placeCall(to []string)  { m[0].placeCall(to) }
+func (m multiInputs) callAll()               { m[0].callAll() }
+func (m multiInputs) hangup()                { m[0].hangup() }
+func (m multiInputs) setVolume(percent int)  { m[0].setVolume(percent) }
+func (m multiInputs) setDoNotDisturb(v bool) { m[0].setDoNotDisturb(v) }
+func (m multiInputs) setMute(v bool)         { m[0].setMute(v) }
+func (m multiInputs) setHold(v bool)         { m[0].setHold(v) }
+
+func (m multiInputs) Close() {
+	for _, i := range m {
+		i.Close()
+	}
+}
+
 // E.g. buttons, stateful menu with display, voice commands
 type physicalInputs struct {
 	station                        *Station
 	groupCallButton, endCallButton *gpiod.Line
-	// volumeControl                  *struct{}
+	// callTo is what the black button calls, instead of every station
+	callTo []string
 }
 
 // map of button handlers, take gpiod.LineEvent input
@@ -34,30 +60,27 @@ type physicalInputs struct {
 // also, what creates it? it should be wrappers around handlers in calls/, like callAll, and endCall, (and set dnd?)
 type Handlers map[string]func(gpiod.LineEvent)
 
-func newPhysicalInputs(mainContext context.Context, dotEnv map[string]string, station *Station) *physicalInputs {
+func newPhysicalInputs(mainContext context.Context, cfg *config.Config, station *Station) *physicalInputs {
 	chip := reserveChip()
 	defer chip.Close()
 	// TODO intercom.Close hangs on the client side when context cancelled, find a way to allow it to close
-	redButtonPin, _ := strconv.Atoi(dotEnv["RED_BUTTON_PIN"])
-	log.Printf("Found pin %d for red button in .env ...\n", redButtonPin)
-	blackButtonPin, _ := strconv.Atoi(dotEnv["BLACK_BUTTON_PIN"])
-	log.Printf("Found pin %d for black button in .env ...\n", blackButtonPin)
 	// Set up button lines
 	inputs := &physicalInputs{
 		station: station,
+		callTo:  cfg.Features.CallButtonTo,
 	}
-	groupCallButton, err := chip.RequestLine(blackButtonPin,
+	groupCallButton, err := chip.RequestLine(cfg.Pins.BlackButton,
 		gpiod.WithDebounce(time.Millisecond*30),
-		gpiod.WithFallingEdge, // use WithBothEdges and a timer if long-press required
-		gpiod.WithEventHandler(inputs.blackButtonHandler))
+		gpiod.WithBothEdges,
+		gpiod.WithEventHandler(pressHandler(inputs.blackButtonHandler, inputs.blackButtonLongPressHandler)))
 	if err != nil {
 		msg := fmt.Sprintf("RequestLine returned error: %s\n", err)
 		panic(msg)
 	}
-	endCallButton, err := chip.RequestLine(redButtonPin,
+	endCallButton, err := chip.RequestLine(cfg.Pins.RedButton,
 		gpiod.WithDebounce(time.Millisecond*30),
-		gpiod.WithFallingEdge,
-		gpiod.WithEventHandler(inputs.redButtonHandler))
+		gpiod.WithBothEdges,
+		gpiod.WithEventHandler(pressHandler(inputs.redButtonHandler, inputs.redButtonLongPressHandler)))
 	if err != nil {
 		msg := fmt.Sprintf("RequestLine returned error: %s\n", err)
 		log.Println(msg)
@@ -68,14 +91,43 @@ func newPhysicalInputs(mainContext context.Context, dotEnv map[string]string, st
 	return inputs
 }
 
+// pressHandler turns presses (falling edge) and releases (rising edge) into
+// short and long presses, which are handled on release
+func pressHandler(short, long func(gpiod.LineEvent)) func(gpiod.LineEvent) {
+	var pressedAt time.Duration
+	return func(evt gpiod.LineEvent) {
+		if evt.Type == gpiod.LineEventFallingEdge {
+			pressedAt = evt.Timestamp
+			return
+		}
+		if pressedAt == 0 {
+			// Released without a press, e.g. held down at startup
+			return
+		}
+		heldFor := evt.Timestamp - pressedAt
+		pressedAt = 0
+		if heldFor >= longPressDuration {
+			long(evt)
+		} else {
+			short(evt)
+		}
+	}
+}
+
 func (i *physicalInputs) blackButtonHandler(gpiod.LineEvent) {
 	log.Debugln("group call handler: callAll")
 	defer log.Debugln("group call handler: completed callAll")
-	if i.station.Status.Has(StatusDoNotDisturb) && i.station.Status.Has(StatusIncomingCall) {
+	if i.station.Status.Has(StatusRinging) {
 		log.Debugln("accepting call")
 		i.acceptCall()
 	} else if i.station.Status.Has(StatusCallConnected) || i.station.Status.Has(StatusOutgoingCall) {
 		log.Debugln("blackButtonHandler: call already outgoing or connected, doing nothing")
+	} else if len(i.station.doorbell) > 0 {
+		log.Debugln("blackButtonHandler: ringing the doorbell")
+		i.station.ringDoorbell()
+	} else if len(i.callTo) > 0 {
+		log.Debugln("blackButtonHandler: calling", i.callTo)
+		i.placeCall(i.callTo)
 	} else {
 		log.Debugln("blackButtonHandler: calling all")
 		i.callAll()
@@ -86,7 +138,7 @@ func (i *physicalInputs) blackButtonHandler(gpiod.LineEvent) {
 func (i *physicalInputs) redButtonHandler(gpiod.LineEvent) {
 	log.Debugln("end call handler: hangup")
 	defer log.Debugln("end call handler: completed handler")
-	if i.station.Status.Has(StatusDoNotDisturb) && i.station.Status.Has(StatusIncomingCall) {
+	if i.station.Status.Has(StatusRinging) {
 		log.Debugln("rejecting call")
 		i.rejectCall()
 	} else if i.station.hasCalls() {
@@ -98,6 +150,29 @@ func (i *physicalInputs) redButtonHandler(gpiod.LineEvent) {
 	}
 }
 
+func (i *physicalInputs) blackButtonLongPressHandler(gpiod.LineEvent) {
+	if !i.station.Status.Has(StatusCallConnected) {
+		log.Debugln("blackButtonLongPressHandler: no call connected, doing nothing")
+		return
+	}
+	log.Debugln("toggling mute")
+	i.setMute(!i.station.Status.Has(StatusMuted))
+}
+
+func (i *physicalInputs) redButtonLongPressHandler(gpiod.LineEvent) {
+	if !i.station.Status.Has(StatusCallConnected) {
+		log.Debugln("redButtonLongPressHandler: no call connected, doing nothing")
+		return
+	}
+	if i.station.canSwap() {
+		log.Debugln("swapping calls")
+		i.station.swapCalls()
+		return
+	}
+	log.Debugln("toggling hold")
+	i.setHold(!i.station.Status.Has(StatusOnHold))
+}
+
 func (i *physicalInputs) Close() {
 	log.Debugln("physicalInputs.Close: enter")
 	i.endCallButton.Close()
@@ -115,6 +190,7 @@ func (i *physicalInputs) rejectCall() {
 }
 
 func (i *physicalInputs) placeCall(to []string) {
+	i.station.placeCall(to)
 }
 
 func (i *physicalInputs) callAll() {
@@ -128,9 +204,19 @@ func (i *physicalInputs) hangup() {
 }
 
 func (i *physicalInputs) setVolume(percent int) {
+	i.station.setVolume(percent)
 }
 
 func (i *physicalInputs) setDoNotDisturb(v bool) {
+	i.station.setDoNotDisturb(v)
+}
+
+func (i *physicalInputs) setMute(v bool) {
+	i.station.muteAll(v)
+}
+
+func (i *physicalInputs) setHold(v bool) {
+	i.station.holdAll(v)
 }
 
 func (i *physicalInputs) toggleDoNotDisturb() {
@@ -4,20 +4,72 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"sync"
+	"time"
 
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/sip"
 	"github.com/figadore/go-intercom/pkg/call"
 	"github.com/warthog618/gpiod"
 )
 
 type Station struct {
+	// Name identifies this station to peers and home automation
+	Name        string
 	CallManager call.Manager
 	// Context     context.Context
 	Inputs     Inputs
 	Outputs    Outputs
 	Speaker    *Speaker
 	Microphone *Microphone
+	// DeviceRate is the sample rate of the sound card. Call audio is
+	// converted to and from it
+	DeviceRate int
 	Status     *Status
+	events     eventHandlers
+	mqtt       *mqttClient
+	webhooks   []*webhook
+	scheduler  *scheduler
+	// callerPolicies decide how incoming calls are handled
+	callerPolicies callerPolicies
+	voicemail      voicemailConfig
+	recording      recordingConfig
+	// announcementDir holds the clips that can be played on other stations
+	announcementDir string
+	// tts speaks text, for the tts output and the say command
+	tts TTSEngine
+	// ringGroups are called by name, like stations in the directory
+	ringGroups map[string]call.RingGroup
+	// doorbell is the ring group the button rings, if this is a doorbell station
+	doorbell []string
+	// monitor is set if other stations may listen in, or noise raises alerts
+	monitor *monitor
+	alert   struct {
+		sync.Mutex
+		// clear ends the alert status
+		clear *time.Timer
+	}
+	// Media decides whether call audio uses RTP or the gRPC stream
+	Media MediaConfig
+	// Dial bounds outgoing call setup, and decides whether dropped calls are redialed
+	Dial DialConfig
+	// BusyPolicy decides how a call that comes in during another one is handled
+	BusyPolicy BusyPolicy
+	// ListenAddress is where calls from other stations are taken
+	ListenAddress string
+	// SIP registers the station with a PBX, if set
+	SIP *sip.Config
+	// Hub is the address of a hub to register with, if set
+	Hub       string
+	directory directory
+	// presence is what was last heard from each peer, pinged every PresenceInterval
+	presence         presenceList
+	PresenceInterval time.Duration
+	// state holds the volume settings saved across restarts
+	state *savedState
+	// history records every call that ends
+	history *callHistory
 }
 
 func (station *Station) UpdateStatus() {
@@ -28,37 +80,107 @@ func (station *Station) UpdateStatus() {
 		station.Status.Clear(StatusIncomingCall)
 		station.Status.Clear(StatusOutgoingCall)
 	}
+	muted, held := false, false
+	for _, c := range station.CallManager.Calls() {
+		muted = muted || c.IsMuted()
+		held = held || c.IsHeld()
+	}
+	if muted != station.Status.Has(StatusMuted) {
+		station.Status.Toggle(StatusMuted)
+	}
+	if held != station.Status.Has(StatusOnHold) {
+		station.Status.Toggle(StatusOnHold)
+	}
 }
 
-// New creates a Station
+// New creates a Station from its settings, which have been checked by config.Load
 // ctx is the main context from cmd
-func New(ctx context.Context, dotEnv map[string]string, callManagerFactory func(*Station) call.Manager) *Station {
-	// get access to leds, display, etc
-	outputs := getOutputs(dotEnv)
+func New(ctx context.Context, cfg *config.Config, callManagerFactory func(*Station) call.Manager) *Station {
+	state := loadState(cfg.Station.StateFile)
+	rate := cfg.Audio.SampleRate
+	if rate == 0 {
+		rate = SampleRate
+	}
 	speaker := Speaker{
 		AudioCh: make(chan []float32),
+		rate:    rate,
+		device:  cfg.Audio.Speaker,
 		done:    make(chan struct{}),
+		gain:    newGain(volumeGain(state.SpeakerVolume)),
 	}
 	mic := Microphone{
 		AudioCh: make(chan []float32),
+		rate:    rate,
+		device:  cfg.Audio.Microphone,
 		done:    make(chan struct{}),
+		gain:    newGain(float32(state.MicGain) / 100),
+	}
+	presenceInterval := defaultPresenceInterval
+	if cfg.IsSet("PRESENCE_INTERVAL") {
+		presenceInterval = cfg.Peers.PresenceInterval
 	}
 	station := Station{
-		Speaker:    &speaker,
-		Microphone: &mic,
-		Outputs:    outputs,
+		Name:             stationName(cfg.Station.Name),
+		Speaker:          &speaker,
+		Microphone:       &mic,
+		DeviceRate:       rate,
+		callerPolicies:   newCallerPolicies(cfg.Policies),
+		voicemail:        newVoicemailConfig(cfg.Voicemail),
+		recording:        newRecordingConfig(cfg),
+		announcementDir:  defaultAnnouncementDir,
+		tts:              newTTSEngine(cfg.Audio.TTSCommand),
+		doorbell:         cfg.Features.Doorbell,
+		state:            state,
+		Media:            newMediaConfig(cfg),
+		Dial:             newDialConfig(cfg.Dial),
+		BusyPolicy:       parseBusyPolicy(cfg.Policies.Busy),
+		ListenAddress:    defaultListenAddress,
+		SIP:              newSIPConfig(cfg.SIP),
+		Hub:              cfg.Peers.Hub,
+		directory:        newDirectory(cfg.Peers.Directory),
+		ringGroups:       newRingGroups(cfg.RingGroups),
+		presence:         presenceList{peers: make(map[string]Presence)},
+		PresenceInterval: presenceInterval,
+	}
+	if cfg.Announcements.Dir != "" {
+		station.announcementDir = cfg.Announcements.Dir
+	}
+	if cfg.Station.Listen != "" {
+		station.ListenAddress = cfg.Station.Listen
 	}
 	status := Status{
 		status:  StatusDefault,
 		station: &station,
 	}
 	station.Status = &status
+	station.scheduler = newScheduler(cfg.Policies, &station)
+	// get access to leds, display, etc
+	station.Outputs = getOutputs(cfg, &station)
+	station.history = loadCallHistory(cfg.Station.HistoryFile)
+	station.Subscribe(station.history)
+	station.webhooks = newWebhooks(cfg)
+	for _, w := range station.webhooks {
+		station.Subscribe(w)
+	}
 	callManager := callManagerFactory(&station)
 	station.CallManager = callManager
 
 	// get access to buttons, volume, etc
-	inputs := getInputs(ctx, dotEnv, &station)
+	inputs := getInputs(ctx, cfg, &station)
 	station.Inputs = inputs
+
+	// Apply do-not-disturb schedules once everything is set up
+	go station.scheduler.run(ctx)
+	// Recordings may have expired while the station was off
+	go station.pruneRecordings()
+	if monitorConfig := newMonitorConfig(cfg.Monitor); monitorConfig.enabled() {
+		station.monitor = &monitor{
+			station:   &station,
+			config:    monitorConfig,
+			listeners: make(map[chan []float32]struct{}),
+		}
+		go station.monitor.run(ctx)
+	}
 	return &station
 }
 
@@ -74,28 +196,126 @@ func (s *Station) callAll() {
 	s.CallManager.CallAll()
 }
 
+// placeCall calls stations and ring groups by name
+func (s *Station) placeCall(to []string) {
+	if to = s.callGroups(to, false); len(to) > 0 {
+		s.CallManager.PlaceCall(to)
+	}
+}
+
+func (s *Station) placeUrgentCall(to []string) {
+	if to = s.callGroups(to, true); len(to) > 0 {
+		s.CallManager.PlaceUrgentCall(to)
+	}
+}
+
 func (s *Station) hangupAll() {
 	s.CallManager.HangupAll()
 }
 
-func getOutputs(dotEnv map[string]string) Outputs {
-	if val, ok := dotEnv["OUTPUT_TYPE"]; ok && val == "led" {
-		chip := reserveChip()
-		defer chip.Close()
-		return newLedDisplay(chip)
+// muteAll mutes or unmutes every call
+func (s *Station) muteAll(muted bool) {
+	for _, c := range s.CallManager.Calls() {
+		if err := s.CallManager.Mute(c.Id, muted); err != nil {
+			log.Println("Unable to mute call:", err)
+		}
+	}
+}
+
+// holdAll puts every call on or off hold
+func (s *Station) holdAll(held bool) {
+	for _, c := range s.CallManager.Calls() {
+		if err := s.CallManager.Hold(c.Id, held); err != nil {
+			log.Println("Unable to hold call:", err)
+		}
+	}
+}
+
+func (s *Station) setDoNotDisturb(v bool) {
+	if v {
+		s.Status.Set(StatusDoNotDisturb)
 	} else {
-		panic(fmt.Sprintf("Unknown output type: %v", val))
+		s.Status.Clear(StatusDoNotDisturb)
 	}
 }
 
+// stationName falls back to the hostname when no name is set
+func stationName(name string) string {
+	if name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		log.Println("Unable to get hostname:", err)
+		return "intercom"
+	}
+	return name
+}
+
+func getOutputs(cfg *config.Config, station *Station) Outputs {
+	var outputs multiOutputs
+	for _, val := range cfg.Features.Outputs {
+		switch val {
+		case "led":
+			chip := reserveChip()
+			outputs = append(outputs, newLedDisplay(cfg.Pins, chip))
+			chip.Close()
+		case "mqtt":
+			outputs = append(outputs, station.mqttClient(cfg.MQTT))
+		case "ring":
+			outputs = append(outputs, newRinger(cfg, station))
+		case "tts":
+			outputs = append(outputs, newTTSOutput(station))
+		default:
+			panic(fmt.Sprintf("Unknown output type: %v", val))
+		}
+	}
+	if len(outputs) == 0 {
+		panic("No output type set")
+	}
+	if len(outputs) == 1 {
+		return outputs[0]
+	}
+	return outputs
+}
+
 // ctx is station context/main context from cmd
-func getInputs(ctx context.Context, dotEnv map[string]string, station *Station) Inputs {
-	if val, ok := dotEnv["INPUT_TYPE"]; ok && val == "button" {
-		inputs := newPhysicalInputs(ctx, dotEnv, station)
-		return inputs
-	} else {
-		panic(fmt.Sprintf("Unknown display type: %v", val))
+func getInputs(ctx context.Context, cfg *config.Config, station *Station) Inputs {
+	var inputs multiInputs
+	for _, val := range cfg.Features.Inputs {
+		switch val {
+		case "button":
+			inputs = append(inputs, newPhysicalInputs(ctx, cfg, station))
+		case "mqtt":
+			m := station.mqttClient(cfg.MQTT)
+			m.acceptCommands()
+			inputs = append(inputs, m)
+		case "control":
+			inputs = append(inputs, newControlInputs(cfg.Features, station))
+		case "volume":
+			inputs = append(inputs, newVolumeInputs(ctx, cfg, station))
+		case "voice":
+			inputs = append(inputs, newVoiceInputs(ctx, cfg.Voice, station))
+		default:
+			panic(fmt.Sprintf("Unknown input type: %v", val))
+		}
+	}
+	if len(inputs) == 0 {
+		panic("No input type set")
 	}
+	if len(inputs) == 1 {
+		return inputs[0]
+	}
+	return inputs
+}
+
+// mqttClient returns the station's MQTT connection, which is shared by the
+// mqtt input and output types
+func (s *Station) mqttClient(c config.MQTTConfig) *mqttClient {
+	if s.mqtt == nil {
+		s.mqtt = newMqttClient(c, s)
+	}
+	return s.mqtt
 }
 
 // StartPlayback begins the station's speaker playback
@@ -128,6 +348,9 @@ func (s *Station) Close() {
 	s.Outputs.Close()
 	s.Speaker.Close()
 	s.Microphone.Close()
+	for _, w := range s.webhooks {
+		w.Close()
+	}
 	log.Println("Station.Closed()")
 }
 
@@ -0,0 +1,41 @@
+package station
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/figadore/go-intercom/internal/config"
+)
+
+// MediaConfig decides how call audio is carried. Calls are always set up over
+// gRPC, but audio can move to RTP over UDP, which doesn't stall the whole
+// stream when a packet is lost
+type MediaConfig struct {
+	// RTP is tried first when both ends support it, falling back to the gRPC stream when UDP is blocked
+	RTP bool
+	// MinPort and MaxPort limit the UDP ports used, e.g. for a firewall. 0 means any port
+	MinPort, MaxPort int
+	// Adaptive RTP audio changes codec, packet size and redundancy during a call, based on loss and RTT
+	Adaptive bool
+	// Codecs limit what RTP audio is sent as, "l16" and "pcmu". Empty means both
+	Codecs []string
+}
+
+// newMediaConfig applies the defaults, RTP with adaptive audio, on any port,
+// with either codec
+func newMediaConfig(cfg *config.Config) MediaConfig {
+	m := MediaConfig{
+		RTP:      cfg.Media.Transport != "grpc",
+		Adaptive: cfg.Media.Adaptive || !cfg.IsSet("MEDIA_ADAPTIVE"),
+		Codecs:   cfg.Media.Codecs,
+	}
+	if ports := cfg.Media.RTPPorts; ports != "" {
+		bounds := strings.SplitN(ports, "-", 2)
+		m.MinPort, _ = strconv.Atoi(bounds[0])
+		m.MaxPort = m.MinPort
+		if len(bounds) == 2 {
+			m.MaxPort, _ = strconv.Atoi(bounds[1])
+		}
+	}
+	return m
+}
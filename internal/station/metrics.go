@@ -0,0 +1,53 @@
+package station
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// callMetrics are reported for each call, labeled with the call id and the
+// station on the other end
+var callMetrics = []struct {
+	name, kind, help string
+	value            func(q call.Quality) float64
+}{
+	{"intercom_call_rtt_seconds", "gauge", "Round-trip time to the other end",
+		func(q call.Quality) float64 { return q.RTT / 1000 }},
+	{"intercom_call_jitter_seconds", "gauge", "Inter-arrival jitter of received audio",
+		func(q call.Quality) float64 { return q.Jitter / 1000 }},
+	{"intercom_call_packets_lost_total", "counter", "RTP packets that never arrived",
+		func(q call.Quality) float64 { return float64(q.PacketsLost) }},
+	{"intercom_call_packets_late_total", "counter", "RTP packets that arrived out of order",
+		func(q call.Quality) float64 { return float64(q.PacketsLate) }},
+	{"intercom_call_send_bytes_per_second", "gauge", "Audio sent over the last second",
+		func(q call.Quality) float64 { return float64(q.SendRate) }},
+	{"intercom_call_receive_bytes_per_second", "gauge", "Audio received over the last second",
+		func(q call.Quality) float64 { return float64(q.ReceiveRate) }},
+	{"intercom_call_underflows_total", "counter", "Times the speaker ran out of audio during the call",
+		func(q call.Quality) float64 { return float64(q.Underflows) }},
+}
+
+// handleMetrics writes the station's metrics in the Prometheus text format
+func (c *controlInputs) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	calls := c.station.CallManager.Calls()
+	metricHeader(w, "intercom_calls", "gauge", "Calls in progress, including pending calls")
+	fmt.Fprintf(w, "intercom_calls %v\n", len(calls))
+	metricHeader(w, "intercom_speaker_underflows_total", "counter", "Times the speaker ran out of audio")
+	fmt.Fprintf(w, "intercom_speaker_underflows_total %v\n", c.station.Speaker.Underflows())
+	for _, m := range callMetrics {
+		metricHeader(w, m.name, m.kind, m.help)
+		for _, active := range calls {
+			fmt.Fprintf(w, "%v{id=\"%v\",peer=\"%v\"} %v\n", m.name, active.Id, labelEscaper.Replace(active.Peer), m.value(active.CurrentQuality()))
+		}
+	}
+}
+
+func metricHeader(w http.ResponseWriter, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
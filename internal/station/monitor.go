@@ -0,0 +1,201 @@
+package station
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jfreymuth/pulse"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	defaultMonitorDuration = 3 * time.Second
+	// After an alert, noise doesn't raise another one for this long
+	monitorAlertInterval = time.Minute
+	// How long the alert status stays set on stations that were alerted
+	monitorAlertDisplay = 30 * time.Second
+	// Listeners that fall this many messages behind miss audio
+	monitorListenerBuffer = 10
+)
+
+// monitorConfig makes the station a monitor, e.g. in a nursery, that other
+// stations may listen in to, and that alerts them when it hears noise
+type monitorConfig struct {
+	// listeners may listen in, by station name, or "*" for any station
+	listeners []string
+	// threshold is the level, in dBFS, that noise must pass for duration
+	// to raise an alert. 0 means no alerts
+	threshold float64
+	duration  time.Duration
+	// alertTo are the stations alerted, or "*" for every known station
+	alertTo []string
+}
+
+// newMonitorConfig applies the defaults, 3s of noise to raise an alert, sent
+// to the listeners unless MONITOR_ALERT_TO says otherwise
+func newMonitorConfig(c config.MonitorConfig) monitorConfig {
+	m := monitorConfig{
+		listeners: c.Listeners,
+		threshold: c.Threshold,
+		duration:  defaultMonitorDuration,
+		alertTo:   c.Listeners,
+	}
+	if c.Duration > 0 {
+		m.duration = c.Duration
+	}
+	if len(c.AlertTo) > 0 {
+		m.alertTo = c.AlertTo
+	}
+	return m
+}
+
+func (m monitorConfig) enabled() bool {
+	return len(m.listeners) > 0 || m.threshold != 0
+}
+
+// monitor records from the mic for as long as the station runs, sending the
+// audio to listeners and checking it for noise
+type monitor struct {
+	sync.Mutex
+	station   *Station
+	config    monitorConfig
+	listeners map[chan []float32]struct{}
+	// loud is how long the level has been over the threshold
+	loud      time.Duration
+	lastAlert time.Time
+}
+
+// IsMonitor is whether other stations may listen in to this one
+func (s *Station) IsMonitor() bool {
+	return s.monitor != nil && len(s.monitor.config.listeners) > 0
+}
+
+// MayListen is whether a station may listen in to this one
+func (s *Station) MayListen(name string) bool {
+	if !s.IsMonitor() {
+		return false
+	}
+	for _, l := range s.monitor.config.listeners {
+		if l == "*" || l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MonitorAudio returns mic audio at DeviceRate until ctx is done. Audio is
+// dropped if it isn't read in time
+func (s *Station) MonitorAudio(ctx context.Context) <-chan []float32 {
+	ch := make(chan []float32, monitorListenerBuffer)
+	s.monitor.Lock()
+	s.monitor.listeners[ch] = struct{}{}
+	s.monitor.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.monitor.Lock()
+		delete(s.monitor.listeners, ch)
+		s.monitor.Unlock()
+	}()
+	return ch
+}
+
+func (m *monitor) run(ctx context.Context) {
+	c, err := pulse.NewClient()
+	if err != nil {
+		log.Println("monitor: error creating pulse client", err)
+		return
+	}
+	defer c.Close()
+	rate := m.station.DeviceRate
+	stream, err := newRecord(c, pulse.Float32Writer(m.write), m.station.Microphone.device, rate)
+	if err != nil {
+		log.Println("monitor: error creating record stream", err)
+		return
+	}
+	defer stream.Close()
+	log.Println("Monitoring the mic")
+	stream.Start()
+	<-ctx.Done()
+	stream.Stop()
+}
+
+func (m *monitor) write(buf []float32) (int, error) {
+	data := append([]float32(nil), buf...)
+	m.Lock()
+	for ch := range m.listeners {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+	m.Unlock()
+	if m.config.threshold != 0 {
+		m.checkLevel(data)
+	}
+	return len(buf), nil
+}
+
+// checkLevel raises an alert once the level has been over the threshold for the configured duration
+func (m *monitor) checkLevel(samples []float32) {
+	level := Level(samples)
+	m.Lock()
+	if level < m.config.threshold {
+		m.loud = 0
+		m.Unlock()
+		return
+	}
+	m.loud += time.Duration(len(samples)) * time.Second / time.Duration(m.station.DeviceRate)
+	alert := m.loud >= m.config.duration && time.Since(m.lastAlert) > monitorAlertInterval
+	if alert {
+		m.lastAlert = time.Now()
+		m.loud = 0
+	}
+	m.Unlock()
+	if alert {
+		log.Printf("Monitor heard noise at %.1fdBFS, alerting %v\n", level, m.config.alertTo)
+		m.station.Publish(Event{Type: EventMonitorAlert, From: m.station.Name, Level: level})
+		go m.station.CallManager.Alert(level, m.config.alertTo)
+	}
+}
+
+// Level returns the RMS level of samples in dBFS, down to -100
+func Level(samples []float32) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	if len(samples) == 0 || sum == 0 {
+		return -100
+	}
+	return math.Max(-100, 10*math.Log10(sum/float64(len(samples))))
+}
+
+// listen plays a monitor station's mic until it's hung up
+func (s *Station) listen(name string) {
+	go s.CallManager.Listen(name)
+}
+
+// ReceiveAlert plays a chime and sets the alert status when a monitor hears
+// noise. Alerts come through during do-not-disturb
+func (s *Station) ReceiveAlert(from string, level float64) {
+	log.Printf("Alert from monitor %v, level %.1fdBFS\n", from, level)
+	s.Publish(Event{Type: EventMonitorAlert, From: from, Level: level})
+	s.Status.Set(StatusMonitorAlert)
+	s.alert.Lock()
+	if s.alert.clear != nil {
+		s.alert.clear.Stop()
+	}
+	s.alert.clear = time.AfterFunc(monitorAlertDisplay, func() {
+		s.Status.Clear(StatusMonitorAlert)
+	})
+	s.alert.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), alertToneDuration)
+	go func() {
+		defer cancel()
+		playTone(ctx, alertTone(s.Volume(), s.DeviceRate), s.Speaker.device)
+	}()
+}
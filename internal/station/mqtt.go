@@ -0,0 +1,411 @@
+package station
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	mqttQos            = 1
+	mqttConnectTimeout = 10 * time.Second
+	payloadOnline      = "online"
+	payloadOffline     = "offline"
+)
+
+// mqttClient connects the station to an MQTT broker, e.g. for Home Assistant
+//
+// As Outputs, it publishes the station status and call events. As Inputs, it
+// accepts commands on <prefix>/command/<action> and maps them onto the same
+// actions as the buttons
+type mqttClient struct {
+	station         *Station
+	client          mqtt.Client
+	prefix          string
+	discoveryPrefix string
+	closeOnce       sync.Once
+	// commands is set once the client is used as Inputs. Until then, nothing
+	// is subscribed to, so an output-only station can't be controlled
+	sync.Mutex
+	commands bool
+}
+
+func newMqttClient(c config.MQTTConfig, station *Station) *mqttClient {
+	m := &mqttClient{
+		station: station,
+		prefix:  "intercom/" + station.Name,
+	}
+	if c.TopicPrefix != "" {
+		m.prefix = strings.TrimSuffix(c.TopicPrefix, "/")
+	}
+	if c.Discovery {
+		m.discoveryPrefix = "homeassistant"
+		if c.DiscoveryPrefix != "" {
+			m.discoveryPrefix = strings.TrimSuffix(c.DiscoveryPrefix, "/")
+		}
+	}
+	log.Printf("Connecting to MQTT broker %v with topic prefix %v\n", c.Broker, m.prefix)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID("go-intercom-"+station.Name).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetWill(m.topic("availability"), payloadOffline, mqttQos, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("MQTT connection lost:", err)
+		})
+	m.client = mqtt.NewClient(opts)
+	// With ConnectRetry, this keeps trying in the background if the broker is down
+	token := m.client.Connect()
+	if token.WaitTimeout(mqttConnectTimeout) && token.Error() != nil {
+		log.Println("Error connecting to MQTT broker:", token.Error())
+	}
+	station.Subscribe(m)
+	return m
+}
+
+func (m *mqttClient) topic(name string) string {
+	return m.prefix + "/" + name
+}
+
+// onConnect is called on the first connection and every reconnection
+func (m *mqttClient) onConnect(client mqtt.Client) {
+	log.Println("Connected to MQTT broker")
+	if m.takesCommands() {
+		client.Subscribe(m.topic("command/+"), mqttQos, m.commandHandler)
+	}
+	m.publish("availability", true, payloadOnline)
+	if m.discoveryPrefix != "" {
+		m.publishDiscovery()
+	}
+	m.UpdateStatus(m.station.Status)
+}
+
+// acceptCommands subscribes to commands, now if the client is connected, and
+// on every reconnection. Discovery is published again, with the command topics
+func (m *mqttClient) acceptCommands() {
+	m.Lock()
+	m.commands = true
+	m.Unlock()
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+	m.client.Subscribe(m.topic("command/+"), mqttQos, m.commandHandler)
+	if m.discoveryPrefix != "" {
+		m.publishDiscovery()
+	}
+}
+
+func (m *mqttClient) takesCommands() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.commands
+}
+
+// publish sends a message without waiting, so it never blocks the caller.
+// Errors are logged, since there is nothing else to do about them
+func (m *mqttClient) publish(name string, retained bool, payload interface{}) {
+	token := m.client.Publish(m.topic(name), mqttQos, retained, payload)
+	go func() {
+		if token.WaitTimeout(mqttConnectTimeout) && token.Error() != nil {
+			log.Printf("Error publishing to MQTT topic %v: %v\n", name, token.Error())
+		}
+	}()
+}
+
+func (m *mqttClient) publishJSON(name string, retained bool, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding MQTT payload for %v: %v\n", name, err)
+		return
+	}
+	m.publish(name, retained, payload)
+}
+
+// UpdateStatus publishes all status flags and peer presence as retained JSON
+// objects, and the current volume settings as retained numbers
+func (m *mqttClient) UpdateStatus(status *Status) {
+	m.publishJSON("status", true, statusPayload(status))
+	m.publishJSON("presence", true, m.station.Peers())
+	m.publish("volume", true, []byte(strconv.Itoa(m.station.Volume())))
+	m.publish("mic_gain", true, []byte(strconv.Itoa(m.station.micGain())))
+}
+
+func statusPayload(status *Status) map[string]bool {
+	return map[string]bool{
+		"error":          status.Has(StatusError),
+		"do_not_disturb": status.Has(StatusDoNotDisturb),
+		"incoming_call":  status.Has(StatusIncomingCall),
+		"outgoing_call":  status.Has(StatusOutgoingCall),
+		"call_connected": status.Has(StatusCallConnected),
+		"ringing":        status.Has(StatusRinging),
+		"urgent_call":    status.Has(StatusUrgentCall),
+		"muted":          status.Has(StatusMuted),
+		"on_hold":        status.Has(StatusOnHold),
+		"monitor_alert":  status.Has(StatusMonitorAlert),
+		"doorbell":       status.Has(StatusDoorbell),
+		"call_waiting":   status.Has(StatusCallWaiting),
+	}
+}
+
+// HandleEvent publishes call events, which are not retained
+func (m *mqttClient) HandleEvent(e Event) {
+	m.publishJSON("event", false, e)
+}
+
+// commandHandler maps <prefix>/command/<action> messages to Inputs actions
+func (m *mqttClient) commandHandler(_ mqtt.Client, msg mqtt.Message) {
+	action := msg.Topic()[strings.LastIndex(msg.Topic(), "/")+1:]
+	payload := strings.TrimSpace(string(msg.Payload()))
+	log.Printf("Received MQTT command %v: %v\n", action, payload)
+	switch action {
+	case "call":
+		m.placeCall(parseStations(payload))
+	case "call_urgent":
+		m.station.placeUrgentCall(parseStations(payload))
+	case "call_all":
+		m.callAll()
+	case "hangup":
+		m.hangup()
+	case "accept":
+		m.acceptCall()
+	case "reject":
+		m.rejectCall()
+	case "swap":
+		m.station.swapCalls()
+	case "dnd":
+		on, ok := parseOnOff(payload)
+		if !ok {
+			log.Println("Unknown MQTT do-not-disturb payload:", payload)
+			return
+		}
+		m.setDoNotDisturb(on)
+	case "mute", "hold":
+		on, ok := parseOnOff(payload)
+		if !ok {
+			log.Printf("Unknown MQTT %v payload: %v\n", action, payload)
+		} else if action == "mute" {
+			m.setMute(on)
+		} else {
+			m.setHold(on)
+		}
+	case "volume":
+		percent, err := strconv.Atoi(payload)
+		if err != nil || percent < 0 || percent > 100 {
+			log.Println("Invalid MQTT volume payload:", payload)
+			return
+		}
+		m.setVolume(percent)
+	case "mic_gain":
+		percent, err := strconv.Atoi(payload)
+		if err != nil {
+			log.Println("Invalid MQTT mic gain payload:", payload)
+			return
+		}
+		if err := m.station.setMicGain(percent); err != nil {
+			log.Println("Invalid MQTT mic gain payload:", err)
+		}
+	case "announce":
+		// <clip> plays on every station, <clip>:<station>,<station> on just those
+		clip, to := payload, ""
+		if i := strings.Index(payload, ":"); i >= 0 {
+			clip, to = payload[:i], payload[i+1:]
+		}
+		if err := m.station.announce(strings.TrimSpace(clip), parseStations(to)); err != nil {
+			log.Println("Invalid MQTT announce payload:", err)
+		}
+	case "doorbell":
+		m.station.ringDoorbell()
+	case "listen":
+		if payload == "" {
+			log.Println("Invalid MQTT listen payload: no station")
+			return
+		}
+		m.station.listen(payload)
+	case "say":
+		// Plain text is spoken here, {"text":...,"to":[...]} on other stations
+		var req controlRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			req = controlRequest{Text: payload}
+		}
+		go m.station.say(req.Text, req.To)
+	default:
+		log.Println("Unknown MQTT command:", action)
+	}
+}
+
+func parseOnOff(payload string) (on bool, ok bool) {
+	switch strings.ToUpper(payload) {
+	case "ON", "TRUE", "1":
+		return true, true
+	case "OFF", "FALSE", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// parseStations splits a comma separated list of stations in a command
+// payload, such as kitchen,hall
+func parseStations(payload string) []string {
+	var names []string
+	for _, name := range strings.Split(payload, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Accepting or rejecting only makes sense while a call is ringing,
+// otherwise nothing is listening on the accept channel
+func (m *mqttClient) acceptCall() {
+	if m.station.Status.Has(StatusRinging) {
+		m.station.AcceptCall()
+	}
+}
+
+func (m *mqttClient) rejectCall() {
+	if m.station.Status.Has(StatusRinging) {
+		m.station.RejectCall()
+	}
+}
+
+func (m *mqttClient) placeCall(to []string) {
+	m.station.placeCall(to)
+}
+
+func (m *mqttClient) callAll() {
+	m.station.callAll()
+}
+
+func (m *mqttClient) hangup() {
+	m.station.hangupAll()
+}
+
+func (m *mqttClient) setVolume(percent int) {
+	m.station.setVolume(percent)
+}
+
+func (m *mqttClient) setDoNotDisturb(v bool) {
+	m.station.setDoNotDisturb(v)
+}
+
+func (m *mqttClient) setMute(v bool) {
+	m.station.muteAll(v)
+}
+
+func (m *mqttClient) setHold(v bool) {
+	m.station.holdAll(v)
+}
+
+// Close is shared by Inputs and Outputs, so only disconnect once
+func (m *mqttClient) Close() {
+	m.closeOnce.Do(func() {
+		log.Debugln("mqttClient.Close: enter")
+		token := m.client.Publish(m.topic("availability"), mqttQos, true, payloadOffline)
+		token.WaitTimeout(time.Second)
+		m.client.Disconnect(250)
+		log.Debugln("mqttClient.Close: disconnected")
+	})
+}
+
+var invalidObjectId = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// publishDiscovery announces the station's entities to Home Assistant
+// Without commands, switches and numbers are read-only sensors, and there are
+// no buttons
+// See https://www.home-assistant.io/docs/mqtt/discovery/
+func (m *mqttClient) publishDiscovery() {
+	commands := m.takesCommands()
+	nodeId := "intercom_" + invalidObjectId.ReplaceAllString(m.station.Name, "_")
+	device := map[string]interface{}{
+		"identifiers":  []string{nodeId},
+		"name":         "Intercom " + m.station.Name,
+		"manufacturer": "go-intercom",
+	}
+	entity := func(component, objectId, name string, config map[string]interface{}) {
+		config["name"] = fmt.Sprintf("Intercom %v %v", m.station.Name, name)
+		config["unique_id"] = nodeId + "_" + objectId
+		config["device"] = device
+		config["availability_topic"] = m.topic("availability")
+		payload, err := json.Marshal(config)
+		if err != nil {
+			log.Println("Error encoding MQTT discovery config:", err)
+			return
+		}
+		topic := fmt.Sprintf("%v/%v/%v/%v/config", m.discoveryPrefix, component, nodeId, objectId)
+		m.client.Publish(topic, mqttQos, true, payload)
+	}
+	for objectId, field := range map[string]string{
+		"dnd":  "do_not_disturb",
+		"mute": "muted",
+		"hold": "on_hold",
+	} {
+		config := map[string]interface{}{
+			"state_topic":    m.topic("status"),
+			"value_template": fmt.Sprintf("{{ 'ON' if value_json.%v else 'OFF' }}", field),
+		}
+		if !commands {
+			entity("binary_sensor", objectId, strings.ReplaceAll(field, "_", " "), config)
+			continue
+		}
+		config["command_topic"] = m.topic("command/" + objectId)
+		entity("switch", objectId, strings.ReplaceAll(field, "_", " "), config)
+	}
+	for objectId, name := range map[string]string{
+		"call_connected": "call connected",
+		"incoming_call":  "incoming call",
+		"ringing":        "ringing",
+		"outgoing_call":  "outgoing call",
+		"error":          "error",
+		"monitor_alert":  "monitor alert",
+		"doorbell":       "doorbell",
+		"call_waiting":   "call waiting",
+	} {
+		entity("binary_sensor", objectId, name, map[string]interface{}{
+			"state_topic":    m.topic("status"),
+			"value_template": fmt.Sprintf("{{ 'ON' if value_json.%v else 'OFF' }}", objectId),
+		})
+	}
+	if !commands {
+		entity("sensor", "volume", "volume", map[string]interface{}{"state_topic": m.topic("volume")})
+		entity("sensor", "mic_gain", "mic gain", map[string]interface{}{"state_topic": m.topic("mic_gain")})
+		return
+	}
+	for objectId, name := range map[string]string{
+		"call_all": "call all",
+		"hangup":   "hang up",
+		"accept":   "accept call",
+		"reject":   "reject call",
+		"swap":     "swap calls",
+	} {
+		entity("button", objectId, name, map[string]interface{}{
+			"command_topic": m.topic("command/" + objectId),
+		})
+	}
+	entity("number", "volume", "volume", map[string]interface{}{
+		"command_topic": m.topic("command/volume"),
+		"state_topic":   m.topic("volume"),
+		"min":           0,
+		"max":           100,
+	})
+	entity("number", "mic_gain", "mic gain", map[string]interface{}{
+		"command_topic": m.topic("command/mic_gain"),
+		"state_topic":   m.topic("mic_gain"),
+		"min":           0,
+		"max":           maxMicGain,
+	})
+}
@@ -0,0 +1,209 @@
+package station
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMqttClient records what is published and subscribed to, in place of a broker
+type fakeMqttClient struct {
+	sync.Mutex
+	connected     bool
+	subscriptions map[string]mqtt.MessageHandler
+	published     map[string]string
+}
+
+func newFakeMqttClient() *fakeMqttClient {
+	return &fakeMqttClient{
+		connected:     true,
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		published:     make(map[string]string),
+	}
+}
+
+func (f *fakeMqttClient) IsConnected() bool      { return f.connected }
+func (f *fakeMqttClient) IsConnectionOpen() bool { return f.connected }
+func (f *fakeMqttClient) Connect() mqtt.Token    { return fakeToken{} }
+func (f *fakeMqttClient) Disconnect(uint)        {}
+
+func (f *fakeMqttClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	f.Lock()
+	defer f.Unlock()
+	switch p := payload.(type) {
+	case string:
+		f.published[topic] = p
+	case []byte:
+		f.published[topic] = string(p)
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMqttClient) Subscribe(topic string, _ byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.Lock()
+	defer f.Unlock()
+	f.subscriptions[topic] = callback
+	return fakeToken{}
+}
+
+func (f *fakeMqttClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic := range filters {
+		f.Subscribe(topic, 0, callback)
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMqttClient) Unsubscribe(topics ...string) mqtt.Token {
+	f.Lock()
+	defer f.Unlock()
+	for _, topic := range topics {
+		delete(f.subscriptions, topic)
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMqttClient) AddRoute(string, mqtt.MessageHandler) {}
+
+func (f *fakeMqttClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+func (f *fakeMqttClient) subscribed(topic string) (mqtt.MessageHandler, bool) {
+	f.Lock()
+	defer f.Unlock()
+	handler, ok := f.subscriptions[topic]
+	return handler, ok
+}
+
+func (f *fakeMqttClient) message(topic string) (string, bool) {
+	f.Lock()
+	defer f.Unlock()
+	payload, ok := f.published[topic]
+	return payload, ok
+}
+
+type fakeToken struct{}
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Error() error                   { return nil }
+
+func (fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return mqttQos }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+// newTestMqttClient connects an mqttClient for a station called kitchen to a fake broker
+func newTestMqttClient(discovery bool) (*mqttClient, *fakeMqttClient) {
+	s := &Station{
+		Name:  "kitchen",
+		state: &savedState{SpeakerVolume: defaultVolume},
+	}
+	s.Status = &Status{station: s}
+	fake := newFakeMqttClient()
+	m := &mqttClient{
+		station: s,
+		client:  fake,
+		prefix:  "intercom/kitchen",
+	}
+	if discovery {
+		m.discoveryPrefix = "homeassistant"
+	}
+	s.Outputs = m
+	return m, fake
+}
+
+func TestMqttOutputOnlyDoesNotSubscribe(t *testing.T) {
+	m, fake := newTestMqttClient(true)
+	m.onConnect(fake)
+	if len(fake.subscriptions) != 0 {
+		t.Errorf("subscribed to %v without the mqtt input", fake.subscriptions)
+	}
+	if payload, _ := fake.message("intercom/kitchen/availability"); payload != payloadOnline {
+		t.Errorf("availability is %q, want %q", payload, payloadOnline)
+	}
+	if _, ok := fake.message("homeassistant/switch/intercom_kitchen/dnd/config"); ok {
+		t.Error("published a do-not-disturb switch without the mqtt input")
+	}
+	if _, ok := fake.message("homeassistant/binary_sensor/intercom_kitchen/dnd/config"); !ok {
+		t.Error("didn't publish do-not-disturb as a sensor")
+	}
+	if _, ok := fake.message("homeassistant/button/intercom_kitchen/hangup/config"); ok {
+		t.Error("published a hang up button without the mqtt input")
+	}
+}
+
+func TestMqttInputSubscribes(t *testing.T) {
+	m, fake := newTestMqttClient(true)
+	// The output connects first, then the input is added
+	m.onConnect(fake)
+	m.acceptCommands()
+	if _, ok := fake.subscribed("intercom/kitchen/command/+"); !ok {
+		t.Fatal("didn't subscribe to commands once used as an input")
+	}
+	config, ok := fake.message("homeassistant/switch/intercom_kitchen/dnd/config")
+	if !ok {
+		t.Fatal("didn't publish the do-not-disturb switch once used as an input")
+	}
+	if !strings.Contains(config, `"command_topic":"intercom/kitchen/command/dnd"`) {
+		t.Errorf("do-not-disturb switch has no command topic: %v", config)
+	}
+
+	// Reconnecting subscribes again
+	delete(fake.subscriptions, "intercom/kitchen/command/+")
+	m.onConnect(fake)
+	if _, ok := fake.subscribed("intercom/kitchen/command/+"); !ok {
+		t.Error("didn't subscribe to commands again on reconnection")
+	}
+}
+
+func TestMqttInputNotConnected(t *testing.T) {
+	m, fake := newTestMqttClient(false)
+	fake.connected = false
+	m.acceptCommands()
+	if len(fake.subscriptions) != 0 {
+		t.Fatal("subscribed while not connected")
+	}
+	fake.connected = true
+	m.onConnect(fake)
+	if _, ok := fake.subscribed("intercom/kitchen/command/+"); !ok {
+		t.Error("didn't subscribe to commands on connecting")
+	}
+}
+
+func TestMqttCommand(t *testing.T) {
+	m, fake := newTestMqttClient(false)
+	m.onConnect(fake)
+	m.acceptCommands()
+	handler, _ := fake.subscribed("intercom/kitchen/command/+")
+	handler(fake, fakeMessage{topic: "intercom/kitchen/command/dnd", payload: "ON"})
+	if !m.station.Status.Has(StatusDoNotDisturb) {
+		t.Fatal("dnd ON didn't turn on do-not-disturb")
+	}
+	payload, _ := fake.message("intercom/kitchen/status")
+	var status map[string]bool
+	if err := json.Unmarshal([]byte(payload), &status); err != nil {
+		t.Fatalf("status %q: %v", payload, err)
+	}
+	if !status["do_not_disturb"] {
+		t.Errorf("published status %v doesn't have do-not-disturb", status)
+	}
+}
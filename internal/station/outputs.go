@@ -2,10 +2,9 @@ package station
 
 import (
 	"log"
-	"strconv"
 	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/figadore/go-intercom/internal/config"
 	"github.com/warthog618/gpiod"
 )
 
@@ -17,6 +16,21 @@ type Outputs interface {
 	Close()
 }
 
+// multiOutputs sends status updates to several Outputs, e.g. LEDs and MQTT
+type multiOutputs []Outputs
+
+func (m multiOutputs) UpdateStatus(status *Status) {
+	for _, o := range m {
+		o.UpdateStatus(status)
+	}
+}
+
+func (m multiOutputs) Close() {
+	for _, o := range m {
+		o.Close()
+	}
+}
+
 type led struct {
 	line     *gpiod.Line
 	ticker   *time.Ticker
@@ -99,24 +113,13 @@ type ledDisplay struct {
 	greenLed, yellowLed *led
 }
 
-func newLedDisplay(chip *gpiod.Chip) *ledDisplay {
-	// Find out which LED pins we're working with on this device
-	dotEnv, err := godotenv.Read()
-	if err != nil {
-		panic(err)
-	}
-
-	greenLedPin, _ := strconv.Atoi(dotEnv["GREEN_LED_PIN"])
-	log.Printf("Found pin %d for green LED in .env ...\n", greenLedPin)
-	yellowLedPin, _ := strconv.Atoi(dotEnv["YELLOW_LED_PIN"])
-	log.Printf("Found pin %d for yellow LED in .env ...\n", yellowLedPin)
-
+func newLedDisplay(pins config.PinsConfig, chip *gpiod.Chip) *ledDisplay {
 	// Set up LED lines
-	greenLed, err := chip.RequestLine(greenLedPin, gpiod.AsOutput(0))
+	greenLed, err := chip.RequestLine(pins.GreenLed, gpiod.AsOutput(0))
 	if err != nil {
 		panic(err)
 	}
-	yellowLed, err := chip.RequestLine(yellowLedPin, gpiod.AsOutput(0))
+	yellowLed, err := chip.RequestLine(pins.YellowLed, gpiod.AsOutput(0))
 	if err != nil {
 		panic(err)
 	}
@@ -149,6 +152,21 @@ func (d *ledDisplay) UpdateStatus(status *Status) {
 		log.Println("call connected status")
 		d.greenLed.on()
 	}
+	if status.Has(StatusOnHold) {
+		// green slow blink
+		log.Println("call on hold status")
+		d.greenLed.blink(time.Millisecond * 1500)
+	}
+	if status.Has(StatusMuted) {
+		// yellow slow blink
+		log.Println("call muted status")
+		d.yellowLed.blink(time.Millisecond * 1500)
+	}
+	if status.Has(StatusMonitorAlert) {
+		// yellow fast blink
+		log.Println("monitor alert status")
+		d.yellowLed.blink(time.Millisecond * 200)
+	}
 	if status.Has(StatusError) {
 		// green/yellow on
 		d.yellowLed.on()
@@ -0,0 +1,131 @@
+package station
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/figadore/go-intercom/pkg/resample"
+)
+
+const (
+	// Audio goes to the speaker in 20ms chunks
+	playoutChunksPerSecond = 50
+	// Drift corrections are limited to 0.1%, which can't be heard
+	maxDriftPPM = 1000
+	// ppm of correction for every 100ms the buffer is away from its target
+	driftGain = 1000
+	// How slowly the fill level and packet size estimates follow changes, in chunks
+	fillSmoothing = 100
+	// Beyond this many seconds more than the target, e.g. after the network
+	// stalls, audio is dropped rather than slowly caught up on
+	maxExcessSeconds = 1
+)
+
+// PlayoutBuffer sits between a call's received audio and the speaker
+//
+// Audio is received at the rate of the other end's sound card, and played at
+// the rate of this one. No two run at exactly the same rate, so over a long call
+// the buffer would slowly fill or run dry. PlayoutBuffer watches how full it
+// stays, estimates the drift from that, and resamples received audio to
+// cancel it, keeping the latency bounded
+type PlayoutBuffer struct {
+	sync.Mutex
+	// rate is the sample rate of the audio written, and of the speaker
+	rate      int
+	samples   []float32
+	resampler *resample.Linear
+	// fill and packet are smoothed, in samples
+	fill   float64
+	packet float64
+	// notify wakes Play when audio arrives
+	notify chan struct{}
+}
+
+// NewPlayoutBuffer creates a buffer for audio at rate
+func NewPlayoutBuffer(rate int) *PlayoutBuffer {
+	return &PlayoutBuffer{
+		rate:      rate,
+		resampler: resample.NewLinear(1),
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// Write adds received audio. It never blocks, so the network is read as fast as audio arrives
+func (b *PlayoutBuffer) Write(samples []float32) {
+	b.Lock()
+	if b.packet == 0 {
+		b.packet = float64(len(samples))
+	}
+	b.packet += (float64(len(samples)) - b.packet) / fillSmoothing
+	b.samples = append(b.samples, b.resampler.Process(samples)...)
+	if excess := len(b.samples) - int(b.target()) - maxExcessSeconds*b.rate; excess > 0 {
+		b.samples = b.samples[excess:]
+		b.fill -= float64(excess)
+	}
+	b.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// target is the fill level to aim for: a packet's worth of audio, plus some room for jitter
+func (b *PlayoutBuffer) target() float64 {
+	return b.packet + 2*float64(b.chunk())
+}
+
+// chunk is the number of samples sent to the speaker at a time
+func (b *PlayoutBuffer) chunk() int {
+	return b.rate / playoutChunksPerSecond
+}
+
+// Play sends audio to ch at the speaker's pace until ctx is done
+func (b *PlayoutBuffer) Play(ctx context.Context, ch chan []float32) {
+	for {
+		chunk := b.next()
+		if chunk == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.notify:
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- chunk:
+		}
+	}
+}
+
+// next takes the next chunk of audio, and adjusts the drift correction
+func (b *PlayoutBuffer) next() []float32 {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.samples) == 0 {
+		return nil
+	}
+	b.fill += (float64(len(b.samples)) - b.fill) / fillSmoothing
+	// Resample to fewer samples while the buffer is too full, and more while it's too empty
+	errorSeconds := (b.fill - b.target()) / float64(b.rate)
+	ppm := math.Max(-maxDriftPPM, math.Min(maxDriftPPM, driftGain*errorSeconds*10))
+	b.resampler.SetRatio(1 - ppm/1e6)
+	n := b.chunk()
+	if n > len(b.samples) {
+		n = len(b.samples)
+	}
+	chunk := make([]float32, n)
+	copy(chunk, b.samples)
+	b.samples = b.samples[n:]
+	return chunk
+}
+
+// Drift returns the current correction in ppm, positive when the other end's
+// clock runs fast, and the smoothed buffer fill in milliseconds
+func (b *PlayoutBuffer) Drift() (ppm float64, fillMs float64) {
+	b.Lock()
+	defer b.Unlock()
+	return (1 - b.resampler.Ratio()) * 1e6, b.fill * 1000 / float64(b.rate)
+}
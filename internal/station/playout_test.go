@@ -0,0 +1,71 @@
+package station
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestPlayoutDrift plays a long call from a station whose clock runs fast or
+// slow, and checks the buffer neither grows nor runs dry
+func TestPlayoutDrift(t *testing.T) {
+	const (
+		rate     = WidebandRate
+		packet   = rate / 50
+		duration = 30 * time.Minute
+		// Time for the correction to settle
+		settle = 2 * time.Minute
+		// Without correction, 200ppm over the call would be 360ms
+		maxError = 40 * time.Millisecond
+	)
+	for _, ppm := range []float64{200, -200} {
+		b := NewPlayoutBuffer(rate)
+		// The other end sends a packet every 20ms by its clock, and the
+		// speaker takes a chunk every 20ms by ours
+		sendInterval := 20 * time.Millisecond.Seconds() / (1 + ppm/1e6)
+		playInterval := 20 * time.Millisecond.Seconds()
+		nextSend, nextPlay := 0.0, 2*playInterval
+		minFill, maxFill := math.MaxInt32, 0
+		underruns, plays := 0, 0
+		driftSum := 0.0
+		for nextPlay < duration.Seconds() {
+			if nextSend <= nextPlay {
+				b.Write(make([]float32, packet))
+				nextSend += sendInterval
+				continue
+			}
+			b.Lock()
+			fill := len(b.samples)
+			b.Unlock()
+			chunk := b.next()
+			nextPlay += playInterval
+			if nextPlay < settle.Seconds() {
+				continue
+			}
+			if len(chunk) < b.chunk() {
+				underruns++
+			}
+			if fill < minFill {
+				minFill = fill
+			}
+			if fill > maxFill {
+				maxFill = fill
+			}
+			// The correction swings as packets slip, so check its average
+			drift, _ := b.Drift()
+			driftSum += drift
+			plays++
+		}
+		target := int(b.target())
+		bound := int(maxError.Seconds() * rate)
+		if minFill < target-bound || maxFill > target+bound {
+			t.Errorf("%+vppm: buffer went from %v to %v samples, want %v±%v", ppm, minFill, maxFill, target, bound)
+		}
+		if underruns > 0 {
+			t.Errorf("%+vppm: speaker ran dry %v times", ppm, underruns)
+		}
+		if drift := driftSum / float64(plays); math.Abs(drift-ppm) > 10 {
+			t.Errorf("%+vppm: corrected %.0fppm on average", ppm, drift)
+		}
+	}
+}
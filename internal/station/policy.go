@@ -0,0 +1,89 @@
+package station
+
+import (
+	"fmt"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+// Policy decides how an incoming call is handled, based on who is calling
+type Policy int
+
+const (
+	// PolicyDefault auto-answers, unless do-not-disturb is on
+	PolicyDefault Policy = iota
+	// PolicyAnswer always auto-answers, even in do-not-disturb
+	PolicyAnswer
+	// PolicyReject always rejects the call
+	PolicyReject
+	// PolicyRing always waits for the call to be accepted, and rings at full volume, even during quiet hours
+	PolicyRing
+	// PolicyVoicemail records a message without ringing
+	PolicyVoicemail
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyDefault:
+		return "default"
+	case PolicyAnswer:
+		return "answer"
+	case PolicyReject:
+		return "reject"
+	case PolicyRing:
+		return "ring"
+	case PolicyVoicemail:
+		return "voicemail"
+	}
+	return "unknown"
+}
+
+func parsePolicy(name string) (Policy, error) {
+	for p := PolicyDefault; p <= PolicyVoicemail; p++ {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return PolicyDefault, fmt.Errorf("unknown policy %q", name)
+}
+
+// callerPolicies maps caller station names to policies
+// An urgent call from one of urgentCallers rings even in do-not-disturb
+type callerPolicies struct {
+	policies      map[string]Policy
+	urgentCallers map[string]bool
+}
+
+// newCallerPolicies takes CALLER_POLICIES, e.g. "nursery=ring,spam=reject",
+// and URGENT_CALLERS, e.g. "nursery,frontdoor" or "*" for anyone
+func newCallerPolicies(c config.PoliciesConfig) callerPolicies {
+	p := callerPolicies{
+		policies:      make(map[string]Policy),
+		urgentCallers: make(map[string]bool),
+	}
+	for caller, name := range c.Callers {
+		policy, err := parsePolicy(name)
+		if err != nil {
+			log.Printf("Ignoring policy for %v: %v\n", caller, err)
+			continue
+		}
+		p.policies[caller] = policy
+	}
+	for _, caller := range c.UrgentCallers {
+		p.urgentCallers[caller] = true
+	}
+	return p
+}
+
+// CallPolicy returns the policy for an incoming call from the named station
+// Urgent calls ring at full volume through do-not-disturb, rather than being
+// answered, so the mic is never opened without someone accepting
+func (s *Station) CallPolicy(caller string, urgent bool) Policy {
+	policy := s.callerPolicies.policies[caller]
+	if urgent && policy != PolicyReject && (s.callerPolicies.urgentCallers[caller] || s.callerPolicies.urgentCallers["*"]) {
+		log.Printf("Urgent call from %v allowed to break through do-not-disturb\n", caller)
+		return PolicyRing
+	}
+	return policy
+}
@@ -0,0 +1,38 @@
+package station
+
+import (
+	"testing"
+
+	"github.com/figadore/go-intercom/internal/config"
+)
+
+func TestCallPolicy(t *testing.T) {
+	s := &Station{
+		callerPolicies: newCallerPolicies(config.PoliciesConfig{
+			Callers:       map[string]string{"nursery": "answer", "spam": "reject", "garage": "voicemail"},
+			UrgentCallers: []string{"nursery", "spam", "garage", "office"},
+		}),
+	}
+	tests := []struct {
+		caller string
+		urgent bool
+		want   Policy
+	}{
+		{"nursery", false, PolicyAnswer},
+		{"spam", false, PolicyReject},
+		{"garage", false, PolicyVoicemail},
+		{"kitchen", false, PolicyDefault},
+		// Urgent calls ring, rather than opening the mic
+		{"nursery", true, PolicyRing},
+		{"garage", true, PolicyRing},
+		{"office", true, PolicyRing},
+		{"spam", true, PolicyReject},
+		// Only from urgent callers
+		{"kitchen", true, PolicyDefault},
+	}
+	for _, tt := range tests {
+		if got := s.CallPolicy(tt.caller, tt.urgent); got != tt.want {
+			t.Errorf("CallPolicy(%v, %v) = %v, want %v", tt.caller, tt.urgent, got, tt.want)
+		}
+	}
+}
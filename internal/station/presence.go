@@ -0,0 +1,96 @@
+package station
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+// Presence is what this station last heard from a peer
+type Presence int
+
+const (
+	PresenceUnknown Presence = iota
+	PresenceOnline
+	PresenceOffline
+	PresenceDoNotDisturb
+	PresenceInCall
+)
+
+func (p Presence) String() string {
+	switch p {
+	case PresenceOnline:
+		return "online"
+	case PresenceOffline:
+		return "offline"
+	case PresenceDoNotDisturb:
+		return "dnd"
+	case PresenceInCall:
+		return "in_call"
+	}
+	return "unknown"
+}
+
+func (p Presence) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Reachable is true unless the peer is known to be offline
+func (p Presence) Reachable() bool {
+	return p != PresenceOffline
+}
+
+// How often peers are pinged, unless PRESENCE_INTERVAL is set
+const defaultPresenceInterval = 30 * time.Second
+
+// presenceList tracks the presence of every known station by name
+type presenceList struct {
+	sync.Mutex
+	peers map[string]Presence
+}
+
+// Stations returns the names of the intercom stations in the directory,
+// leaving out SIP phones
+func (s *Station) Stations() []string {
+	var names []string
+	for name, address := range s.directory {
+		if !strings.HasPrefix(address, "sip:") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetPresence records a peer's presence. Outputs are updated when it changes
+func (s *Station) SetPresence(name string, p Presence) {
+	s.presence.Lock()
+	old := s.presence.peers[name]
+	s.presence.peers[name] = p
+	s.presence.Unlock()
+	if old != p {
+		log.Printf("Station %v is %v\n", name, p)
+		s.Outputs.UpdateStatus(s.Status)
+	}
+}
+
+// Presence returns what was last heard from a peer
+func (s *Station) Presence(name string) Presence {
+	s.presence.Lock()
+	defer s.presence.Unlock()
+	return s.presence.peers[name]
+}
+
+// Peers returns the presence of every peer that has been pinged
+func (s *Station) Peers() map[string]Presence {
+	s.presence.Lock()
+	defer s.presence.Unlock()
+	peers := make(map[string]Presence, len(s.presence.peers))
+	for name, p := range s.presence.peers {
+		peers[name] = p
+	}
+	return peers
+}
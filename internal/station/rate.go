@@ -0,0 +1,33 @@
+package station
+
+// WidebandRate is the highest rate audio is sent at between stations. Every
+// station supports SampleRate, so calls fall back to it when either end can't
+// do better
+const WidebandRate = 16000
+
+// WireRate is the highest rate this station offers for calls
+func (s *Station) WireRate() int {
+	if s.DeviceRate >= WidebandRate {
+		return WidebandRate
+	}
+	return SampleRate
+}
+
+// NegotiateRate picks the rate for a call from what each end offered: the
+// lower of the two. Ends that don't say, like SIP phones and older stations,
+// only support SampleRate
+func NegotiateRate(local, remote int) int {
+	if remote == 0 {
+		remote = SampleRate
+	}
+	if remote < local {
+		return remote
+	}
+	return local
+}
+
+// fragmentSize scales FragmentSize to a sound card rate, so that each
+// fragment is the same length of time at any rate
+func fragmentSize(rate int) int {
+	return FragmentSize * rate / SampleRate
+}
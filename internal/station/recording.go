@@ -0,0 +1,327 @@
+package station
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/ogg"
+	"github.com/figadore/go-intercom/pkg/wav"
+)
+
+const defaultRecordingDir = "recordings"
+
+// recordingFormats are the file formats calls can be recorded in, by extension
+var recordingFormats = []string{"wav", "ogg"}
+
+// RecordingMode is which audio of a call is recorded
+type RecordingMode int
+
+const (
+	RecordingOff RecordingMode = iota
+	// RecordingMic is what this station sent, after mute and hold
+	RecordingMic
+	// RecordingRemote is what the other end sent
+	RecordingRemote
+	// RecordingMixed is both, mixed into one track
+	RecordingMixed
+)
+
+func (m RecordingMode) String() string {
+	switch m {
+	case RecordingMic:
+		return "mic"
+	case RecordingRemote:
+		return "remote"
+	case RecordingMixed:
+		return "mixed"
+	}
+	return "off"
+}
+
+type recordingConfig struct {
+	mode RecordingMode
+	// format is wav, or ogg for FLAC in Ogg, which takes around half the space
+	format string
+	dir    string
+	// Recordings older than retention are deleted, and the oldest are deleted
+	// while there are more than maxBytes. 0 means no limit
+	retention time.Duration
+	maxBytes  int64
+	// notice plays a tone to the other end when a recorded call connects
+	notice bool
+}
+
+// newRecordingConfig takes CALL_RECORDING (off, mic, remote or mixed, default
+// off), RECORDING_FORMAT (wav or ogg, default wav), RECORDING_DIR,
+// RECORDING_RETENTION, e.g. "720h", RECORDING_MAX_MB and RECORDING_NOTICE
+// (true or false, default true)
+func newRecordingConfig(cfg *config.Config) recordingConfig {
+	c := cfg.Recording
+	r := recordingConfig{
+		format:    "wav",
+		dir:       defaultRecordingDir,
+		retention: c.Retention,
+		maxBytes:  int64(c.MaxMB) << 20,
+		notice:    c.Notice || !cfg.IsSet("RECORDING_NOTICE"),
+	}
+	for m := RecordingOff; m <= RecordingMixed; m++ {
+		if m.String() == c.Mode {
+			r.mode = m
+		}
+	}
+	if c.Format != "" {
+		r.format = c.Format
+	}
+	if c.Dir != "" {
+		r.dir = c.Dir
+	}
+	return r
+}
+
+// RecordingNotice is whether the other end should hear a tone when a recorded call connects
+func (s *Station) RecordingNotice() bool {
+	return s.recording.mode != RecordingOff && s.recording.notice
+}
+
+// audioWriter is a WAV or Ogg file being written
+type audioWriter interface {
+	Write(samples []float32) error
+	Close() error
+}
+
+// CallRecording records a call to a WAV or Ogg file named after the call, at
+// the call's sample rate. Mic and Remote may be called from different goroutines
+type CallRecording struct {
+	sync.Mutex
+	station *Station
+	call    *call.Call
+	mode    RecordingMode
+	path    string
+	file    *os.File
+	writer  audioWriter
+	// When mixing, audio from each side waits here for the other side's
+	mic, remote []float32
+}
+
+// RecordCall starts recording a connected call. It returns nil if calls aren't recorded
+func (s *Station) RecordCall(c *call.Call) (*CallRecording, error) {
+	if s.recording.mode == RecordingOff {
+		return nil, nil
+	}
+	s.pruneRecordings()
+	if err := os.MkdirAll(s.recording.dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.recording.dir, c.Id.String()+"."+s.recording.format)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var w audioWriter
+	if s.recording.format == "ogg" {
+		w, err = ogg.NewWriter(f, c.SampleRate)
+	} else {
+		w, err = wav.NewWriter(f, c.SampleRate)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	log.Println("Recording call to", path)
+	return &CallRecording{
+		station: s,
+		call:    c,
+		mode:    s.recording.mode,
+		path:    path,
+		file:    f,
+		writer:  w,
+	}, nil
+}
+
+// Mic records audio sent to the other end
+func (r *CallRecording) Mic(samples []float32) {
+	switch r.mode {
+	case RecordingMic:
+		r.write(samples)
+	case RecordingMixed:
+		r.Lock()
+		r.mic = append(r.mic, samples...)
+		r.Unlock()
+		r.mix(false)
+	}
+}
+
+// Remote records audio received from the other end
+func (r *CallRecording) Remote(samples []float32) {
+	switch r.mode {
+	case RecordingRemote:
+		r.write(samples)
+	case RecordingMixed:
+		r.Lock()
+		r.remote = append(r.remote, samples...)
+		r.Unlock()
+		r.mix(false)
+	}
+}
+
+func (r *CallRecording) write(samples []float32) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.writer.Write(samples); err != nil {
+		log.Println("Error writing call recording:", err)
+	}
+}
+
+// mix writes the audio both sides have sent so far. If one side falls more
+// than a second behind, e.g. because it stopped sending, the other side is
+// written against silence. flush writes everything
+func (r *CallRecording) mix(flush bool) {
+	r.Lock()
+	defer r.Unlock()
+	n, longest := len(r.mic), len(r.remote)
+	if n > longest {
+		n, longest = longest, n
+	}
+	if flush || longest-n > r.call.SampleRate {
+		n = longest
+	}
+	if n == 0 {
+		return
+	}
+	mixed := make([]float32, n)
+	r.mic = r.mic[addTo(mixed, r.mic):]
+	r.remote = r.remote[addTo(mixed, r.remote):]
+	if err := r.writer.Write(mixed); err != nil {
+		log.Println("Error writing call recording:", err)
+	}
+}
+
+// addTo adds src to the start of dst, and returns how many samples were added
+func addTo(dst []float32, src []float32) int {
+	n := len(src)
+	if n > len(dst) {
+		n = len(dst)
+	}
+	for i := 0; i < n; i++ {
+		dst[i] += src[i]
+	}
+	return n
+}
+
+// Close finishes the file and publishes a recording event
+func (r *CallRecording) Close() error {
+	if r.mode == RecordingMixed {
+		r.mix(true)
+	}
+	r.Lock()
+	defer r.Unlock()
+	err := r.writer.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Println("Error saving call recording:", err)
+		return err
+	}
+	r.station.Publish(Event{Type: EventCallRecorded, Call: r.call, Recording: r.path})
+	return nil
+}
+
+// RecordingInfo describes a saved call recording
+type RecordingInfo struct {
+	Id call.CallId `json:"id"`
+	// Format is wav or ogg
+	Format   string    `json:"format"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	path     string
+}
+
+// Recordings lists saved call recordings, newest first
+func (s *Station) Recordings() []RecordingInfo {
+	entries, err := ioutil.ReadDir(s.recording.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Unable to list call recordings:", err)
+		}
+		return []RecordingInfo{}
+	}
+	recordings := []RecordingInfo{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || !isRecordingFormat(strings.TrimPrefix(ext, ".")) {
+			continue
+		}
+		id, err := call.ParseCallId(strings.TrimSuffix(e.Name(), ext))
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{
+			Id:       id,
+			Format:   strings.TrimPrefix(ext, "."),
+			Size:     e.Size(),
+			Modified: e.ModTime(),
+			path:     filepath.Join(s.recording.dir, e.Name()),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Modified.After(recordings[j].Modified)
+	})
+	return recordings
+}
+
+func isRecordingFormat(format string) bool {
+	for _, f := range recordingFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordingPath returns the file a call was recorded to, if it exists, and its format
+func (s *Station) RecordingPath(id call.CallId) (string, string, bool) {
+	for _, format := range recordingFormats {
+		path := filepath.Join(s.recording.dir, id.String()+"."+format)
+		if _, err := os.Stat(path); err == nil {
+			return path, format, true
+		}
+	}
+	return "", "", false
+}
+
+// pruneRecordings deletes recordings past the retention period, then the
+// oldest recordings until they fit in the size cap
+func (s *Station) pruneRecordings() {
+	if s.recording.retention == 0 && s.recording.maxBytes == 0 {
+		return
+	}
+	recordings := s.Recordings()
+	var total int64
+	for _, r := range recordings {
+		total += r.Size
+	}
+	// Oldest first
+	for i := len(recordings) - 1; i >= 0; i-- {
+		r := recordings[i]
+		expired := s.recording.retention > 0 && time.Since(r.Modified) > s.recording.retention
+		tooBig := s.recording.maxBytes > 0 && total > s.recording.maxBytes
+		if !expired && !tooBig {
+			break
+		}
+		if err := os.Remove(r.path); err != nil {
+			log.Println("Unable to delete call recording:", err)
+			continue
+		}
+		log.Println("Deleted call recording", r.path)
+		total -= r.Size
+	}
+}
@@ -0,0 +1,71 @@
+package station
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+func TestRecordCall(t *testing.T) {
+	for _, format := range recordingFormats {
+		t.Run(format, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "recordings")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			s := &Station{
+				Name: "kitchen",
+				recording: newRecordingConfig(&config.Config{
+					Recording: config.RecordingConfig{Mode: "mixed", Format: format, Dir: dir},
+				}),
+			}
+			if !s.RecordingNotice() {
+				t.Error("no recording notice, which is on unless RECORDING_NOTICE is false")
+			}
+			c := call.New(call.NewCallId(), "hall", "kitchen", func() {})
+			c.SampleRate = SampleRate
+			r, err := s.RecordCall(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 50; i++ {
+				r.Mic(constantFrame(0.25))
+				r.Remote(constantFrame(-0.5))
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			recordings := s.Recordings()
+			if len(recordings) != 1 || recordings[0].Id != c.Id || recordings[0].Format != format {
+				t.Fatalf("recordings are %+v, want the call's in %v", recordings, format)
+			}
+			path, gotFormat, ok := s.RecordingPath(c.Id)
+			if !ok || gotFormat != format {
+				t.Fatalf("recording path is %v, %v, %v", path, gotFormat, ok)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			magic := map[string]string{"wav": "RIFF", "ogg": "OggS"}[format]
+			if !bytes.HasPrefix(data, []byte(magic)) {
+				t.Errorf("%v file starts with %q", format, data[:4])
+			}
+		})
+	}
+}
+
+// constantFrame is 20ms of a constant level
+func constantFrame(level float32) []float32 {
+	samples := make([]float32, SampleRate/50)
+	for i := range samples {
+		samples[i] = level
+	}
+	return samples
+}
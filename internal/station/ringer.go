@@ -0,0 +1,91 @@
+package station
+
+import (
+	"context"
+	"sync"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	defaultRingVolume      = 100
+	defaultQuietRingVolume = 25
+)
+
+// ringer plays a ringtone while an incoming call waits to be accepted
+// During quiet hours the ringtone is quieter, or suppressed at volume 0
+// During a call, it beeps instead, at the speaker volume
+type ringer struct {
+	sync.Mutex
+	station     *Station
+	volume      int
+	quietVolume int
+	stop        func()
+}
+
+// newRinger takes RING_VOLUME and QUIET_HOURS_RING_VOLUME, where 0 is silent
+func newRinger(cfg *config.Config, station *Station) *ringer {
+	r := &ringer{
+		station:     station,
+		volume:      defaultRingVolume,
+		quietVolume: defaultQuietRingVolume,
+	}
+	if cfg.IsSet("RING_VOLUME") {
+		r.volume = cfg.Audio.RingVolume
+	}
+	if cfg.IsSet("QUIET_HOURS_RING_VOLUME") {
+		r.quietVolume = cfg.Audio.QuietHoursRingVolume
+	}
+	return r
+}
+
+func (r *ringer) UpdateStatus(status *Status) {
+	if status.Has(StatusRinging) {
+		r.start(status.Has(StatusUrgentCall), status.Has(StatusDoorbell), status.Has(StatusCallWaiting))
+	} else {
+		r.stopRinging()
+	}
+}
+
+func (r *ringer) start(urgent bool, doorbell bool, waiting bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.stop != nil {
+		return
+	}
+	if waiting {
+		ctx, cancel := context.WithCancel(context.Background())
+		r.stop = cancel
+		go playTone(ctx, callWaitingTone(r.station.Volume(), r.station.DeviceRate), r.station.Speaker.device)
+		return
+	}
+	volume := r.volume
+	if r.station.scheduler.isQuiet() && !urgent {
+		volume = r.quietVolume
+	}
+	if volume == 0 {
+		log.Println("Quiet hours, not playing ringtone")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stop = cancel
+	t := ringTone(volume, r.station.DeviceRate)
+	if doorbell {
+		t = doorbellTone(volume, r.station.DeviceRate)
+	}
+	go playTone(ctx, t, r.station.Speaker.device)
+}
+
+func (r *ringer) stopRinging() {
+	r.Lock()
+	defer r.Unlock()
+	if r.stop != nil {
+		r.stop()
+		r.stop = nil
+	}
+}
+
+func (r *ringer) Close() {
+	r.stopRinging()
+}
@@ -0,0 +1,55 @@
+package station
+
+import (
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+const defaultRingGroupTimeout = 15 * time.Second
+
+// newRingGroups takes the numbered ring groups, e.g.
+// RING_GROUP_1_NAME=upstairs, RING_GROUP_1_MEMBERS=kitchen,office,
+// RING_GROUP_1_STRATEGY=sequential and RING_GROUP_1_TIMEOUT=20s
+// Groups are called by name, like the stations in the directory
+func newRingGroups(configs []config.RingGroupConfig) map[string]call.RingGroup {
+	groups := make(map[string]call.RingGroup)
+	for _, c := range configs {
+		g := call.RingGroup{
+			Name:    c.Name,
+			Members: c.Members,
+			Timeout: defaultRingGroupTimeout,
+		}
+		switch c.Strategy {
+		case "conference":
+			g.Strategy = call.RingConference
+		case "sequential":
+			g.Strategy = call.RingSequential
+		default:
+			g.Strategy = call.RingFirstAnswer
+		}
+		if c.Timeout > 0 {
+			g.Timeout = c.Timeout
+		}
+		groups[g.Name] = g
+	}
+	return groups
+}
+
+// callGroups rings the groups in to, and returns the rest, which are stations
+func (s *Station) callGroups(to []string, urgent bool) []string {
+	var stations []string
+	for _, name := range to {
+		g, ok := s.ringGroups[name]
+		if !ok {
+			stations = append(stations, name)
+			continue
+		}
+		g.Urgent = urgent
+		log.Printf("Ringing group %v (%v)\n", g.Name, g.Strategy)
+		go s.CallManager.Ring(g)
+	}
+	return stations
+}
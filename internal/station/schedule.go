@@ -0,0 +1,79 @@
+package station
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const scheduleInterval = 30 * time.Second
+
+// scheduler sets and clears do-not-disturb, and tracks quiet hours
+//
+// Changes are only made when a schedule boundary is crossed, so a manual
+// toggle stays in effect until the next boundary
+type scheduler struct {
+	sync.Mutex
+	station      *Station
+	doNotDisturb config.Schedule
+	quietHours   config.Schedule
+	quiet        bool
+	lastDnd      bool
+	lastDndKnown bool
+}
+
+// newScheduler reads the schedules, which config has checked
+func newScheduler(c config.PoliciesConfig, station *Station) *scheduler {
+	s := &scheduler{station: station}
+	if c.DNDSchedule != "" {
+		s.doNotDisturb, _ = config.ParseSchedule(c.DNDSchedule)
+		log.Printf("Using do-not-disturb schedule %v ...\n", c.DNDSchedule)
+	}
+	if c.QuietHours != "" {
+		s.quietHours, _ = config.ParseSchedule(c.QuietHours)
+		log.Printf("Using quiet hours %v ...\n", c.QuietHours)
+	}
+	return s
+}
+
+// run checks the schedules until ctx is cancelled
+// ctx is station context/main context from cmd
+func (s *scheduler) run(ctx context.Context) {
+	if s.doNotDisturb == nil && s.quietHours == nil {
+		return
+	}
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		s.update(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *scheduler) update(now time.Time) {
+	s.Lock()
+	s.quiet = s.quietHours.Active(now)
+	dnd := s.doNotDisturb.Active(now)
+	changed := s.doNotDisturb != nil && (!s.lastDndKnown || dnd != s.lastDnd)
+	s.lastDnd = dnd
+	s.lastDndKnown = true
+	s.Unlock()
+	if changed {
+		log.Println("Do-not-disturb schedule boundary reached, setting do-not-disturb:", dnd)
+		s.station.setDoNotDisturb(dnd)
+	}
+}
+
+// isQuiet returns whether quiet hours are currently active
+func (s *scheduler) isQuiet() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.quiet
+}
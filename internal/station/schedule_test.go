@@ -0,0 +1,101 @@
+package station
+
+import (
+	"testing"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+)
+
+// fakeClock is a time in the week from Sunday 7 January 2024
+type fakeClock struct {
+	now time.Time
+}
+
+// set moves the clock to a day and time, e.g. "mon 22:00"
+func (c *fakeClock) set(t *testing.T, when string) time.Time {
+	t.Helper()
+	days := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	var at time.Time
+	for i, day := range days {
+		if when[:3] == day {
+			at = time.Date(2024, 1, 7+i, 0, 0, 0, 0, time.Local)
+		}
+	}
+	clock, err := time.Parse("15:04", when[4:])
+	if at.IsZero() || err != nil {
+		t.Fatalf("invalid time %q", when)
+	}
+	c.now = at.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+	return c.now
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	s := &Station{Name: "kitchen", Outputs: multiOutputs(nil)}
+	s.Status = &Status{station: s}
+	sched := newScheduler(config.PoliciesConfig{
+		DNDSchedule: "mon-fri 22:00-07:00",
+		QuietHours:  "sat,sun 12:00-14:00",
+	}, s)
+
+	// Each step sets the clock, toggles do-not-disturb by hand if manual
+	// is set, then runs the scheduler
+	steps := []struct {
+		at     string
+		manual string
+		dnd    bool
+		quiet  bool
+	}{
+		{"mon 21:00", "on", false, false}, // the first update applies the schedule, over the toggle
+		{"mon 21:30", "on", true, false},
+		{"mon 21:45", "", true, false}, // a manual toggle lasts until the next boundary
+		{"mon 22:00", "", true, false},
+		{"mon 23:00", "off", false, false},
+		{"tue 03:00", "", false, false},
+		{"tue 07:00", "", false, false},
+		{"tue 08:00", "on", true, false},
+		{"tue 21:59", "", true, false},
+		{"tue 22:00", "", true, false},
+		{"wed 07:00", "", false, false},
+		{"fri 22:00", "", true, false},
+		{"sat 06:59", "", true, false}, // Friday night runs into Saturday morning
+		{"sat 07:00", "", false, false},
+		{"sat 12:00", "", false, true},
+		{"sat 14:00", "", false, false},
+		{"sat 22:00", "", false, false}, // weekends aren't in the do-not-disturb schedule
+		{"sun 13:59", "on", true, true},
+		{"sun 14:00", "", true, false},
+		{"sun 23:00", "", true, false},
+		{"mon 07:00", "", true, false}, // Sunday night isn't in the schedule, so Monday morning isn't a boundary
+		{"mon 22:00", "", true, false},
+		{"tue 07:00", "", false, false},
+	}
+	clock := &fakeClock{}
+	for _, step := range steps {
+		now := clock.set(t, step.at)
+		switch step.manual {
+		case "on":
+			s.setDoNotDisturb(true)
+		case "off":
+			s.setDoNotDisturb(false)
+		}
+		sched.update(now)
+		if got := s.Status.Has(StatusDoNotDisturb); got != step.dnd {
+			t.Errorf("%v: do-not-disturb is %v, want %v", step.at, got, step.dnd)
+		}
+		if got := sched.isQuiet(); got != step.quiet {
+			t.Errorf("%v: quiet is %v, want %v", step.at, got, step.quiet)
+		}
+	}
+}
+
+func TestSchedulerWithoutSchedules(t *testing.T) {
+	s := &Station{Name: "kitchen", Outputs: multiOutputs(nil)}
+	s.Status = &Status{station: s}
+	sched := newScheduler(config.PoliciesConfig{}, s)
+	s.setDoNotDisturb(true)
+	sched.update(time.Now())
+	if !s.Status.Has(StatusDoNotDisturb) || sched.isQuiet() {
+		t.Error("scheduler changed the status without schedules")
+	}
+}
@@ -0,0 +1,32 @@
+package station
+
+import (
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/internal/sip"
+)
+
+const defaultSIPExpires = time.Hour
+
+// newSIPConfig returns nil if SIP_SERVER is not set. Registrations are
+// renewed hourly unless SIP_EXPIRES says otherwise
+func newSIPConfig(c config.SIPConfig) *sip.Config {
+	if c.Server == "" {
+		return nil
+	}
+	sipConfig := &sip.Config{
+		Server:   c.Server,
+		User:     c.User,
+		Password: c.Password,
+		Domain:   c.Domain,
+		Port:     c.Port,
+		Expires:  defaultSIPExpires,
+	}
+	if c.Expires > 0 {
+		sipConfig.Expires = c.Expires
+	}
+	log.Printf("Using SIP server %v for user %v ...\n", c.Server, c.User)
+	return sipConfig
+}
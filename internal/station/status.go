@@ -54,6 +54,13 @@ const (
 	StatusIncomingCall                      // 4
 	StatusOutgoingCall                      // 8
 	StatusCallConnected                     // 16
+	StatusRinging                           // 32, waiting for an incoming call to be accepted or rejected
+	StatusUrgentCall                        // 64, the ringing call ignores quiet hours
+	StatusMuted                             // 128, one or more calls muted
+	StatusOnHold                            // 256, one or more calls on hold
+	StatusMonitorAlert                      // 512, a monitor heard noise
+	StatusDoorbell                          // 1024, the ringing call is from a doorbell
+	StatusCallWaiting                       // 2048, the ringing call came in during another call
 	StatusDefault       = status(0)
 )
 
@@ -69,6 +76,20 @@ func (s status) String() string {
 		return "OutgoingCall"
 	case StatusCallConnected:
 		return "CallConnected"
+	case StatusRinging:
+		return "Ringing"
+	case StatusUrgentCall:
+		return "UrgentCall"
+	case StatusMuted:
+		return "Muted"
+	case StatusOnHold:
+		return "OnHold"
+	case StatusMonitorAlert:
+		return "MonitorAlert"
+	case StatusDoorbell:
+		return "Doorbell"
+	case StatusCallWaiting:
+		return "CallWaiting"
 	case StatusDefault:
 		return "Default"
 	}
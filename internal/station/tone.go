@@ -0,0 +1,158 @@
+package station
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jfreymuth/pulse"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/resample"
+)
+
+// tone generates a repeating pattern of sine tones, e.g. a ringtone
+// cadence alternates between tone and silence, starting with tone
+type tone struct {
+	freqs   []float64
+	cadence []time.Duration
+	gain    float32
+	// rate is the sample rate the tone is played at
+	rate int
+	pos  int
+}
+
+func ringTone(volume int, rate int) *tone {
+	return &tone{
+		freqs:   []float64{440, 480},
+		cadence: []time.Duration{400 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 2 * time.Second},
+		gain:    float32(volume) / 100,
+		rate:    rate,
+	}
+}
+
+// doorbellTone is a chime, so that visitors at the door can be told apart from calls
+func doorbellTone(volume int, rate int) *tone {
+	return &tone{
+		freqs:   []float64{659, 523},
+		cadence: []time.Duration{600 * time.Millisecond, 300 * time.Millisecond, 600 * time.Millisecond, 2500 * time.Millisecond},
+		gain:    float32(volume) / 100,
+		rate:    rate,
+	}
+}
+
+// alertTone is a short chime, played for alertToneDuration
+func alertTone(volume int, rate int) *tone {
+	return &tone{
+		freqs:   []float64{880},
+		cadence: []time.Duration{150 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond, 2 * time.Second},
+		gain:    float32(volume) / 100,
+		rate:    rate,
+	}
+}
+
+const alertToneDuration = time.Second
+
+// callWaitingTone is a quiet beep, played over a call while another one waits
+func callWaitingTone(volume int, rate int) *tone {
+	return &tone{
+		freqs:   []float64{440},
+		cadence: []time.Duration{300 * time.Millisecond, 10 * time.Second},
+		gain:    float32(volume) / 400,
+		rate:    rate,
+	}
+}
+
+// busyTone is played for busyToneDuration when a station that was called is busy
+func busyTone(volume int, rate int) *tone {
+	return &tone{
+		freqs:   []float64{480, 620},
+		cadence: []time.Duration{500 * time.Millisecond, 500 * time.Millisecond},
+		gain:    float32(volume) / 100,
+		rate:    rate,
+	}
+}
+
+const busyToneDuration = 3 * time.Second
+
+func (t *tone) samples(d time.Duration) int {
+	return int(d.Seconds() * float64(t.rate))
+}
+
+// Read fills buf with the next samples of the tone. It never runs out
+func (t *tone) Read(buf []float32) (int, error) {
+	period := 0
+	for _, d := range t.cadence {
+		period += t.samples(d)
+	}
+	for i := range buf {
+		buf[i] = 0
+		if t.isOn(t.pos % period) {
+			var v float64
+			for _, f := range t.freqs {
+				v += math.Sin(2 * math.Pi * f * float64(t.pos) / float64(t.rate))
+			}
+			buf[i] = float32(v/float64(len(t.freqs))) * t.gain
+		}
+		t.pos++
+	}
+	return len(buf), nil
+}
+
+func (t *tone) isOn(pos int) bool {
+	for i, d := range t.cadence {
+		pos -= t.samples(d)
+		if pos < 0 {
+			return i%2 == 0
+		}
+	}
+	return false
+}
+
+// playTone plays t through its own pulse stream to device until ctx is
+// cancelled. This does not use the Speaker, so it can play alongside calls
+func playTone(ctx context.Context, t *tone, device string) {
+	c, err := pulse.NewClient()
+	if err != nil {
+		log.Println("playTone: error creating pulse client", err)
+		return
+	}
+	defer c.Close()
+	stream, err := newPlayback(c, pulse.Float32Reader(t.Read), device, t.rate)
+	if err != nil {
+		log.Println("playTone: error creating playback stream", err)
+		return
+	}
+	defer stream.Close()
+	stream.Start()
+	<-ctx.Done()
+	stream.Stop()
+}
+
+// playSamples plays audio recorded at rate through its own pulse stream, and
+// returns once it has been heard. Like playTone, it can play alongside calls
+func playSamples(samples []float32, rate int, deviceRate int, device string) {
+	samples = resample.New(rate, deviceRate).Process(append(samples, make([]float32, rate/50)...))
+	c, err := pulse.NewClient()
+	if err != nil {
+		log.Println("playSamples: error creating pulse client", err)
+		return
+	}
+	defer c.Close()
+	read := func(buf []float32) (int, error) {
+		n := copy(buf, samples)
+		samples = samples[n:]
+		if n < len(buf) {
+			return n, pulse.EndOfData
+		}
+		return n, nil
+	}
+	stream, err := newPlayback(c, pulse.Float32Reader(read), device, deviceRate)
+	if err != nil {
+		log.Println("playSamples: error creating playback stream", err)
+		return
+	}
+	defer stream.Close()
+	stream.Start()
+	stream.Drain()
+}
@@ -0,0 +1,158 @@
+package station
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/wav"
+)
+
+const (
+	defaultTTSCommand = "espeak-ng --stdout"
+	// How long speech may take to synthesize
+	ttsTimeout = 30 * time.Second
+	// Phrases waiting to be spoken by the tts output. More are dropped
+	ttsQueueSize = 4
+)
+
+// TTSEngine turns text into speech
+type TTSEngine interface {
+	// Synthesize returns the speech and its sample rate
+	Synthesize(ctx context.Context, text string) ([]float32, int, error)
+}
+
+// commandEngine runs a local program such as espeak-ng or piper, which reads
+// text on stdin and writes a WAV file to stdout
+type commandEngine struct {
+	args []string
+}
+
+// newTTSEngine runs TTS_COMMAND, e.g. "piper --model en_US-amy-medium.onnx --output_file -"
+func newTTSEngine(command string) TTSEngine {
+	if command == "" {
+		command = defaultTTSCommand
+	}
+	return &commandEngine{args: strings.Fields(command)}
+}
+
+func (e *commandEngine) Synthesize(ctx context.Context, text string) ([]float32, int, error) {
+	cmd := exec.CommandContext(ctx, e.args[0], e.args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, 0, fmt.Errorf("%v: %v: %s", e.args[0], err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return nil, 0, fmt.Errorf("%v: %w", e.args[0], err)
+	}
+	r, err := wav.NewReader(bytes.NewReader(out))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v: %w", e.args[0], err)
+	}
+	samples, err := r.ReadAll()
+	return samples, r.SampleRate(), err
+}
+
+// say speaks text on this station if to is empty, otherwise on other
+// stations, by name or "*" for all of them
+// Speech plays through its own stream, so it can be heard during calls
+func (s *Station) say(text string, to []string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errors.New("nothing to say")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ttsTimeout)
+	defer cancel()
+	samples, rate, err := s.tts.Synthesize(ctx, text)
+	if err != nil {
+		log.Println("Unable to synthesize speech:", err)
+		s.Publish(Event{Type: EventError, Err: err})
+		return err
+	}
+	if len(to) > 0 {
+		s.CallManager.Announce(text, samples, rate, to)
+		return nil
+	}
+	go playSamples(samples, rate, s.DeviceRate, s.Speaker.device)
+	return nil
+}
+
+// ttsOutput speaks status changes, e.g. "Incoming call"
+type ttsOutput struct {
+	sync.Mutex
+	station *Station
+	last    status
+	phrases chan string
+	done    chan struct{}
+}
+
+// Phrases spoken when a status flag is set and cleared. Empty phrases aren't spoken
+var ttsPhrases = []struct {
+	flag       status
+	set, clear string
+}{
+	{StatusRinging, "Incoming call", ""},
+	{StatusCallConnected, "Call connected", "Call ended"},
+	{StatusDoNotDisturb, "Do not disturb on", "Do not disturb off"},
+}
+
+func newTTSOutput(station *Station) *ttsOutput {
+	t := &ttsOutput{
+		station: station,
+		phrases: make(chan string, ttsQueueSize),
+		done:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// UpdateStatus queues a phrase for each change, without waiting for it to be spoken
+func (t *ttsOutput) UpdateStatus(status *Status) {
+	status.Lock()
+	current := status.status
+	status.Unlock()
+	t.Lock()
+	defer t.Unlock()
+	for _, p := range ttsPhrases {
+		phrase := ""
+		if current&p.flag != 0 && t.last&p.flag == 0 {
+			phrase = p.set
+		} else if current&p.flag == 0 && t.last&p.flag != 0 {
+			phrase = p.clear
+		}
+		if phrase == "" {
+			continue
+		}
+		select {
+		case t.phrases <- phrase:
+		default:
+			log.Println("tts: too much to say, dropping:", phrase)
+		}
+	}
+	t.last = current
+}
+
+func (t *ttsOutput) run() {
+	for {
+		select {
+		case phrase := <-t.phrases:
+			if err := t.station.say(phrase, nil); err != nil {
+				log.Println("tts: unable to say", phrase)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *ttsOutput) Close() {
+	close(t.done)
+}
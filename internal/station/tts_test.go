@@ -0,0 +1,198 @@
+package station
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// fakeTTSEngine returns the same speech for any text, and records what it was asked to say
+type fakeTTSEngine struct {
+	sync.Mutex
+	samples []float32
+	rate    int
+	err     error
+	texts   []string
+}
+
+func (e *fakeTTSEngine) Synthesize(ctx context.Context, text string) ([]float32, int, error) {
+	e.Lock()
+	defer e.Unlock()
+	e.texts = append(e.texts, text)
+	return e.samples, e.rate, e.err
+}
+
+// announcement is a call to Announce
+type announcement struct {
+	name    string
+	samples []float32
+	rate    int
+	to      []string
+}
+
+// fakeCallManager records what the station asks of it. Methods the tests
+// don't use are left to the embedded nil Manager, and panic
+type fakeCallManager struct {
+	call.Manager
+	sync.Mutex
+	announcements []announcement
+	placed        [][]string
+	urgent        [][]string
+	calledAll     int
+	accepted      int
+	rejected      int
+	hungUp        int
+	// accept is what AcceptCh returns
+	accept chan bool
+}
+
+func (m *fakeCallManager) Announce(name string, samples []float32, sampleRate int, to []string) {
+	m.Lock()
+	defer m.Unlock()
+	m.announcements = append(m.announcements, announcement{name, samples, sampleRate, to})
+}
+
+func (m *fakeCallManager) PlaceCall(to []string) {
+	m.Lock()
+	defer m.Unlock()
+	m.placed = append(m.placed, to)
+}
+
+func (m *fakeCallManager) CallAll() {
+	m.Lock()
+	defer m.Unlock()
+	m.calledAll++
+}
+
+func (m *fakeCallManager) HangupAll() {
+	m.Lock()
+	defer m.Unlock()
+	m.hungUp++
+}
+
+func (m *fakeCallManager) AcceptCh() chan bool {
+	return m.accept
+}
+
+func (m *fakeCallManager) Calls() []*call.Call {
+	return nil
+}
+
+// eventRecorder keeps the events a station publishes
+type eventRecorder struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) HandleEvent(e Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestSayOnOtherStations(t *testing.T) {
+	speech := []float32{0.1, 0.2, 0.3}
+	engine := &fakeTTSEngine{samples: speech, rate: 22050}
+	calls := &fakeCallManager{}
+	s := &Station{Name: "kitchen", tts: engine, CallManager: calls}
+
+	if err := s.say("  Dinner is ready ", []string{"hall", "office"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(engine.texts, []string{"Dinner is ready"}) {
+		t.Errorf("synthesized %q", engine.texts)
+	}
+	want := []announcement{{"Dinner is ready", speech, 22050, []string{"hall", "office"}}}
+	if !reflect.DeepEqual(calls.announcements, want) {
+		t.Errorf("announced %+v, want %+v", calls.announcements, want)
+	}
+}
+
+func TestSayNothing(t *testing.T) {
+	engine := &fakeTTSEngine{}
+	s := &Station{Name: "kitchen", tts: engine, CallManager: &fakeCallManager{}}
+	if err := s.say(" ", []string{"*"}); err == nil {
+		t.Error("said nothing without an error")
+	}
+	if len(engine.texts) != 0 {
+		t.Errorf("synthesized %q", engine.texts)
+	}
+}
+
+func TestSayEngineError(t *testing.T) {
+	engine := &fakeTTSEngine{err: errors.New("no voice")}
+	calls := &fakeCallManager{}
+	events := &eventRecorder{}
+	s := &Station{Name: "kitchen", tts: engine, CallManager: calls}
+	s.Subscribe(events)
+
+	if err := s.say("hello", []string{"*"}); err != engine.err {
+		t.Errorf("got error %v, want %v", err, engine.err)
+	}
+	if len(calls.announcements) != 0 {
+		t.Errorf("announced %+v after an error", calls.announcements)
+	}
+	if len(events.events) != 1 || events.events[0].Type != EventError || events.events[0].Err != engine.err {
+		t.Errorf("published %+v, want an error event", events.events)
+	}
+}
+
+func TestTTSOutputPhrases(t *testing.T) {
+	s := &Station{Name: "kitchen"}
+	s.Status = &Status{station: s}
+	// Not started, so phrases stay queued
+	out := &ttsOutput{station: s, phrases: make(chan string, ttsQueueSize)}
+	s.Status.Lock()
+	s.Status.status = StatusRinging
+	s.Status.Unlock()
+	out.UpdateStatus(s.Status)
+	s.Status.Lock()
+	s.Status.status = StatusCallConnected | StatusDoNotDisturb
+	s.Status.Unlock()
+	out.UpdateStatus(s.Status)
+	out.UpdateStatus(s.Status)
+	close(out.phrases)
+	var phrases []string
+	for p := range out.phrases {
+		phrases = append(phrases, p)
+	}
+	want := []string{"Incoming call", "Call connected", "Do not disturb on"}
+	if !reflect.DeepEqual(phrases, want) {
+		t.Errorf("queued %q, want %q", phrases, want)
+	}
+}
+
+func TestMqttSay(t *testing.T) {
+	m, fake := newTestMqttClient(false)
+	engine := &fakeTTSEngine{samples: []float32{0.5}, rate: 16000}
+	calls := &fakeCallManager{}
+	m.station.tts = engine
+	m.station.CallManager = calls
+	m.onConnect(fake)
+	m.acceptCommands()
+	handler, _ := fake.subscribed("intercom/kitchen/command/+")
+	handler(fake, fakeMessage{topic: "intercom/kitchen/command/say", payload: `{"text": "Bus in 5 minutes", "to": ["hall"]}`})
+
+	// Speech is synthesized in the background
+	deadline := time.Now().Add(time.Second)
+	for {
+		calls.Lock()
+		n := len(calls.announcements)
+		calls.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := []announcement{{"Bus in 5 minutes", engine.samples, 16000, []string{"hall"}}}
+	calls.Lock()
+	defer calls.Unlock()
+	if !reflect.DeepEqual(calls.announcements, want) {
+		t.Errorf("announced %+v, want %+v", calls.announcements, want)
+	}
+}
@@ -0,0 +1,356 @@
+package station
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jfreymuth/pulse"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/resample"
+)
+
+const (
+	defaultWakeWord = "intercom"
+	// recognizerRate is the rate audio is sent to the recognizer at
+	recognizerRate = 16000
+	// A command may follow the wake word in the same utterance, or in the next one within this long
+	wakeTimeout = 5 * time.Second
+	// How often to check whether calls have started or stopped using the mic
+	micCheckInterval = 250 * time.Millisecond
+	// How long to wait before restarting a recognizer that stopped
+	recognizerRestartDelay = 5 * time.Second
+)
+
+// Recognizer turns speech into text, without sending it anywhere
+type Recognizer interface {
+	// Recognize listens to audio at rate until ctx is done, and sends each utterance it hears to text
+	Recognize(ctx context.Context, audio <-chan []float32, rate int, text chan<- string) error
+}
+
+// commandRecognizer runs a local program, e.g. a Vosk script, which reads
+// 16-bit little-endian mono audio on stdin and writes one line of text per
+// utterance to stdout
+type commandRecognizer struct {
+	args []string
+}
+
+func (r *commandRecognizer) Recognize(ctx context.Context, audio <-chan []float32, rate int, text chan<- string) error {
+	cmd := exec.CommandContext(ctx, r.args[0], r.args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%v: %w", r.args[0], err)
+	}
+	go writePCM(ctx, stdin, audio)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			select {
+			case text <- line:
+			case <-ctx.Done():
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%v: %w", r.args[0], err)
+	}
+	return ctx.Err()
+}
+
+// writePCM converts audio to 16-bit little-endian samples for a recognizer
+func writePCM(ctx context.Context, w io.WriteCloser, audio <-chan []float32) {
+	defer w.Close()
+	for {
+		select {
+		case samples := <-audio:
+			buf := make([]byte, 2*len(samples))
+			for i, s := range samples {
+				v := math.Max(-1, math.Min(1, float64(s)))
+				binary.LittleEndian.PutUint16(buf[2*i:], uint16(int16(v*math.MaxInt16)))
+			}
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// voiceInputs listens for a wake word followed by a command, e.g. "intercom
+// call kitchen". While calls are using the mic it listens to their audio, and
+// in between it records from the mic itself
+type voiceInputs struct {
+	station    *Station
+	recognizer Recognizer
+	wakeWord   []string
+	// awake is when the wake word was last heard on its own
+	awake  time.Time
+	mic    chan []float32
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newVoiceInputs runs VOICE_RECOGNIZER, the recognizer command, e.g.
+// "python3 vosk-listen.py --model /opt/vosk-model-small-en-us", and listens
+// for VOICE_WAKE_WORD, default "intercom"
+func newVoiceInputs(mainContext context.Context, c config.VoiceConfig, station *Station) *voiceInputs {
+	wakeWord := defaultWakeWord
+	if c.WakeWord != "" {
+		wakeWord = c.WakeWord
+	}
+	log.Printf("Listening for %q with %v ...\n", wakeWord, c.Recognizer)
+	return startVoiceInputs(mainContext, station, &commandRecognizer{args: strings.Fields(c.Recognizer)}, wakeWord)
+}
+
+func startVoiceInputs(mainContext context.Context, station *Station, recognizer Recognizer, wakeWord string) *voiceInputs {
+	ctx, cancel := context.WithCancel(mainContext)
+	v := &voiceInputs{
+		station:    station,
+		recognizer: recognizer,
+		wakeWord:   words(wakeWord),
+		mic:        make(chan []float32, 50),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	station.Microphone.tap = v.mic
+	go v.run(ctx)
+	return v
+}
+
+// words splits text into lower case words, without punctuation
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+func (v *voiceInputs) run(ctx context.Context) {
+	defer close(v.done)
+	audio := make(chan []float32, 50)
+	text := make(chan string)
+	go v.resample(ctx, audio)
+	go v.listenWhileIdle(ctx)
+	go func() {
+		for {
+			err := v.recognizer.Recognize(ctx, audio, recognizerRate, text)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("Voice recognizer stopped:", err)
+			select {
+			case <-time.After(recognizerRestartDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case t := <-text:
+			v.handle(t)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resample converts mic audio to the recognizer's rate
+func (v *voiceInputs) resample(ctx context.Context, audio chan<- []float32) {
+	toRecognizer := resample.New(v.station.DeviceRate, recognizerRate)
+	for {
+		select {
+		case samples := <-v.mic:
+			select {
+			case audio <- toRecognizer.Process(samples):
+			default:
+				// The recognizer is behind
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listenWhileIdle records from the mic whenever no calls are, so that it
+// doesn't compete with them for it
+func (v *voiceInputs) listenWhileIdle(ctx context.Context) {
+	ticker := time.NewTicker(micCheckInterval)
+	defer ticker.Stop()
+	var stop context.CancelFunc
+	for {
+		idle := !v.station.Microphone.inUse()
+		if idle && stop == nil {
+			var recordCtx context.Context
+			recordCtx, stop = context.WithCancel(ctx)
+			go v.record(recordCtx)
+		} else if !idle && stop != nil {
+			stop()
+			stop = nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if stop != nil {
+				stop()
+			}
+			return
+		}
+	}
+}
+
+// record sends audio from its own pulse stream until ctx is done
+func (v *voiceInputs) record(ctx context.Context) {
+	c, err := pulse.NewClient()
+	if err != nil {
+		log.Println("voiceInputs: error creating pulse client", err)
+		return
+	}
+	defer c.Close()
+	write := func(buf []float32) (int, error) {
+		select {
+		case v.mic <- append([]float32(nil), buf...):
+		default:
+		}
+		return len(buf), nil
+	}
+	rate := v.station.DeviceRate
+	stream, err := newRecord(c, pulse.Float32Writer(write), v.station.Microphone.device, rate)
+	if err != nil {
+		log.Println("voiceInputs: error creating record stream", err)
+		return
+	}
+	defer stream.Close()
+	stream.Start()
+	<-ctx.Done()
+	stream.Stop()
+}
+
+// handle acts on an utterance, if it's a command after the wake word
+func (v *voiceInputs) handle(text string) {
+	heard := words(text)
+	if i := index(heard, v.wakeWord); i >= 0 {
+		heard = heard[i+len(v.wakeWord):]
+	} else if time.Since(v.awake) > wakeTimeout {
+		return
+	}
+	if len(heard) == 0 {
+		log.Println("Heard wake word, listening for a command")
+		v.awake = time.Now()
+		return
+	}
+	v.awake = time.Time{}
+	command := strings.Join(heard, " ")
+	log.Printf("Heard voice command %q\n", command)
+	switch command {
+	case "call everyone", "call everybody", "call all":
+		v.callAll()
+	case "hang up", "end call":
+		v.hangup()
+	case "answer", "accept":
+		if v.station.Status.Has(StatusRinging) {
+			v.acceptCall()
+		}
+	case "do not disturb", "do not disturb on":
+		v.setDoNotDisturb(true)
+	case "do not disturb off":
+		v.setDoNotDisturb(false)
+	case "mute", "unmute":
+		v.setMute(command == "mute")
+	case "swap", "swap calls":
+		v.station.swapCalls()
+	default:
+		if strings.HasPrefix(command, "call ") {
+			if name, ok := v.station.spokenStation(heard[1:]); ok {
+				v.placeCall([]string{name})
+				return
+			}
+		}
+		log.Printf("Unknown voice command %q\n", command)
+	}
+}
+
+// index returns where sub starts in s, or -1
+func index(s []string, sub []string) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		match := true
+		for j := range sub {
+			match = match && s[i+j] == sub[j]
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// spokenStation finds the station or ring group name that was said,
+// ignoring spaces, case and punctuation, e.g. "front door" for front-door
+func (s *Station) spokenStation(spoken []string) (string, bool) {
+	said := strings.Join(spoken, "")
+	for name := range s.directory {
+		if strings.Join(words(name), "") == said {
+			return name, true
+		}
+	}
+	for name := range s.ringGroups {
+		if strings.Join(words(name), "") == said {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (v *voiceInputs) acceptCall() {
+	v.station.AcceptCall()
+}
+
+func (v *voiceInputs) placeCall(to []string) {
+	v.station.placeCall(to)
+}
+
+func (v *voiceInputs) callAll() {
+	v.station.callAll()
+}
+
+func (v *voiceInputs) hangup() {
+	v.station.hangupAll()
+}
+
+func (v *voiceInputs) setVolume(percent int) {
+	v.station.setVolume(percent)
+}
+
+func (v *voiceInputs) setDoNotDisturb(on bool) {
+	v.station.setDoNotDisturb(on)
+}
+
+func (v *voiceInputs) setMute(on bool) {
+	v.station.muteAll(on)
+}
+
+func (v *voiceInputs) setHold(on bool) {
+	v.station.holdAll(on)
+}
+
+func (v *voiceInputs) Close() {
+	log.Debugln("voiceInputs.Close: enter")
+	v.cancel()
+	<-v.done
+}
@@ -0,0 +1,199 @@
+package station
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/figadore/go-intercom/pkg/call"
+)
+
+// fakeRecognizer waits for audio, then "hears" each of its utterances in turn
+type fakeRecognizer struct {
+	utterances []string
+	// heard gets the number of samples in the first audio it was sent
+	heard chan int
+}
+
+func (r *fakeRecognizer) Recognize(ctx context.Context, audio <-chan []float32, rate int, text chan<- string) error {
+	select {
+	case samples := <-audio:
+		r.heard <- len(samples)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, u := range r.utterances {
+		select {
+		case text <- u:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// newVoiceStation returns a station with a fake call manager, a
+// directory and a ring group, and voice inputs that aren't listening
+func newVoiceStation(wakeWord string) (*voiceInputs, *fakeCallManager) {
+	calls := &fakeCallManager{accept: make(chan bool, 1)}
+	s := &Station{
+		Name:        "kitchen",
+		CallManager: calls,
+		Outputs:     multiOutputs{},
+		directory:   directory{"front-door": "12", "Garage": "13"},
+		ringGroups:  map[string]call.RingGroup{"up_stairs": {Name: "up_stairs"}},
+	}
+	s.Status = &Status{station: s}
+	return &voiceInputs{station: s, wakeWord: words(wakeWord)}, calls
+}
+
+func TestVoiceCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  status
+		text    string
+		placed  [][]string
+		all     int
+		hungUp  int
+		accept  bool
+		wantDND bool
+	}{
+		{name: "call everyone", text: "Intercom, call everyone.", all: 1},
+		{name: "call all", text: "ok intercom call all", all: 1},
+		{name: "call a station", text: "intercom call front door", placed: [][]string{{"front-door"}}},
+		{name: "call ignores case", text: "intercom call garage", placed: [][]string{{"Garage"}}},
+		{name: "unknown station", text: "intercom call the moon"},
+		{name: "hang up", text: "intercom hang up", hungUp: 1},
+		{name: "end call", text: "intercom end call", hungUp: 1},
+		{name: "answer while ringing", status: StatusRinging, text: "intercom answer", accept: true},
+		{name: "answer without a call", text: "intercom answer"},
+		{name: "do not disturb", text: "intercom do not disturb", wantDND: true},
+		{name: "do not disturb on", text: "intercom do not disturb on", wantDND: true},
+		{name: "do not disturb off", status: StatusDoNotDisturb, text: "intercom do not disturb off"},
+		{name: "no wake word", text: "call everyone"},
+		{name: "wake word after the command", text: "call everyone intercom"},
+		{name: "unknown command", status: StatusDoNotDisturb, text: "intercom make tea", wantDND: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, calls := newVoiceStation("intercom")
+			v.station.Status.status = tt.status
+
+			v.handle(tt.text)
+
+			if !reflect.DeepEqual(calls.placed, tt.placed) {
+				t.Errorf("placed calls to %q, want %q", calls.placed, tt.placed)
+			}
+			if calls.calledAll != tt.all {
+				t.Errorf("called everyone %v times, want %v", calls.calledAll, tt.all)
+			}
+			if calls.hungUp != tt.hungUp {
+				t.Errorf("hung up %v times, want %v", calls.hungUp, tt.hungUp)
+			}
+			select {
+			case accepted := <-calls.accept:
+				if !tt.accept || !accepted {
+					t.Errorf("answered with %v", accepted)
+				}
+			default:
+				if tt.accept {
+					t.Error("didn't answer")
+				}
+			}
+			if got := v.station.Status.Has(StatusDoNotDisturb); got != tt.wantDND {
+				t.Errorf("do not disturb is %v, want %v", got, tt.wantDND)
+			}
+		})
+	}
+}
+
+func TestVoiceWakeWordAlone(t *testing.T) {
+	v, calls := newVoiceStation("Hey House")
+
+	v.handle("call everyone")
+	v.handle("hey, house")
+	if calls.calledAll != 0 {
+		t.Fatal("acted on the wake word alone")
+	}
+	v.handle("call everyone")
+	if calls.calledAll != 1 {
+		t.Fatalf("called everyone %v times after the wake word, want 1", calls.calledAll)
+	}
+	// Each wake word is good for one command
+	v.handle("hang up")
+	if calls.hungUp != 0 {
+		t.Error("acted on a second command after one wake word")
+	}
+
+	v.handle("hey house")
+	v.awake = v.awake.Add(-wakeTimeout - time.Second)
+	v.handle("hang up")
+	if calls.hungUp != 0 {
+		t.Error("acted on a command after the wake word timed out")
+	}
+}
+
+func TestSpokenStation(t *testing.T) {
+	v, _ := newVoiceStation("intercom")
+	tests := []struct {
+		spoken string
+		want   string
+		ok     bool
+	}{
+		{"front door", "front-door", true},
+		{"frontdoor", "front-door", true},
+		{"garage", "Garage", true},
+		{"up stairs", "up_stairs", true},
+		{"back door", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := v.station.spokenStation(words(tt.spoken))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("spokenStation(%q) = %q, %v, want %q, %v", tt.spoken, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestVoiceRecognizer(t *testing.T) {
+	recognizer := &fakeRecognizer{
+		utterances: []string{"intercom", "call front door"},
+		heard:      make(chan int, 1),
+	}
+	v, calls := newVoiceStation("intercom")
+	v.station.DeviceRate = 48000
+	// A call is using the mic, so voice inputs listen to its audio rather
+	// than recording on their own
+	v.station.Microphone = &Microphone{recording: 1}
+	voice := startVoiceInputs(context.Background(), v.station, recognizer, "intercom")
+	defer voice.Close()
+
+	v.station.Microphone.tap <- make([]float32, 4800)
+	select {
+	case n := <-recognizer.heard:
+		// Resampled from 48kHz to 16kHz, give or take the filter's delay
+		if n < 1500 || n > 1600 {
+			t.Errorf("recognizer got %v samples, want about 1600", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("recognizer got no audio")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		calls.Lock()
+		placed := calls.placed
+		calls.Unlock()
+		if len(placed) > 0 {
+			if !reflect.DeepEqual(placed, [][]string{{"front-door"}}) {
+				t.Errorf("placed calls to %q", placed)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no call placed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
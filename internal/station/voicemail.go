@@ -0,0 +1,91 @@
+package station
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/figadore/go-intercom/pkg/call"
+	"github.com/figadore/go-intercom/pkg/wav"
+)
+
+const (
+	defaultVoicemailDir         = "voicemail"
+	defaultVoicemailMaxDuration = time.Minute
+)
+
+type voicemailConfig struct {
+	dir         string
+	maxDuration time.Duration
+}
+
+func newVoicemailConfig(c config.VoicemailConfig) voicemailConfig {
+	v := voicemailConfig{
+		dir:         defaultVoicemailDir,
+		maxDuration: defaultVoicemailMaxDuration,
+	}
+	if c.Dir != "" {
+		v.dir = c.Dir
+	}
+	if c.MaxDuration > 0 {
+		v.maxDuration = c.MaxDuration
+	}
+	return v
+}
+
+// Voicemail records a message from a caller to a WAV file named after the call
+type Voicemail struct {
+	// MaxDuration is how long the caller may speak for
+	MaxDuration time.Duration
+	station     *Station
+	call        *call.Call
+	path        string
+	file        *os.File
+	writer      *wav.Writer
+}
+
+// RecordVoicemail creates a new voicemail file for the call, at the call's sample rate
+func (s *Station) RecordVoicemail(c *call.Call) (*Voicemail, error) {
+	if err := os.MkdirAll(s.voicemail.dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.voicemail.dir, c.Id.String()+".wav")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := wav.NewWriter(f, c.SampleRate)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	log.Println("Recording voicemail to", path)
+	return &Voicemail{
+		MaxDuration: s.voicemail.maxDuration,
+		station:     s,
+		call:        c,
+		path:        path,
+		file:        f,
+		writer:      w,
+	}, nil
+}
+
+func (v *Voicemail) Write(samples []float32) error {
+	return v.writer.Write(samples)
+}
+
+// Close finishes the file and publishes a voicemail event
+func (v *Voicemail) Close() error {
+	err := v.writer.Close()
+	if closeErr := v.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Println("Error saving voicemail:", err)
+		return err
+	}
+	v.station.Publish(Event{Type: EventVoicemail, Call: v.call, Recording: v.path})
+	return nil
+}
@@ -0,0 +1,197 @@
+package station
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	defaultStateFile = "state.json"
+	defaultVolume    = 100
+	defaultMicGain   = 100
+	maxMicGain       = 200
+)
+
+// gain is a multiplier that can be changed while audio is flowing
+type gain struct {
+	bits uint32
+}
+
+func newGain(v float32) *gain {
+	g := &gain{}
+	g.set(v)
+	return g
+}
+
+func (g *gain) set(v float32) {
+	atomic.StoreUint32(&g.bits, math.Float32bits(v))
+}
+
+func (g *gain) get() float32 {
+	return math.Float32frombits(atomic.LoadUint32(&g.bits))
+}
+
+// apply scales samples in place
+func (g *gain) apply(samples []float32) {
+	ApplyGain(samples, g.get())
+}
+
+// ApplyGain scales samples in place
+func ApplyGain(samples []float32, v float32) {
+	if v == 1 {
+		return
+	}
+	for i := range samples {
+		samples[i] *= v
+	}
+}
+
+// volumeGain converts a 0-100 volume to a gain. Loudness is roughly
+// logarithmic, so a squared curve gives more even steps than a linear one
+func volumeGain(percent int) float32 {
+	v := float32(percent) / 100
+	return v * v
+}
+
+// savedState holds settings that persist across restarts
+type savedState struct {
+	sync.Mutex    `json:"-"`
+	path          string
+	SpeakerVolume int            `json:"speaker_volume"`
+	MicGain       int            `json:"mic_gain"`
+	PeerVolumes   map[string]int `json:"peer_volumes"`
+}
+
+// loadState reads STATE_FILE (default state.json). A missing file is not an error
+func loadState(path string) *savedState {
+	s := &savedState{
+		path:          defaultStateFile,
+		SpeakerVolume: defaultVolume,
+		MicGain:       defaultMicGain,
+	}
+	if path != "" {
+		s.path = path
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Printf("No saved state at %v, using defaults\n", s.path)
+	} else if err != nil {
+		log.Println("Unable to read saved state:", err)
+	} else if err := json.Unmarshal(data, s); err != nil {
+		log.Println("Unable to parse saved state:", err)
+	}
+	if s.PeerVolumes == nil {
+		s.PeerVolumes = make(map[string]int)
+	}
+	return s
+}
+
+// save must be called with the lock held
+func (s *savedState) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Println("Unable to encode state:", err)
+		return
+	}
+	if err := ioutil.WriteFile(s.path, data, 0644); err != nil {
+		log.Println("Unable to save state:", err)
+	}
+}
+
+func (s *savedState) peerVolume(peer string) int {
+	s.Lock()
+	defer s.Unlock()
+	if v, ok := s.PeerVolumes[peer]; ok {
+		return v
+	}
+	return defaultVolume
+}
+
+// setVolume sets the speaker volume for all calls, 0-100
+func (s *Station) setVolume(percent int) {
+	s.state.Lock()
+	s.setVolumeLocked(percent)
+	s.state.Unlock()
+	s.Outputs.UpdateStatus(s.Status)
+}
+
+// adjustVolume changes the speaker volume by delta, e.g. from a rotary encoder.
+// The lock is held from reading the volume to saving it, so that turns that
+// arrive together all count
+func (s *Station) adjustVolume(delta int) {
+	s.state.Lock()
+	percent := s.state.SpeakerVolume + delta
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	s.setVolumeLocked(percent)
+	s.state.Unlock()
+	s.Outputs.UpdateStatus(s.Status)
+}
+
+// setVolumeLocked must be called with the state lock held, so that the saved
+// volume and the speaker's gain agree
+func (s *Station) setVolumeLocked(percent int) {
+	log.Println("Setting speaker volume:", percent)
+	s.state.SpeakerVolume = percent
+	s.state.save()
+	s.Speaker.gain.set(volumeGain(percent))
+}
+
+// setMicGain sets the mic gain, 0-200 where 100 leaves the mic unchanged
+func (s *Station) setMicGain(percent int) error {
+	if percent < 0 || percent > maxMicGain {
+		return fmt.Errorf("mic gain must be 0-%d", maxMicGain)
+	}
+	log.Println("Setting mic gain:", percent)
+	s.state.Lock()
+	s.state.MicGain = percent
+	s.state.save()
+	s.state.Unlock()
+	s.Microphone.gain.set(float32(percent) / 100)
+	s.Outputs.UpdateStatus(s.Status)
+	return nil
+}
+
+// Volume returns the speaker volume, 0-100
+func (s *Station) Volume() int {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.state.SpeakerVolume
+}
+
+func (s *Station) micGain() int {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.state.MicGain
+}
+
+// PeerVolume returns the saved volume for calls with the named station, 0-100
+func (s *Station) PeerVolume(peer string) int {
+	return s.state.peerVolume(peer)
+}
+
+// SavePeerVolume remembers the volume of a call for the next call with the same station
+func (s *Station) SavePeerVolume(peer string, percent int) {
+	if peer == "" {
+		return
+	}
+	s.state.Lock()
+	defer s.state.Unlock()
+	s.state.PeerVolumes[peer] = percent
+	s.state.save()
+}
+
+// CallGain converts a call's 0-100 volume to a gain
+func CallGain(percent int) float32 {
+	return volumeGain(percent)
+}
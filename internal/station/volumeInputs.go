@@ -0,0 +1,120 @@
+package station
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+	"github.com/warthog618/gpiod"
+)
+
+const defaultVolumeStep = 5
+
+// volumeInputs changes the speaker volume with either a rotary encoder
+// (VOLUME_ENCODER_A_PIN and VOLUME_ENCODER_B_PIN) or a pair of buttons
+// (VOLUME_UP_PIN and VOLUME_DOWN_PIN)
+type volumeInputs struct {
+	station *Station
+	step    int
+	lines   []*gpiod.Line
+}
+
+func newVolumeInputs(mainContext context.Context, cfg *config.Config, station *Station) *volumeInputs {
+	chip := reserveChip()
+	defer chip.Close()
+	inputs := &volumeInputs{
+		station: station,
+		step:    defaultVolumeStep,
+	}
+	if cfg.Audio.VolumeStep > 0 {
+		inputs.step = cfg.Audio.VolumeStep
+	}
+	if cfg.IsSet("VOLUME_ENCODER_A_PIN") {
+		b, err := chip.RequestLine(cfg.Pins.VolumeEncoderB, gpiod.AsInput)
+		if err != nil {
+			panic(fmt.Sprintf("RequestLine returned error: %s\n", err))
+		}
+		inputs.lines = append(inputs.lines, b)
+		a, err := chip.RequestLine(cfg.Pins.VolumeEncoderA,
+			gpiod.WithDebounce(time.Millisecond*2),
+			gpiod.WithFallingEdge,
+			gpiod.WithEventHandler(inputs.encoderHandler(b)))
+		if err != nil {
+			panic(fmt.Sprintf("RequestLine returned error: %s\n", err))
+		}
+		inputs.lines = append(inputs.lines, a)
+		return inputs
+	}
+	for pin, delta := range map[int]int{cfg.Pins.VolumeUp: inputs.step, cfg.Pins.VolumeDown: -inputs.step} {
+		delta := delta
+		line, err := chip.RequestLine(pin,
+			gpiod.WithDebounce(time.Millisecond*30),
+			gpiod.WithFallingEdge,
+			gpiod.WithEventHandler(func(gpiod.LineEvent) {
+				inputs.station.adjustVolume(delta)
+			}))
+		if err != nil {
+			panic(fmt.Sprintf("RequestLine returned error: %s\n", err))
+		}
+		inputs.lines = append(inputs.lines, line)
+	}
+	return inputs
+}
+
+// encoderHandler handles a falling edge on the encoder's A line. The level of
+// the B line at that moment gives the direction of rotation
+func (i *volumeInputs) encoderHandler(b *gpiod.Line) func(gpiod.LineEvent) {
+	return func(gpiod.LineEvent) {
+		level, err := b.Value()
+		if err != nil {
+			log.Println("Error reading volume encoder:", err)
+			return
+		}
+		if level == 1 {
+			i.station.adjustVolume(i.step)
+		} else {
+			i.station.adjustVolume(-i.step)
+		}
+	}
+}
+
+func (i *volumeInputs) Close() {
+	log.Debugln("volumeInputs.Close: enter")
+	for _, line := range i.lines {
+		line.Close()
+	}
+}
+
+func (i *volumeInputs) acceptCall() {
+	i.station.AcceptCall()
+}
+
+func (i *volumeInputs) placeCall(to []string) {
+	i.station.placeCall(to)
+}
+
+func (i *volumeInputs) callAll() {
+	i.station.callAll()
+}
+
+func (i *volumeInputs) hangup() {
+	i.station.hangupAll()
+}
+
+func (i *volumeInputs) setVolume(percent int) {
+	i.station.setVolume(percent)
+}
+
+func (i *volumeInputs) setDoNotDisturb(v bool) {
+	i.station.setDoNotDisturb(v)
+}
+
+func (i *volumeInputs) setMute(v bool) {
+	i.station.muteAll(v)
+}
+
+func (i *volumeInputs) setHold(v bool) {
+	i.station.holdAll(v)
+}
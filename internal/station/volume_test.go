@@ -0,0 +1,75 @@
+package station
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newVolumeStation returns a station whose state is saved in a temporary directory
+func newVolumeStation(t *testing.T, volume int) *Station {
+	state := loadState(filepath.Join(t.TempDir(), "state.json"))
+	state.SpeakerVolume = volume
+	s := &Station{
+		Name:    "kitchen",
+		Outputs: multiOutputs(nil),
+		Speaker: &Speaker{gain: newGain(volumeGain(volume))},
+		state:   state,
+	}
+	s.Status = &Status{station: s}
+	return s
+}
+
+func TestAdjustVolume(t *testing.T) {
+	tests := []struct {
+		name   string
+		volume int
+		delta  int
+		want   int
+	}{
+		{"up", 50, 5, 55},
+		{"down", 50, -5, 45},
+		{"up to the maximum", 98, 5, 100},
+		{"past the maximum", 100, 5, 100},
+		{"down to zero", 3, -5, 0},
+		{"past zero", 0, -5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newVolumeStation(t, tt.volume)
+			s.adjustVolume(tt.delta)
+			if got := s.Volume(); got != tt.want {
+				t.Errorf("got volume %d, want %d", got, tt.want)
+			}
+			if got, want := s.Speaker.gain.get(), volumeGain(tt.want); got != want {
+				t.Errorf("got gain %v, want %v", got, want)
+			}
+			if saved := loadState(s.state.path).SpeakerVolume; saved != tt.want {
+				t.Errorf("saved volume %d, want %d", saved, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdjustVolumeConcurrently(t *testing.T) {
+	s := newVolumeStation(t, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.adjustVolume(2)
+		}()
+	}
+	wg.Wait()
+	// Every turn counts
+	if got := s.Volume(); got != 80 {
+		t.Errorf("got volume %d, want 80", got)
+	}
+	if saved := loadState(s.state.path).SpeakerVolume; saved != 80 {
+		t.Errorf("saved volume %d, want 80", saved)
+	}
+	if got, want := s.Speaker.gain.get(), volumeGain(80); got != want {
+		t.Errorf("got gain %v, want %v", got, want)
+	}
+}
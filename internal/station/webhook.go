@@ -0,0 +1,168 @@
+package station
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+	"github.com/figadore/go-intercom/internal/log"
+)
+
+const (
+	webhookQueueSize      = 32
+	webhookTimeout        = 10 * time.Second
+	webhookDefaultRetries = 3
+	webhookDefaultBackoff = time.Second
+)
+
+type webhookDelivery struct {
+	event   EventType
+	payload []byte
+}
+
+// webhook posts station events as JSON to a URL
+//
+// Deliveries are queued and sent from a separate goroutine, so that calls are
+// never blocked by a slow or unreachable server. If the queue is full, the
+// event is dropped
+type webhook struct {
+	sync.Mutex
+	url     string
+	events  map[EventType]bool
+	secret  []byte
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	queue   chan webhookDelivery
+	done    chan struct{}
+	closed  bool
+}
+
+// newWebhooks starts the numbered webhooks, from WEBHOOK_1_URL
+func newWebhooks(cfg *config.Config) []*webhook {
+	var webhooks []*webhook
+	for i, c := range cfg.Webhooks {
+		prefix := fmt.Sprintf("WEBHOOK_%d_", i+1)
+		w := &webhook{
+			url:     c.URL,
+			events:  make(map[EventType]bool),
+			secret:  []byte(c.Secret),
+			retries: webhookDefaultRetries,
+			backoff: webhookDefaultBackoff,
+			client:  &http.Client{Timeout: webhookTimeout},
+			queue:   make(chan webhookDelivery, webhookQueueSize),
+			done:    make(chan struct{}),
+		}
+		// Config has checked the event names
+		for _, name := range c.Events {
+			if t, err := parseEventType(name); err == nil {
+				w.events[t] = true
+			}
+		}
+		if cfg.IsSet(prefix + "RETRIES") {
+			w.retries = c.Retries
+		}
+		if c.Backoff > 0 {
+			w.backoff = c.Backoff
+		}
+		log.Printf("Sending events %v to webhook %v ...\n", c.Events, c.URL)
+		go w.deliverAll()
+		webhooks = append(webhooks, w)
+	}
+	return webhooks
+}
+
+func parseEventType(name string) (EventType, error) {
+	for t := EventIncomingCall; t < eventTypeCount; t++ {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event %q", name)
+}
+
+// HandleEvent queues the event for delivery if it passes the filter.
+// An empty filter matches all events
+func (w *webhook) HandleEvent(e Event) {
+	if len(w.events) > 0 && !w.events[e.Type] {
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Error encoding webhook payload:", err)
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- webhookDelivery{event: e.Type, payload: payload}:
+	default:
+		log.Printf("WARN: webhook queue for %v is full, dropping %v event\n", w.url, e.Type)
+	}
+}
+
+func (w *webhook) deliverAll() {
+	defer close(w.done)
+	for d := range w.queue {
+		backoff := w.backoff
+		for attempt := 0; ; attempt++ {
+			err := w.deliver(d)
+			if err == nil {
+				break
+			}
+			if attempt >= w.retries {
+				log.Printf("Webhook %v failed after %d attempts: %v\n", w.url, attempt+1, err)
+				break
+			}
+			log.Printf("Webhook %v failed, retrying in %v: %v\n", w.url, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (w *webhook) deliver(d webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Intercom-Event", d.event.String())
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(d.payload)
+		req.Header.Set("X-Intercom-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	return nil
+}
+
+// Close stops accepting events, and gives queued deliveries a few seconds to finish
+func (w *webhook) Close() {
+	w.Lock()
+	w.closed = true
+	close(w.queue)
+	w.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(5 * time.Second):
+		log.Println("WARN: timeout waiting for webhook deliveries to", w.url)
+	}
+}
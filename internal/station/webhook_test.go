@@ -0,0 +1,180 @@
+package station
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/figadore/go-intercom/internal/config"
+)
+
+// hookRequest is a delivery a webhook server received
+type hookRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// hookServer records deliveries, and answers each with the status status returns
+type hookServer struct {
+	*httptest.Server
+	sync.Mutex
+	requests []hookRequest
+	received chan struct{}
+	status   func(n int) int
+}
+
+func newHookServer(t *testing.T, status func(n int) int) *hookServer {
+	s := &hookServer{received: make(chan struct{}, 100), status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.Lock()
+		s.requests = append(s.requests, hookRequest{header: r.Header, body: body, at: time.Now()})
+		n := len(s.requests)
+		s.Unlock()
+		s.received <- struct{}{}
+		w.WriteHeader(s.status(n))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *hookServer) deliveries() []hookRequest {
+	s.Lock()
+	defer s.Unlock()
+	return append([]hookRequest(nil), s.requests...)
+}
+
+// newTestWebhook starts a webhook. Closing it waits for its deliveries
+func newTestWebhook(c config.WebhookConfig) *webhook {
+	return newWebhooks(&config.Config{Webhooks: []config.WebhookConfig{c}})[0]
+}
+
+func statusOK(int) int { return http.StatusOK }
+
+func TestWebhookSignature(t *testing.T) {
+	server := newHookServer(t, statusOK)
+	w := newWebhooks(&config.Config{Webhooks: []config.WebhookConfig{
+		{URL: server.URL, Secret: "s3cret"},
+		{URL: server.URL},
+	}})
+	e := Event{Type: EventMissedCall, Station: "kitchen", From: "hall"}
+	for _, hook := range w {
+		hook.HandleEvent(e)
+		hook.Close()
+	}
+	got := server.deliveries()
+	if len(got) != 2 {
+		t.Fatalf("got %d deliveries, want 2", len(got))
+	}
+	for _, d := range got {
+		if d.header.Get("Content-Type") != "application/json" || d.header.Get("X-Intercom-Event") != "missed" {
+			t.Errorf("got headers %v", d.header)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(d.body, &payload); err != nil || payload["event"] != "missed" || payload["from"] != "hall" {
+			t.Errorf("got payload %s", d.body)
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(got[0].body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got[0].header.Get("X-Intercom-Signature") != want {
+		t.Errorf("got signature %q, want %q", got[0].header.Get("X-Intercom-Signature"), want)
+	}
+	if sig := got[1].header.Get("X-Intercom-Signature"); sig != "" {
+		t.Errorf("got signature %q without a secret", sig)
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	server := newHookServer(t, statusOK)
+	filtered := newTestWebhook(config.WebhookConfig{URL: server.URL, Events: []string{"missed", "busy"}})
+	for _, typ := range []EventType{EventIncomingCall, EventMissedCall, EventCallEnded, EventBusy} {
+		filtered.HandleEvent(Event{Type: typ})
+	}
+	filtered.Close()
+	var got []string
+	for _, d := range server.deliveries() {
+		got = append(got, d.header.Get("X-Intercom-Event"))
+	}
+	if len(got) != 2 || got[0] != "missed" || got[1] != "busy" {
+		t.Errorf("got events %v, want missed and busy", got)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	backoff := 20 * time.Millisecond
+	tests := []struct {
+		name     string
+		status   func(n int) int
+		attempts int
+	}{
+		{"succeeds on the third attempt", func(n int) int {
+			if n < 3 {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusOK
+		}, 3},
+		{"gives up", func(int) int { return http.StatusInternalServerError }, 1 + webhookDefaultRetries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newHookServer(t, tt.status)
+			w := newTestWebhook(config.WebhookConfig{URL: server.URL, Backoff: backoff})
+			w.HandleEvent(Event{Type: EventIncomingCall})
+			w.Close()
+			got := server.deliveries()
+			if len(got) != tt.attempts {
+				t.Fatalf("got %d attempts, want %d", len(got), tt.attempts)
+			}
+			// The wait doubles after each failure
+			for i := 1; i < len(got); i++ {
+				want := backoff << uint(i-1)
+				if wait := got[i].at.Sub(got[i-1].at); wait < want {
+					t.Errorf("attempt %d was %v after the last, want at least %v", i+1, wait, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	server := newHookServer(t, func(int) int {
+		<-release
+		return http.StatusOK
+	})
+	// Before the server closes, which waits for its handlers
+	t.Cleanup(unblock)
+	w := newTestWebhook(config.WebhookConfig{URL: server.URL})
+
+	// The first delivery holds up the rest, which fill the queue
+	w.HandleEvent(Event{Type: EventIncomingCall})
+	select {
+	case <-server.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first event wasn't delivered")
+	}
+	start := time.Now()
+	for i := 0; i < webhookQueueSize+10; i++ {
+		w.HandleEvent(Event{Type: EventCallEnded})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("queueing events took %v while the server was stuck", elapsed)
+	}
+	unblock()
+	w.Close()
+	if got := len(server.deliveries()); got != 1+webhookQueueSize {
+		t.Errorf("got %d deliveries, want %d with the rest dropped", got, 1+webhookQueueSize)
+	}
+}
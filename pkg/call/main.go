@@ -1,9 +1,16 @@
 package call
 
 import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/rs/xid"
 )
 
+var ErrCallNotFound = errors.New("call not found")
+
 type Status int
 
 const (
@@ -11,6 +18,8 @@ const (
 	StatusPending = Status(1 << iota)
 	StatusActive
 	StatusTerminating
+	// StatusHeld is an active call where audio is paused in both directions
+	StatusHeld
 )
 
 func (s Status) String() string {
@@ -21,10 +30,16 @@ func (s Status) String() string {
 		return "Active"
 	case StatusTerminating:
 		return "Terminating"
+	case StatusHeld:
+		return "Held"
 	}
 	return "Unknown"
 }
 
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 type ContextKey string
 
 type CallId xid.ID
@@ -33,26 +48,68 @@ func (id CallId) String() string {
 	return xid.ID(id).String()
 }
 
+func (id CallId) MarshalText() ([]byte, error) {
+	return xid.ID(id).MarshalText()
+}
+
 func NewCallId() CallId {
 	return CallId(xid.New())
 }
 
+func ParseCallId(id string) (CallId, error) {
+	parsed, err := xid.FromString(id)
+	return CallId(parsed), err
+}
+
 type Call struct {
-	Id     CallId
-	To     string
-	From   string
-	Status Status
-	cancel func()
+	sync.Mutex `json:"-"`
+	Id         CallId `json:"id"`
+	To         string `json:"to"`
+	From       string `json:"from"`
+	Status     Status `json:"status"`
+	// Peer is the name of the station on the other end, if known
+	Peer string `json:"peer,omitempty"`
+	// Urgent is set by the caller, and may break through do-not-disturb
+	Urgent bool `json:"urgent,omitempty"`
+	// Doorbell is set by doorbell stations, and always rings, with its own tone
+	Doorbell bool `json:"doorbell,omitempty"`
+	// Group is the ring group the call was placed to, if any
+	Group string `json:"group,omitempty"`
+	// Participants are the other stations in a conference, as the hub last reported them
+	Participants []string `json:"participants,omitempty"`
+	// Replaces is the station whose call with this end this call takes over,
+	// after a transfer or when a station is added to the call
+	Replaces string `json:"replaces,omitempty"`
+	// ReplacesToken proves that Replaces was allowed, for direct calls
+	ReplacesToken string `json:"-"`
+	// Muted stops sending mic audio. RemoteMuted and RemoteHeld are reported by the other end
+	Muted       bool `json:"muted"`
+	RemoteMuted bool `json:"remote_muted"`
+	RemoteHeld  bool `json:"remote_held"`
+	// Volume is the speaker volume for this call only, 0-100
+	Volume int `json:"volume"`
+	// SampleRate is the rate audio is sent at, agreed with the other end when the call connects
+	SampleRate int `json:"sample_rate,omitempty"`
+	// StartedAt is when the call was placed or received, and ConnectedAt is when it was first answered
+	StartedAt   time.Time `json:"started_at"`
+	ConnectedAt time.Time `json:"connected_at,omitempty"`
+	// Quality is measured at this end while the call is connected
+	Quality Quality `json:"quality"`
+	cancel  func()
+	// onAnswer is called when the call is first answered
+	onAnswer func(*Call)
 	// TODO add pointer to call manager? or at least a callback when when cancel is called?
 }
 
 func New(callId CallId, to string, from string, cancel func()) *Call {
 	call := Call{
-		Id:     callId,
-		To:     to,
-		From:   from,
-		cancel: cancel,
-		Status: StatusPending,
+		Id:        callId,
+		To:        to,
+		From:      from,
+		cancel:    cancel,
+		Status:    StatusPending,
+		Volume:    100,
+		StartedAt: time.Now(),
 	}
 	return &call
 }
@@ -63,30 +120,281 @@ func New(callId CallId, to string, from string, cancel func()) *Call {
 //}
 
 func (c *Call) Hangup() {
-	c.Status = StatusTerminating
+	c.SetStatus(StatusTerminating)
 	c.cancel()
 }
 
+func (c *Call) SetStatus(s Status) {
+	c.Lock()
+	c.Status = s
+	answered := s == StatusActive && c.ConnectedAt.IsZero()
+	if answered {
+		c.ConnectedAt = time.Now()
+	}
+	onAnswer := c.onAnswer
+	c.Unlock()
+	if answered && onAnswer != nil {
+		onAnswer(c)
+	}
+}
+
+// OnAnswer sets a function to call when the call is first answered, e.g. to
+// hang up the other calls to a ring group
+func (c *Call) OnAnswer(f func(*Call)) {
+	c.Lock()
+	defer c.Unlock()
+	c.onAnswer = f
+}
+
+// Connected returns whether the call was ever answered, even if it has ended since
+func (c *Call) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return !c.ConnectedAt.IsZero()
+}
+
+func (c *Call) CurrentStatus() Status {
+	c.Lock()
+	defer c.Unlock()
+	return c.Status
+}
+
+// SetMuted returns whether the value changed
+func (c *Call) SetMuted(muted bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	changed := c.Muted != muted
+	c.Muted = muted
+	return changed
+}
+
+func (c *Call) IsMuted() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.Muted
+}
+
+// SetHeld moves an active call on or off hold, and returns whether anything changed
+func (c *Call) SetHeld(held bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	if held && c.Status == StatusActive {
+		c.Status = StatusHeld
+		return true
+	} else if !held && c.Status == StatusHeld {
+		c.Status = StatusActive
+		return true
+	}
+	return false
+}
+
+func (c *Call) IsHeld() bool {
+	return c.CurrentStatus() == StatusHeld
+}
+
+func (c *Call) SetVolume(percent int) {
+	c.Lock()
+	defer c.Unlock()
+	c.Volume = percent
+}
+
+func (c *Call) CurrentVolume() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.Volume
+}
+
+// SetRemote records the mute and hold state reported by the other end, and returns whether it changed
+func (c *Call) SetRemote(muted bool, held bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	changed := c.RemoteMuted != muted || c.RemoteHeld != held
+	c.RemoteMuted = muted
+	c.RemoteHeld = held
+	return changed
+}
+
+// SetParticipants records the other stations in a conference, and returns whether they changed
+func (c *Call) SetParticipants(names []string) bool {
+	c.Lock()
+	defer c.Unlock()
+	changed := len(names) != len(c.Participants)
+	for i := 0; !changed && i < len(names); i++ {
+		changed = names[i] != c.Participants[i]
+	}
+	c.Participants = names
+	return changed
+}
+
+// Includes returns whether the station is on the other end of the call, or in the conference
+func (c *Call) Includes(name string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.Peer == name {
+		return true
+	}
+	for _, p := range c.Participants {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Quality describes the network conditions of a call, as measured at this end
+type Quality struct {
+	// RTT is the latest round-trip time, measured with timestamped keepalives
+	RTT    float64 `json:"rtt_ms"`
+	MaxRTT float64 `json:"max_rtt_ms"`
+	// Jitter is the inter-arrival jitter of received audio, as in RFC 3550
+	Jitter    float64 `json:"jitter_ms"`
+	MaxJitter float64 `json:"max_jitter_ms"`
+	// PacketsLost and PacketsLate count RTP packets that never arrived, or arrived out of order
+	// PacketsRecovered counts lost packets whose audio arrived in the next packet
+	PacketsLost      uint64 `json:"packets_lost"`
+	PacketsLate      uint64 `json:"packets_late"`
+	PacketsRecovered uint64 `json:"packets_recovered"`
+	// RemoteLoss is the percentage of packets the other end lost, as it last reported
+	RemoteLoss int `json:"remote_loss_percent"`
+	// Media is how audio is sent, e.g. "L16 20ms", which may change during the call
+	Media string `json:"media"`
+	// Rates are in bytes per second over the last second, totals are for the whole call
+	SendRate      int   `json:"send_bytes_per_second"`
+	ReceiveRate   int   `json:"receive_bytes_per_second"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	// Underflows counts the times the speaker ran out of audio during the call
+	Underflows uint64 `json:"underflows"`
+	// Drift is the correction for the other end's sound card clock, and Buffer
+	// is how much received audio is waiting to be played
+	Drift  float64 `json:"drift_ppm"`
+	Buffer float64 `json:"buffer_ms"`
+}
+
+func (c *Call) SetQuality(q Quality) {
+	c.Lock()
+	defer c.Unlock()
+	c.Quality = q
+}
+
+func (c *Call) CurrentQuality() Quality {
+	c.Lock()
+	defer c.Unlock()
+	return c.Quality
+}
+
+// MarshalJSON locks the call, since it may be updated while being sent somewhere
+func (c *Call) MarshalJSON() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	// Marshal as a type without this method, to avoid recursion
+	type call Call
+	return json.Marshal((*call)(c))
+}
+
 type Manager interface {
 	CallAll()
+	PlaceCall(to []string)
+	PlaceUrgentCall(to []string)
 	HangupAll()
 	AcceptCall()
 	RejectCall()
 	AcceptCh() chan bool
 	HasCalls() bool
-	// PlaceCall(ctx context.Context, to []string)
+	Calls() []*Call
+	Mute(id CallId, muted bool) error
+	Hold(id CallId, held bool) error
+	SetVolume(id CallId, percent int) error
+	// Announce plays audio on other stations, as a one-way call. name is
+	// what the audio is, e.g. the clip it was read from
+	Announce(name string, samples []float32, sampleRate int, to []string)
+	// Ring calls the members of a ring group
+	Ring(group RingGroup)
+	// Listen plays a monitor station's mic, as a one-way call
+	Listen(name string)
+	// Alert tells stations that a monitor heard noise at level, in dBFS
+	Alert(level float64, to []string)
+	// Transfer hands a call over to another station, without talking to it first
+	Transfer(id CallId, to string) error
+	// CompleteTransfer connects the other ends of two calls, e.g. after
+	// asking the second station whether it will take the first call, and
+	// leaves both
+	CompleteTransfer(id CallId, consult CallId) error
+	// AddParticipant turns a call into a conference with another station
+	AddParticipant(id CallId, to string) error
 	// ServeCall(ctx context.Context, from string)
 }
 
+// RingStrategy decides how the members of a ring group are called
+type RingStrategy int
+
+const (
+	// RingFirstAnswer rings every member at once. The first to answer gets
+	// the call, and the others stop ringing
+	RingFirstAnswer RingStrategy = iota
+	// RingConference calls every member at once, and everyone who answers is
+	// in the call, like calling all
+	RingConference
+	// RingSequential rings one member at a time, each for the group's
+	// Timeout, until one answers
+	RingSequential
+)
+
+func (s RingStrategy) String() string {
+	switch s {
+	case RingFirstAnswer:
+		return "first"
+	case RingConference:
+		return "conference"
+	case RingSequential:
+		return "sequential"
+	}
+	return "unknown"
+}
+
+// RingGroup is a set of stations that are called together
+type RingGroup struct {
+	Name     string
+	Members  []string
+	Strategy RingStrategy
+	// Timeout is how long each member rings, for sequential groups
+	Timeout time.Duration
+	Urgent  bool
+	// Doorbell calls ring with the doorbell tone
+	Doorbell bool
+}
+
 type GenericManager struct {
+	sync.Mutex
 	CallList map[CallId]*Call
 }
 
 func (m *GenericManager) HasCalls() bool {
-	for _, call := range m.CallList {
-		if (call.Status&StatusPending)|(call.Status&StatusActive) != 0 {
+	for _, call := range m.Calls() {
+		if call.CurrentStatus()&(StatusPending|StatusActive|StatusHeld) != 0 {
 			return true
 		}
 	}
 	return false
 }
+
+// Calls returns a snapshot of the call list
+func (m *GenericManager) Calls() []*Call {
+	m.Lock()
+	defer m.Unlock()
+	calls := make([]*Call, 0, len(m.CallList))
+	for _, call := range m.CallList {
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+func (m *GenericManager) Get(id CallId) (*Call, error) {
+	m.Lock()
+	defer m.Unlock()
+	call, ok := m.CallList[id]
+	if !ok {
+		return nil, ErrCallNotFound
+	}
+	return call, nil
+}
@@ -0,0 +1,346 @@
+package ogg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+)
+
+const (
+	// blockSize is the number of samples in each FLAC frame, e.g. 256ms at 16kHz
+	blockSize = 4096
+	// maxOrder is the highest fixed predictor tried
+	maxOrder     = 4
+	maxRiceParam = 14
+	vendor       = "go-intercom"
+)
+
+// Subframe types
+const (
+	subframeConstant = 0x00
+	subframeVerbatim = 0x01
+	subframeFixed    = 0x08
+)
+
+var errClosed = errors.New("ogg: writer is closed")
+
+// Writer encodes audio as FLAC, in an Ogg stream (the Ogg FLAC mapping 1.0).
+// Each FLAC frame goes on a page of its own
+type Writer struct {
+	pages      pageWriter
+	sampleRate int
+	// block is audio waiting for a full frame
+	block []int32
+	// pending is the last packet, held back so that Close can mark its page as the last
+	pending        []byte
+	pendingGranule int64
+	samples        int64
+	frames         uint64
+	closed         bool
+}
+
+// NewWriter writes the Ogg FLAC headers to w
+func NewWriter(w io.Writer, sampleRate int) (*Writer, error) {
+	writer := &Writer{
+		pages:      pageWriter{w: w, serial: rand.Uint32()},
+		sampleRate: sampleRate,
+		block:      make([]int32, 0, blockSize),
+	}
+	if err := writer.pages.writePage(writer.streamInfo(), 0, flagFirst); err != nil {
+		return nil, err
+	}
+	writer.pending = vorbisComment()
+	return writer, nil
+}
+
+// streamInfo is the first packet: the mapping header, then the FLAC
+// signature and STREAMINFO. The total number of samples is left unknown
+func (w *Writer) streamInfo() []byte {
+	b := make([]byte, 0, 51)
+	b = append(b, 0x7f, 'F', 'L', 'A', 'C', 1, 0)
+	// One more header packet, the Vorbis comment
+	b = append(b, 0, 1)
+	b = append(b, 'f', 'L', 'a', 'C')
+	// Metadata block header: STREAMINFO, 34 bytes
+	b = append(b, 0, 0, 0, 34)
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], blockSize)
+	binary.BigEndian.PutUint16(info[2:], blockSize)
+	// 20 bits of sample rate, 3 of channels-1 (mono) and 5 of bits per sample-1
+	binary.BigEndian.PutUint32(info[10:], uint32(w.sampleRate)<<12|15<<4)
+	return append(b, info...)
+}
+
+// vorbisComment is the second header packet, which the mapping requires
+func vorbisComment() []byte {
+	length := 4 + len(vendor) + 4
+	// Metadata block header: the last block, VORBIS_COMMENT
+	b := []byte{0x80 | 4, byte(length >> 16), byte(length >> 8), byte(length)}
+	b = append(b, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(vendor)))
+	b = append(b, vendor...)
+	// No comments
+	return append(b, 0, 0, 0, 0)
+}
+
+// Write appends samples, clipping them to [-1, 1]
+func (w *Writer) Write(samples []float32) error {
+	if w.closed {
+		return errClosed
+	}
+	for _, s := range samples {
+		v := math.Max(-1, math.Min(1, float64(s)))
+		w.block = append(w.block, int32(int16(v*math.MaxInt16)))
+		if len(w.block) == blockSize {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush encodes the block as a frame, and writes the packet before it
+func (w *Writer) flush() error {
+	frame := encodeFrame(w.block, w.frames)
+	w.frames++
+	w.samples += int64(len(w.block))
+	w.block = w.block[:0]
+	if err := w.pages.writePage(w.pending, w.pendingGranule, 0); err != nil {
+		return err
+	}
+	w.pending, w.pendingGranule = frame, w.samples
+	return nil
+}
+
+// Size returns the number of bytes written so far
+func (w *Writer) Size() int {
+	return w.pages.size
+}
+
+// Close writes the rest of the audio, ending the stream. It does not close the underlying writer
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if len(w.block) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.closed = true
+	return w.pages.writePage(w.pending, w.pendingGranule, flagLast)
+}
+
+// encodeFrame encodes a block of 16-bit mono samples as a FLAC frame
+func encodeFrame(block []int32, number uint64) []byte {
+	var b bitWriter
+	// Sync code and fixed block size, then the block size as 16 bits at the
+	// end of the header, the sample rate from STREAMINFO, mono and 16-bit
+	b.write(0xfff8, 16)
+	b.write(0x70, 8)
+	b.write(0x08, 8)
+	b.writeUTF8(number)
+	b.write(uint64(len(block)-1), 16)
+	b.write(uint64(crc8(b.bytes())), 8)
+	encodeSubframe(&b, block)
+	b.align()
+	b.write(uint64(crc16(b.bytes())), 16)
+	return b.bytes()
+}
+
+// encodeSubframe picks whichever encoding is smallest: a constant, the
+// fixed predictor that leaves the smallest residual, or the samples as they are
+func encodeSubframe(b *bitWriter, block []int32) {
+	constant := true
+	for _, s := range block {
+		if s != block[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		b.write(subframeConstant<<1, 8)
+		b.writeSigned(block[0], 16)
+		return
+	}
+	order, residual := bestPredictor(block)
+	param, bits := riceParam(residual)
+	// Subframe header, warm up samples, residual coding method and partition order
+	fixedBits := int64(8+order*16+6+4) + bits
+	if len(residual) == 0 || fixedBits >= int64(8+len(block)*16) {
+		b.write(subframeVerbatim<<1, 8)
+		for _, s := range block {
+			b.writeSigned(s, 16)
+		}
+		return
+	}
+	b.write(uint64(subframeFixed|order)<<1, 8)
+	for _, s := range block[:order] {
+		b.writeSigned(s, 16)
+	}
+	// Rice coding with 4-bit parameters, in a single partition
+	b.write(0, 2)
+	b.write(0, 4)
+	b.write(uint64(param), 4)
+	for _, r := range residual {
+		u := zigzag(r)
+		q := u >> uint(param)
+		b.writeUnary(q)
+		b.write(uint64(u), param)
+	}
+}
+
+// bestPredictor returns the fixed predictor order with the smallest
+// residual, and the residual
+func bestPredictor(block []int32) (int, []int32) {
+	best, bestSum := 0, uint64(math.MaxUint64)
+	for order := 0; order <= maxOrder && order < len(block); order++ {
+		var sum uint64
+		for i := order; i < len(block); i++ {
+			r := predictionError(block, i, order)
+			if r < 0 {
+				r = -r
+			}
+			sum += uint64(r)
+		}
+		if sum < bestSum {
+			best, bestSum = order, sum
+		}
+	}
+	residual := make([]int32, 0, len(block)-best)
+	for i := best; i < len(block); i++ {
+		residual = append(residual, predictionError(block, i, best))
+	}
+	return best, residual
+}
+
+// predictionError is the difference between sample i and its prediction by
+// the fixed polynomial predictor of order
+func predictionError(x []int32, i int, order int) int32 {
+	switch order {
+	case 1:
+		return x[i] - x[i-1]
+	case 2:
+		return x[i] - 2*x[i-1] + x[i-2]
+	case 3:
+		return x[i] - 3*x[i-1] + 3*x[i-2] - x[i-3]
+	case 4:
+		return x[i] - 4*x[i-1] + 6*x[i-2] - 4*x[i-3] + x[i-4]
+	}
+	return x[i]
+}
+
+// riceParam returns the Rice parameter that codes the residual in the
+// fewest bits, and that number of bits
+func riceParam(residual []int32) (int, int64) {
+	best, bestBits := 0, int64(math.MaxInt64)
+	for param := 0; param <= maxRiceParam; param++ {
+		var bits int64
+		for _, r := range residual {
+			bits += int64(zigzag(r)>>uint(param)) + 1 + int64(param)
+			if bits >= bestBits {
+				break
+			}
+		}
+		if bits < bestBits {
+			best, bestBits = param, bits
+		}
+	}
+	return best, bestBits
+}
+
+// zigzag folds signed values into unsigned ones, 0, -1, 1, -2... to 0, 1, 2, 3...
+func zigzag(r int32) uint32 {
+	return uint32(r<<1) ^ uint32(r>>31)
+}
+
+// bitWriter writes big-endian bit fields
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write writes the low n bits of v, for n up to 32
+func (b *bitWriter) write(v uint64, n int) {
+	b.acc = b.acc<<uint(n) | v&(1<<uint(n)-1)
+	b.nbits += uint(n)
+	for b.nbits >= 8 {
+		b.nbits -= 8
+		b.buf = append(b.buf, byte(b.acc>>b.nbits))
+	}
+}
+
+func (b *bitWriter) writeSigned(v int32, n int) {
+	b.write(uint64(uint32(v)), n)
+}
+
+// writeUnary writes q zeros, then a one
+func (b *bitWriter) writeUnary(q uint32) {
+	for ; q >= 32; q -= 32 {
+		b.write(0, 32)
+	}
+	b.write(1, int(q)+1)
+}
+
+// writeUTF8 writes a frame number in the extended UTF-8 coding FLAC uses
+func (b *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		b.write(v, 8)
+		return
+	}
+	// Continuation bytes each hold 6 bits, and the first byte what's left
+	n := 1
+	for v >= 1<<uint(6*n+6-n) {
+		n++
+	}
+	b.write(0xff00>>uint(n+1)|v>>uint(6*n), 8)
+	for i := n - 1; i >= 0; i-- {
+		b.write(0x80|v>>uint(6*i)&0x3f, 8)
+	}
+}
+
+// align pads with zeros to the next byte
+func (b *bitWriter) align() {
+	if b.nbits > 0 {
+		b.write(0, int(8-b.nbits))
+	}
+}
+
+// bytes returns the whole bytes written so far
+func (b *bitWriter) bytes() []byte {
+	return b.buf
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, d := range data {
+		crc ^= d
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
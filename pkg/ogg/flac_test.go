@@ -0,0 +1,347 @@
+package ogg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The decoder below follows the Ogg (RFC 3533) and FLAC specifications
+// independently of the writer, and checks every checksum on the way
+
+type page struct {
+	flags   byte
+	granule int64
+	seq     uint32
+	packets [][]byte
+	// continued is whether the last packet goes on to the next page
+	continued bool
+}
+
+func readPages(t *testing.T, data []byte) []page {
+	t.Helper()
+	var pages []page
+	for len(data) > 0 {
+		if len(data) < pageHeaderSize || string(data[:4]) != "OggS" || data[4] != 0 {
+			t.Fatalf("page %v: bad header", len(pages))
+		}
+		segments := int(data[26])
+		lacing := data[pageHeaderSize : pageHeaderSize+segments]
+		size := pageHeaderSize + segments
+		for _, l := range lacing {
+			size += int(l)
+		}
+		raw := append([]byte(nil), data[:size]...)
+		want := binary.LittleEndian.Uint32(raw[22:])
+		binary.LittleEndian.PutUint32(raw[22:], 0)
+		if got := pageCRC(0, raw); got != want {
+			t.Fatalf("page %v: checksum %08x, want %08x", len(pages), got, want)
+		}
+		p := page{
+			flags:   data[5],
+			granule: int64(binary.LittleEndian.Uint64(data[6:])),
+			seq:     binary.LittleEndian.Uint32(data[18:]),
+		}
+		body := data[pageHeaderSize+segments : size]
+		var packet []byte
+		for i, l := range lacing {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+			if l < 255 {
+				p.packets = append(p.packets, packet)
+				packet = nil
+			} else if i == len(lacing)-1 {
+				p.continued = true
+				p.packets = append(p.packets, packet)
+			}
+		}
+		pages = append(pages, p)
+		data = data[size:]
+	}
+	return pages
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> uint(7-r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) readSigned(n int) int32 {
+	v := r.read(n)
+	return int32(int64(v<<uint(64-n)) >> uint(64-n))
+}
+
+func (r *bitReader) readUnary() uint64 {
+	var q uint64
+	for r.read(1) == 0 {
+		q++
+	}
+	return q
+}
+
+func (r *bitReader) readUTF8() uint64 {
+	first := r.read(8)
+	n := 0
+	for first&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	if n == 0 {
+		return first
+	}
+	v := first & (0xff >> uint(n+1))
+	for i := 1; i < n; i++ {
+		v = v<<6 | r.read(8)&0x3f
+	}
+	return v
+}
+
+// decodeFrame decodes a 16-bit mono frame, checking its number and checksums
+func decodeFrame(frame []byte, number uint64) ([]int32, error) {
+	r := &bitReader{data: frame}
+	if sync := r.read(14); sync != 0x3ffe {
+		return nil, fmt.Errorf("sync code %x", sync)
+	}
+	if r.read(1) != 0 || r.read(1) != 0 {
+		return nil, fmt.Errorf("not a fixed block size")
+	}
+	sizeCode, rateCode := r.read(4), r.read(4)
+	if channels, sampleSize := r.read(4), r.read(3); channels != 0 || sampleSize != 4 {
+		return nil, fmt.Errorf("channels %v, sample size %v", channels, sampleSize)
+	}
+	r.read(1)
+	if n := r.readUTF8(); n != number {
+		return nil, fmt.Errorf("frame number %v, want %v", n, number)
+	}
+	var size int
+	switch sizeCode {
+	case 6:
+		size = int(r.read(8)) + 1
+	case 7:
+		size = int(r.read(16)) + 1
+	default:
+		return nil, fmt.Errorf("block size code %v", sizeCode)
+	}
+	if rateCode != 0 {
+		return nil, fmt.Errorf("sample rate code %v", rateCode)
+	}
+	if crc := byte(r.read(8)); crc != crc8(frame[:r.pos/8-1]) {
+		return nil, fmt.Errorf("header checksum")
+	}
+	if r.read(1) != 0 {
+		return nil, fmt.Errorf("subframe padding")
+	}
+	kind := r.read(6)
+	if r.read(1) != 0 {
+		return nil, fmt.Errorf("wasted bits")
+	}
+	samples := make([]int32, 0, size)
+	switch {
+	case kind == 0:
+		v := r.readSigned(16)
+		for i := 0; i < size; i++ {
+			samples = append(samples, v)
+		}
+	case kind == 1:
+		for i := 0; i < size; i++ {
+			samples = append(samples, r.readSigned(16))
+		}
+	case kind&0x38 == 0x08 && kind&7 <= 4:
+		order := int(kind & 7)
+		for i := 0; i < order; i++ {
+			samples = append(samples, r.readSigned(16))
+		}
+		if method := r.read(2); method != 0 {
+			return nil, fmt.Errorf("residual coding method %v", method)
+		}
+		partitions := 1 << r.read(4)
+		for p := 0; p < partitions; p++ {
+			n := size / partitions
+			if p == 0 {
+				n -= order
+			}
+			param := int(r.read(4))
+			if param == 15 {
+				return nil, fmt.Errorf("escaped partition")
+			}
+			for i := 0; i < n; i++ {
+				u := r.readUnary()<<uint(param) | r.read(param)
+				residual := int32(u>>1) ^ -int32(u&1)
+				x := samples
+				j := len(x)
+				var prediction int32
+				switch order {
+				case 1:
+					prediction = x[j-1]
+				case 2:
+					prediction = 2*x[j-1] - x[j-2]
+				case 3:
+					prediction = 3*x[j-1] - 3*x[j-2] + x[j-3]
+				case 4:
+					prediction = 4*x[j-1] - 6*x[j-2] + 4*x[j-3] - x[j-4]
+				}
+				samples = append(samples, prediction+residual)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("subframe type %v", kind)
+	}
+	if r.pos%8 != 0 && r.read(8-r.pos%8) != 0 {
+		return nil, fmt.Errorf("frame padding")
+	}
+	end := r.pos / 8
+	if crc := uint16(r.read(16)); crc != crc16(frame[:end]) {
+		return nil, fmt.Errorf("frame checksum")
+	}
+	if r.pos/8 != len(frame) {
+		return nil, fmt.Errorf("%v bytes after the frame", len(frame)-r.pos/8)
+	}
+	return samples, nil
+}
+
+// decode reads a whole Ogg FLAC file, and returns its sample rate and samples
+func decode(t *testing.T, data []byte) (int, []int32) {
+	t.Helper()
+	pages := readPages(t, data)
+	if len(pages) < 2 {
+		t.Fatalf("%v pages, want at least the two headers", len(pages))
+	}
+	var packets [][]byte
+	var granules []int64
+	for i, p := range pages {
+		if p.seq != uint32(i) {
+			t.Errorf("page %v has sequence number %v", i, p.seq)
+		}
+		if wantFirst := i == 0; (p.flags&flagFirst != 0) != wantFirst {
+			t.Errorf("page %v has flags %x", i, p.flags)
+		}
+		if wantLast := i == len(pages)-1; (p.flags&flagLast != 0) != wantLast {
+			t.Errorf("page %v has flags %x", i, p.flags)
+		}
+		if p.continued || len(p.packets) != 1 {
+			t.Fatalf("page %v has %v packets, want 1", i, len(p.packets))
+		}
+		packets = append(packets, p.packets[0])
+		granules = append(granules, p.granule)
+	}
+
+	info := packets[0]
+	if len(info) != 51 || !bytes.Equal(info[:9], []byte{0x7f, 'F', 'L', 'A', 'C', 1, 0, 0, 1}) || string(info[9:13]) != "fLaC" {
+		t.Fatalf("bad first packet %x", info)
+	}
+	if info[13] != 0 || info[16] != 34 {
+		t.Fatalf("first metadata block isn't STREAMINFO: %x", info[13:17])
+	}
+	r := &bitReader{data: info[17:]}
+	minBlock, maxBlock := r.read(16), r.read(16)
+	r.read(48)
+	rate, channels, bits := int(r.read(20)), r.read(3)+1, r.read(5)+1
+	if minBlock != blockSize || maxBlock != blockSize || channels != 1 || bits != 16 {
+		t.Errorf("STREAMINFO: blocks %v-%v, %v channels, %v bits", minBlock, maxBlock, channels, bits)
+	}
+	comment := packets[1]
+	if comment[0] != 0x84 || int(comment[1])<<16|int(comment[2])<<8|int(comment[3]) != len(comment)-4 {
+		t.Fatalf("second packet isn't the last metadata block, a Vorbis comment: %x", comment)
+	}
+	if granules[0] != 0 || granules[1] != 0 {
+		t.Errorf("header pages have granule positions %v and %v", granules[0], granules[1])
+	}
+
+	var samples []int32
+	for i, frame := range packets[2:] {
+		block, err := decodeFrame(frame, uint64(i))
+		if err != nil {
+			t.Fatalf("frame %v: %v", i, err)
+		}
+		if i < len(packets)-3 && len(block) != blockSize {
+			t.Errorf("frame %v has %v samples", i, len(block))
+		}
+		samples = append(samples, block...)
+		if granules[i+2] != int64(len(samples)) {
+			t.Errorf("frame %v has granule position %v, want %v", i, granules[i+2], len(samples))
+		}
+	}
+	return rate, samples
+}
+
+func TestWriter(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name   string
+		signal func(i int) float32
+		length int
+		// maxSize is the most the file may take up, as a fraction of 16-bit PCM
+		maxSize float64
+	}{
+		{"silence", func(int) float32 { return 0 }, 3 * blockSize, 0.01},
+		{"tone", func(i int) float32 { return 0.5 * float32(math.Sin(float64(i)*2*math.Pi*440/16000)) }, 10000, 0.7},
+		{"noise", func(int) float32 { return random.Float32()*2 - 1 }, 5000, 1.05},
+		{"clipped", func(i int) float32 { return float32(i%7-3) / 2 }, 100, 1.5},
+		{"one sample", func(int) float32 { return 0.25 }, 1, 100},
+		{"empty", func(int) float32 { return 0 }, 0, 0},
+		// Over 127 frames, so frame numbers take more than a byte
+		{"long", func(i int) float32 { return float32(i%1000)/1000 - 0.5 }, 130 * blockSize, 0.6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, 16000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]int32, tt.length)
+			var chunk []float32
+			for i := 0; i < tt.length; i++ {
+				s := tt.signal(i)
+				want[i] = int32(int16(math.Max(-1, math.Min(1, float64(s))) * math.MaxInt16))
+				// Written in uneven chunks, as calls do
+				if chunk = append(chunk, s); len(chunk) == 333 {
+					if err := w.Write(chunk); err != nil {
+						t.Fatal(err)
+					}
+					chunk = nil
+				}
+			}
+			if err := w.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if w.Size() != buf.Len() {
+				t.Errorf("size is %v, wrote %v bytes", w.Size(), buf.Len())
+			}
+			if err := w.Write([]float32{0}); err == nil {
+				t.Error("wrote after closing")
+			}
+
+			rate, got := decode(t, buf.Bytes())
+			if rate != 16000 {
+				t.Errorf("sample rate is %v", rate)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("decoded %v samples, want %v", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("sample %v is %v, want %v", i, got[i], want[i])
+				}
+			}
+			if size := float64(buf.Len()-100) / float64(2*tt.length); tt.length > 0 && size > tt.maxSize {
+				t.Errorf("audio takes %.2f of its PCM size, want at most %v", size, tt.maxSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Package ogg reads Ogg Vorbis files and writes Ogg FLAC files as float32
+// samples. Files are written as mono 16-bit, losslessly compressed, so they
+// take up around half the space of a WAV file and play in browsers and media players
+package ogg
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Page header flags
+const (
+	flagFirst = 0x02
+	flagLast  = 0x04
+)
+
+const pageHeaderSize = 27
+
+// crcTable is for the Ogg page checksum, CRC-32 with polynomial 0x04c11db7,
+// unreflected
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func pageCRC(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// pageWriter writes one logical stream, one packet per page
+type pageWriter struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+	size   int
+}
+
+// writePage writes packet on a page of its own. granule is the position
+// after the packet, in samples. Packets must be shorter than 65025 bytes
+func (p *pageWriter) writePage(packet []byte, granule int64, flags byte) error {
+	segments := len(packet)/255 + 1
+	page := make([]byte, pageHeaderSize+segments, pageHeaderSize+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], p.serial)
+	binary.LittleEndian.PutUint32(page[18:], p.seq)
+	page[26] = byte(segments)
+	// Lacing values: 255 for each full segment, then the rest, which may be 0
+	for i := 0; i < segments-1; i++ {
+		page[pageHeaderSize+i] = 255
+	}
+	page[pageHeaderSize+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], pageCRC(0, page))
+	p.seq++
+	n, err := p.w.Write(page)
+	p.size += n
+	return err
+}
@@ -0,0 +1,28 @@
+package ogg
+
+import (
+	"io"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// ReadVorbis reads a whole Ogg Vorbis file, and returns it with its sample
+// rate. Files with more than one channel are mixed down to mono
+func ReadVorbis(r io.Reader) ([]float32, int, error) {
+	samples, format, err := oggvorbis.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if format.Channels == 1 {
+		return samples, format.SampleRate, nil
+	}
+	mono := make([]float32, len(samples)/format.Channels)
+	for i := range mono {
+		var sum float32
+		for _, s := range samples[i*format.Channels : (i+1)*format.Channels] {
+			sum += s
+		}
+		mono[i] = sum / float32(format.Channels)
+	}
+	return mono, format.SampleRate, nil
+}
@@ -0,0 +1,45 @@
+package ogg
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// testdata/vorbis.ogg is a second of mono audio at 44.1kHz, from the
+// oggvorbis package's tests
+func TestReadVorbis(t *testing.T) {
+	f, err := os.Open("testdata/vorbis.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	samples, rate, err := ReadVorbis(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 44100 || len(samples) != 44100 {
+		t.Errorf("got %v samples at %vHz, want 44100 at 44100Hz", len(samples), rate)
+	}
+	loud := false
+	for _, s := range samples {
+		if s > 0.1 || s < -0.1 {
+			loud = true
+		}
+	}
+	if !loud {
+		t.Error("decoded silence")
+	}
+}
+
+func TestReadVorbisNotVorbis(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, _, err := ReadVorbis(&buf); err == nil {
+		t.Error("read Ogg FLAC as Vorbis")
+	}
+}
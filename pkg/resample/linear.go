@@ -0,0 +1,56 @@
+// Package resample changes the sample rate of audio
+package resample
+
+// Linear resamples a stream of audio by linear interpolation. It is cheap
+// enough to correct clock drift on a Pi Zero, where the ratio stays within a
+// fraction of a percent of 1 and the interpolation error is inaudible
+//
+// Audio is passed through in chunks, and the position between chunks is
+// kept, so the ratio can change at any time without clicks
+type Linear struct {
+	// ratio is output samples per input sample
+	ratio float64
+	// pos is where the next output sample falls, in input samples from the
+	// start of the next chunk. -1 is the last sample of the previous chunk
+	pos  float64
+	last float32
+}
+
+// NewLinear creates a resampler that outputs ratio samples for every input sample
+func NewLinear(ratio float64) *Linear {
+	return &Linear{ratio: ratio}
+}
+
+// SetRatio changes the ratio, starting with the next chunk
+func (r *Linear) SetRatio(ratio float64) {
+	r.ratio = ratio
+}
+
+func (r *Linear) Ratio() float64 {
+	return r.ratio
+}
+
+// Process resamples the next chunk of audio
+func (r *Linear) Process(in []float32) []float32 {
+	if len(in) == 0 {
+		return nil
+	}
+	step := 1 / r.ratio
+	out := make([]float32, 0, int(float64(len(in))*r.ratio)+2)
+	sample := func(i int) float32 {
+		if i < 0 {
+			return r.last
+		}
+		return in[i]
+	}
+	n := float64(len(in))
+	for ; r.pos < n-1; r.pos += step {
+		i := int(r.pos+1) - 1
+		frac := float32(r.pos - float64(i))
+		a, b := sample(i), sample(i+1)
+		out = append(out, a+(b-a)*frac)
+	}
+	r.pos -= n
+	r.last = in[len(in)-1]
+	return out
+}
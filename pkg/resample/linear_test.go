@@ -0,0 +1,124 @@
+package resample
+
+import (
+	"math"
+	"testing"
+)
+
+type processor interface {
+	Process(in []float32) []float32
+}
+
+// sine returns n samples of a tone at rate
+func sine(rate int, freq float64, amplitude float64, n int) []float32 {
+	x := make([]float32, n)
+	for i := range x {
+		x[i] = float32(amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return x
+}
+
+// process passes in through r in chunks of size samples, as audio arrives
+func process(r processor, in []float32, size int) []float32 {
+	var out []float32
+	for len(in) > 0 {
+		n := size
+		if n > len(in) {
+			n = len(in)
+		}
+		out = append(out, r.Process(in[:n])...)
+		in = in[n:]
+	}
+	return out
+}
+
+// amplitude returns the peak of a sine from its RMS
+func amplitude(x []float32) float64 {
+	var sum float64
+	for _, v := range x {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(2 * sum / float64(len(x)))
+}
+
+// frequency returns the frequency of a sine at rate, from its rising zero crossings
+func frequency(x []float32, rate int) float64 {
+	first, last := -1.0, -1.0
+	crossings := 0
+	for i := 1; i < len(x); i++ {
+		if x[i-1] < 0 && x[i] >= 0 {
+			at := float64(i-1) + float64(-x[i-1]/(x[i]-x[i-1]))
+			if first < 0 {
+				first = at
+			}
+			last = at
+			crossings++
+		}
+	}
+	if crossings < 2 {
+		return 0
+	}
+	return float64(crossings-1) / (last - first) * float64(rate)
+}
+
+func TestLinearLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		ratio float64
+	}{
+		{"8k to 16k", 2},
+		{"16k to 8k", 0.5},
+		{"16k to 48k", 3},
+		{"48k to 16k", 1.0 / 3},
+		{"clock drift", 1.0005},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make([]float32, 16000)
+			out := process(NewLinear(tt.ratio), in, 160)
+			// Up to one input sample is held back for the next chunk
+			want := float64(len(in)) * tt.ratio
+			if math.Abs(float64(len(out))-want) > tt.ratio+1 {
+				t.Errorf("got %d samples, want %.0f", len(out), want)
+			}
+		})
+	}
+}
+
+func TestLinearSetRatio(t *testing.T) {
+	// Interpolating a ramp gives a ramp, so each step shows where the
+	// output samples fell, including across chunks
+	ramp := make([]float32, 1000)
+	for i := range ramp {
+		ramp[i] = float32(i)
+	}
+	r := NewLinear(2)
+	out := process(r, ramp[:500], 100)
+	r.SetRatio(4)
+	if r.Ratio() != 4 {
+		t.Errorf("ratio is %v, want 4", r.Ratio())
+	}
+	switched := len(out)
+	out = append(out, process(r, ramp[500:], 100)...)
+	for i := 1; i < len(out); i++ {
+		want := float32(0.5)
+		if i > switched {
+			want = 0.25
+		}
+		if step := out[i] - out[i-1]; math.Abs(float64(step-want)) > 1e-3 {
+			t.Fatalf("step %d is %v, want %v", i, step, want)
+		}
+	}
+}
+
+func TestLinearRoundTrip(t *testing.T) {
+	// Correcting drift one way then back leaves the tone as it was
+	in := sine(16000, 440, 0.5, 16000)
+	out := process(NewLinear(1/1.0005), process(NewLinear(1.0005), in, 320), 320)
+	if got := amplitude(out); math.Abs(got-0.5) > 0.01 {
+		t.Errorf("amplitude is %.3f, want 0.5", got)
+	}
+	if got := frequency(out, 16000); math.Abs(got-440) > 1 {
+		t.Errorf("frequency is %.1fHz, want 440Hz", got)
+	}
+}
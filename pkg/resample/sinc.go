@@ -0,0 +1,114 @@
+package resample
+
+import "math"
+
+const (
+	// Zero crossings of the sinc on each side of a sample. More is sharper,
+	// but slower
+	sincZeroCrossings = 16
+	// The cutoff sits just below the lower of the two Nyquist frequencies,
+	// so the filter can roll off before aliasing
+	sincCutoff = 0.9
+)
+
+// Sinc converts audio between two fixed sample rates with a windowed-sinc
+// filter, e.g. between a sound card's native 48kHz and 16kHz on the wire
+//
+// The filter is precomputed for each phase of the ratio between the rates,
+// so rates should have a large common divisor, as the usual audio rates do
+type Sinc struct {
+	// The output is up/down times the rate of the input
+	up, down int
+	// width is half the filter length, in input samples
+	width  int
+	coeffs [][]float32
+	// buf holds input not yet fully used. The next output sample falls at
+	// index + phase/up
+	buf   []float32
+	index int
+	phase int
+}
+
+// New creates a resampler from inRate to outRate. If the rates are equal, audio is passed through unchanged
+func New(inRate, outRate int) *Sinc {
+	g := gcd(inRate, outRate)
+	r := &Sinc{up: outRate / g, down: inRate / g}
+	if r.up == r.down {
+		return r
+	}
+	// Low-pass at the lower of the two rates
+	cutoff := sincCutoff
+	if r.up < r.down {
+		cutoff *= float64(r.up) / float64(r.down)
+	}
+	r.width = int(math.Ceil(sincZeroCrossings / cutoff))
+	r.coeffs = make([][]float32, r.up)
+	for p := range r.coeffs {
+		taps := make([]float32, 2*r.width)
+		var sum float64
+		h := make([]float64, len(taps))
+		for j := range taps {
+			// Distance from the output sample to input sample j
+			u := float64(r.width-1-j) + float64(p)/float64(r.up)
+			h[j] = cutoff * sinc(cutoff*u) * blackman(u/float64(r.width))
+			sum += h[j]
+		}
+		// Normalize each phase, so there is no ripple at DC
+		for j := range taps {
+			taps[j] = float32(h[j] / sum)
+		}
+		r.coeffs[p] = taps
+	}
+	r.buf = make([]float32, r.width-1)
+	r.index = r.width - 1
+	return r
+}
+
+// Process converts the next chunk of audio. The output lags the input by
+// half the filter length
+func (r *Sinc) Process(in []float32) []float32 {
+	if r.coeffs == nil {
+		return in
+	}
+	r.buf = append(r.buf, in...)
+	out := make([]float32, 0, len(in)*r.up/r.down+1)
+	for r.index+r.width < len(r.buf) {
+		start := r.index - r.width + 1
+		var v float32
+		for j, h := range r.coeffs[r.phase] {
+			v += r.buf[start+j] * h
+		}
+		out = append(out, v)
+		r.phase += r.down
+		r.index += r.phase / r.up
+		r.phase %= r.up
+	}
+	// Keep only the input the next output samples need
+	if drop := r.index - r.width + 1; drop > 0 {
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.index -= drop
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window, for x from -1 to 1
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,84 @@
+package resample
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var rates = [][2]int{
+	{8000, 16000},
+	{16000, 8000},
+	{16000, 48000},
+	{48000, 16000},
+	{8000, 48000},
+	{48000, 8000},
+}
+
+func TestSincLength(t *testing.T) {
+	for _, rate := range rates {
+		in, out := rate[0], rate[1]
+		t.Run(fmt.Sprintf("%d to %d", in, out), func(t *testing.T) {
+			r := New(in, out)
+			if got := float64(r.up) / float64(r.down); got != float64(out)/float64(in) {
+				t.Errorf("ratio is %v, want %v", got, float64(out)/float64(in))
+			}
+			// One second, in 20ms chunks
+			got := len(process(r, make([]float32, in), in/50))
+			// The output lags by half the filter
+			lag := r.width * out / in
+			if want := out - lag; got < want-1 || got > out {
+				t.Errorf("got %d samples, want %d-%d", got, want, out)
+			}
+		})
+	}
+	r := New(16000, 16000)
+	in := sine(16000, 1000, 0.5, 320)
+	if out := r.Process(in); len(out) != len(in) || out[10] != in[10] {
+		t.Error("equal rates didn't pass audio through")
+	}
+}
+
+func TestSincRoundTrip(t *testing.T) {
+	for _, rate := range rates {
+		in, out := rate[0], rate[1]
+		t.Run(fmt.Sprintf("%d to %d", in, out), func(t *testing.T) {
+			x := sine(in, 1000, 0.5, in)
+			y := process(New(out, in), process(New(in, out), x, in/50), out/50)
+			// Leave out where the filters start up
+			y = y[len(y)/4:]
+			if got := amplitude(y); math.Abs(got-0.5) > 0.01 {
+				t.Errorf("amplitude is %.3f, want 0.5", got)
+			}
+			if got := frequency(y, in); math.Abs(got-1000) > 1 {
+				t.Errorf("frequency is %.1fHz, want 1000Hz", got)
+			}
+		})
+	}
+}
+
+func TestSincAntiAliasing(t *testing.T) {
+	// Tones above the new Nyquist frequency are filtered out, rather than
+	// folding back down. Tones well below it are kept
+	tests := []struct {
+		in, out int
+		freq    float64
+		want    float64
+	}{
+		{48000, 16000, 12000, 0},
+		{48000, 16000, 20000, 0},
+		{16000, 8000, 6000, 0},
+		{48000, 8000, 10000, 0},
+		{48000, 16000, 3000, 0.5},
+		{16000, 8000, 2000, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%vHz from %d to %d", tt.freq, tt.in, tt.out), func(t *testing.T) {
+			y := process(New(tt.in, tt.out), sine(tt.in, tt.freq, 0.5, tt.in), tt.in/50)
+			y = y[len(y)/4:]
+			if got := amplitude(y); math.Abs(got-tt.want) > 0.005 {
+				t.Errorf("amplitude is %.4f, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package rtp
+
+const (
+	// PayloadTypePCMU is G.711 mu-law at 8kHz (RFC 3551)
+	PayloadTypePCMU = 0
+	ulawBias        = 0x84
+	ulawClip        = 32635
+)
+
+// EncodePCMU converts samples in the range [-1, 1] to G.711 mu-law
+func EncodePCMU(samples []float32) []byte {
+	buf := make([]byte, len(samples))
+	for i, s := range samples {
+		if s > 1 {
+			s = 1
+		} else if s < -1 {
+			s = -1
+		}
+		buf[i] = linearToULaw(int(s * 32767))
+	}
+	return buf
+}
+
+// DecodePCMU converts G.711 mu-law to samples in the range [-1, 1]
+func DecodePCMU(buf []byte) []float32 {
+	samples := make([]float32, len(buf))
+	for i, u := range buf {
+		samples[i] = float32(ulawToLinear(u)) / 32767
+	}
+	return samples
+}
+
+func linearToULaw(s int) byte {
+	var sign byte
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > ulawClip {
+		s = ulawClip
+	}
+	s += ulawBias
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> (exponent + 3)) & 0x0f
+	return ^(sign | byte(exponent<<4) | byte(mantissa))
+}
+
+func ulawToLinear(u byte) int {
+	u = ^u
+	exponent := (u >> 4) & 0x07
+	mantissa := u & 0x0f
+	s := ((int(mantissa) << 3) + ulawBias) << exponent
+	s -= ulawBias
+	if u&0x80 != 0 {
+		return -s
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+// Package rtp sends and receives audio as RTP packets over UDP (RFC 3550)
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	version    = 2
+	headerSize = 12
+	// PayloadTypeL16 is a dynamic payload type for 16-bit linear PCM at 8kHz (RFC 3551)
+	PayloadTypeL16 = 96
+	// PayloadTypeL16Wideband is a dynamic payload type for 16-bit linear PCM at 16kHz
+	PayloadTypeL16Wideband = 98
+	// payloadTypeProbe marks packets used to check that UDP gets through
+	payloadTypeProbe = 127
+)
+
+var errShortPacket = errors.New("rtp: packet too short")
+
+// Packet is an RTP packet. Extension is the body of a header extension,
+// which must be a multiple of 4 bytes long
+type Packet struct {
+	Marker           bool
+	PayloadType      uint8
+	SequenceNumber   uint16
+	Timestamp        uint32
+	SSRC             uint32
+	ExtensionProfile uint16
+	Extension        []byte
+	Payload          []byte
+}
+
+// Size returns the length of the encoded packet
+func (p *Packet) Size() int {
+	size := headerSize + len(p.Payload)
+	if p.Extension != nil {
+		size += 4 + len(p.Extension)
+	}
+	return size
+}
+
+// Marshal encodes the packet. CSRCs and padding are not supported
+func (p *Packet) Marshal() []byte {
+	buf := make([]byte, p.Size())
+	buf[0] = version << 6
+	if p.Extension != nil {
+		buf[0] |= 1 << 4
+	}
+	buf[1] = p.PayloadType & 0x7f
+	if p.Marker {
+		buf[1] |= 1 << 7
+	}
+	binary.BigEndian.PutUint16(buf[2:], p.SequenceNumber)
+	binary.BigEndian.PutUint32(buf[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:], p.SSRC)
+	n := headerSize
+	if p.Extension != nil {
+		binary.BigEndian.PutUint16(buf[n:], p.ExtensionProfile)
+		binary.BigEndian.PutUint16(buf[n+2:], uint16(len(p.Extension)/4))
+		n += 4
+		n += copy(buf[n:], p.Extension)
+	}
+	copy(buf[n:], p.Payload)
+	return buf
+}
+
+// Unmarshal decodes a packet. Payload and Extension point into buf
+func (p *Packet) Unmarshal(buf []byte) error {
+	if len(buf) < headerSize {
+		return errShortPacket
+	}
+	if buf[0]>>6 != version {
+		return errors.New("rtp: unsupported version")
+	}
+	hasPadding := buf[0]&(1<<5) != 0
+	hasExtension := buf[0]&(1<<4) != 0
+	csrcCount := int(buf[0] & 0x0f)
+	p.Marker = buf[1]&(1<<7) != 0
+	p.PayloadType = buf[1] & 0x7f
+	p.SequenceNumber = binary.BigEndian.Uint16(buf[2:])
+	p.Timestamp = binary.BigEndian.Uint32(buf[4:])
+	p.SSRC = binary.BigEndian.Uint32(buf[8:])
+	n := headerSize + 4*csrcCount
+	p.ExtensionProfile = 0
+	p.Extension = nil
+	if hasExtension {
+		if len(buf) < n+4 {
+			return errShortPacket
+		}
+		p.ExtensionProfile = binary.BigEndian.Uint16(buf[n:])
+		length := 4 * int(binary.BigEndian.Uint16(buf[n+2:]))
+		n += 4
+		if len(buf) < n+length {
+			return errShortPacket
+		}
+		p.Extension = buf[n : n+length]
+		n += length
+	}
+	end := len(buf)
+	if hasPadding {
+		end -= int(buf[end-1])
+	}
+	if end < n {
+		return errShortPacket
+	}
+	p.Payload = buf[n:end]
+	return nil
+}
+
+// EncodeL16 converts samples in the range [-1, 1] to 16-bit big-endian PCM
+func EncodeL16(samples []float32) []byte {
+	buf := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		if s > 1 {
+			s = 1
+		} else if s < -1 {
+			s = -1
+		}
+		binary.BigEndian.PutUint16(buf[2*i:], uint16(int16(s*32767)))
+	}
+	return buf
+}
+
+// DecodeL16 converts 16-bit big-endian PCM to samples in the range [-1, 1]
+func DecodeL16(buf []byte) []float32 {
+	samples := make([]float32, len(buf)/2)
+	for i := range samples {
+		samples[i] = float32(int16(binary.BigEndian.Uint16(buf[2*i:]))) / 32767
+	}
+	return samples
+}
@@ -0,0 +1,89 @@
+package rtp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Packet
+	}{
+		{"audio", Packet{PayloadType: PayloadTypeL16, SequenceNumber: 65535, Timestamp: 1 << 31, SSRC: 0xdeadbeef, Payload: []byte{1, 2, 3, 4}}},
+		{"marker", Packet{Marker: true, PayloadType: PayloadTypePCMU, SequenceNumber: 1, Payload: []byte{0xff}}},
+		{"extension", Packet{PayloadType: PayloadTypeL16, SequenceNumber: 7, ExtensionProfile: 0xbede, Extension: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Payload: []byte{9, 10}}},
+		{"empty extension", Packet{PayloadType: PayloadTypeL16, ExtensionProfile: 0x1000, Extension: []byte{}, Payload: []byte{9}}},
+		{"extension without payload", Packet{PayloadType: payloadTypeProbe, ExtensionProfile: 0x1000, Extension: []byte{1, 2, 3, 4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := tt.p.Marshal()
+			if len(buf) != tt.p.Size() {
+				t.Errorf("got %d bytes, Size is %d", len(buf), tt.p.Size())
+			}
+			var got Packet
+			if err := got.Unmarshal(buf); err != nil {
+				t.Fatal(err)
+			}
+			if got.Marker != tt.p.Marker || got.PayloadType != tt.p.PayloadType || got.SequenceNumber != tt.p.SequenceNumber ||
+				got.Timestamp != tt.p.Timestamp || got.SSRC != tt.p.SSRC || got.ExtensionProfile != tt.p.ExtensionProfile {
+				t.Errorf("got header %+v, want %+v", got, tt.p)
+			}
+			if (got.Extension == nil) != (tt.p.Extension == nil) || !bytes.Equal(got.Extension, tt.p.Extension) {
+				t.Errorf("got extension %v, want %v", got.Extension, tt.p.Extension)
+			}
+			if !bytes.Equal(got.Payload, tt.p.Payload) {
+				t.Errorf("got payload %v, want %v", got.Payload, tt.p.Payload)
+			}
+		})
+	}
+}
+
+func TestPacketExtensionHeader(t *testing.T) {
+	p := Packet{PayloadType: PayloadTypeL16, SequenceNumber: 0x0102, Timestamp: 0x03040506, SSRC: 0x0708090a,
+		ExtensionProfile: 0xbede, Extension: []byte{0xaa, 0xbb, 0xcc, 0xdd}, Payload: []byte{0xee}}
+	want := []byte{
+		0x90, PayloadTypeL16, 0x01, 0x02, // version 2 with the extension bit
+		0x03, 0x04, 0x05, 0x06,
+		0x07, 0x08, 0x09, 0x0a,
+		0xbe, 0xde, 0x00, 0x01, // profile, then the length in 32-bit words
+		0xaa, 0xbb, 0xcc, 0xdd,
+		0xee,
+	}
+	if got := p.Marshal(); !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestPacketUnmarshalErrors(t *testing.T) {
+	valid := (&Packet{PayloadType: PayloadTypeL16, Extension: []byte{1, 2, 3, 4}, Payload: []byte{5}}).Marshal()
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"short header", valid[:headerSize-1]},
+		{"version 1", append([]byte{0x50}, valid[1:]...)},
+		{"short extension header", valid[:headerSize+2]},
+		{"short extension", valid[:headerSize+6]},
+		{"padding longer than the packet", append(append([]byte{valid[0] | 1<<5}, valid[1:len(valid)-1]...), 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Packet
+			if err := p.Unmarshal(tt.buf); err == nil {
+				t.Errorf("got %+v, want an error", p)
+			}
+		})
+	}
+
+	// CSRCs and padding from other senders are skipped
+	buf := []byte{0xa1, PayloadTypePCMU, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 0xff, 0xfe, 0, 0, 3}
+	var p Packet
+	if err := p.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Payload, []byte{0xff, 0xfe}) {
+		t.Errorf("got payload % x, want ff fe", p.Payload)
+	}
+}
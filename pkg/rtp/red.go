@@ -0,0 +1,82 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PayloadTypeRED is a dynamic payload type for redundant audio (RFC 2198).
+// Each packet repeats earlier audio, so a lost packet can be replaced from
+// the one after it
+const PayloadTypeRED = 97
+
+const (
+	// Limits of the RED block header fields
+	maxREDOffset = 1<<14 - 1
+	maxREDLength = 1<<10 - 1
+)
+
+var errInvalidRED = errors.New("rtp: invalid redundant payload")
+
+// Block is one piece of audio in a redundant payload. TimestampOffset is how
+// many samples earlier than the packet's timestamp it starts
+type Block struct {
+	PayloadType     uint8
+	TimestampOffset uint32
+	Payload         []byte
+}
+
+// EncodeRED puts the redundant blocks, oldest first, ahead of the primary
+// audio. Redundant blocks that don't fit the header fields are left out
+func EncodeRED(primary Block, redundant []Block) []byte {
+	var headers, payloads []byte
+	for _, b := range redundant {
+		if b.TimestampOffset > maxREDOffset || len(b.Payload) > maxREDLength {
+			continue
+		}
+		header := make([]byte, 4)
+		header[0] = 1<<7 | b.PayloadType&0x7f
+		binary.BigEndian.PutUint32(header, binary.BigEndian.Uint32(header)|b.TimestampOffset<<10|uint32(len(b.Payload)))
+		headers = append(headers, header...)
+		payloads = append(payloads, b.Payload...)
+	}
+	headers = append(headers, primary.PayloadType&0x7f)
+	return append(append(headers, payloads...), primary.Payload...)
+}
+
+// DecodeRED splits a redundant payload into the primary audio and the
+// redundant blocks, oldest first
+func DecodeRED(payload []byte) (primary Block, redundant []Block, err error) {
+	n := 0
+	for {
+		if n >= len(payload) {
+			return primary, nil, errInvalidRED
+		}
+		if payload[n]&(1<<7) == 0 {
+			primary.PayloadType = payload[n] & 0x7f
+			n++
+			break
+		}
+		if n+4 > len(payload) {
+			return primary, nil, errInvalidRED
+		}
+		header := binary.BigEndian.Uint32(payload[n:])
+		redundant = append(redundant, Block{
+			PayloadType:     uint8(header>>24) & 0x7f,
+			TimestampOffset: header >> 10 & maxREDOffset,
+			// The length is used to slice the payload below
+			Payload: make([]byte, header&maxREDLength),
+		})
+		n += 4
+	}
+	for i := range redundant {
+		length := len(redundant[i].Payload)
+		if n+length > len(payload) {
+			return primary, nil, errInvalidRED
+		}
+		redundant[i].Payload = payload[n : n+length]
+		n += length
+	}
+	primary.Payload = payload[n:]
+	return primary, redundant, nil
+}
@@ -0,0 +1,281 @@
+package rtp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxPacketSize = 1500
+	probeInterval = 50 * time.Millisecond
+)
+
+// random picks initial SSRCs, sequence numbers and timestamps, as RFC 3550 recommends
+var random = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func randomUint32() uint32 {
+	random.Lock()
+	defer random.Unlock()
+	return random.Uint32()
+}
+
+// Session is one end of an RTP audio stream between two hosts
+//
+// Packets that arrive late or twice are dropped rather than played out of
+// order, since the audio they carry has already been replaced by newer audio
+type Session struct {
+	sync.Mutex
+	conn   *net.UDPConn
+	remote *net.UDPAddr
+	ssrc   uint32
+	seq    uint16
+	ts     uint32
+	// payloadType is the audio format sent, L16 by default. Packets in other
+	// formats are dropped, unless they are accepted too
+	payloadType uint8
+	accepted    map[uint8]bool
+
+	// Receive state
+	started bool
+	lastSeq uint16
+	lost    uint64
+	late    uint64
+
+	bytesSent     uint64
+	bytesReceived uint64
+
+	probed    chan struct{}
+	probeOnce sync.Once
+	stopProbe chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// Listen opens a UDP port for a new session. If minPort is 0, any free port
+// is used, otherwise the first free port from minPort to maxPort
+func Listen(minPort, maxPort int) (*Session, error) {
+	if maxPort < minPort {
+		maxPort = minPort
+	}
+	var lastErr error
+	for port := minPort; port <= maxPort; port++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return &Session{
+			conn:        conn,
+			ssrc:        randomUint32(),
+			seq:         uint16(randomUint32()),
+			ts:          randomUint32(),
+			payloadType: PayloadTypeL16,
+			accepted:    map[uint8]bool{PayloadTypeL16: true},
+			probed:      make(chan struct{}),
+			stopProbe:   make(chan struct{}),
+		}, nil
+	}
+	return nil, fmt.Errorf("rtp: no free UDP port from %d to %d: %w", minPort, maxPort, lastErr)
+}
+
+// LocalPort is the UDP port to tell the other end about
+func (s *Session) LocalPort() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// SetRemote sets where packets are sent. Packets from other hosts are ignored
+func (s *Session) SetRemote(host string, port int) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.remote = addr
+	return nil
+}
+
+// SetPayloadType changes the audio format sent and accepted, e.g. to PCMU for SIP phones
+func (s *Session) SetPayloadType(pt uint8) {
+	s.Lock()
+	defer s.Unlock()
+	s.payloadType = pt
+	s.accepted = map[uint8]bool{pt: true}
+}
+
+// AcceptPayloadType accepts another audio format, for when the other end
+// changes formats during the session
+func (s *Session) AcceptPayloadType(pt uint8) {
+	s.Lock()
+	defer s.Unlock()
+	s.accepted[pt] = true
+}
+
+// Probe sends probe packets to the other end, and returns whether one of its
+// probes arrived within timeout. Probes keep being sent in the background
+// until the first audio packet, so the other end can finish probing too
+func (s *Session) Probe(ctx context.Context, timeout time.Duration) bool {
+	go s.sendProbes()
+	go s.readProbes()
+	select {
+	case <-s.probed:
+		return true
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (s *Session) sendProbes() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	probe := (&Packet{PayloadType: payloadTypeProbe, SSRC: s.ssrc}).Marshal()
+	for {
+		if _, err := s.conn.WriteToUDP(probe, s.remote); err != nil {
+			return
+		}
+		select {
+		case <-s.stopProbe:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readProbes reads until the first probe arrives. Any audio packet that
+// arrives first is dropped, which is harmless since it carries little audio
+func (s *Session) readProbes() {
+	buf := make([]byte, maxPacketSize)
+	var p Packet
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !s.fromRemote(from) || p.Unmarshal(buf[:n]) != nil {
+			continue
+		}
+		s.probeOnce.Do(func() { close(s.probed) })
+		return
+	}
+}
+
+func (s *Session) fromRemote(addr *net.UDPAddr) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.remote != nil && addr.IP.Equal(s.remote.IP) && addr.Port == s.remote.Port
+}
+
+// WriteAudio sends one packet of audio in the session's payload type. samples is the number of samples
+// in the payload, used to advance the RTP timestamp
+func (s *Session) WriteAudio(payload []byte, samples int, extensionProfile uint16, extension []byte) error {
+	s.Lock()
+	pt := s.payloadType
+	s.Unlock()
+	return s.WriteAudioAs(pt, payload, samples, extensionProfile, extension)
+}
+
+// WriteAudioAs is like WriteAudio, but in the given payload type, e.g. when
+// the sender changes codecs during the session
+func (s *Session) WriteAudioAs(pt uint8, payload []byte, samples int, extensionProfile uint16, extension []byte) error {
+	s.stopOnce.Do(func() { close(s.stopProbe) })
+	s.Lock()
+	p := Packet{
+		PayloadType:      pt,
+		SequenceNumber:   s.seq,
+		Timestamp:        s.ts,
+		SSRC:             s.ssrc,
+		ExtensionProfile: extensionProfile,
+		Extension:        extension,
+		Payload:          payload,
+	}
+	buf := p.Marshal()
+	s.seq++
+	s.ts += uint32(samples)
+	s.bytesSent += uint64(len(buf))
+	remote := s.remote
+	s.Unlock()
+	_, err := s.conn.WriteToUDP(buf, remote)
+	return err
+}
+
+// ReadAudio blocks until the next audio packet in sequence arrives. It must
+// not be called before Probe has returned
+func (s *Session) ReadAudio() (*Packet, error) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		if !s.fromRemote(from) {
+			continue
+		}
+		p := &Packet{}
+		if err := p.Unmarshal(buf[:n]); err != nil || !s.accepts(p.PayloadType) {
+			continue
+		}
+		if s.accept(p.SequenceNumber, n) {
+			return p, nil
+		}
+	}
+}
+
+func (s *Session) accepts(pt uint8) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.accepted[pt]
+}
+
+// accept tracks the sequence numbers received, and returns whether a packet
+// is newer than every packet before it
+func (s *Session) accept(seq uint16, size int) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.bytesReceived += uint64(size)
+	if !s.started {
+		s.started = true
+		s.lastSeq = seq
+		return true
+	}
+	// Sequence numbers wrap, so compare the signed difference
+	diff := int16(seq - s.lastSeq)
+	if diff <= 0 {
+		s.late++
+		return false
+	}
+	s.lost += uint64(diff - 1)
+	s.lastSeq = seq
+	return true
+}
+
+// Stats returns the number of packets lost, and the number dropped for arriving late or twice
+func (s *Session) Stats() (lost uint64, late uint64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.lost, s.late
+}
+
+// Bytes returns the size of every audio packet sent and received, including headers
+func (s *Session) Bytes() (sent uint64, received uint64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.bytesSent, s.bytesReceived
+}
+
+// Close stops probing and unblocks any reads
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.stopOnce.Do(func() { close(s.stopProbe) })
+		err = s.conn.Close()
+	})
+	return err
+}
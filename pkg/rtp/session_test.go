@@ -0,0 +1,86 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccept(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		want []bool
+		lost uint64
+		late uint64
+	}{
+		{"in order", []uint16{10, 11, 12}, []bool{true, true, true}, 0, 0},
+		{"gap", []uint16{10, 13, 14}, []bool{true, true, true}, 2, 0},
+		{"late", []uint16{10, 12, 11, 13}, []bool{true, true, false, true}, 1, 1},
+		{"twice", []uint16{10, 11, 11}, []bool{true, true, false}, 0, 1},
+		{"wraparound", []uint16{65534, 65535, 0, 1}, []bool{true, true, true, true}, 0, 0},
+		{"gap across wraparound", []uint16{65534, 1}, []bool{true, true}, 2, 0},
+		{"late across wraparound", []uint16{65535, 1, 0, 65535}, []bool{true, true, false, false}, 1, 2},
+		{"random start", []uint16{40000, 40001}, []bool{true, true}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{}
+			for i, seq := range tt.seqs {
+				if got := s.accept(seq, 100); got != tt.want[i] {
+					t.Errorf("packet %d: got %v, want %v", seq, got, tt.want[i])
+				}
+			}
+			if lost, late := s.Stats(); lost != tt.lost || late != tt.late {
+				t.Errorf("got %d lost and %d late, want %d and %d", lost, late, tt.lost, tt.late)
+			}
+			if _, received := s.Bytes(); received != uint64(100*len(tt.seqs)) {
+				t.Errorf("got %d bytes received, want %d", received, 100*len(tt.seqs))
+			}
+		})
+	}
+}
+
+// listen opens a session on a local port, closed when the test ends
+func listen(t *testing.T) *Session {
+	t.Helper()
+	s, err := Listen(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestReadAudio(t *testing.T) {
+	a, b, other := listen(t), listen(t), listen(t)
+	for _, pair := range []struct{ from, to *Session }{{a, b}, {b, a}, {other, b}} {
+		if err := pair.from.SetRemote("127.0.0.1", pair.to.LocalPort()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Packets from another port, and in formats b doesn't take, are dropped
+	if err := other.WriteAudio([]byte("other"), 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteAudioAs(PayloadTypePCMU, []byte("pcmu"), 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteAudio([]byte("audio"), 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *Packet)
+	go func() {
+		p, _ := b.ReadAudio()
+		got <- p
+	}()
+	select {
+	case p := <-got:
+		if p == nil || string(p.Payload) != "audio" || p.SSRC != a.ssrc {
+			t.Errorf("got %+v, want the L16 packet from a", p)
+		}
+	case <-time.After(2 * time.Second):
+		b.Close()
+		t.Fatal("no packet")
+	}
+}
@@ -0,0 +1,76 @@
+// Package wav reads and writes WAV files as float32 samples. Files are written as mono 16-bit PCM
+package wav
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const headerSize = 44
+
+type Writer struct {
+	w          io.WriteSeeker
+	sampleRate int
+	dataSize   int
+}
+
+// NewWriter writes a WAV header to w. The sizes in the header are filled in by Close
+func NewWriter(w io.WriteSeeker, sampleRate int) (*Writer, error) {
+	writer := &Writer{
+		w:          w,
+		sampleRate: sampleRate,
+	}
+	if err := writer.writeHeader(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (w *Writer) writeHeader() error {
+	header := make([]byte, headerSize)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(headerSize-8+w.dataSize))
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)                     // fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:], 1)                      // PCM
+	binary.LittleEndian.PutUint16(header[22:], 1)                      // mono
+	binary.LittleEndian.PutUint32(header[24:], uint32(w.sampleRate))   // sample rate
+	binary.LittleEndian.PutUint32(header[28:], uint32(w.sampleRate*2)) // byte rate
+	binary.LittleEndian.PutUint16(header[32:], 2)                      // block align
+	binary.LittleEndian.PutUint16(header[34:], 16)                     // bits per sample
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(w.dataSize))
+	_, err := w.w.Write(header)
+	return err
+}
+
+// Write appends samples, clipping them to [-1, 1]
+func (w *Writer) Write(samples []float32) error {
+	buf := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		v := math.Max(-1, math.Min(1, float64(s)))
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(int16(v*math.MaxInt16)))
+	}
+	n, err := w.w.Write(buf)
+	w.dataSize += n
+	return err
+}
+
+// Size returns the number of bytes written so far, including the header
+func (w *Writer) Size() int {
+	return headerSize + w.dataSize
+}
+
+// Close updates the header with the final sizes. It does not close the underlying writer
+func (w *Writer) Close() error {
+	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	_, err := w.w.Seek(0, io.SeekEnd)
+	return err
+}
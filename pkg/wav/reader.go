@@ -0,0 +1,165 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	formatPCM   = 1
+	formatFloat = 3
+)
+
+var errNotWAV = errors.New("wav: not a WAV file")
+
+// Reader reads the samples of a WAV file as float32. Files with more than
+// one channel are mixed down to mono
+type Reader struct {
+	r          io.Reader
+	sampleRate int
+	channels   int
+	format     uint16
+	// bytesPerSample is for one channel
+	bytesPerSample int
+	// remaining is the number of bytes of audio left to read
+	remaining int
+}
+
+// NewReader reads the header of a WAV file in 8, 16, 24 or 32-bit PCM, or 32-bit float
+func NewReader(r io.Reader) (*Reader, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, errNotWAV
+	}
+	reader := &Reader{r: r}
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		rawSize := binary.LittleEndian.Uint32(chunk[4:])
+		size := int(rawSize & math.MaxInt32)
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			if size < 16 {
+				return nil, errNotWAV
+			}
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return nil, err
+			}
+			reader.format = binary.LittleEndian.Uint16(fmtChunk[0:])
+			reader.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:]))
+			reader.sampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:]))
+			reader.bytesPerSample = int(binary.LittleEndian.Uint16(fmtChunk[14:])) / 8
+			// WAVE_FORMAT_EXTENSIBLE keeps the real format in the sub-format
+			if reader.format == 0xfffe && size >= 26 {
+				reader.format = binary.LittleEndian.Uint16(fmtChunk[24:])
+			}
+		case "data":
+			if reader.channels == 0 {
+				return nil, errNotWAV
+			}
+			if err := reader.check(); err != nil {
+				return nil, err
+			}
+			reader.remaining = size
+			// Programs writing to a pipe can't go back to fill in the size
+			if rawSize == 0 || rawSize == math.MaxUint32 {
+				reader.remaining = math.MaxInt32
+			}
+			return reader, nil
+		default:
+			// Skip chunks such as LIST, padded to an even size
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size+size%2)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (r *Reader) check() error {
+	switch {
+	case r.format == formatPCM && r.bytesPerSample >= 1 && r.bytesPerSample <= 4:
+	case r.format == formatFloat && r.bytesPerSample == 4:
+	default:
+		return fmt.Errorf("wav: unsupported format %v with %v bits per sample", r.format, r.bytesPerSample*8)
+	}
+	if r.sampleRate <= 0 {
+		return errNotWAV
+	}
+	return nil
+}
+
+// SampleRate returns the rate the file was recorded at
+func (r *Reader) SampleRate() int {
+	return r.sampleRate
+}
+
+// Read fills buf with the next samples. It returns io.EOF at the end of the audio
+func (r *Reader) Read(buf []float32) (int, error) {
+	frameSize := r.bytesPerSample * r.channels
+	frames := len(buf)
+	if max := r.remaining / frameSize; frames > max {
+		frames = max
+	}
+	if frames == 0 {
+		return 0, io.EOF
+	}
+	data := make([]byte, frames*frameSize)
+	n, err := io.ReadFull(r.r, data)
+	frames = n / frameSize
+	r.remaining -= frames * frameSize
+	if err == io.ErrUnexpectedEOF {
+		// The header said there is more audio than there is
+		r.remaining = 0
+		err = nil
+	}
+	for i := 0; i < frames; i++ {
+		var sum float32
+		for c := 0; c < r.channels; c++ {
+			sum += r.sample(data[(i*r.channels+c)*r.bytesPerSample:])
+		}
+		buf[i] = sum / float32(r.channels)
+	}
+	return frames, err
+}
+
+// ReadAll reads the rest of the audio
+func (r *Reader) ReadAll() ([]float32, error) {
+	var samples []float32
+	buf := make([]float32, 4096)
+	for {
+		n, err := r.Read(buf)
+		samples = append(samples, buf[:n]...)
+		if err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return samples, err
+		}
+	}
+}
+
+// sample decodes one sample from the start of b
+func (r *Reader) sample(b []byte) float32 {
+	switch {
+	case r.format == formatFloat:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b))
+	case r.bytesPerSample == 1:
+		// 8-bit WAV is unsigned
+		return (float32(b[0]) - 128) / 128
+	}
+	// Signed little-endian, shifted up to 32 bits
+	var v int32
+	for i := 0; i < r.bytesPerSample; i++ {
+		v |= int32(b[i]) << (8 * (4 - r.bytesPerSample + i))
+	}
+	return float32(v) / (1 << 31)
+}